@@ -1,22 +1,29 @@
 package main
 
 import (
-	"crypto/sha256"
-	"encoding/hex"
+	"context"
+	"flag"
 	"fmt"
 	"io"
 	"log"
-	"net/http"
+	"net"
+	"net/netip"
 	"os"
 	"os/signal"
 	"strconv"
 	"strings"
 	"syscall"
+	"time"
 
+	"github.com/spaghetti-lover/go-http/pkg/fileserver"
 	"github.com/spaghetti-lover/go-http/pkg/headers"
+	"github.com/spaghetti-lover/go-http/pkg/middleware"
+	"github.com/spaghetti-lover/go-http/pkg/proxy"
 	"github.com/spaghetti-lover/go-http/pkg/request"
 	"github.com/spaghetti-lover/go-http/pkg/response"
 	"github.com/spaghetti-lover/go-http/pkg/server"
+	"github.com/spaghetti-lover/go-http/pkg/sse"
+	"github.com/spaghetti-lover/go-http/pkg/websocket"
 )
 
 const (
@@ -52,10 +59,49 @@ const (
 `
 )
 
+var staticHandler = fileserver.Handler("assets", "/assets")
+
+// httpbinProxy forwards /httpbin/* to https://httpbin.org/*
+var httpbinProxy *proxy.Proxy
+
+// tunnelHandler lets clients use the demo as a forward proxy, nil unless
+// -tunnel-allow lists destinations
+var tunnelHandler server.Handler
+
 func handleRequest(w *response.Writer, req *request.Request) {
+	if req.RequestLine.Method == "CONNECT" {
+		if tunnelHandler == nil {
+			writeError(w, response.MethodNotAllowed, "Tunneling is off, start with -tunnel-allow\n")
+			return
+		}
+		tunnelHandler(w, req)
+		return
+	}
+
 	// Check if this is a proxy request to httpbin
 	if strings.HasPrefix(req.RequestLine.RequestTarget, "/httpbin/") {
-		handleProxy(w, req)
+		httpbinProxy.Handle(w, req)
+		return
+	}
+
+	// Serve static files from the assets folder
+	if strings.HasPrefix(req.RequestLine.RequestTarget, "/assets/") {
+		staticHandler(w, req)
+		return
+	}
+
+	if req.RequestLine.RequestTarget == "/events" {
+		handleEvents(w, req)
+		return
+	}
+
+	if req.RequestLine.RequestTarget == "/whoami" {
+		handleWhoami(w, req)
+		return
+	}
+
+	if req.RequestLine.RequestTarget == "/ws" {
+		handleWebSocket(w, req)
 		return
 	}
 
@@ -109,11 +155,83 @@ func handleRequest(w *response.Writer, req *request.Request) {
 	}
 }
 
+// handleEvents counts up once a second as Server-Sent Events, resuming after
+// the last event a reconnecting client saw
+func handleEvents(w *response.Writer, req *request.Request) {
+	stream, err := sse.Start(w, req, sse.Options{Retry: 2 * time.Second})
+	if err != nil {
+		log.Printf("Error starting event stream: %v", err)
+		return
+	}
+	defer stream.Close()
+
+	n, _ := strconv.Atoi(stream.LastEventID())
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for n < 60 {
+		select {
+		case <-stream.Done():
+			return
+		case now := <-ticker.C:
+			n++
+			err := stream.Send(sse.Event{ID: strconv.Itoa(n), Event: "tick", Data: now.Format(time.RFC3339)})
+			if err != nil {
+				return
+			}
+		}
+	}
+}
+
+// handleWebSocket echoes messages back and pushes the server time every second
+func handleWebSocket(w *response.Writer, req *request.Request) {
+	conn, err := websocket.Upgrade(w, req, websocket.Options{Compression: true})
+	if err != nil {
+		log.Printf("Error upgrading to websocket: %v", err)
+		return
+	}
+
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		ticker := time.NewTicker(time.Second)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case now := <-ticker.C:
+				if err := conn.WriteMessage(websocket.TextMessage, []byte(now.Format(time.RFC3339))); err != nil {
+					return
+				}
+			}
+		}
+	}()
+
+	for {
+		messageType, data, err := conn.ReadMessage()
+		if err != nil {
+			return
+		}
+		if err := conn.WriteMessage(messageType, data); err != nil {
+			conn.Close(websocket.CloseInternalError, "")
+			return
+		}
+	}
+}
+
 func handleVideo(w *response.Writer, req *request.Request) {
-	// Read the video file
-	videoData, err := os.ReadFile("assets/vim.mp4")
+	// Open the video file, it's streamed rather than read into memory
+	videoFile, err := os.Open("assets/vim.mp4")
 	if err != nil {
-		log.Printf("Error reading video file: %v", err)
+		log.Printf("Error opening video file: %v", err)
+		writeError(w, response.InternalServerError, "Failed to read video file")
+		return
+	}
+	defer videoFile.Close()
+
+	info, err := videoFile.Stat()
+	if err != nil {
+		log.Printf("Error reading video file info: %v", err)
 		writeError(w, response.InternalServerError, "Failed to read video file")
 		return
 	}
@@ -127,7 +245,7 @@ func handleVideo(w *response.Writer, req *request.Request) {
 
 	// Create headers with video content type
 	h := headers.NewHeaders()
-	h.Set("Content-Length", strconv.Itoa(len(videoData)))
+	h.Set("Content-Length", strconv.FormatInt(info.Size(), 10))
 	h.Set("Connection", "close")
 	h.Override("Content-Type", "video/mp4")
 
@@ -138,8 +256,8 @@ func handleVideo(w *response.Writer, req *request.Request) {
 		return
 	}
 
-	// Write body (binary video data)
-	_, err = w.WriteBody(videoData)
+	// Write body (binary video data), sent with sendfile on plain TCP
+	_, err = io.Copy(w, videoFile)
 	if err != nil {
 		log.Printf("Error writing body: %v", err)
 		return
@@ -148,148 +266,191 @@ func handleVideo(w *response.Writer, req *request.Request) {
 	log.Println("Video served successfully")
 }
 
-func handleProxy(w *response.Writer, req *request.Request) {
-	// Remove /httpbin prefix and build httpbin.org URL
-	path := strings.TrimPrefix(req.RequestLine.RequestTarget, "/httpbin")
-	url := "https://httpbin.org" + path
-
-	log.Printf("Proxying request to: %s", url)
-
-	// Make request to httpbin.org
-	resp, err := http.Get(url)
-	if err != nil {
-		log.Printf("Error making requét to httpbin.org: %v", err)
-		writeError(w, response.InternalServerError, "Failed to proxy request")
-		return
-	}
-	defer resp.Body.Close()
-
-	// Write status line
-	statusCode := response.StatusCode(fmt.Sprintf("%d", resp.StatusCode))
-	err = w.WriteStatusLine(statusCode)
+func writeError(w *response.Writer, statusCode response.StatusCode, message string) {
+	err := w.WriteStatusLine(statusCode)
 	if err != nil {
 		log.Printf("Error writing status line: %v", err)
 		return
 	}
 
-	// Create headers - remove Content-Length and add Transfer-Encoding
 	h := headers.NewHeaders()
-
-	// Copy headers from httpbin response (except Content-Length)
-	for key, values := range resp.Header {
-		if strings.ToLower(key) != "content-length" {
-			for _, value := range values {
-				h.Set(key, value)
-			}
-		}
-	}
-
-	// Add Transfer-Encoding: chunked
-	h.Override("Transfer-Encoding", "chunked")
+	h.Set("Content-Length", strconv.Itoa(len(message)))
 	h.Set("Connection", "close")
-	// Announce trailers
-	h.Set("Trailer", "X-Content-SHA256, X-Content-Length")
+	h.Override("Content-Type", "text/plain")
 
-	// Write headers
 	err = w.WriteHeaders(h)
 	if err != nil {
 		log.Printf("Error writing headers: %v", err)
 		return
 	}
 
-	// Keep track of full response body for hash calculation
-	var fullBody []byte
-
-	// Stream response body in chunks
-	buf := make([]byte, 1024)
-	for {
-		n, err := resp.Body.Read(buf)
-
-		if n > 0 {
-			log.Printf("Read %d bytes from httpbin.org", n)
-
-			// Append to full body for hash calculation
-			fullBody = append(fullBody, buf[:n]...)
-
-			// Write chunk
-			_, writeErr := w.WriteChunkedBody(buf[:n])
-			if writeErr != nil {
-				log.Printf("Error writing chunk: %v", writeErr)
-				return
-			}
-		}
-
-		if err == io.EOF {
-			break
-		}
-
-		if err != nil {
-			log.Printf("Error reading from httpbin.org: %v", err)
-			break
-		}
-	}
-
-	// Write final chunk
-	_, err = w.WriteChunkedBodyDone()
-	if err != nil {
-		log.Printf("Erorr writing final chunk: %v", err)
-		return
-	}
-
-	// Calculate SHA256 hash of full body
-	hash := sha256.Sum256(fullBody)
-	hashHex := hex.EncodeToString(hash[:])
-
-	// Create trailers
-	trailers := headers.NewHeaders()
-	trailers.Set("X-Content-SHA256", hashHex)
-	trailers.Set("X-Content-Length", strconv.Itoa(len(fullBody)))
-
-	// Write trailers
-	err = w.WriteTrailers(trailers)
+	_, err = w.WriteBody([]byte(message))
 	if err != nil {
-		log.Printf("Error writing trailers: %v", err)
-		return
+		log.Printf("Error writing body: %v", err)
 	}
-
-	log.Println("Proxy request completed successfully")
 }
 
-func writeError(w *response.Writer, statusCode response.StatusCode, message string) {
-	err := w.WriteStatusLine(statusCode)
+// handleWhoami tells the client what the server knows about it
+func handleWhoami(w *response.Writer, req *request.Request) {
+	info := req.Conn
+	body := fmt.Sprintf("client %s\nremote %s\nlocal %s\nconnection %d, request %d\ntls %v\n",
+		req.ClientIP, info.RemoteAddr, info.LocalAddr, info.ID, info.Requests, info.TLS != nil)
+
+	err := w.WriteStatusLine(response.OK)
 	if err != nil {
 		log.Printf("Error writing status line: %v", err)
 		return
 	}
-
 	h := headers.NewHeaders()
-	h.Set("Content-Length", strconv.Itoa(len(message)))
-	h.Set("Connection", "close")
+	h.Set("Content-Length", strconv.Itoa(len(body)))
 	h.Override("Content-Type", "text/plain")
-
 	err = w.WriteHeaders(h)
 	if err != nil {
 		log.Printf("Error writing headers: %v", err)
 		return
 	}
-
-	_, err = w.WriteBody([]byte(message))
+	_, err = w.WriteBody([]byte(body))
 	if err != nil {
 		log.Printf("Error writing body: %v", err)
 	}
 }
 
+// logConnState logs a connection's change of state, the way a dashboard
+// would be fed
+func logConnState(conn net.Conn, state server.ConnState, stats server.ConnStats) {
+	log.Printf("Connection %d from %s %s: %d requests, %d bytes read, %d written in %s",
+		stats.ID, conn.RemoteAddr(), state, stats.Requests, stats.BytesRead, stats.BytesWritten,
+		stats.Duration.Round(time.Millisecond))
+}
+
+// parsePrefixes parses a flag's comma-separated networks, e.g. 10.0.0.0/8
+func parsePrefixes(name, value string) []netip.Prefix {
+	var prefixes []netip.Prefix
+	for _, cidr := range strings.Split(value, ",") {
+		prefix, err := netip.ParsePrefix(strings.TrimSpace(cidr))
+		if err != nil {
+			log.Fatalf("Error parsing %s: %v", name, err)
+		}
+		prefixes = append(prefixes, prefix)
+	}
+	return prefixes
+}
+
 func main() {
 	const port = 42069
-	srv, err := server.Serve(port, handleRequest)
+	unixSocket := flag.String("unix", "", "listen on this Unix socket instead of port 42069")
+	proxyTrusted := flag.String("proxy-protocol", "", "read PROXY protocol headers from these comma-separated networks, e.g. 127.0.0.0/8")
+	forwardTrusted := flag.String("trusted-proxies", "", "believe the client address these comma-separated networks forward")
+	forwardedHeader := flag.String("forwarded-header", "x-forwarded-for", "where trusted proxies record clients: x-forwarded-for or forwarded")
+	maxConns := flag.Int("max-conns", 0, "serve at most this many connections, answering 503 past it (0 means no limit)")
+	workers := flag.Int("workers", 0, "run at most this many handlers at once (0 means no limit)")
+	tunnelAllow := flag.String("tunnel-allow", "", "answer CONNECT for these comma-separated host:port patterns, e.g. *.example.com:443 (private addresses stay refused)")
+	logConns := flag.Bool("log-conns", false, "log every connection's changes of state with its stats")
+	flag.Parse()
+
+	var err error
+	httpbinProxy, err = proxy.New("https://httpbin.org", proxy.Options{
+		Rewrites: []proxy.Rewrite{{Prefix: "/httpbin", Replace: ""}},
+		Timeout:  10 * time.Second,
+	})
+	if err != nil {
+		log.Fatalf("Error configuring proxy: %v", err)
+	}
+
+	if *tunnelAllow != "" {
+		tunnelHandler = proxy.Tunnel(proxy.TunnelOptions{Allow: strings.Split(*tunnelAllow, ",")})
+	}
+
+	handler := server.Chain(handleRequest,
+		middleware.HashTrailers(middleware.HashTrailersOptions{ContentDigest: true}),
+		middleware.Compress(middleware.CompressOptions{}),
+		middleware.Decompress(middleware.DecompressOptions{}),
+	)
+
+	opts := []server.Option{server.WithH2C(), server.WithPipelining(8)}
+	if *proxyTrusted != "" {
+		trusted := parsePrefixes("-proxy-protocol", *proxyTrusted)
+		opts = append(opts, server.WithProxyProtocol(server.ProxyProtocolOptions{Trusted: trusted}))
+	}
+	if *maxConns > 0 {
+		opts = append(opts, server.WithMaxConns(*maxConns, server.OverflowReject))
+	}
+	if *workers > 0 {
+		opts = append(opts, server.WithWorkers(*workers))
+	}
+	if *forwardTrusted != "" {
+		header := request.XForwardedFor
+		switch *forwardedHeader {
+		case "x-forwarded-for":
+		case "forwarded":
+			header = request.Forwarded
+		default:
+			log.Fatalf("Error parsing -forwarded-header: %q is neither x-forwarded-for nor forwarded", *forwardedHeader)
+		}
+		opts = append(opts, server.WithTrustedProxies(header, parsePrefixes("-trusted-proxies", *forwardTrusted)...))
+	}
+	if *logConns {
+		opts = append(opts, server.WithConnState(logConnState))
+	}
+
+	// A listener handed over by a restart wins, then socket activation, then
+	// a Unix socket, then the TCP port
+	var srv *server.Server
+	var where string
+	handedOff, err := server.HandoffListener()
+	if err != nil {
+		log.Fatalf("Error taking over listener: %v", err)
+	}
+	activated, err := server.SystemdListeners()
+	if err != nil {
+		log.Fatalf("Error inheriting listeners: %v", err)
+	}
+	switch {
+	case handedOff != nil:
+		srv, err = server.ServeListener(handedOff, handler, opts...)
+		where = "handed over " + handedOff.Addr().String()
+	case len(activated) > 0:
+		srv, err = server.ServeListener(activated[0], handler, opts...)
+		where = "socket-activated " + activated[0].Name
+	case *unixSocket != "":
+		var listener net.Listener
+		listener, err = server.ListenUnix(*unixSocket, server.UnixOptions{})
+		if err == nil {
+			srv, err = server.ServeListener(listener, handler, opts...)
+		}
+		where = *unixSocket
+	default:
+		srv, err = server.Serve(port, handler, opts...)
+		where = "port " + strconv.Itoa(port)
+	}
 	if err != nil {
 		log.Fatalf("Error starting server: %v", err)
 	}
-	defer srv.Close()
-	log.Println("Server started on port", port)
+	log.Println("Server started on", where)
+	if err := server.HandoffReady(); err != nil {
+		log.Printf("Error signalling the previous process: %v", err)
+	}
 
+	// SIGHUP or SIGUSR2 restarts without dropping a connection: a new process
+	// takes over the listener and this one finishes what it's serving
 	sigChan := make(chan os.Signal, 1)
-	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
-	<-sigChan
+	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP, syscall.SIGUSR2)
+	for sig := range sigChan {
+		if sig == syscall.SIGHUP || sig == syscall.SIGUSR2 {
+			process, err := srv.Handoff(10 * time.Second)
+			if err != nil {
+				log.Printf("Error restarting, still serving: %v", err)
+				continue
+			}
+			log.Println("Handed over to process", process.Pid)
+		}
+		break
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	if err := srv.Shutdown(ctx); err != nil {
+		log.Printf("Error shutting down: %v", err)
+	}
 	log.Println("Server gracefully stopped")
 }
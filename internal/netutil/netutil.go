@@ -0,0 +1,24 @@
+// Package netutil holds what the connection wrappers in pkg share
+package netutil
+
+import (
+	"io"
+	"net"
+)
+
+// ReadFrom copies r to conn, through conn's own ReadFrom when it has one so
+// zero-copy writes such as sendfile still happen
+func ReadFrom(conn net.Conn, r io.Reader) (int64, error) {
+	if rf, ok := conn.(io.ReaderFrom); ok {
+		return rf.ReadFrom(r)
+	}
+	return io.Copy(struct{ io.Writer }{conn}, r)
+}
+
+// CloseWrite half-closes conn, or closes it when it can't be half-closed
+func CloseWrite(conn net.Conn) error {
+	if cw, ok := conn.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+	return conn.Close()
+}
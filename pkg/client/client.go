@@ -0,0 +1,156 @@
+package client
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/spaghetti-lover/go-http/pkg/headers"
+	"github.com/spaghetti-lover/go-http/pkg/request"
+	"github.com/spaghetti-lover/go-http/pkg/response"
+)
+
+var ErrMalformedStatusLine = response.ErrMalformedStatusLine
+var ErrUnsupportedScheme = fmt.Errorf("unsupported url scheme")
+
+// Response is a parsed HTTP/1.1 response
+type Response = response.Response
+
+// Client sends requests through a Transport that pools connections. The zero
+// value is usable and shares DefaultTransport.
+type Client struct {
+	// Timeout bounds a whole exchange, from dialing to the end of the body.
+	// 0 means no timeout beyond the context's.
+	Timeout time.Duration
+
+	// Transport sends the requests, nil means DefaultTransport
+	Transport *Transport
+}
+
+// DefaultClient is used by the package level helpers
+var DefaultClient = &Client{}
+
+// NewRequest builds a request for an absolute http or https URL. The target
+// is kept in absolute form, Do turns it into origin form on the wire.
+func NewRequest(method, rawURL string, body []byte) (*request.Request, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, fmt.Errorf("%w: %q", ErrUnsupportedScheme, u.Scheme)
+	}
+
+	req := &request.Request{
+		RequestLine: request.Line{
+			Method:        method,
+			RequestTarget: u.String(),
+			HttpVersion:   "1.1",
+		},
+		Headers: headers.NewHeaders(),
+		Body:    body,
+	}
+	req.Headers.Set("Host", u.Host)
+	return req, nil
+}
+
+// Get issues a GET with DefaultClient
+func Get(ctx context.Context, rawURL string) (*Response, error) {
+	req, err := NewRequest("GET", rawURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	return DefaultClient.Do(ctx, req)
+}
+
+// Do sends req and reads the full response. An absolute-form request target
+// decides scheme and host, otherwise the Host header is dialed over plain
+// http. 1xx interim responses end up in Response.Interim.
+func (c *Client) Do(ctx context.Context, req *request.Request) (*Response, error) {
+	if c.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.Timeout)
+		defer cancel()
+	}
+
+	return c.transport().RoundTrip(ctx, req)
+}
+
+// Open is like Do but returns once the response headers are in, with the
+// body left to stream from body, which must be closed. See Transport.Open.
+// Timeout covers reading the body too.
+func (c *Client) Open(ctx context.Context, req *request.Request) (*Response, io.ReadCloser, error) {
+	if c.Timeout <= 0 {
+		return c.transport().Open(ctx, req)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, c.Timeout)
+	resp, body, err := c.transport().Open(ctx, req)
+	if err != nil {
+		cancel()
+		return nil, nil, err
+	}
+	return resp, &cancelBody{ReadCloser: body, cancel: cancel}, nil
+}
+
+func (c *Client) transport() *Transport {
+	if c.Transport == nil {
+		return DefaultTransport
+	}
+	return c.Transport
+}
+
+// cancelBody releases the timeout context along with the body
+type cancelBody struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (b *cancelBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.cancel()
+	return err
+}
+
+// splitTarget works out where req goes and its origin-form target
+func splitTarget(req *request.Request) (scheme, host, target string, err error) {
+	target = req.RequestLine.RequestTarget
+	if strings.HasPrefix(target, "/") || target == "*" {
+		host = req.Headers.Get("Host")
+		if host == "" {
+			return "", "", "", fmt.Errorf("request has neither an absolute target nor a Host header")
+		}
+		return "http", host, target, nil
+	}
+
+	u, err := url.Parse(target)
+	if err != nil {
+		return "", "", "", err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return "", "", "", fmt.Errorf("%w: %q", ErrUnsupportedScheme, u.Scheme)
+	}
+	return u.Scheme, u.Host, u.RequestURI(), nil
+}
+
+// writeRequest serializes req with an origin-form target
+func writeRequest(w io.Writer, req *request.Request, host, target string) error {
+	wire := &request.Request{
+		RequestLine: request.Line{
+			Method:        req.RequestLine.Method,
+			RequestTarget: target,
+			HttpVersion:   "1.1",
+		},
+		Headers:  req.Headers.Clone(),
+		Body:     req.Body,
+		Trailers: req.Trailers,
+	}
+	if wire.Headers.Get("Host") == "" {
+		wire.Headers.Override("Host", host)
+	}
+
+	return wire.Write(w)
+}
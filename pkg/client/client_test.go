@@ -0,0 +1,140 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/spaghetti-lover/go-http/pkg/headers"
+	"github.com/spaghetti-lover/go-http/pkg/request"
+	"github.com/spaghetti-lover/go-http/pkg/response"
+	"github.com/spaghetti-lover/go-http/pkg/server"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func testHandler(w *response.Writer, req *request.Request) {
+	switch req.RequestLine.RequestTarget {
+	case "/chunked":
+		w.WriteStatusLine(response.OK)
+		h := headers.NewHeaders()
+		h.Set("Transfer-Encoding", "chunked")
+		h.Set("Trailer", "X-Count")
+		w.WriteHeaders(h)
+		w.WriteChunkedBody([]byte("hello "))
+		w.WriteChunkedBody([]byte("world"))
+		w.WriteLastChunk()
+		trailers := headers.NewHeaders()
+		trailers.Set("X-Count", "2")
+		w.WriteTrailers(trailers)
+	case "/close":
+		w.WriteStatusLine(response.OK)
+		w.WriteHeaders(headers.NewHeaders())
+		w.Write([]byte("until close"))
+	case "/slow":
+		time.Sleep(500 * time.Millisecond)
+		fallthrough
+	case "/continue":
+		w.WriteInformational(response.Continue, nil)
+		fallthrough
+	default:
+		body := req.RequestLine.Method + " " + req.RequestLine.RequestTarget + " " + string(req.Body)
+		w.WriteStatusLine(response.OK)
+		h := headers.NewHeaders()
+		h.Set("Content-Length", strconv.Itoa(len(body)))
+		h.Set("X-Host", req.Headers.Get("Host"))
+		w.WriteHeaders(h)
+		if req.RequestLine.Method != "HEAD" {
+			w.WriteBody([]byte(body))
+		}
+	}
+}
+
+func startServer(t *testing.T) string {
+	t.Helper()
+	srv, err := server.Serve(0, testHandler)
+	require.NoError(t, err)
+	t.Cleanup(func() { srv.Close() })
+	return fmt.Sprintf("http://%s", srv.Addr())
+}
+
+func TestClientDo(t *testing.T) {
+	base := startServer(t)
+	ctx := context.Background()
+
+	// Test: Content-Length body
+	resp, err := Get(ctx, base+"/hello?x=1")
+	require.NoError(t, err)
+	assert.Equal(t, response.OK, resp.StatusCode)
+	assert.Equal(t, "OK", resp.Reason)
+	assert.Equal(t, "1.1", resp.HttpVersion)
+	assert.Equal(t, "GET /hello?x=1 ", string(resp.Body))
+	assert.Equal(t, base[len("http://"):], resp.Headers.Get("X-Host"))
+
+	// Test: Request body
+	req, err := NewRequest("POST", base+"/upload", []byte("payload"))
+	require.NoError(t, err)
+	resp, err = DefaultClient.Do(ctx, req)
+	require.NoError(t, err)
+	assert.Equal(t, "POST /upload payload", string(resp.Body))
+
+	// Test: Origin-form target with Host header
+	req, err = NewRequest("GET", base+"/", nil)
+	require.NoError(t, err)
+	req.RequestLine.RequestTarget = "/origin"
+	resp, err = DefaultClient.Do(ctx, req)
+	require.NoError(t, err)
+	assert.Equal(t, "GET /origin ", string(resp.Body))
+
+	// Test: Chunked body with trailers
+	resp, err = Get(ctx, base+"/chunked")
+	require.NoError(t, err)
+	assert.Equal(t, "hello world", string(resp.Body))
+	require.NotNil(t, resp.Trailers)
+	assert.Equal(t, "2", resp.Trailers.Get("X-Count"))
+
+	// Test: Body delimited by connection close
+	resp, err = Get(ctx, base+"/close")
+	require.NoError(t, err)
+	assert.Equal(t, "until close", string(resp.Body))
+
+	// Test: HEAD has no body despite Content-Length
+	req, err = NewRequest("HEAD", base+"/", nil)
+	require.NoError(t, err)
+	resp, err = DefaultClient.Do(ctx, req)
+	require.NoError(t, err)
+	assert.Equal(t, "7", resp.Headers.Get("Content-Length"))
+	assert.Empty(t, resp.Body)
+
+	// Test: Interim responses are skipped
+	resp, err = Get(ctx, base+"/continue")
+	require.NoError(t, err)
+	assert.Equal(t, response.OK, resp.StatusCode)
+	assert.Equal(t, "GET /continue ", string(resp.Body))
+
+	// Test: Unsupported scheme
+	_, err = NewRequest("GET", "ftp://example.com/", nil)
+	require.ErrorIs(t, err, ErrUnsupportedScheme)
+}
+
+func TestClientTimeout(t *testing.T) {
+	base := startServer(t)
+
+	// Test: Client timeout
+	c := &Client{Timeout: 100 * time.Millisecond}
+	req, err := NewRequest("GET", base+"/slow", nil)
+	require.NoError(t, err)
+	_, err = c.Do(context.Background(), req)
+	require.ErrorIs(t, err, context.DeadlineExceeded)
+
+	// Test: Context cancellation
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(100*time.Millisecond, cancel)
+	start := time.Now()
+	_, err = DefaultClient.Do(ctx, req)
+	require.True(t, errors.Is(err, context.Canceled))
+	assert.Less(t, time.Since(start), 400*time.Millisecond)
+}
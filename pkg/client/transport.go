@@ -0,0 +1,565 @@
+package client
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/spaghetti-lover/go-http/pkg/request"
+	"github.com/spaghetti-lover/go-http/pkg/response"
+)
+
+// Defaults for the Transport limits left at zero
+const (
+	DefaultMaxIdleConns        = 100
+	DefaultMaxIdleConnsPerHost = 2
+	DefaultIdleConnTimeout     = 90 * time.Second
+)
+
+var errUnexpectedData = errors.New("unexpected data on idle connection")
+
+// aLongTimeAgo is a deadline that makes blocked reads and writes return
+var aLongTimeAgo = time.Unix(1, 0)
+
+// Transport sends requests over pooled connections. A connection whose
+// response allows it is kept per scheme, host and port, and reused by the
+// next request to the same origin. The zero value is usable.
+type Transport struct {
+	// TLSConfig is used for https targets, nil means the defaults
+	TLSConfig *tls.Config
+
+	// Dial opens the underlying connection, nil means a net.Dialer. TLS is
+	// layered on top for https targets.
+	Dial func(ctx context.Context, network, addr string) (net.Conn, error)
+
+	// MaxIdleConns bounds idle connections across all hosts, the oldest is
+	// closed to make room. 0 means DefaultMaxIdleConns.
+	MaxIdleConns int
+
+	// MaxIdleConnsPerHost bounds idle connections to one host, extra ones
+	// are closed. 0 means DefaultMaxIdleConnsPerHost.
+	MaxIdleConnsPerHost int
+
+	// MaxConnsPerHost bounds open connections to one host, idle ones
+	// included. Requests over the limit wait for a connection to free up.
+	// 0 means no limit.
+	MaxConnsPerHost int
+
+	// IdleConnTimeout closes connections that stayed idle this long.
+	// 0 means DefaultIdleConnTimeout.
+	IdleConnTimeout time.Duration
+
+	mu        sync.Mutex
+	hosts     map[string]*hostConns
+	idleCount int
+}
+
+// DefaultTransport is used by clients without a Transport
+var DefaultTransport = &Transport{}
+
+// hostConns is the pool for one scheme://host:port
+type hostConns struct {
+	// idle is ordered from least to most recently used
+	idle []*persistConn
+	// open counts connections dialed or being dialed, idle ones included
+	open int
+	// waiters get either a connection handed over or nil, which is a
+	// reserved slot to dial into
+	waiters []chan *persistConn
+}
+
+type persistConn struct {
+	net.Conn
+	t   *Transport
+	key string
+
+	idleAt    time.Time
+	idleTimer *time.Timer
+	// probe gets the result of the read that watches an idle connection
+	probe chan error
+}
+
+// RoundTrip sends req and reads the full response over a pooled
+// connection
+func (t *Transport) RoundTrip(ctx context.Context, req *request.Request) (*Response, error) {
+	resp, body, err := t.Open(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+	defer body.Close()
+
+	resp.Body, err = io.ReadAll(body)
+	if err != nil {
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			return nil, ctxErr
+		}
+		return nil, err
+	}
+	return resp, nil
+}
+
+// Open sends req and returns as soon as the response headers are in,
+// leaving the body to be read from body. Trailers are set once body
+// returned io.EOF. body must be closed, and the connection only goes back
+// to the pool if it was read to the end.
+//
+// An idempotent request that fails on a reused connection before any
+// response arrived, typically because the server closed it at the same
+// moment, is retried once.
+func (t *Transport) Open(ctx context.Context, req *request.Request) (*Response, io.ReadCloser, error) {
+	scheme, host, target, err := splitTarget(req)
+	if err != nil {
+		return nil, nil, err
+	}
+	addr := canonicalAddr(scheme, host)
+
+	for attempt := 0; ; attempt++ {
+		pc, reused, err := t.getConn(ctx, scheme, addr)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		resp, body, nothingRead, err := t.exchange(ctx, pc, req, host, target)
+		if err == nil {
+			return resp, body, nil
+		}
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			return nil, nil, ctxErr
+		}
+		if reused && nothingRead && attempt == 0 && idempotent(req.RequestLine.Method) {
+			continue
+		}
+		return nil, nil, err
+	}
+}
+
+// CloseIdleConnections closes every pooled connection not in use
+func (t *Transport) CloseIdleConnections() {
+	t.mu.Lock()
+	var idle []*persistConn
+	for _, hc := range t.hosts {
+		idle = append(idle, hc.idle...)
+		hc.idle = nil
+	}
+	t.idleCount = 0
+	t.mu.Unlock()
+
+	for _, pc := range idle {
+		pc.idleTimer.Stop()
+		pc.close()
+	}
+}
+
+// exchange sends req on pc and reads the response head. nothingRead
+// reports that an error came before any response bytes.
+func (t *Transport) exchange(ctx context.Context, pc *persistConn, req *request.Request, host, target string) (resp *Response, body io.ReadCloser, nothingRead bool, err error) {
+	// Unblock reads and writes as soon as the context is done. It runs after
+	// ctx.Err() is set, so a timeout is reported as the context's error.
+	stop := context.AfterFunc(ctx, func() {
+		pc.SetDeadline(aLongTimeAgo)
+	})
+
+	counter := &countingReader{reader: pc.Conn}
+	var stream io.Reader
+	err = writeRequest(pc.Conn, req, host, target)
+	if err == nil {
+		resp, stream, err = response.HeadFromReader(counter, req.RequestLine.Method)
+	}
+	if err != nil {
+		stop()
+		pc.close()
+		return nil, nil, counter.n == 0, err
+	}
+
+	return resp, &connBody{
+		pc:     pc,
+		req:    req,
+		resp:   resp,
+		stream: stream,
+		stop:   stop,
+		eof:    !hasBody(req, resp),
+	}, false, nil
+}
+
+// connBody streams a response body and decides what happens to the
+// connection when it's closed
+type connBody struct {
+	pc     *persistConn
+	req    *request.Request
+	resp   *Response
+	stream io.Reader
+	stop   func() bool
+	eof    bool
+	closed bool
+}
+
+func (b *connBody) Read(p []byte) (int, error) {
+	if b.eof {
+		return 0, io.EOF
+	}
+
+	n, err := b.stream.Read(p)
+	if err == io.EOF {
+		b.eof = true
+	}
+	return n, err
+}
+
+// Close gives the connection back to the pool when the body was read to the
+// end and both sides allow it, and closes it otherwise
+func (b *connBody) Close() error {
+	if b.closed {
+		return nil
+	}
+	b.closed = true
+
+	// A connection whose deadline the context may have touched isn't safe
+	// to hand out again
+	interrupted := !b.stop()
+	if !b.eof || interrupted || !reusable(b.req, b.resp) {
+		b.pc.close()
+		return nil
+	}
+
+	b.pc.t.putConn(b.pc)
+	return nil
+}
+
+// getConn returns an idle connection to addr, dials a new one, or waits for
+// one when the host is at MaxConnsPerHost
+func (t *Transport) getConn(ctx context.Context, scheme, addr string) (pc *persistConn, reused bool, err error) {
+	key := scheme + "://" + addr
+
+	for {
+		t.mu.Lock()
+		if t.hosts == nil {
+			t.hosts = map[string]*hostConns{}
+		}
+		hc := t.hosts[key]
+		if hc == nil {
+			hc = &hostConns{}
+			t.hosts[key] = hc
+		}
+
+		// The most recently used connection is the likeliest to be alive
+		if n := len(hc.idle); n > 0 {
+			pc := hc.idle[n-1]
+			hc.idle = hc.idle[:n-1]
+			t.idleCount--
+			t.mu.Unlock()
+
+			if pc.takeIdle() {
+				return pc, true, nil
+			}
+			// Closed by the server while idle
+			pc.close()
+			continue
+		}
+
+		if t.MaxConnsPerHost <= 0 || hc.open < t.MaxConnsPerHost {
+			hc.open++
+			t.mu.Unlock()
+			pc, err := t.dialConn(ctx, scheme, addr, key)
+			return pc, false, err
+		}
+
+		ch := make(chan *persistConn, 1)
+		hc.waiters = append(hc.waiters, ch)
+		t.mu.Unlock()
+
+		select {
+		case pc := <-ch:
+			if pc == nil {
+				pc, err := t.dialConn(ctx, scheme, addr, key)
+				return pc, false, err
+			}
+			return pc, true, nil
+		case <-ctx.Done():
+			t.mu.Lock()
+			removed := hc.removeWaiter(ch)
+			t.mu.Unlock()
+
+			// Whatever was handed over meanwhile goes to the next in line
+			if !removed {
+				if pc := <-ch; pc != nil {
+					t.putConn(pc)
+				} else {
+					t.release(key)
+				}
+			}
+			return nil, false, ctx.Err()
+		}
+	}
+}
+
+// dialConn opens a connection into a slot already counted in open
+func (t *Transport) dialConn(ctx context.Context, scheme, addr, key string) (*persistConn, error) {
+	conn, err := t.dial(ctx, scheme, addr)
+	if err != nil {
+		t.release(key)
+		return nil, err
+	}
+	return &persistConn{Conn: conn, t: t, key: key}, nil
+}
+
+func (t *Transport) dial(ctx context.Context, scheme, addr string) (net.Conn, error) {
+	dial := t.Dial
+	if dial == nil {
+		var dialer net.Dialer
+		dial = dialer.DialContext
+	}
+
+	conn, err := dial(ctx, "tcp", addr)
+	if err != nil || scheme != "https" {
+		return conn, err
+	}
+
+	config := t.TLSConfig
+	if config == nil {
+		config = &tls.Config{}
+	}
+	if config.ServerName == "" {
+		config = config.Clone()
+		config.ServerName, _, _ = net.SplitHostPort(addr)
+	}
+
+	tlsConn := tls.Client(conn, config)
+	if err := tlsConn.HandshakeContext(ctx); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return tlsConn, nil
+}
+
+// putConn hands pc to a waiting request or keeps it idle
+func (t *Transport) putConn(pc *persistConn) {
+	var evicted *persistConn
+
+	t.mu.Lock()
+	hc := t.hosts[pc.key]
+	if len(hc.waiters) > 0 {
+		ch := hc.waiters[0]
+		hc.waiters = hc.waiters[1:]
+		t.mu.Unlock()
+		ch <- pc
+		return
+	}
+
+	if len(hc.idle) >= orDefault(t.MaxIdleConnsPerHost, DefaultMaxIdleConnsPerHost) {
+		t.mu.Unlock()
+		pc.close()
+		return
+	}
+
+	if t.idleCount >= orDefault(t.MaxIdleConns, DefaultMaxIdleConns) {
+		evicted = t.removeOldestIdle()
+	}
+
+	pc.idleAt = time.Now()
+	hc.idle = append(hc.idle, pc)
+	t.idleCount++
+
+	timeout := t.IdleConnTimeout
+	if timeout <= 0 {
+		timeout = DefaultIdleConnTimeout
+	}
+	pc.idleTimer = time.AfterFunc(timeout, func() {
+		t.removeIdle(pc)
+	})
+	pc.watch()
+	t.mu.Unlock()
+
+	if evicted != nil {
+		evicted.idleTimer.Stop()
+		evicted.close()
+	}
+}
+
+// removeIdle drops pc from the pool and closes it, unless a request has
+// taken it in the meantime
+func (t *Transport) removeIdle(pc *persistConn) {
+	t.mu.Lock()
+	hc := t.hosts[pc.key]
+	removed := false
+	if hc != nil {
+		for i, idle := range hc.idle {
+			if idle == pc {
+				hc.idle = append(hc.idle[:i], hc.idle[i+1:]...)
+				t.idleCount--
+				removed = true
+				break
+			}
+		}
+	}
+	t.mu.Unlock()
+
+	if removed {
+		pc.idleTimer.Stop()
+		pc.close()
+	}
+}
+
+// removeOldestIdle takes the least recently used idle connection out of the
+// pool. t.mu must be held.
+func (t *Transport) removeOldestIdle() *persistConn {
+	var oldest *hostConns
+	for _, hc := range t.hosts {
+		if len(hc.idle) > 0 && (oldest == nil || hc.idle[0].idleAt.Before(oldest.idle[0].idleAt)) {
+			oldest = hc
+		}
+	}
+	if oldest == nil {
+		return nil
+	}
+
+	pc := oldest.idle[0]
+	oldest.idle = oldest.idle[1:]
+	t.idleCount--
+	return pc
+}
+
+// release frees the slot of a closed connection, or passes it on to a
+// waiting request
+func (t *Transport) release(key string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	hc := t.hosts[key]
+	if len(hc.waiters) > 0 {
+		ch := hc.waiters[0]
+		hc.waiters = hc.waiters[1:]
+		ch <- nil
+		return
+	}
+
+	hc.open--
+	if hc.open == 0 && len(hc.idle) == 0 {
+		delete(t.hosts, key)
+	}
+}
+
+func (hc *hostConns) removeWaiter(ch chan *persistConn) bool {
+	for i, waiter := range hc.waiters {
+		if waiter == ch {
+			hc.waiters = append(hc.waiters[:i], hc.waiters[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// watch reads from the idle connection in the background. A server closing
+// it shows up as io.EOF, and the connection leaves the pool right away.
+func (pc *persistConn) watch() {
+	pc.probe = make(chan error, 1)
+	go func() {
+		var b [1]byte
+		n, err := pc.Conn.Read(b[:])
+		if n > 0 {
+			err = errUnexpectedData
+		}
+		pc.probe <- err
+
+		if !isTimeout(err) {
+			pc.t.removeIdle(pc)
+		}
+	}()
+}
+
+// takeIdle stops the background read of a connection taken out of the pool
+// and reports whether it is still usable
+func (pc *persistConn) takeIdle() bool {
+	pc.idleTimer.Stop()
+	pc.Conn.SetReadDeadline(aLongTimeAgo)
+	err := <-pc.probe
+	pc.Conn.SetReadDeadline(time.Time{})
+	return isTimeout(err)
+}
+
+func (pc *persistConn) close() {
+	pc.Conn.Close()
+	pc.t.release(pc.key)
+}
+
+// reusable reports whether the connection can carry another request after
+// resp, which needs both sides to keep it open and a body that didn't run
+// until close
+func reusable(req *request.Request, resp *Response) bool {
+	if resp.HttpVersion != "1.1" || resp.Headers.HasToken("Connection", "close") || req.Headers.HasToken("Connection", "close") {
+		return false
+	}
+
+	switch {
+	case resp.StatusCode == "101":
+		// The connection belongs to another protocol now
+		return false
+	case req.RequestLine.Method == "HEAD", resp.StatusCode == "204", resp.StatusCode == response.NotModified:
+		return true
+	}
+
+	return resp.Headers.HasToken("Transfer-Encoding", "chunked") || resp.Headers.Get("Content-Length") != ""
+}
+
+// hasBody reports whether resp may carry a body that's still to be read
+func hasBody(req *request.Request, resp *Response) bool {
+	switch {
+	case req.RequestLine.Method == "HEAD", resp.StatusCode == "204", resp.StatusCode == response.NotModified:
+		return false
+	}
+	return resp.Headers.Get("Content-Length") != "0"
+}
+
+func idempotent(method string) bool {
+	switch method {
+	case "GET", "HEAD", "OPTIONS", "TRACE", "PUT", "DELETE":
+		return true
+	}
+	return false
+}
+
+// canonicalAddr adds the scheme's default port to host when it has none
+func canonicalAddr(scheme, host string) string {
+	if _, _, err := net.SplitHostPort(host); err == nil {
+		return host
+	}
+
+	port := "80"
+	if scheme == "https" {
+		port = "443"
+	}
+	return net.JoinHostPort(strings.Trim(host, "[]"), port)
+}
+
+func orDefault(n, def int) int {
+	if n <= 0 {
+		return def
+	}
+	return n
+}
+
+func isTimeout(err error) bool {
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
+
+// countingReader counts bytes read, to tell a connection that died before
+// answering from one that failed midway
+type countingReader struct {
+	reader io.Reader
+	n      int
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, err := r.reader.Read(p)
+	r.n += n
+	if err != nil && !errors.Is(err, io.EOF) {
+		err = fmt.Errorf("error reading response: %w", err)
+	}
+	return n, err
+}
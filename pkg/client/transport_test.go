@@ -0,0 +1,256 @@
+package client
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/spaghetti-lover/go-http/pkg/request"
+	"github.com/spaghetti-lover/go-http/pkg/server"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// countDials makes tr count the connections it opens
+func countDials(tr *Transport) *atomic.Int32 {
+	var dials atomic.Int32
+	tr.Dial = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		dials.Add(1)
+		var dialer net.Dialer
+		return dialer.DialContext(ctx, network, addr)
+	}
+	return &dials
+}
+
+func (t *Transport) idleConns() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.idleCount
+}
+
+func TestTransportReuse(t *testing.T) {
+	base := startServer(t)
+	tr := &Transport{}
+	dials := countDials(tr)
+	c := &Client{Transport: tr}
+	ctx := context.Background()
+
+	// Test: Sequential requests share one connection
+	for i := 0; i < 3; i++ {
+		req, err := NewRequest("POST", base+"/echo", []byte(strconv.Itoa(i)))
+		require.NoError(t, err)
+		resp, err := c.Do(ctx, req)
+		require.NoError(t, err)
+		assert.Equal(t, "POST /echo "+strconv.Itoa(i), string(resp.Body))
+	}
+	assert.Equal(t, int32(1), dials.Load())
+	assert.Equal(t, 1, tr.idleConns())
+
+	// Test: Content-Length bodies arriving over many reads end where they
+	// should, and the connection is reused after them
+	big := strings.Repeat("x", 50000)
+	for i := 0; i < 2; i++ {
+		req, err := NewRequest("POST", base+"/echo", []byte(big))
+		require.NoError(t, err)
+		resp, err := c.Do(ctx, req)
+		require.NoError(t, err)
+		assert.Equal(t, "POST /echo "+big, string(resp.Body))
+	}
+	assert.Equal(t, int32(1), dials.Load())
+
+	// Test: Chunked responses leave the connection reusable
+	req, err := NewRequest("GET", base+"/chunked", nil)
+	require.NoError(t, err)
+	_, err = c.Do(ctx, req)
+	require.NoError(t, err)
+	assert.Equal(t, int32(1), dials.Load())
+
+	// Test: A body delimited by close uses up the connection
+	req, err = NewRequest("GET", base+"/close", nil)
+	require.NoError(t, err)
+	resp, err := c.Do(ctx, req)
+	require.NoError(t, err)
+	assert.Equal(t, "until close", string(resp.Body))
+	assert.Equal(t, 0, tr.idleConns())
+
+	req, err = NewRequest("GET", base+"/", nil)
+	require.NoError(t, err)
+	_, err = c.Do(ctx, req)
+	require.NoError(t, err)
+	assert.Equal(t, int32(2), dials.Load())
+
+	// Test: Connection: close from the client
+	req, err = NewRequest("GET", base+"/", nil)
+	require.NoError(t, err)
+	req.Headers.Set("Connection", "close")
+	_, err = c.Do(ctx, req)
+	require.NoError(t, err)
+	assert.Equal(t, 0, tr.idleConns())
+
+	tr.CloseIdleConnections()
+}
+
+func TestTransportIdle(t *testing.T) {
+	ctx := context.Background()
+
+	// Test: Connections closed by the server leave the pool
+	srv, err := server.Serve(0, testHandler, server.WithIdleTimeout(50*time.Millisecond))
+	require.NoError(t, err)
+	t.Cleanup(func() { srv.Close() })
+	base := fmt.Sprintf("http://%s", srv.Addr())
+
+	tr := &Transport{}
+	dials := countDials(tr)
+	c := &Client{Transport: tr}
+	req, err := NewRequest("GET", base+"/", nil)
+	require.NoError(t, err)
+	_, err = c.Do(ctx, req)
+	require.NoError(t, err)
+	assert.Equal(t, 1, tr.idleConns())
+	require.Eventually(t, func() bool { return tr.idleConns() == 0 }, time.Second, 10*time.Millisecond)
+
+	_, err = c.Do(ctx, req)
+	require.NoError(t, err)
+	assert.Equal(t, int32(2), dials.Load())
+
+	// Test: Connections idle past IdleConnTimeout are closed
+	tr = &Transport{IdleConnTimeout: 50 * time.Millisecond}
+	c = &Client{Transport: tr}
+	req, err = NewRequest("GET", startServer(t)+"/", nil)
+	require.NoError(t, err)
+	_, err = c.Do(ctx, req)
+	require.NoError(t, err)
+	assert.Equal(t, 1, tr.idleConns())
+	require.Eventually(t, func() bool { return tr.idleConns() == 0 }, time.Second, 10*time.Millisecond)
+}
+
+func TestTransportLimits(t *testing.T) {
+	base := startServer(t)
+	ctx := context.Background()
+
+	concurrently := func(c *Client, n int, target string) {
+		var wg sync.WaitGroup
+		for i := 0; i < n; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				req, err := NewRequest("GET", target, nil)
+				require.NoError(t, err)
+				resp, err := c.Do(ctx, req)
+				require.NoError(t, err)
+				assert.Equal(t, "200", string(resp.StatusCode))
+			}()
+		}
+		wg.Wait()
+	}
+
+	// Test: MaxConnsPerHost makes requests wait for a connection
+	tr := &Transport{MaxConnsPerHost: 1}
+	dials := countDials(tr)
+	concurrently(&Client{Transport: tr}, 3, base+"/continue")
+	assert.Equal(t, int32(1), dials.Load())
+
+	// Test: Waiting is bounded by the context, and gives up its place
+	tr = &Transport{MaxConnsPerHost: 1}
+	dials = countDials(tr)
+	go concurrently(&Client{Transport: tr}, 1, base+"/slow")
+	time.Sleep(100 * time.Millisecond)
+	req, err := NewRequest("GET", base+"/", nil)
+	require.NoError(t, err)
+	_, err = (&Client{Transport: tr, Timeout: 100 * time.Millisecond}).Do(ctx, req)
+	require.ErrorIs(t, err, context.DeadlineExceeded)
+	_, err = (&Client{Transport: tr}).Do(ctx, req)
+	require.NoError(t, err)
+	assert.Equal(t, int32(1), dials.Load())
+
+	// Test: MaxIdleConnsPerHost closes extra connections
+	tr = &Transport{MaxIdleConnsPerHost: 1}
+	dials = countDials(tr)
+	concurrently(&Client{Transport: tr}, 3, base+"/slow")
+	assert.Equal(t, int32(3), dials.Load())
+	assert.Equal(t, 1, tr.idleConns())
+
+	// Test: MaxIdleConns evicts the oldest idle connection
+	tr = &Transport{MaxIdleConns: 1}
+	c := &Client{Transport: tr}
+	other := startServer(t)
+	for _, target := range []string{base + "/", other + "/"} {
+		req, err := NewRequest("GET", target, nil)
+		require.NoError(t, err)
+		_, err = c.Do(ctx, req)
+		require.NoError(t, err)
+	}
+	assert.Equal(t, 1, tr.idleConns())
+	tr.mu.Lock()
+	assert.Len(t, tr.hosts, 1)
+	tr.mu.Unlock()
+}
+
+// startFlakyServer answers every request, except that the first connection
+// is dropped when its second request arrives, the way a server closing an
+// idle connection races with a client reusing it
+func startFlakyServer(t *testing.T) string {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { listener.Close() })
+
+	go func() {
+		for accepted := 0; ; accepted++ {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func(conn net.Conn, first bool) {
+				defer conn.Close()
+				for served := 0; ; served++ {
+					req, err := request.FromReader(conn)
+					if err != nil || (first && served == 1) {
+						return
+					}
+					body := req.RequestLine.Method + " " + req.RequestLine.RequestTarget
+					fmt.Fprintf(conn, "HTTP/1.1 200 OK\r\nContent-Length: %d\r\n\r\n%s", len(body), body)
+				}
+			}(conn, accepted == 0)
+		}
+	}()
+
+	return fmt.Sprintf("http://%s", listener.Addr())
+}
+
+func TestTransportRetry(t *testing.T) {
+	ctx := context.Background()
+
+	// Test: Idempotent requests are retried once on a stale connection
+	base := startFlakyServer(t)
+	tr := &Transport{}
+	dials := countDials(tr)
+	c := &Client{Transport: tr}
+	for _, target := range []string{"/one", "/two"} {
+		req, err := NewRequest("GET", base+target, nil)
+		require.NoError(t, err)
+		resp, err := c.Do(ctx, req)
+		require.NoError(t, err)
+		assert.Equal(t, "GET "+target, string(resp.Body))
+	}
+	assert.Equal(t, int32(2), dials.Load())
+
+	// Test: Other requests aren't
+	base = startFlakyServer(t)
+	c = &Client{Transport: &Transport{}}
+	req, err := NewRequest("GET", base+"/one", nil)
+	require.NoError(t, err)
+	_, err = c.Do(ctx, req)
+	require.NoError(t, err)
+	req, err = NewRequest("POST", base+"/two", []byte("data"))
+	require.NoError(t, err)
+	_, err = c.Do(ctx, req)
+	require.ErrorIs(t, err, io.ErrUnexpectedEOF)
+}
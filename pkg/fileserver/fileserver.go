@@ -0,0 +1,139 @@
+package fileserver
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/spaghetti-lover/go-http/pkg/headers"
+	"github.com/spaghetti-lover/go-http/pkg/request"
+	"github.com/spaghetti-lover/go-http/pkg/response"
+	"github.com/spaghetti-lover/go-http/pkg/server"
+)
+
+const indexFile = "index.html"
+
+// Handler serves files below root for request targets starting with prefix.
+// Responses carry ETag and Last-Modified validators and conditional
+// requests are answered with 304 / 412 where appropriate.
+func Handler(root, prefix string) server.Handler {
+	return func(w *response.Writer, req *request.Request) {
+		method := req.RequestLine.Method
+		if method != "GET" && method != "HEAD" {
+			h := headers.NewHeaders()
+			h.Set("Allow", "GET, HEAD")
+			writeError(w, response.MethodNotAllowed, h)
+			return
+		}
+
+		name, ok := resolve(root, prefix, req.RequestLine.RequestTarget)
+		if !ok {
+			writeError(w, response.NotFound, headers.NewHeaders())
+			return
+		}
+
+		serveFile(w, req, name)
+	}
+}
+
+// resolve maps a request target onto a path below root, refusing anything
+// that would escape it
+func resolve(root, prefix, target string) (string, bool) {
+	if i := strings.IndexAny(target, "?#"); i != -1 {
+		target = target[:i]
+	}
+	if !strings.HasPrefix(target, prefix) {
+		return "", false
+	}
+
+	p, err := url.PathUnescape(strings.TrimPrefix(target, prefix))
+	if err != nil || strings.Contains(p, "\x00") {
+		return "", false
+	}
+
+	p = path.Clean("/" + p)
+	return filepath.Join(root, filepath.FromSlash(p)), true
+}
+
+func serveFile(w *response.Writer, req *request.Request, name string) {
+	info, err := os.Stat(name)
+	if err == nil && info.IsDir() {
+		name = filepath.Join(name, indexFile)
+		info, err = os.Stat(name)
+	}
+	if err != nil || info.IsDir() {
+		writeError(w, response.NotFound, headers.NewHeaders())
+		return
+	}
+
+	h := headers.NewHeaders()
+	etag := fmt.Sprintf("%x-%x", info.ModTime().Unix(), info.Size())
+	response.SetETag(h, etag, false)
+	response.SetLastModified(h, info.ModTime())
+
+	status := response.CheckPreconditions(req, h.Get("ETag"), info.ModTime())
+	if status != response.OK {
+		err = response.WriteConditional(w, status, h)
+		if err != nil {
+			log.Printf("Error writing conditional response: %v", err)
+		}
+		return
+	}
+
+	f, err := os.Open(name)
+	if err != nil {
+		writeError(w, response.InternalServerError, headers.NewHeaders())
+		return
+	}
+	defer f.Close()
+
+	contentType := mime.TypeByExtension(filepath.Ext(name))
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+
+	h.Set("Content-Length", strconv.FormatInt(info.Size(), 10))
+	h.Set("Content-Type", contentType)
+
+	err = w.WriteStatusLine(response.OK)
+	if err != nil {
+		log.Printf("Error writing status line: %v", err)
+		return
+	}
+
+	err = w.WriteHeaders(h)
+	if err != nil {
+		log.Printf("Error writing headers: %v", err)
+		return
+	}
+
+	if req.RequestLine.Method == "HEAD" {
+		return
+	}
+
+	_, err = io.Copy(w, f)
+	if err != nil {
+		log.Printf("Error writing body: %v", err)
+	}
+}
+
+func writeError(w *response.Writer, statusCode response.StatusCode, h *headers.Headers) {
+	err := w.WriteStatusLine(statusCode)
+	if err != nil {
+		log.Printf("Error writing status line: %v", err)
+		return
+	}
+
+	h.Set("Content-Length", "0")
+	err = w.WriteHeaders(h)
+	if err != nil {
+		log.Printf("Error writing headers: %v", err)
+	}
+}
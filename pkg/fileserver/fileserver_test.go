@@ -0,0 +1,81 @@
+package fileserver
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/spaghetti-lover/go-http/pkg/request"
+	"github.com/spaghetti-lover/go-http/pkg/response"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func serve(t *testing.T, root, raw string) string {
+	t.Helper()
+	req, err := request.FromReader(strings.NewReader(raw))
+	require.NoError(t, err)
+
+	var buf bytes.Buffer
+	Handler(root, "/static")(response.NewWriter(&buf), req)
+	return buf.String()
+}
+
+func TestHandler(t *testing.T) {
+	root := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(root, "hello.txt"), []byte("hello"), 0o644))
+	require.NoError(t, os.Mkdir(filepath.Join(root, "docs"), 0o755))
+	require.NoError(t, os.WriteFile(filepath.Join(root, "docs", "index.html"), []byte("<p>docs</p>"), 0o644))
+
+	modTime := time.Date(2024, 3, 1, 11, 30, 45, 0, time.UTC)
+	require.NoError(t, os.Chtimes(filepath.Join(root, "hello.txt"), modTime, modTime))
+
+	// Test: Plain file
+	out := serve(t, root, "GET /static/hello.txt HTTP/1.1\r\nHost: localhost\r\n\r\n")
+	assert.True(t, strings.HasPrefix(out, "HTTP/1.1 200 OK\r\n"))
+	assert.Contains(t, out, "last-modified: Fri, 01 Mar 2024 11:30:45 GMT\r\n")
+	assert.Contains(t, out, "content-length: 5\r\n")
+	assert.Contains(t, out, "content-type: text/plain")
+	assert.True(t, strings.HasSuffix(out, "\r\n\r\nhello"))
+
+	// Test: Directory index
+	out = serve(t, root, "GET /static/docs/ HTTP/1.1\r\nHost: localhost\r\n\r\n")
+	assert.True(t, strings.HasPrefix(out, "HTTP/1.1 200 OK\r\n"))
+	assert.True(t, strings.HasSuffix(out, "<p>docs</p>"))
+
+	// Test: HEAD has no body
+	out = serve(t, root, "HEAD /static/hello.txt HTTP/1.1\r\nHost: localhost\r\n\r\n")
+	assert.True(t, strings.HasSuffix(out, "\r\n\r\n"))
+
+	// Test: Revalidation with If-None-Match
+	etag := fmt.Sprintf(`"%x-%x"`, modTime.Unix(), 5)
+	out = serve(t, root, "GET /static/hello.txt HTTP/1.1\r\nHost: localhost\r\nIf-None-Match: "+etag+"\r\n\r\n")
+	assert.True(t, strings.HasPrefix(out, "HTTP/1.1 304 Not Modified\r\n"))
+	assert.Contains(t, out, "etag: "+etag+"\r\n")
+	assert.True(t, strings.HasSuffix(out, "\r\n\r\n"))
+
+	// Test: Revalidation with If-Modified-Since
+	out = serve(t, root, "GET /static/hello.txt HTTP/1.1\r\nHost: localhost\r\nIf-Modified-Since: Fri, 01 Mar 2024 11:30:45 GMT\r\n\r\n")
+	assert.True(t, strings.HasPrefix(out, "HTTP/1.1 304 Not Modified\r\n"))
+
+	// Test: Failed If-Match
+	out = serve(t, root, "GET /static/hello.txt HTTP/1.1\r\nHost: localhost\r\nIf-Match: \"nope\"\r\n\r\n")
+	assert.True(t, strings.HasPrefix(out, "HTTP/1.1 412 Precondition Failed\r\n"))
+
+	// Test: Missing file
+	out = serve(t, root, "GET /static/missing.txt HTTP/1.1\r\nHost: localhost\r\n\r\n")
+	assert.True(t, strings.HasPrefix(out, "HTTP/1.1 404 Not Found\r\n"))
+
+	// Test: Path traversal stays inside root
+	out = serve(t, root, "GET /static/../../etc/passwd HTTP/1.1\r\nHost: localhost\r\n\r\n")
+	assert.True(t, strings.HasPrefix(out, "HTTP/1.1 404 Not Found\r\n"))
+
+	// Test: Unsupported method
+	out = serve(t, root, "DELETE /static/hello.txt HTTP/1.1\r\nHost: localhost\r\n\r\n")
+	assert.True(t, strings.HasPrefix(out, "HTTP/1.1 405 Method Not Allowed\r\n"))
+	assert.Contains(t, out, "allow: GET, HEAD\r\n")
+}
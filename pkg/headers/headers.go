@@ -66,11 +66,20 @@ func parseHeader(fieldLine []byte) (name, value string, err error) {
 
 type Headers struct {
 	headers map[string]string
+	// values keeps each value of a repeated field apart, for fields such as
+	// Set-Cookie that can't be joined into one line
+	values map[string][]string
+	// names keeps the spelling a field was first seen with and order the
+	// sequence fields were added in, both keyed by the lowercased name
+	names map[string]string
+	order []string
 }
 
 func NewHeaders() *Headers {
 	return &Headers{
 		headers: map[string]string{},
+		values:  map[string][]string{},
+		names:   map[string]string{},
 	}
 }
 
@@ -79,24 +88,92 @@ func (h *Headers) Get(name string) string {
 }
 
 func (h *Headers) Set(name, value string) {
-	name = strings.ToLower(name)
+	key := h.track(name)
 
-	if v, ok := h.headers[name]; ok {
-		h.headers[name] = fmt.Sprintf("%s, %s", v, value)
+	if v, ok := h.headers[key]; ok {
+		h.headers[key] = fmt.Sprintf("%s, %s", v, value)
 	} else {
-		h.headers[name] = value
+		h.headers[key] = value
 	}
+	h.values[key] = append(h.values[key], value)
 }
 
 func (h *Headers) Override(name, value string) {
-	name = strings.ToLower(name)
-	h.headers[name] = value
+	key := h.track(name)
+	h.headers[key] = value
+	h.values[key] = []string{value}
+}
+
+// Values returns a field's values one by one, as they were set or parsed,
+// where Get joins them with commas
+func (h *Headers) Values(name string) []string {
+	return h.values[strings.ToLower(name)]
+}
+
+func (h *Headers) Del(name string) {
+	key := strings.ToLower(name)
+	if _, ok := h.headers[key]; !ok {
+		return
+	}
+
+	delete(h.headers, key)
+	delete(h.values, key)
+	delete(h.names, key)
+	for i, k := range h.order {
+		if k == key {
+			h.order = append(h.order[:i], h.order[i+1:]...)
+			break
+		}
+	}
+}
+
+// HasToken reports whether the comma-separated field name contains token,
+// ignoring case, as in Connection: keep-alive, close
+func (h *Headers) HasToken(name, token string) bool {
+	for _, v := range strings.Split(h.Get(name), ",") {
+		if strings.EqualFold(strings.TrimSpace(v), token) {
+			return true
+		}
+	}
+	return false
 }
 
 func (h *Headers) All() map[string]string {
 	return h.headers
 }
 
+// Names returns the field names in the order they were first added, spelled
+// the way they were first seen
+func (h *Headers) Names() []string {
+	names := make([]string, 0, len(h.order))
+	for _, key := range h.order {
+		names = append(names, h.names[key])
+	}
+	return names
+}
+
+// Clone returns an independent copy of h
+func (h *Headers) Clone() *Headers {
+	c := NewHeaders()
+	for _, key := range h.order {
+		c.headers[key] = h.headers[key]
+		c.values[key] = append([]string(nil), h.values[key]...)
+		c.names[key] = h.names[key]
+	}
+	c.order = append(c.order, h.order...)
+	return c
+}
+
+// track records a new field name and returns its lookup key
+func (h *Headers) track(name string) string {
+	key := strings.ToLower(name)
+	if _, ok := h.headers[key]; !ok {
+		h.names[key] = name
+		h.order = append(h.order, key)
+	}
+	return key
+}
+
 func (h *Headers) Parse(data []byte) (bytesRead int, done bool, err error) {
 	read := 0
 	isDone := false
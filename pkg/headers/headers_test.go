@@ -45,3 +45,41 @@ func TestHeaderParse(t *testing.T) {
 	assert.True(t, done)
 	assert.Equal(t, len(data), n)
 }
+
+func TestHeaderDel(t *testing.T) {
+	headers := NewHeaders()
+	headers.Set("Content-Length", "5")
+	headers.Set("Content-Type", "text/plain")
+	headers.Del("CONTENT-LENGTH")
+	assert.Equal(t, "", headers.Get("Content-Length"))
+	assert.Equal(t, "text/plain", headers.Get("Content-Type"))
+	assert.Len(t, headers.All(), 1)
+}
+
+func TestHeaderOrder(t *testing.T) {
+	headers := NewHeaders()
+	data := []byte("Host: localhost\r\nX-Custom: 1\r\nAccept: */*\r\nx-custom: 2\r\n\r\n")
+	_, done, err := headers.Parse(data)
+	require.NoError(t, err)
+	require.True(t, done)
+	assert.Equal(t, []string{"Host", "X-Custom", "Accept"}, headers.Names())
+	assert.Equal(t, "1, 2", headers.Get("x-custom"))
+	assert.Equal(t, []string{"1", "2"}, headers.Values("X-CUSTOM"))
+	assert.Nil(t, headers.Values("Missing"))
+
+	// Override keeps the position, new fields go last
+	headers.Override("HOST", "example.com")
+	headers.Set("User-Agent", "test")
+	assert.Equal(t, []string{"Host", "X-Custom", "Accept", "User-Agent"}, headers.Names())
+
+	headers.Del("x-custom")
+	assert.Equal(t, []string{"Host", "Accept", "User-Agent"}, headers.Names())
+
+	// Clone is independent
+	clone := headers.Clone()
+	clone.Set("X-Extra", "yes")
+	clone.Override("Host", "other")
+	assert.Equal(t, []string{"Host", "Accept", "User-Agent"}, headers.Names())
+	assert.Equal(t, "example.com", headers.Get("Host"))
+	assert.Equal(t, []string{"Host", "Accept", "User-Agent", "X-Extra"}, clone.Names())
+}
@@ -0,0 +1,157 @@
+package http2
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// ClientPreface opens every HTTP/2 connection from the client (RFC 9113 §3.4)
+const ClientPreface = "PRI * HTTP/2.0\r\n\r\nSM\r\n\r\n"
+
+type frameType byte
+
+const (
+	frameData         frameType = 0x0
+	frameHeaders      frameType = 0x1
+	framePriority     frameType = 0x2
+	frameRSTStream    frameType = 0x3
+	frameSettings     frameType = 0x4
+	framePushPromise  frameType = 0x5
+	framePing         frameType = 0x6
+	frameGoAway       frameType = 0x7
+	frameWindowUpdate frameType = 0x8
+	frameContinuation frameType = 0x9
+)
+
+const (
+	flagEndStream  = 0x1
+	flagAck        = 0x1
+	flagEndHeaders = 0x4
+	flagPadded     = 0x8
+	flagPriority   = 0x20
+)
+
+type settingID uint16
+
+const (
+	settingHeaderTableSize      settingID = 0x1
+	settingEnablePush           settingID = 0x2
+	settingMaxConcurrentStreams settingID = 0x3
+	settingInitialWindowSize    settingID = 0x4
+	settingMaxFrameSize         settingID = 0x5
+	settingMaxHeaderListSize    settingID = 0x6
+)
+
+// ErrCode is an HTTP/2 error code, sent in RST_STREAM and GOAWAY
+type ErrCode uint32
+
+const (
+	ErrCodeNo                 ErrCode = 0x0
+	ErrCodeProtocol           ErrCode = 0x1
+	ErrCodeInternal           ErrCode = 0x2
+	ErrCodeFlowControl        ErrCode = 0x3
+	ErrCodeSettingsTimeout    ErrCode = 0x4
+	ErrCodeStreamClosed       ErrCode = 0x5
+	ErrCodeFrameSize          ErrCode = 0x6
+	ErrCodeRefusedStream      ErrCode = 0x7
+	ErrCodeCancel             ErrCode = 0x8
+	ErrCodeCompression        ErrCode = 0x9
+	ErrCodeConnect            ErrCode = 0xA
+	ErrCodeEnhanceYourCalm    ErrCode = 0xB
+	ErrCodeInadequateSecurity ErrCode = 0xC
+	ErrCodeHTTP11Required     ErrCode = 0xD
+)
+
+const (
+	frameHeaderLen = 9
+
+	// defaultMaxFrameSize and defaultWindowSize are the initial values
+	// of the corresponding settings for both sides
+	defaultMaxFrameSize = 16384
+	defaultWindowSize   = 65535
+
+	maxFrameSizeLimit = 1<<24 - 1
+	maxWindowSize     = 1<<31 - 1
+)
+
+// ConnError ends the whole connection with a GOAWAY
+type ConnError struct {
+	Code   ErrCode
+	Reason string
+}
+
+func (e ConnError) Error() string {
+	return fmt.Sprintf("http2: connection error %d: %s", e.Code, e.Reason)
+}
+
+// streamError resets a single stream
+type streamError struct {
+	streamID uint32
+	code     ErrCode
+}
+
+func (e streamError) Error() string {
+	return fmt.Sprintf("http2: stream %d error %d", e.streamID, e.code)
+}
+
+type frame struct {
+	typ      frameType
+	flags    byte
+	streamID uint32
+	payload  []byte
+}
+
+func (f *frame) has(flag byte) bool {
+	return f.flags&flag != 0
+}
+
+// readFrame reads the next frame, refusing payloads over maxSize
+func readFrame(r io.Reader, maxSize uint32) (*frame, error) {
+	var head [frameHeaderLen]byte
+	if _, err := io.ReadFull(r, head[:]); err != nil {
+		return nil, err
+	}
+
+	length := uint32(head[0])<<16 | uint32(head[1])<<8 | uint32(head[2])
+	f := &frame{
+		typ:      frameType(head[3]),
+		flags:    head[4],
+		streamID: binary.BigEndian.Uint32(head[5:]) & (1<<31 - 1),
+	}
+	if length > maxSize {
+		return nil, ConnError{ErrCodeFrameSize, fmt.Sprintf("frame of %d bytes", length)}
+	}
+
+	f.payload = make([]byte, length)
+	if _, err := io.ReadFull(r, f.payload); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// appendFrame appends a frame with its header to dst
+func appendFrame(dst []byte, typ frameType, flags byte, streamID uint32, payload []byte) []byte {
+	length := len(payload)
+	dst = append(dst, byte(length>>16), byte(length>>8), byte(length), byte(typ), flags)
+	dst = binary.BigEndian.AppendUint32(dst, streamID)
+	return append(dst, payload...)
+}
+
+// unpad strips the padding of DATA and HEADERS frames
+func unpad(f *frame) ([]byte, error) {
+	p := f.payload
+	if !f.has(flagPadded) {
+		return p, nil
+	}
+	if len(p) == 0 {
+		return nil, ConnError{ErrCodeFrameSize, "padded frame without pad length"}
+	}
+
+	padLen := int(p[0])
+	p = p[1:]
+	if padLen > len(p) {
+		return nil, ConnError{ErrCodeProtocol, "padding longer than the payload"}
+	}
+	return p[:len(p)-padLen], nil
+}
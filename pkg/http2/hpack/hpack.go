@@ -0,0 +1,293 @@
+package hpack
+
+import (
+	"fmt"
+)
+
+// HeaderField is one decoded or to be encoded field. Names are lowercase.
+type HeaderField struct {
+	Name  string
+	Value string
+}
+
+// size is what the field counts against a dynamic table (RFC 7541 §4.1)
+func (f HeaderField) size() int {
+	return len(f.Name) + len(f.Value) + 32
+}
+
+// DefaultTableSize is the dynamic table size both sides start with
+const DefaultTableSize = 4096
+
+var ErrInvalidIndex = fmt.Errorf("hpack: invalid table index")
+var ErrInvalidHuffman = fmt.Errorf("hpack: invalid huffman coding")
+var ErrStringTooLong = fmt.Errorf("hpack: string too long")
+var ErrTruncated = fmt.Errorf("hpack: truncated header block")
+var ErrTableSizeUpdate = fmt.Errorf("hpack: invalid dynamic table size update")
+
+// table is a dynamic table, newest entry last
+type table struct {
+	entries []HeaderField
+	size    int
+	maxSize int
+}
+
+func (t *table) add(f HeaderField) {
+	t.entries = append(t.entries, f)
+	t.size += f.size()
+	t.evict()
+}
+
+func (t *table) setMaxSize(n int) {
+	t.maxSize = n
+	t.evict()
+}
+
+func (t *table) evict() {
+	drop := 0
+	for t.size > t.maxSize && drop < len(t.entries) {
+		t.size -= t.entries[drop].size()
+		drop++
+	}
+	t.entries = t.entries[drop:]
+}
+
+// Decoder decodes header blocks from one peer, in order, keeping the dynamic
+// table between them
+type Decoder struct {
+	dynamic table
+
+	// maxTableSize is the most the peer may grow the table to, the
+	// SETTINGS_HEADER_TABLE_SIZE we announced
+	maxTableSize int
+
+	// MaxStringLength bounds decoded names and values
+	MaxStringLength int
+}
+
+func NewDecoder(maxTableSize int) *Decoder {
+	return &Decoder{
+		dynamic:         table{maxSize: maxTableSize},
+		maxTableSize:    maxTableSize,
+		MaxStringLength: 16 << 10,
+	}
+}
+
+// Decode decodes a complete header block, fragments already joined
+func (d *Decoder) Decode(block []byte) ([]HeaderField, error) {
+	var fields []HeaderField
+	for first := true; len(block) > 0; first = false {
+		b := block[0]
+		var err error
+		switch {
+		case b&0x80 != 0:
+			// Indexed field
+			var index uint64
+			index, block, err = readInt(block, 7)
+			if err != nil {
+				return nil, err
+			}
+			f, err := d.at(index)
+			if err != nil {
+				return nil, err
+			}
+			fields = append(fields, f)
+
+		case b&0xC0 == 0x40:
+			// Literal with incremental indexing
+			var f HeaderField
+			f, block, err = d.readLiteral(block, 6)
+			if err != nil {
+				return nil, err
+			}
+			d.dynamic.add(f)
+			fields = append(fields, f)
+
+		case b&0xE0 == 0x20:
+			// Dynamic table size update, only at the start of a block
+			var size uint64
+			size, block, err = readInt(block, 5)
+			if err != nil {
+				return nil, err
+			}
+			if !first || size > uint64(d.maxTableSize) {
+				return nil, ErrTableSizeUpdate
+			}
+			d.dynamic.setMaxSize(int(size))
+
+		default:
+			// Literal without indexing or never indexed
+			var f HeaderField
+			f, block, err = d.readLiteral(block, 4)
+			if err != nil {
+				return nil, err
+			}
+			fields = append(fields, f)
+		}
+	}
+	return fields, nil
+}
+
+// at looks up an index in the static table followed by the dynamic one
+func (d *Decoder) at(index uint64) (HeaderField, error) {
+	switch {
+	case index == 0:
+		return HeaderField{}, ErrInvalidIndex
+	case index <= uint64(len(staticTable)):
+		return staticTable[index-1], nil
+	}
+
+	index -= uint64(len(staticTable))
+	if index > uint64(len(d.dynamic.entries)) {
+		return HeaderField{}, ErrInvalidIndex
+	}
+	return d.dynamic.entries[len(d.dynamic.entries)-int(index)], nil
+}
+
+// readLiteral reads a literal field whose name index has an n-bit prefix
+func (d *Decoder) readLiteral(block []byte, n uint) (HeaderField, []byte, error) {
+	index, block, err := readInt(block, n)
+	if err != nil {
+		return HeaderField{}, nil, err
+	}
+
+	var f HeaderField
+	if index > 0 {
+		named, err := d.at(index)
+		if err != nil {
+			return HeaderField{}, nil, err
+		}
+		f.Name = named.Name
+	} else {
+		f.Name, block, err = d.readString(block)
+		if err != nil {
+			return HeaderField{}, nil, err
+		}
+	}
+
+	f.Value, block, err = d.readString(block)
+	if err != nil {
+		return HeaderField{}, nil, err
+	}
+	return f, block, nil
+}
+
+func (d *Decoder) readString(block []byte) (string, []byte, error) {
+	if len(block) == 0 {
+		return "", nil, ErrTruncated
+	}
+	huffman := block[0]&0x80 != 0
+
+	length, block, err := readInt(block, 7)
+	if err != nil {
+		return "", nil, err
+	}
+	if length > uint64(len(block)) {
+		return "", nil, ErrTruncated
+	}
+	raw := block[:length]
+	block = block[length:]
+
+	if !huffman {
+		if len(raw) > d.MaxStringLength {
+			return "", nil, ErrStringTooLong
+		}
+		return string(raw), block, nil
+	}
+
+	s, err := huffmanDecode(raw, d.MaxStringLength)
+	return s, block, err
+}
+
+// readInt reads an integer with an n-bit prefix (RFC 7541 §5.1)
+func readInt(block []byte, n uint) (uint64, []byte, error) {
+	if len(block) == 0 {
+		return 0, nil, ErrTruncated
+	}
+
+	max := uint64(1)<<n - 1
+	v := uint64(block[0]) & max
+	block = block[1:]
+	if v < max {
+		return v, block, nil
+	}
+
+	for shift := uint(0); ; shift += 7 {
+		if len(block) == 0 {
+			return 0, nil, ErrTruncated
+		}
+		// Anything past 2^28 or so is an attack, not a header
+		if shift > 28 {
+			return 0, nil, fmt.Errorf("hpack: integer overflow")
+		}
+		b := block[0]
+		block = block[1:]
+		v += uint64(b&0x7F) << shift
+		if b&0x80 == 0 {
+			return v, block, nil
+		}
+	}
+}
+
+// Encoder encodes header blocks without a dynamic table: fields are sent
+// as static table references where possible and literals otherwise, which
+// leaves nothing for the peer to keep in sync
+type Encoder struct{}
+
+// Encode appends the header block for fields to dst
+func (Encoder) Encode(dst []byte, fields []HeaderField) []byte {
+	for _, f := range fields {
+		nameIndex := 0
+		for i, s := range staticTable {
+			if s.Name != f.Name {
+				continue
+			}
+			if s.Value == f.Value {
+				nameIndex = -(i + 1)
+				break
+			}
+			if nameIndex == 0 {
+				nameIndex = i + 1
+			}
+		}
+
+		if nameIndex < 0 {
+			dst = appendInt(dst, 0x80, 7, uint64(-nameIndex))
+			continue
+		}
+
+		// Literal without indexing
+		dst = appendInt(dst, 0x00, 4, uint64(nameIndex))
+		if nameIndex == 0 {
+			dst = appendString(dst, f.Name)
+		}
+		dst = appendString(dst, f.Value)
+	}
+	return dst
+}
+
+// appendInt appends v with an n-bit prefix, the higher bits of the first
+// byte set to flags
+func appendInt(dst []byte, flags byte, n uint, v uint64) []byte {
+	max := uint64(1)<<n - 1
+	if v < max {
+		return append(dst, flags|byte(v))
+	}
+
+	dst = append(dst, flags|byte(max))
+	v -= max
+	for v >= 0x80 {
+		dst = append(dst, byte(v)|0x80)
+		v >>= 7
+	}
+	return append(dst, byte(v))
+}
+
+// appendString appends s, Huffman coded when that's shorter
+func appendString(dst []byte, s string) []byte {
+	if n := huffmanLen(s); n < len(s) {
+		dst = appendInt(dst, 0x80, 7, uint64(n))
+		return huffmanEncode(dst, s)
+	}
+	dst = appendInt(dst, 0x00, 7, uint64(len(s)))
+	return append(dst, s...)
+}
@@ -0,0 +1,114 @@
+package hpack
+
+import (
+	"encoding/hex"
+	"math/rand"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func decodeHex(t *testing.T, d *Decoder, s string) []HeaderField {
+	t.Helper()
+	block, err := hex.DecodeString(strings.ReplaceAll(s, " ", ""))
+	require.NoError(t, err)
+	fields, err := d.Decode(block)
+	require.NoError(t, err)
+	return fields
+}
+
+func TestDecodeRFCExamples(t *testing.T) {
+	// Test: Requests without Huffman coding (RFC 7541 C.3.1)
+	d := NewDecoder(DefaultTableSize)
+	assert.Equal(t, []HeaderField{
+		{":method", "GET"}, {":scheme", "http"}, {":path", "/"}, {":authority", "www.example.com"},
+	}, decodeHex(t, d, "8286 8441 0f77 7777 2e65 7861 6d70 6c65 2e63 6f6d"))
+
+	// Test: Requests with Huffman coding share a dynamic table (C.4)
+	d = NewDecoder(DefaultTableSize)
+	assert.Equal(t, []HeaderField{
+		{":method", "GET"}, {":scheme", "http"}, {":path", "/"}, {":authority", "www.example.com"},
+	}, decodeHex(t, d, "8286 8441 8cf1 e3c2 e5f2 3a6b a0ab 90f4 ff"))
+	assert.Equal(t, []HeaderField{
+		{":method", "GET"}, {":scheme", "http"}, {":path", "/"}, {":authority", "www.example.com"},
+		{"cache-control", "no-cache"},
+	}, decodeHex(t, d, "8286 84be 5886 a8eb 1064 9cbf"))
+	assert.Equal(t, []HeaderField{
+		{":method", "GET"}, {":scheme", "https"}, {":path", "/index.html"}, {":authority", "www.example.com"},
+		{"custom-key", "custom-value"},
+	}, decodeHex(t, d, "8287 85bf 4088 25a8 49e9 5ba9 7d7f 8925 a849 e95b b8e8 b4bf"))
+	assert.Equal(t, 164, d.dynamic.size)
+	assert.Len(t, d.dynamic.entries, 3)
+}
+
+func TestDecodeErrors(t *testing.T) {
+	for name, block := range map[string]string{
+		"index zero":        "80",
+		"index past tables": "be",
+		"truncated string":  "400a6b6579",
+		"truncated integer": "7f",
+		"late size update":  "8220",
+		"size over limit":   "3fe21f",
+		"eos in string":     "0085ffffffff7f",
+		"padding not ones":  "008100",
+		"padding too long":  "0082ffff",
+	} {
+		block, err := hex.DecodeString(block)
+		require.NoError(t, err)
+		_, err = NewDecoder(DefaultTableSize).Decode(block)
+		assert.Error(t, err, name)
+	}
+}
+
+func TestEncodeRoundTrip(t *testing.T) {
+	fields := []HeaderField{
+		{":status", "200"},
+		{":status", "418"},
+		{"content-type", "text/html; charset=utf-8"},
+		{"x-custom", "value"},
+		{"x-empty", ""},
+		{"x-long", strings.Repeat("abc", 100)},
+	}
+
+	// Test: Exact static matches become a single byte
+	block := Encoder{}.Encode(nil, fields[:1])
+	assert.Equal(t, []byte{0x88}, block)
+
+	// Test: Everything decodes back
+	block = Encoder{}.Encode(nil, fields)
+	decoded, err := NewDecoder(DefaultTableSize).Decode(block)
+	require.NoError(t, err)
+	assert.Equal(t, fields, decoded)
+
+	// Test: Huffman coding of every byte value
+	rnd := rand.New(rand.NewSource(1))
+	for i := 0; i < 200; i++ {
+		b := make([]byte, rnd.Intn(40))
+		rnd.Read(b)
+		s := string(b)
+		decoded, err := huffmanDecode(huffmanEncode(nil, s), 1000)
+		require.NoError(t, err)
+		assert.Equal(t, s, decoded)
+	}
+}
+
+func TestDynamicTableEviction(t *testing.T) {
+	d := NewDecoder(100)
+
+	// Test: Entries that no longer fit are evicted oldest first
+	block := []byte{0x40, 0x01, 'a', 0x20}
+	block = append(block, []byte(strings.Repeat("x", 32))...)
+	block = append(block, 0x40, 0x01, 'b', 0x20)
+	block = append(block, []byte(strings.Repeat("y", 32))...)
+	_, err := d.Decode(block)
+	require.NoError(t, err)
+	require.Len(t, d.dynamic.entries, 1)
+	assert.Equal(t, "b", d.dynamic.entries[0].Name)
+
+	// Test: A size update to zero empties the table
+	_, err = d.Decode([]byte{0x20})
+	require.NoError(t, err)
+	assert.Empty(t, d.dynamic.entries)
+}
@@ -0,0 +1,93 @@
+package hpack
+
+import "sync"
+
+// huffmanNode is a node of the decoding tree, a leaf when children is nil
+type huffmanNode struct {
+	children *[2]*huffmanNode
+	sym      byte
+}
+
+var huffmanRoot = sync.OnceValue(func() *huffmanNode {
+	root := &huffmanNode{}
+	for sym, code := range huffmanCodes {
+		n := root
+		for bit := int(huffmanCodeLen[sym]) - 1; bit >= 0; bit-- {
+			if n.children == nil {
+				n.children = &[2]*huffmanNode{}
+			}
+			b := (code >> bit) & 1
+			if n.children[b] == nil {
+				n.children[b] = &huffmanNode{}
+			}
+			n = n.children[b]
+		}
+		n.sym = byte(sym)
+	}
+	return root
+})
+
+// huffmanDecode decodes a Huffman coded string. The padding must be fewer
+// than 8 bits, all ones (RFC 7541 §5.2).
+func huffmanDecode(p []byte, maxLen int) (string, error) {
+	root := huffmanRoot()
+	out := make([]byte, 0, len(p)*8/5)
+
+	n := root
+	padding := 0 // bits read since the last symbol
+	ones := true // whether they were all ones
+	for _, b := range p {
+		for bit := 7; bit >= 0; bit-- {
+			v := (b >> bit) & 1
+			n = n.children[v]
+			if n == nil {
+				// Only EOS runs off the tree, as its 30 ones have no leaf
+				return "", ErrInvalidHuffman
+			}
+			padding++
+			ones = ones && v == 1
+
+			if n.children == nil {
+				if len(out) >= maxLen {
+					return "", ErrStringTooLong
+				}
+				out = append(out, n.sym)
+				n = root
+				padding = 0
+				ones = true
+			}
+		}
+	}
+
+	if padding > 7 || !ones {
+		return "", ErrInvalidHuffman
+	}
+	return string(out), nil
+}
+
+// huffmanEncode appends the Huffman coding of s to dst, padded with ones
+func huffmanEncode(dst []byte, s string) []byte {
+	var acc uint64
+	bits := 0
+	for i := 0; i < len(s); i++ {
+		acc = acc<<huffmanCodeLen[s[i]] | uint64(huffmanCodes[s[i]])
+		bits += int(huffmanCodeLen[s[i]])
+		for bits >= 8 {
+			bits -= 8
+			dst = append(dst, byte(acc>>bits))
+		}
+	}
+	if bits > 0 {
+		dst = append(dst, byte(acc<<(8-bits))|byte(0xFF>>bits))
+	}
+	return dst
+}
+
+// huffmanLen is the length of s once Huffman coded
+func huffmanLen(s string) int {
+	bits := 0
+	for i := 0; i < len(s); i++ {
+		bits += int(huffmanCodeLen[s[i]])
+	}
+	return (bits + 7) / 8
+}
@@ -0,0 +1,466 @@
+package http2
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/spaghetti-lover/go-http/pkg/headers"
+	"github.com/spaghetti-lover/go-http/pkg/http2/hpack"
+	"github.com/spaghetti-lover/go-http/pkg/request"
+	"github.com/spaghetti-lover/go-http/pkg/response"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type testClient struct {
+	t       *testing.T
+	conn    net.Conn
+	reader  *bufio.Reader
+	decoder *hpack.Decoder
+}
+
+// startConn serves one HTTP/2 connection over loopback and returns a
+// client that has sent its preface with settings
+func startConn(t *testing.T, handler Handler, opts Options, settings ...uint32) *testClient {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { listener.Close() })
+
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		ServeConn(conn, conn, handler, opts, nil)
+	}()
+
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	require.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+
+	c := &testClient{t: t, conn: conn, reader: bufio.NewReader(conn), decoder: hpack.NewDecoder(hpack.DefaultTableSize)}
+	_, err = conn.Write([]byte(ClientPreface))
+	require.NoError(t, err)
+	c.settings(settings...)
+	return c
+}
+
+// settings sends a SETTINGS frame of id, value pairs
+func (c *testClient) settings(pairs ...uint32) {
+	var payload []byte
+	for i := 0; i+1 < len(pairs); i += 2 {
+		payload = binary.BigEndian.AppendUint16(payload, uint16(pairs[i]))
+		payload = binary.BigEndian.AppendUint32(payload, pairs[i+1])
+	}
+	c.write(frameSettings, 0, 0, payload)
+}
+
+func (c *testClient) write(typ frameType, flags byte, streamID uint32, payload []byte) {
+	c.t.Helper()
+	_, err := c.conn.Write(appendFrame(nil, typ, flags, streamID, payload))
+	require.NoError(c.t, err)
+}
+
+func (c *testClient) request(streamID uint32, method, path string, endStream bool, extra ...hpack.HeaderField) {
+	c.t.Helper()
+	fields := append([]hpack.HeaderField{
+		{Name: ":method", Value: method},
+		{Name: ":scheme", Value: "http"},
+		{Name: ":path", Value: path},
+		{Name: ":authority", Value: "example.com"},
+	}, extra...)
+	flags := byte(flagEndHeaders)
+	if endStream {
+		flags |= flagEndStream
+	}
+	c.write(frameHeaders, flags, streamID, hpack.Encoder{}.Encode(nil, fields))
+}
+
+// next reads the next frame, skipping the server's SETTINGS and window
+// updates
+func (c *testClient) next() *frame {
+	c.t.Helper()
+	c.conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for {
+		f, err := readFrame(c.reader, maxFrameSizeLimit)
+		require.NoError(c.t, err)
+		if f.typ != frameSettings && f.typ != frameWindowUpdate {
+			return f
+		}
+	}
+}
+
+func (c *testClient) decode(f *frame) map[string]string {
+	c.t.Helper()
+	fields, err := c.decoder.Decode(f.payload)
+	require.NoError(c.t, err)
+	m := map[string]string{}
+	for _, field := range fields {
+		m[field.Name] = field.Value
+	}
+	return m
+}
+
+type testResponse struct {
+	headers  map[string]string
+	body     string
+	trailers map[string]string
+}
+
+// response reads frames of a single stream until it ends
+func (c *testClient) response(streamID uint32) testResponse {
+	c.t.Helper()
+	var resp testResponse
+	for {
+		f := c.next()
+		require.Equal(c.t, streamID, f.streamID, "frame type %d", f.typ)
+		switch f.typ {
+		case frameHeaders:
+			if resp.headers == nil {
+				resp.headers = c.decode(f)
+			} else {
+				resp.trailers = c.decode(f)
+			}
+		case frameData:
+			resp.body += string(f.payload)
+		default:
+			c.t.Fatalf("unexpected frame type %d", f.typ)
+		}
+		if f.has(flagEndStream) {
+			return resp
+		}
+	}
+}
+
+func echoHandler(w *response.Writer, req *request.Request) {
+	w.WriteStatusLine(response.OK)
+	h := headers.NewHeaders()
+	h.Set("Content-Type", "text/plain")
+	h.Set("Content-Length", strconv.Itoa(len(req.Body)))
+	h.Set("Connection", "keep-alive")
+	h.Set("X-Method", req.RequestLine.Method)
+	h.Set("X-Target", req.RequestLine.RequestTarget)
+	h.Set("X-Host", req.Headers.Get("Host"))
+	h.Set("X-Version", req.RequestLine.HttpVersion)
+	if req.Trailers != nil {
+		h.Set("X-Trailer", req.Trailers.Get("X-Checksum"))
+	}
+	w.WriteHeaders(h)
+	w.WriteBody(req.Body)
+}
+
+func TestServeConn(t *testing.T) {
+	c := startConn(t, echoHandler, Options{})
+
+	// Test: A GET is answered on its stream, connection fields dropped
+	c.request(1, "GET", "/hello?x=1", true)
+	resp := c.response(1)
+	assert.Equal(t, "200", resp.headers[":status"])
+	assert.Equal(t, "text/plain", resp.headers["content-type"])
+	assert.Equal(t, "GET", resp.headers["x-method"])
+	assert.Equal(t, "/hello?x=1", resp.headers["x-target"])
+	assert.Equal(t, "example.com", resp.headers["x-host"])
+	assert.Equal(t, "2.0", resp.headers["x-version"])
+	assert.NotContains(t, resp.headers, "connection")
+	assert.Equal(t, "", resp.body)
+
+	// Test: A body over several DATA frames, with trailers, reaches the handler
+	c.request(3, "POST", "/echo", false, hpack.HeaderField{Name: "content-length", Value: "11"})
+	c.write(frameData, 0, 3, []byte("hello "))
+	c.write(frameData, flagPadded, 3, append([]byte{2}, "world\x00\x00"...))
+	c.write(frameHeaders, flagEndHeaders|flagEndStream, 3, hpack.Encoder{}.Encode(nil, []hpack.HeaderField{{Name: "x-checksum", Value: "abc"}}))
+	resp = c.response(3)
+	assert.Equal(t, "200", resp.headers[":status"])
+	assert.Equal(t, "hello world", resp.body)
+	assert.Equal(t, "abc", resp.headers["x-trailer"])
+
+	// Test: PING is echoed back
+	c.write(framePing, 0, 0, []byte("12345678"))
+	f := c.next()
+	assert.Equal(t, framePing, f.typ)
+	assert.True(t, f.has(flagAck))
+	assert.Equal(t, "12345678", string(f.payload))
+}
+
+func TestServeConnLargeBody(t *testing.T) {
+	body := strings.Repeat("x", 50000)
+	c := startConn(t, func(w *response.Writer, req *request.Request) {
+		w.WriteStatusLine(response.OK)
+		h := headers.NewHeaders()
+		h.Set("Content-Length", strconv.Itoa(len(body)))
+		w.WriteHeaders(h)
+		w.WriteBody([]byte(body))
+	}, Options{})
+
+	// Test: A Content-Length body past the first read ends the stream
+	// cleanly, without a reset, and the connection goes on
+	for _, streamID := range []uint32{1, 3} {
+		c.request(streamID, "GET", "/", true)
+		resp := c.response(streamID)
+		assert.Equal(t, "200", resp.headers[":status"])
+		assert.Equal(t, strconv.Itoa(len(body)), resp.headers["content-length"])
+		assert.Equal(t, body, resp.body)
+		c.write(frameWindowUpdate, 0, 0, binary.BigEndian.AppendUint32(nil, uint32(len(body))))
+	}
+}
+
+func TestServeConnTrailers(t *testing.T) {
+	c := startConn(t, func(w *response.Writer, req *request.Request) {
+		w.WriteStatusLine(response.OK)
+		h := headers.NewHeaders()
+		h.Set("Transfer-Encoding", "chunked")
+		h.Set("Trailer", "X-Digest")
+		w.WriteHeaders(h)
+		w.WriteChunkedBody([]byte("part one, "))
+		w.WriteChunkedBody([]byte("part two"))
+		w.WriteLastChunk()
+		trailers := headers.NewHeaders()
+		trailers.Set("X-Digest", "1234")
+		w.WriteTrailers(trailers)
+	}, Options{})
+
+	// Test: Chunked responses become DATA frames, trailers a final HEADERS
+	c.request(1, "GET", "/", true)
+	resp := c.response(1)
+	assert.NotContains(t, resp.headers, "transfer-encoding")
+	assert.Equal(t, "part one, part two", resp.body)
+	assert.Equal(t, map[string]string{"x-digest": "1234"}, resp.trailers)
+}
+
+func TestServeConnSetCookie(t *testing.T) {
+	c := startConn(t, func(w *response.Writer, req *request.Request) {
+		w.WriteStatusLine(response.OK)
+		h := headers.NewHeaders()
+		h.Set("Set-Cookie", "a=1; Path=/")
+		h.Set("Set-Cookie", "b=2")
+		h.Set("Content-Length", "0")
+		w.WriteHeaders(h)
+	}, Options{})
+
+	// Test: Each Set-Cookie value is a field of its own
+	c.request(1, "GET", "/", true)
+	f := c.next()
+	require.Equal(t, frameHeaders, f.typ)
+	fields, err := c.decoder.Decode(f.payload)
+	require.NoError(t, err)
+	var cookies []string
+	for _, field := range fields {
+		if field.Name == "set-cookie" {
+			cookies = append(cookies, field.Value)
+		}
+	}
+	assert.Equal(t, []string{"a=1; Path=/", "b=2"}, cookies)
+}
+
+func TestServeConnMultiplexing(t *testing.T) {
+	release := make(chan struct{})
+	c := startConn(t, func(w *response.Writer, req *request.Request) {
+		if req.RequestLine.RequestTarget == "/slow" {
+			<-release
+		}
+		echoHandler(w, req)
+	}, Options{})
+
+	// Test: A stream still being handled doesn't hold up a later one
+	c.request(1, "GET", "/slow", true)
+	c.request(3, "GET", "/fast", true)
+
+	var order []uint32
+	for len(order) < 2 {
+		f := c.next()
+		if f.has(flagEndStream) {
+			order = append(order, f.streamID)
+			if f.streamID == 3 {
+				close(release)
+			}
+		}
+	}
+	assert.Equal(t, []uint32{3, 1}, order)
+}
+
+func TestServeConnFlowControl(t *testing.T) {
+	body := strings.Repeat("x", 100)
+	c := startConn(t, func(w *response.Writer, req *request.Request) {
+		w.WriteStatusLine(response.OK)
+		h := headers.NewHeaders()
+		h.Set("Content-Length", strconv.Itoa(len(body)))
+		w.WriteHeaders(h)
+		w.WriteBody([]byte(body))
+	}, Options{}, uint32(settingInitialWindowSize), 10)
+
+	c.request(1, "GET", "/", true)
+	f := c.next()
+	require.Equal(t, frameHeaders, f.typ)
+
+	// Test: No more than the window is sent
+	f = c.next()
+	require.Equal(t, frameData, f.typ)
+	assert.Len(t, f.payload, 10)
+	c.conn.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	_, err := c.reader.Peek(1)
+	var netErr net.Error
+	require.True(t, errors.As(err, &netErr) && netErr.Timeout())
+
+	// Test: Opening the window lets the rest through
+	c.write(frameWindowUpdate, 0, 1, binary.BigEndian.AppendUint32(nil, 90))
+	received := len(f.payload)
+	for !f.has(flagEndStream) {
+		f = c.next()
+		received += len(f.payload)
+	}
+	assert.Equal(t, 100, received)
+}
+
+func TestServeConnStreamErrors(t *testing.T) {
+	block := make(chan struct{})
+	t.Cleanup(func() { close(block) })
+	c := startConn(t, func(w *response.Writer, req *request.Request) {
+		if req.RequestLine.RequestTarget == "/block" {
+			<-block
+		}
+		echoHandler(w, req)
+	}, Options{MaxConcurrentStreams: 1, MaxBodySize: 5})
+
+	rstCode := func(f *frame) ErrCode {
+		require.Equal(t, frameRSTStream, f.typ)
+		return ErrCode(binary.BigEndian.Uint32(f.payload))
+	}
+
+	// Test: Malformed requests are reset
+	c.write(frameHeaders, flagEndHeaders|flagEndStream, 1, hpack.Encoder{}.Encode(nil, []hpack.HeaderField{{Name: ":method", Value: "GET"}}))
+	f := c.next()
+	assert.Equal(t, uint32(1), f.streamID)
+	assert.Equal(t, ErrCodeProtocol, rstCode(f))
+
+	c.request(3, "GET", "/", true, hpack.HeaderField{Name: "connection", Value: "close"})
+	assert.Equal(t, ErrCodeProtocol, rstCode(c.next()))
+
+	// Test: Bodies declared over the limit get 413 without the handler
+	c.request(5, "POST", "/", false, hpack.HeaderField{Name: "content-length", Value: "6"})
+	resp := c.next()
+	assert.Equal(t, "413", c.decode(resp)[":status"])
+	assert.True(t, resp.has(flagEndStream))
+	assert.Equal(t, ErrCodeNo, rstCode(c.next()))
+
+	// Test: Bodies growing past the limit are reset before the handler
+	c.request(7, "POST", "/", false)
+	c.write(frameData, 0, 7, []byte("abc"))
+	c.write(frameData, flagEndStream, 7, []byte("def"))
+	f = c.next()
+	assert.Equal(t, uint32(7), f.streamID)
+	assert.Equal(t, ErrCodeCancel, rstCode(f))
+
+	// Test: DATA on a closed stream is refused
+	c.write(frameData, 0, 7, []byte("x"))
+	f = c.next()
+	assert.Equal(t, uint32(7), f.streamID)
+	assert.Equal(t, ErrCodeStreamClosed, rstCode(f))
+
+	// Test: Streams past the concurrency limit are refused
+	c.request(9, "GET", "/block", true)
+	c.request(11, "GET", "/", true)
+	f = c.next()
+	assert.Equal(t, uint32(11), f.streamID)
+	assert.Equal(t, ErrCodeRefusedStream, rstCode(f))
+}
+
+func TestServeConnErrors(t *testing.T) {
+	goAwayCode := func(f *frame) ErrCode {
+		require.Equal(t, frameGoAway, f.typ)
+		return ErrCode(binary.BigEndian.Uint32(f.payload[4:]))
+	}
+
+	for name, test := range map[string]struct {
+		send func(c *testClient)
+		code ErrCode
+	}{
+		"data on stream 0": {func(c *testClient) { c.write(frameData, 0, 0, []byte("x")) }, ErrCodeProtocol},
+		"even stream":      {func(c *testClient) { c.request(2, "GET", "/", true) }, ErrCodeProtocol},
+		"push promise":     {func(c *testClient) { c.write(framePushPromise, flagEndHeaders, 1, make([]byte, 4)) }, ErrCodeProtocol},
+		"bad ping":         {func(c *testClient) { c.write(framePing, 0, 0, []byte("short")) }, ErrCodeFrameSize},
+		"bad hpack":        {func(c *testClient) { c.write(frameHeaders, flagEndHeaders|flagEndStream, 1, []byte{0x80}) }, ErrCodeCompression},
+		"stream reuse": {func(c *testClient) {
+			c.request(3, "GET", "/", true)
+			c.response(3)
+			c.request(1, "GET", "/", true)
+		}, ErrCodeProtocol},
+		"interleaved continuation": {func(c *testClient) {
+			c.write(frameHeaders, 0, 1, hpack.Encoder{}.Encode(nil, []hpack.HeaderField{{Name: ":method", Value: "GET"}}))
+			c.write(framePing, 0, 0, make([]byte, 8))
+		}, ErrCodeProtocol},
+		"window overflow": {func(c *testClient) {
+			c.write(frameWindowUpdate, 0, 0, binary.BigEndian.AppendUint32(nil, 1<<31-1))
+		}, ErrCodeFlowControl},
+	} {
+		// Test: Connection errors end in GOAWAY with the right code
+		c := startConn(t, echoHandler, Options{})
+		test.send(c)
+		assert.Equal(t, test.code, goAwayCode(c.next()), name)
+	}
+}
+
+func TestServeConnUpgrade(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer listener.Close()
+
+	req, err := request.FromReader(strings.NewReader("POST /upgrade HTTP/1.1\r\n" +
+		"Host: example.com\r\nConnection: Upgrade, HTTP2-Settings\r\nUpgrade: h2c\r\n" +
+		"HTTP2-Settings: AAMAAABkAAQAAP__\r\nContent-Length: 4\r\n\r\nbody"))
+	require.NoError(t, err)
+
+	// Test: Only complete upgrade requests qualify
+	assert.True(t, IsUpgrade(req))
+	bad := *req
+	bad.Headers = req.Headers.Clone()
+	bad.Headers.Override("HTTP2-Settings", "AAMA")
+	assert.False(t, IsUpgrade(&bad))
+
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		ServeConn(conn, conn, echoHandler, Options{}, req)
+	}()
+
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+	c := &testClient{t: t, conn: conn, reader: bufio.NewReader(conn), decoder: hpack.NewDecoder(hpack.DefaultTableSize)}
+	_, err = conn.Write([]byte(ClientPreface))
+	require.NoError(t, err)
+	c.settings()
+
+	// Test: The upgraded request is answered on stream 1
+	resp := c.response(1)
+	assert.Equal(t, "200", resp.headers[":status"])
+	assert.Equal(t, "2.0", resp.headers["x-version"])
+	assert.Equal(t, "body", resp.body)
+
+	// Test: Further requests use the next client stream
+	c.request(3, "GET", "/next", true)
+	assert.Equal(t, "/next", c.response(3).headers["x-target"])
+}
+
+func TestServeConnDefaultMaxBodySize(t *testing.T) {
+	c := startConn(t, echoHandler, Options{})
+
+	// Test: Without MaxBodySize bodies are still bounded by the default
+	c.request(1, "POST", "/", false, hpack.HeaderField{Name: "content-length", Value: strconv.Itoa(DefaultMaxBodySize + 1)})
+	f := c.next()
+	assert.Equal(t, "413", c.decode(f)[":status"])
+	assert.Equal(t, frameRSTStream, c.next().typ)
+
+	c.request(3, "POST", "/", false)
+	c.write(frameData, flagEndStream, 3, []byte("short"))
+	resp := c.response(3)
+	assert.Equal(t, "200", resp.headers[":status"])
+}
@@ -0,0 +1,914 @@
+package http2
+
+import (
+	"bufio"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/spaghetti-lover/go-http/pkg/headers"
+	"github.com/spaghetti-lover/go-http/pkg/http2/hpack"
+	"github.com/spaghetti-lover/go-http/pkg/request"
+	"github.com/spaghetti-lover/go-http/pkg/response"
+)
+
+type Handler func(w *response.Writer, req *request.Request)
+
+// DefaultMaxConcurrentStreams is the stream limit announced when Options
+// leaves it at zero
+const DefaultMaxConcurrentStreams = 100
+
+// DefaultMaxBodySize bounds request bodies when Options leaves MaxBodySize
+// at zero. Bodies are buffered whole before the handler runs, so this is
+// what a stream may hold in memory.
+const DefaultMaxBodySize = 10 << 20
+
+// maxHeaderBlock bounds a header block across its CONTINUATION frames
+const maxHeaderBlock = 64 << 10
+
+type Options struct {
+	// MaxConcurrentStreams is how many requests the client may have in
+	// flight, 0 means DefaultMaxConcurrentStreams
+	MaxConcurrentStreams uint32
+
+	// MaxBodySize answers requests declaring a bigger Content-Length with
+	// 413 and resets streams whose body grows past it, 0 means
+	// DefaultMaxBodySize
+	MaxBodySize int64
+
+	// IdleTimeout closes the connection once it has had no streams for
+	// this long, 0 keeps it open
+	IdleTimeout time.Duration
+}
+
+var errStreamReset = errors.New("http2: stream reset")
+var errConnClosed = errors.New("http2: connection closed")
+
+type streamState int
+
+const (
+	stateOpen             streamState = iota
+	stateHalfClosedRemote             // request complete, response pending
+)
+
+type stream struct {
+	id         uint32
+	state      streamState
+	req        *request.Request
+	sendWindow int64
+	reset      bool
+	body       *io.PipeReader
+}
+
+type serverConn struct {
+	conn    net.Conn
+	reader  *bufio.Reader
+	handler Handler
+	opts    Options
+	decoder *hpack.Decoder
+
+	// Owned by the read loop
+	maxStreamID  uint32
+	headerBlock  []byte
+	continuation *frame
+
+	mu            sync.Mutex
+	cond          *sync.Cond
+	streams       map[uint32]*stream
+	sendWindow    int64
+	initialWindow int64
+	maxFrameSize  uint32
+	goingAway     bool
+	closed        bool
+	idleTimer     *time.Timer
+
+	writeMu  sync.Mutex
+	handlers sync.WaitGroup
+}
+
+// ServeConn speaks HTTP/2 on conn until the client goes away, dispatching
+// each stream to handler. r reads from conn and must start at the client
+// preface. For an h2c upgrade, upgrade is the HTTP/1.1 request the 101 was
+// sent for; it becomes stream 1.
+func ServeConn(conn net.Conn, r io.Reader, handler Handler, opts Options, upgrade *request.Request) error {
+	if opts.MaxConcurrentStreams == 0 {
+		opts.MaxConcurrentStreams = DefaultMaxConcurrentStreams
+	}
+	if opts.MaxBodySize <= 0 {
+		opts.MaxBodySize = DefaultMaxBodySize
+	}
+
+	s := &serverConn{
+		conn:          conn,
+		reader:        bufio.NewReader(r),
+		handler:       handler,
+		opts:          opts,
+		decoder:       hpack.NewDecoder(hpack.DefaultTableSize),
+		streams:       map[uint32]*stream{},
+		sendWindow:    defaultWindowSize,
+		initialWindow: defaultWindowSize,
+		maxFrameSize:  defaultMaxFrameSize,
+	}
+	s.cond = sync.NewCond(&s.mu)
+
+	err := s.serve(upgrade)
+
+	s.mu.Lock()
+	s.closed = true
+	for _, st := range s.streams {
+		if st.body != nil {
+			st.body.CloseWithError(errConnClosed)
+		}
+	}
+	if s.idleTimer != nil {
+		s.idleTimer.Stop()
+	}
+	s.cond.Broadcast()
+	s.mu.Unlock()
+
+	var connErr ConnError
+	if errors.As(err, &connErr) {
+		s.goAway(connErr.Code, connErr.Reason)
+	}
+	conn.Close()
+	s.handlers.Wait()
+
+	if errors.Is(err, io.EOF) || errors.Is(err, net.ErrClosed) {
+		return nil
+	}
+	return err
+}
+
+func (s *serverConn) serve(upgrade *request.Request) error {
+	if upgrade != nil {
+		settings, err := upgradeSettings(upgrade)
+		if err != nil {
+			return err
+		}
+		if err := s.applySettings(settings); err != nil {
+			return err
+		}
+	}
+
+	preface := make([]byte, len(ClientPreface))
+	if _, err := io.ReadFull(s.reader, preface); err != nil {
+		return err
+	}
+	if string(preface) != ClientPreface {
+		return fmt.Errorf("http2: bad client preface %q", preface)
+	}
+
+	settings := binary.BigEndian.AppendUint16(nil, uint16(settingMaxConcurrentStreams))
+	settings = binary.BigEndian.AppendUint32(settings, s.opts.MaxConcurrentStreams)
+	if err := s.writeFrame(frameSettings, 0, 0, settings); err != nil {
+		return err
+	}
+
+	// The client's preface ends with its SETTINGS
+	f, err := readFrame(s.reader, defaultMaxFrameSize)
+	if err != nil {
+		return err
+	}
+	if f.typ != frameSettings || f.has(flagAck) {
+		return ConnError{ErrCodeProtocol, "preface without SETTINGS"}
+	}
+	if err := s.processSettings(f); err != nil {
+		return err
+	}
+
+	if upgrade != nil {
+		s.maxStreamID = 1
+		upgrade.RequestLine.HttpVersion = "2.0"
+		st := &stream{id: 1, state: stateHalfClosedRemote, req: upgrade, sendWindow: s.initialWindow}
+		s.mu.Lock()
+		s.streams[1] = st
+		s.mu.Unlock()
+		s.dispatch(st)
+	} else {
+		s.startIdle()
+	}
+
+	for {
+		f, err := readFrame(s.reader, defaultMaxFrameSize)
+		if err != nil {
+			return err
+		}
+
+		err = s.processFrame(f)
+		var se streamError
+		if errors.As(err, &se) {
+			s.resetStream(se.streamID, se.code)
+			continue
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func (s *serverConn) processFrame(f *frame) error {
+	if s.continuation != nil && (f.typ != frameContinuation || f.streamID != s.continuation.streamID) {
+		return ConnError{ErrCodeProtocol, "expected CONTINUATION"}
+	}
+
+	switch f.typ {
+	case frameData:
+		return s.processData(f)
+	case frameHeaders:
+		return s.processHeaders(f)
+	case frameContinuation:
+		return s.processContinuation(f)
+	case framePriority:
+		if f.streamID == 0 {
+			return ConnError{ErrCodeProtocol, "PRIORITY on stream 0"}
+		}
+		if len(f.payload) != 5 {
+			return streamError{f.streamID, ErrCodeFrameSize}
+		}
+		return nil
+	case frameRSTStream:
+		return s.processRSTStream(f)
+	case frameSettings:
+		return s.processSettings(f)
+	case framePushPromise:
+		return ConnError{ErrCodeProtocol, "PUSH_PROMISE from a client"}
+	case framePing:
+		if f.streamID != 0 {
+			return ConnError{ErrCodeProtocol, "PING on a stream"}
+		}
+		if len(f.payload) != 8 {
+			return ConnError{ErrCodeFrameSize, "PING of the wrong size"}
+		}
+		if f.has(flagAck) {
+			return nil
+		}
+		return s.writeFrame(framePing, flagAck, 0, f.payload)
+	case frameGoAway:
+		if f.streamID != 0 {
+			return ConnError{ErrCodeProtocol, "GOAWAY on a stream"}
+		}
+		s.mu.Lock()
+		s.goingAway = true
+		s.mu.Unlock()
+		return nil
+	case frameWindowUpdate:
+		return s.processWindowUpdate(f)
+	}
+
+	// Unknown frame types are ignored (RFC 9113 §4.1)
+	return nil
+}
+
+func (s *serverConn) processData(f *frame) error {
+	if f.streamID == 0 {
+		return ConnError{ErrCodeProtocol, "DATA on stream 0"}
+	}
+	if f.streamID > s.maxStreamID {
+		return ConnError{ErrCodeProtocol, "DATA on an idle stream"}
+	}
+
+	s.mu.Lock()
+	st := s.streams[f.streamID]
+	s.mu.Unlock()
+	if st == nil || st.state != stateOpen {
+		// Nothing is kept, but the frame counted against the connection
+		if err := s.windowUpdate(0, len(f.payload)); err != nil {
+			return err
+		}
+		return streamError{f.streamID, ErrCodeStreamClosed}
+	}
+
+	data, err := unpad(f)
+	if err != nil {
+		return err
+	}
+
+	// Bodies are buffered whole, so the window is only given back while the
+	// body stays within MaxBodySize: past it the stream is reset, and at
+	// most MaxBodySize per stream is ever held
+	if int64(len(st.req.Body)+len(data)) > s.opts.MaxBodySize {
+		if err := s.windowUpdate(0, len(f.payload)); err != nil {
+			return err
+		}
+		return streamError{f.streamID, ErrCodeCancel}
+	}
+	st.req.Body = append(st.req.Body, data...)
+
+	if err := s.windowUpdate(0, len(f.payload)); err != nil {
+		return err
+	}
+	if !f.has(flagEndStream) {
+		if err := s.windowUpdate(f.streamID, len(f.payload)); err != nil {
+			return err
+		}
+	}
+
+	if f.has(flagEndStream) {
+		return s.endRequest(st)
+	}
+	return nil
+}
+
+// windowUpdate gives n bytes of receive window back to the stream, or to the
+// connection when streamID is 0
+func (s *serverConn) windowUpdate(streamID uint32, n int) error {
+	if n == 0 {
+		return nil
+	}
+	return s.writeFrame(frameWindowUpdate, 0, streamID, binary.BigEndian.AppendUint32(nil, uint32(n)))
+}
+
+func (s *serverConn) processHeaders(f *frame) error {
+	if f.streamID == 0 || f.streamID%2 == 0 {
+		return ConnError{ErrCodeProtocol, fmt.Sprintf("HEADERS on stream %d", f.streamID)}
+	}
+
+	block, err := unpad(f)
+	if err != nil {
+		return err
+	}
+	if f.has(flagPriority) {
+		if len(block) < 5 {
+			return ConnError{ErrCodeFrameSize, "HEADERS too short for its priority"}
+		}
+		if binary.BigEndian.Uint32(block)&(1<<31-1) == f.streamID {
+			return streamError{f.streamID, ErrCodeProtocol}
+		}
+		block = block[5:]
+	}
+
+	s.headerBlock = append(s.headerBlock[:0], block...)
+	if !f.has(flagEndHeaders) {
+		s.continuation = f
+		return nil
+	}
+	return s.processHeaderBlock(f)
+}
+
+func (s *serverConn) processContinuation(f *frame) error {
+	if s.continuation == nil {
+		return ConnError{ErrCodeProtocol, "CONTINUATION without HEADERS"}
+	}
+
+	s.headerBlock = append(s.headerBlock, f.payload...)
+	if len(s.headerBlock) > maxHeaderBlock {
+		return ConnError{ErrCodeEnhanceYourCalm, "header block too large"}
+	}
+	if !f.has(flagEndHeaders) {
+		return nil
+	}
+
+	headersFrame := s.continuation
+	s.continuation = nil
+	return s.processHeaderBlock(headersFrame)
+}
+
+// processHeaderBlock handles a complete header block: a new request or the
+// trailers of one
+func (s *serverConn) processHeaderBlock(f *frame) error {
+	// The block must be decoded even for refused streams, the table depends on it
+	fields, err := s.decoder.Decode(s.headerBlock)
+	if err != nil {
+		return ConnError{ErrCodeCompression, err.Error()}
+	}
+
+	s.mu.Lock()
+	st := s.streams[f.streamID]
+	active := len(s.streams)
+	goingAway := s.goingAway
+	s.mu.Unlock()
+
+	if st != nil {
+		if st.state != stateOpen {
+			return streamError{f.streamID, ErrCodeStreamClosed}
+		}
+		// Trailers end the request
+		if !f.has(flagEndStream) {
+			return streamError{f.streamID, ErrCodeProtocol}
+		}
+		st.req.Trailers = headers.NewHeaders()
+		for _, field := range fields {
+			if strings.HasPrefix(field.Name, ":") {
+				return streamError{f.streamID, ErrCodeProtocol}
+			}
+			st.req.Trailers.Set(field.Name, field.Value)
+		}
+		return s.endRequest(st)
+	}
+
+	if f.streamID <= s.maxStreamID {
+		return ConnError{ErrCodeProtocol, fmt.Sprintf("HEADERS on closed stream %d", f.streamID)}
+	}
+	s.maxStreamID = f.streamID
+
+	if goingAway || active >= int(s.opts.MaxConcurrentStreams) {
+		return streamError{f.streamID, ErrCodeRefusedStream}
+	}
+
+	req, err := newRequest(fields)
+	if err != nil {
+		return streamError{f.streamID, ErrCodeProtocol}
+	}
+	req.Conn = request.ConnInfo{RemoteAddr: s.conn.RemoteAddr(), LocalAddr: s.conn.LocalAddr()}
+
+	st = &stream{id: f.streamID, state: stateOpen, req: req}
+	s.mu.Lock()
+	st.sendWindow = s.initialWindow
+	s.streams[st.id] = st
+	s.stopIdle()
+	s.mu.Unlock()
+
+	contentLength, _ := strconv.ParseInt(req.Headers.Get("Content-Length"), 10, 64)
+	if contentLength > s.opts.MaxBodySize {
+		st.state = stateHalfClosedRemote
+		go s.reject(st, response.ContentTooLarge, !f.has(flagEndStream))
+		return nil
+	}
+
+	if f.has(flagEndStream) {
+		return s.endRequest(st)
+	}
+	return nil
+}
+
+// endRequest runs the handler once a request is complete
+func (s *serverConn) endRequest(st *stream) error {
+	if cl := st.req.Headers.Get("Content-Length"); cl != "" && cl != strconv.Itoa(len(st.req.Body)) {
+		return streamError{st.id, ErrCodeProtocol}
+	}
+
+	s.mu.Lock()
+	st.state = stateHalfClosedRemote
+	s.mu.Unlock()
+	s.dispatch(st)
+	return nil
+}
+
+func (s *serverConn) processRSTStream(f *frame) error {
+	if f.streamID == 0 {
+		return ConnError{ErrCodeProtocol, "RST_STREAM on stream 0"}
+	}
+	if len(f.payload) != 4 {
+		return ConnError{ErrCodeFrameSize, "RST_STREAM of the wrong size"}
+	}
+	if f.streamID > s.maxStreamID {
+		return ConnError{ErrCodeProtocol, "RST_STREAM on an idle stream"}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if st := s.streams[f.streamID]; st != nil {
+		s.closeStreamLocked(st)
+	}
+	return nil
+}
+
+func (s *serverConn) processSettings(f *frame) error {
+	if f.streamID != 0 {
+		return ConnError{ErrCodeProtocol, "SETTINGS on a stream"}
+	}
+	if f.has(flagAck) {
+		if len(f.payload) != 0 {
+			return ConnError{ErrCodeFrameSize, "SETTINGS ack with a payload"}
+		}
+		return nil
+	}
+	if len(f.payload)%6 != 0 {
+		return ConnError{ErrCodeFrameSize, "SETTINGS of the wrong size"}
+	}
+
+	if err := s.applySettings(f.payload); err != nil {
+		return err
+	}
+	return s.writeFrame(frameSettings, flagAck, 0, nil)
+}
+
+// applySettings takes on the client's settings, sent in a SETTINGS frame
+// or the HTTP2-Settings header of an upgrade
+func (s *serverConn) applySettings(payload []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	defer s.cond.Broadcast()
+
+	for p := payload; len(p) > 0; p = p[6:] {
+		id := settingID(binary.BigEndian.Uint16(p))
+		value := binary.BigEndian.Uint32(p[2:])
+		switch id {
+		case settingEnablePush:
+			if value > 1 {
+				return ConnError{ErrCodeProtocol, "invalid SETTINGS_ENABLE_PUSH"}
+			}
+		case settingInitialWindowSize:
+			if value > maxWindowSize {
+				return ConnError{ErrCodeFlowControl, "SETTINGS_INITIAL_WINDOW_SIZE too large"}
+			}
+			// Open streams' windows move by the difference (RFC 9113 §6.9.2)
+			delta := int64(value) - s.initialWindow
+			s.initialWindow = int64(value)
+			for _, st := range s.streams {
+				st.sendWindow += delta
+			}
+		case settingMaxFrameSize:
+			if value < defaultMaxFrameSize || value > maxFrameSizeLimit {
+				return ConnError{ErrCodeProtocol, "invalid SETTINGS_MAX_FRAME_SIZE"}
+			}
+			s.maxFrameSize = value
+		}
+	}
+	return nil
+}
+
+func (s *serverConn) processWindowUpdate(f *frame) error {
+	if len(f.payload) != 4 {
+		return ConnError{ErrCodeFrameSize, "WINDOW_UPDATE of the wrong size"}
+	}
+	increment := int64(binary.BigEndian.Uint32(f.payload) & (1<<31 - 1))
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if f.streamID == 0 {
+		if increment == 0 {
+			return ConnError{ErrCodeProtocol, "WINDOW_UPDATE of 0"}
+		}
+		s.sendWindow += increment
+		if s.sendWindow > maxWindowSize {
+			return ConnError{ErrCodeFlowControl, "window over 2^31-1"}
+		}
+		s.cond.Broadcast()
+		return nil
+	}
+
+	if increment == 0 {
+		return streamError{f.streamID, ErrCodeProtocol}
+	}
+	st := s.streams[f.streamID]
+	if st == nil {
+		return nil
+	}
+	st.sendWindow += increment
+	if st.sendWindow > maxWindowSize {
+		return streamError{f.streamID, ErrCodeFlowControl}
+	}
+	s.cond.Broadcast()
+	return nil
+}
+
+// IsUpgrade reports whether an HTTP/1.1 request asks to switch to h2c
+// (RFC 7540 §3.2) with valid HTTP2-Settings
+func IsUpgrade(req *request.Request) bool {
+	if req.RequestLine.HttpVersion != "1.1" ||
+		!req.Headers.HasToken("Upgrade", "h2c") ||
+		!req.Headers.HasToken("Connection", "Upgrade") ||
+		!req.Headers.HasToken("Connection", "HTTP2-Settings") {
+		return false
+	}
+	_, err := upgradeSettings(req)
+	return err == nil
+}
+
+// upgradeSettings decodes the HTTP2-Settings header, a SETTINGS payload in
+// unpadded base64url
+func upgradeSettings(req *request.Request) ([]byte, error) {
+	settings, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(req.Headers.Get("HTTP2-Settings"), "="))
+	if err != nil {
+		return nil, err
+	}
+	if len(settings)%6 != 0 {
+		return nil, ConnError{ErrCodeProtocol, "HTTP2-Settings of the wrong size"}
+	}
+	return settings, nil
+}
+
+// newRequest builds a request from the decoded header fields (RFC 9113
+// §8.3), or fails for malformed ones
+func newRequest(fields []hpack.HeaderField) (*request.Request, error) {
+	req := &request.Request{Headers: headers.NewHeaders()}
+	req.RequestLine.HttpVersion = "2.0"
+
+	var scheme, authority string
+	var cookies []string
+	regular := false
+	for _, f := range fields {
+		if f.Name != strings.ToLower(f.Name) {
+			return nil, fmt.Errorf("uppercase field name %q", f.Name)
+		}
+
+		if strings.HasPrefix(f.Name, ":") {
+			if regular {
+				return nil, fmt.Errorf("pseudo-header %s after regular fields", f.Name)
+			}
+			var target *string
+			switch f.Name {
+			case ":method":
+				target = &req.RequestLine.Method
+			case ":path":
+				target = &req.RequestLine.RequestTarget
+			case ":scheme":
+				target = &scheme
+			case ":authority":
+				target = &authority
+			default:
+				return nil, fmt.Errorf("unknown pseudo-header %s", f.Name)
+			}
+			if *target != "" {
+				return nil, fmt.Errorf("repeated pseudo-header %s", f.Name)
+			}
+			*target = f.Value
+			continue
+		}
+
+		regular = true
+		switch f.Name {
+		case "connection", "keep-alive", "proxy-connection", "transfer-encoding", "upgrade":
+			return nil, fmt.Errorf("connection-specific field %s", f.Name)
+		case "te":
+			if f.Value != "trailers" {
+				return nil, fmt.Errorf("te: %s", f.Value)
+			}
+		case "cookie":
+			// Split cookies are joined back with "; " (RFC 9113 §8.2.3)
+			cookies = append(cookies, f.Value)
+			continue
+		}
+		req.Headers.Set(f.Name, f.Value)
+	}
+
+	if len(cookies) > 0 {
+		req.Headers.Override("cookie", strings.Join(cookies, "; "))
+	}
+
+	if req.RequestLine.Method == "CONNECT" {
+		if authority == "" || scheme != "" || req.RequestLine.RequestTarget != "" {
+			return nil, fmt.Errorf("malformed CONNECT")
+		}
+		req.RequestLine.RequestTarget = authority
+	} else if req.RequestLine.Method == "" || scheme == "" || req.RequestLine.RequestTarget == "" {
+		return nil, fmt.Errorf("missing pseudo-headers")
+	}
+
+	if authority != "" && req.Headers.Get("Host") == "" {
+		req.Headers.Set("Host", authority)
+	}
+	return req, nil
+}
+
+// dispatch runs the handler for a complete request. The response goes
+// through a regular response.Writer whose HTTP/1.1 output is parsed back
+// and framed, so filters and middleware work unchanged.
+func (s *serverConn) dispatch(st *stream) {
+	pr, pw := io.Pipe()
+	s.mu.Lock()
+	st.body = pr
+	s.mu.Unlock()
+
+	s.handlers.Add(1)
+	go func() {
+		defer s.handlers.Done()
+
+		written := make(chan error, 1)
+		go func() {
+			written <- s.writeResponse(st, pr)
+		}()
+
+		w := response.NewWriter(pw)
+		s.handler(w, st.req)
+		w.Finish()
+		pw.Close()
+
+		if err := <-written; err != nil && !errors.Is(err, errStreamReset) && !errors.Is(err, errConnClosed) {
+			s.resetStream(st.id, ErrCodeInternal)
+			return
+		}
+		s.mu.Lock()
+		s.closeStreamLocked(st)
+		s.mu.Unlock()
+	}()
+}
+
+// writeResponse frames what the handler writes to the pipe
+func (s *serverConn) writeResponse(st *stream, pr *io.PipeReader) error {
+	// Whatever the handler writes past the response is dropped
+	defer io.Copy(io.Discard, pr)
+
+	resp, body, err := response.HeadFromReader(pr, st.req.RequestLine.Method)
+	if err != nil {
+		pr.CloseWithError(err)
+		return err
+	}
+
+	fields := []hpack.HeaderField{{Name: ":status", Value: string(resp.StatusCode)}}
+	for _, name := range resp.Headers.Names() {
+		name = strings.ToLower(name)
+		switch name {
+		case "connection", "keep-alive", "proxy-connection", "transfer-encoding", "upgrade":
+			continue
+		}
+		// Repeated fields, Set-Cookie in particular, go out one by one
+		for _, value := range resp.Headers.Values(name) {
+			fields = append(fields, hpack.HeaderField{Name: name, Value: value})
+		}
+	}
+
+	noBody := st.req.RequestLine.Method == "HEAD" || resp.StatusCode == "204" ||
+		resp.StatusCode == response.NotModified || resp.Headers.Get("Content-Length") == "0"
+	if err := s.writeHeaders(st, fields, noBody); err != nil {
+		pr.CloseWithError(err)
+		return err
+	}
+	if noBody {
+		return nil
+	}
+
+	buf := make([]byte, defaultMaxFrameSize)
+	for {
+		n, err := body.Read(buf)
+		if n > 0 {
+			if werr := s.writeData(st, buf[:n], false); werr != nil {
+				pr.CloseWithError(werr)
+				return werr
+			}
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			pr.CloseWithError(err)
+			return err
+		}
+	}
+
+	if resp.Trailers != nil && len(resp.Trailers.Names()) > 0 {
+		var trailers []hpack.HeaderField
+		for _, name := range resp.Trailers.Names() {
+			for _, value := range resp.Trailers.Values(name) {
+				trailers = append(trailers, hpack.HeaderField{Name: strings.ToLower(name), Value: value})
+			}
+		}
+		return s.writeHeaders(st, trailers, true)
+	}
+	return s.writeData(st, nil, true)
+}
+
+// reject answers a stream with an empty response without running the
+// handler. A request still sending its body is told to stop.
+func (s *serverConn) reject(st *stream, statusCode response.StatusCode, reset bool) {
+	fields := []hpack.HeaderField{{Name: ":status", Value: string(statusCode)}, {Name: "content-length", Value: "0"}}
+	if err := s.writeHeaders(st, fields, true); err == nil && reset {
+		s.writeFrame(frameRSTStream, 0, st.id, binary.BigEndian.AppendUint32(nil, uint32(ErrCodeNo)))
+	}
+	s.mu.Lock()
+	s.closeStreamLocked(st)
+	s.mu.Unlock()
+}
+
+// writeHeaders sends a header block, split into CONTINUATION frames as
+// needed. The frames go out back to back as the protocol requires.
+func (s *serverConn) writeHeaders(st *stream, fields []hpack.HeaderField, endStream bool) error {
+	block := hpack.Encoder{}.Encode(nil, fields)
+
+	s.mu.Lock()
+	maxFrameSize := int(s.maxFrameSize)
+	reset, closed := st.reset, s.closed
+	s.mu.Unlock()
+	if reset {
+		return errStreamReset
+	}
+	if closed {
+		return errConnClosed
+	}
+
+	var flags byte
+	if endStream {
+		flags = flagEndStream
+	}
+
+	var buf []byte
+	typ := frameHeaders
+	for {
+		chunk := block[:min(len(block), maxFrameSize)]
+		block = block[len(chunk):]
+		if len(block) == 0 {
+			flags |= flagEndHeaders
+		}
+		buf = appendFrame(buf, typ, flags, st.id, chunk)
+		if len(block) == 0 {
+			break
+		}
+		typ, flags = frameContinuation, 0
+	}
+	return s.write(buf)
+}
+
+// writeData sends p as DATA frames as flow control allows
+func (s *serverConn) writeData(st *stream, p []byte, endStream bool) error {
+	for {
+		s.mu.Lock()
+		for len(p) > 0 && !st.reset && !s.closed && (s.sendWindow <= 0 || st.sendWindow <= 0) {
+			s.cond.Wait()
+		}
+		if st.reset {
+			s.mu.Unlock()
+			return errStreamReset
+		}
+		if s.closed {
+			s.mu.Unlock()
+			return errConnClosed
+		}
+		n := int(min(int64(len(p)), s.sendWindow, st.sendWindow, int64(s.maxFrameSize)))
+		s.sendWindow -= int64(n)
+		st.sendWindow -= int64(n)
+		s.mu.Unlock()
+
+		var flags byte
+		if endStream && n == len(p) {
+			flags = flagEndStream
+		}
+		if err := s.writeFrame(frameData, flags, st.id, p[:n]); err != nil {
+			return err
+		}
+		p = p[n:]
+		if len(p) == 0 {
+			return nil
+		}
+	}
+}
+
+// resetStream sends RST_STREAM and forgets the stream
+func (s *serverConn) resetStream(id uint32, code ErrCode) {
+	s.writeFrame(frameRSTStream, 0, id, binary.BigEndian.AppendUint32(nil, uint32(code)))
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if st := s.streams[id]; st != nil {
+		s.closeStreamLocked(st)
+	}
+}
+
+// closeStreamLocked forgets a stream, failing its handler's writes if it
+// is still running
+func (s *serverConn) closeStreamLocked(st *stream) {
+	if s.streams[st.id] != st {
+		return
+	}
+	delete(s.streams, st.id)
+	st.reset = true
+	if st.body != nil {
+		st.body.CloseWithError(errStreamReset)
+	}
+	s.cond.Broadcast()
+
+	if len(s.streams) == 0 {
+		s.startIdleLocked()
+	}
+}
+
+func (s *serverConn) startIdle() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.startIdleLocked()
+}
+
+// startIdleLocked closes the connection after IdleTimeout without streams
+func (s *serverConn) startIdleLocked() {
+	if s.opts.IdleTimeout <= 0 || s.closed {
+		return
+	}
+	s.stopIdle()
+	s.idleTimer = time.AfterFunc(s.opts.IdleTimeout, func() {
+		s.goAway(ErrCodeNo, "idle")
+		s.conn.Close()
+	})
+}
+
+func (s *serverConn) stopIdle() {
+	if s.idleTimer != nil {
+		s.idleTimer.Stop()
+		s.idleTimer = nil
+	}
+}
+
+func (s *serverConn) goAway(code ErrCode, reason string) {
+	payload := binary.BigEndian.AppendUint32(nil, s.maxStreamID)
+	payload = binary.BigEndian.AppendUint32(payload, uint32(code))
+	payload = append(payload, reason...)
+	s.writeFrame(frameGoAway, 0, 0, payload)
+}
+
+func (s *serverConn) writeFrame(typ frameType, flags byte, streamID uint32, payload []byte) error {
+	return s.write(appendFrame(nil, typ, flags, streamID, payload))
+}
+
+func (s *serverConn) write(p []byte) error {
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+	_, err := s.conn.Write(p)
+	return err
+}
@@ -0,0 +1,248 @@
+package middleware
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/spaghetti-lover/go-http/pkg/headers"
+	"github.com/spaghetti-lover/go-http/pkg/request"
+	"github.com/spaghetti-lover/go-http/pkg/response"
+	"github.com/spaghetti-lover/go-http/pkg/server"
+)
+
+const defaultMinSize = 256
+
+// NoCompression asks Compress for flate level 0, stored blocks in a gzip or
+// deflate framing. flate.NoCompression is 0 too, and 0 means the default.
+const NoCompression = -3
+
+var defaultContentTypes = []string{
+	"text/",
+	"application/json",
+	"application/javascript",
+	"application/xml",
+	"application/xhtml+xml",
+	"image/svg+xml",
+}
+
+// CompressOptions configures Compress. The zero value uses sane defaults.
+type CompressOptions struct {
+	// MinSize skips responses whose Content-Length is smaller, compressing
+	// them would cost more than it saves
+	MinSize int
+
+	// Level is the flate compression level, 0 means the default level and
+	// NoCompression means none
+	Level int
+
+	// ContentTypes lists the media type prefixes worth compressing. Anything
+	// else (images, video, archives) is usually compressed already.
+	ContentTypes []string
+}
+
+// Compress negotiates gzip or deflate from Accept-Encoding and compresses
+// eligible responses on the fly. Compressed responses lose Content-Length and
+// are sent chunked, so handlers can keep writing plain bodies.
+func Compress(opts CompressOptions) server.Middleware {
+	if opts.MinSize == 0 {
+		opts.MinSize = defaultMinSize
+	}
+	switch opts.Level {
+	case 0:
+		opts.Level = flate.DefaultCompression
+	case NoCompression:
+		opts.Level = flate.NoCompression
+	}
+	if opts.ContentTypes == nil {
+		opts.ContentTypes = defaultContentTypes
+	}
+
+	return func(next server.Handler) server.Handler {
+		return func(w *response.Writer, req *request.Request) {
+			coding := ""
+			// HEAD responses have no body to compress
+			if req.RequestLine.Method != "HEAD" {
+				coding = negotiateEncoding(req.Headers.Get("Accept-Encoding"))
+			}
+
+			// Installed even without a coding so the response still carries Vary
+			w.AddFilter(&compressFilter{coding: coding, opts: opts})
+			next(w, req)
+		}
+	}
+}
+
+// negotiateEncoding picks gzip or deflate from an Accept-Encoding value,
+// honouring q-values. Codings that aren't listed are only acceptable through
+// "*". It returns "" when neither is acceptable.
+func negotiateEncoding(acceptEncoding string) string {
+	if acceptEncoding == "" {
+		return ""
+	}
+
+	qvalues := map[string]float64{}
+	for _, item := range strings.Split(acceptEncoding, ",") {
+		params := strings.Split(item, ";")
+		coding := strings.ToLower(strings.TrimSpace(params[0]))
+		if coding == "" {
+			continue
+		}
+
+		q := 1.0
+		for _, param := range params[1:] {
+			name, value, ok := strings.Cut(strings.TrimSpace(param), "=")
+			if !ok || strings.ToLower(strings.TrimSpace(name)) != "q" {
+				continue
+			}
+			parsed, err := strconv.ParseFloat(strings.TrimSpace(value), 64)
+			if err == nil && parsed >= 0 && parsed <= 1 {
+				q = parsed
+			}
+		}
+		qvalues[coding] = q
+	}
+
+	qvalue := func(coding string) float64 {
+		if q, ok := qvalues[coding]; ok {
+			return q
+		}
+		if coding == "gzip" {
+			if q, ok := qvalues["x-gzip"]; ok {
+				return q
+			}
+		}
+		return qvalues["*"]
+	}
+
+	gzipQ, deflateQ := qvalue("gzip"), qvalue("deflate")
+	switch {
+	case gzipQ > 0 && gzipQ >= deflateQ:
+		return "gzip"
+	case deflateQ > 0:
+		return "deflate"
+	}
+	return ""
+}
+
+type compressor interface {
+	io.WriteCloser
+	Flush() error
+}
+
+// compressFilter decides at header time whether the response gets
+// compressed, then runs every piece of body through the compressor
+type compressFilter struct {
+	coding string
+	opts   CompressOptions
+	buf    bytes.Buffer
+	zw     compressor
+}
+
+func (f *compressFilter) Headers(statusCode response.StatusCode, h *headers.Headers) {
+	if !compressibleStatus(statusCode) || !f.compressibleType(h.Get("Content-Type")) {
+		return
+	}
+
+	if !strings.Contains(strings.ToLower(h.Get("Vary")), "accept-encoding") {
+		h.Set("Vary", "Accept-Encoding")
+	}
+
+	if f.coding == "" || h.Get("Content-Encoding") != "" {
+		return
+	}
+
+	if contentLength := h.Get("Content-Length"); contentLength != "" {
+		n, err := strconv.Atoi(contentLength)
+		if err == nil && n < f.opts.MinSize {
+			return
+		}
+	}
+
+	var err error
+	switch f.coding {
+	case "gzip":
+		f.zw, err = gzip.NewWriterLevel(&f.buf, f.opts.Level)
+	case "deflate":
+		f.zw, err = zlib.NewWriterLevel(&f.buf, f.opts.Level)
+	}
+	if err != nil {
+		f.zw = nil
+		return
+	}
+
+	// The encoded bytes are a different representation, so a strong
+	// validator no longer applies to them
+	if etag := h.Get("ETag"); strings.HasPrefix(etag, `"`) {
+		h.Override("ETag", "W/"+etag)
+	}
+
+	h.Del("Content-Length")
+	h.Override("Content-Encoding", f.coding)
+	h.Override("Transfer-Encoding", "chunked")
+}
+
+func (f *compressFilter) compressibleType(contentType string) bool {
+	contentType = strings.ToLower(strings.TrimSpace(contentType))
+	if contentType == "" {
+		return false
+	}
+	for _, prefix := range f.opts.ContentTypes {
+		if strings.HasPrefix(contentType, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+func compressibleStatus(statusCode response.StatusCode) bool {
+	return statusCode != "" && statusCode[0] != '1' &&
+		statusCode != "204" && statusCode != "206" && statusCode != response.NotModified
+}
+
+func (f *compressFilter) Body(p []byte) ([]byte, error) {
+	if f.zw == nil {
+		return p, nil
+	}
+
+	if _, err := f.zw.Write(p); err != nil {
+		return nil, err
+	}
+
+	// Flush so streamed responses aren't held back until the end
+	if err := f.zw.Flush(); err != nil {
+		return nil, err
+	}
+
+	return f.take(), nil
+}
+
+func (f *compressFilter) Close() ([]byte, error) {
+	if f.zw == nil {
+		return nil, nil
+	}
+
+	if err := f.zw.Close(); err != nil {
+		return nil, err
+	}
+
+	return f.take(), nil
+}
+
+func (f *compressFilter) Trailers(h *headers.Headers) {}
+
+// Bypass reports that Headers chose not to compress, Vary aside the
+// response is untouched
+func (f *compressFilter) Bypass() bool {
+	return f.zw == nil
+}
+
+func (f *compressFilter) take() []byte {
+	out := bytes.Clone(f.buf.Bytes())
+	f.buf.Reset()
+	return out
+}
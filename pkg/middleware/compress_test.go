@@ -0,0 +1,205 @@
+package middleware
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"io"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/spaghetti-lover/go-http/pkg/headers"
+	"github.com/spaghetti-lover/go-http/pkg/request"
+	"github.com/spaghetti-lover/go-http/pkg/response"
+	"github.com/spaghetti-lover/go-http/pkg/server"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// run serves raw through handler and parses what the writer emitted
+func run(t *testing.T, handler server.Handler, raw string) *response.Response {
+	t.Helper()
+	req, err := request.FromReader(strings.NewReader(raw))
+	require.NoError(t, err)
+
+	var buf bytes.Buffer
+	w := response.NewWriter(&buf)
+	handler(w, req)
+	require.NoError(t, w.Finish())
+
+	res, err := response.FromReader(&buf, req.RequestLine.Method)
+	require.NoError(t, err)
+	return res
+}
+
+func textHandler(contentType, body string) server.Handler {
+	return func(w *response.Writer, req *request.Request) {
+		w.WriteStatusLine(response.OK)
+		h := headers.NewHeaders()
+		h.Set("Content-Length", strconv.Itoa(len(body)))
+		h.Set("Content-Type", contentType)
+		response.SetETag(h, "v1", false)
+		w.WriteHeaders(h)
+		w.WriteBody([]byte(body))
+	}
+}
+
+func gunzip(t *testing.T, p []byte) string {
+	t.Helper()
+	r, err := gzip.NewReader(bytes.NewReader(p))
+	require.NoError(t, err)
+	out, err := io.ReadAll(r)
+	require.NoError(t, err)
+	return string(out)
+}
+
+func TestNegotiateEncoding(t *testing.T) {
+	assert.Equal(t, "", negotiateEncoding(""))
+	assert.Equal(t, "gzip", negotiateEncoding("gzip, deflate, br"))
+	assert.Equal(t, "deflate", negotiateEncoding("deflate"))
+	assert.Equal(t, "deflate", negotiateEncoding("gzip;q=0.5, deflate;q=0.8"))
+	assert.Equal(t, "gzip", negotiateEncoding("gzip;q=0.8, deflate;q=0.8"))
+	assert.Equal(t, "", negotiateEncoding("gzip;q=0, identity"))
+	assert.Equal(t, "gzip", negotiateEncoding("*"))
+	assert.Equal(t, "deflate", negotiateEncoding("*;q=0.5, gzip;q=0"))
+	assert.Equal(t, "gzip", negotiateEncoding("x-gzip"))
+	assert.Equal(t, "gzip", negotiateEncoding("GZIP ; Q=0.3"))
+	assert.Equal(t, "", negotiateEncoding("br"))
+}
+
+func TestCompress(t *testing.T) {
+	body := strings.Repeat("<p>Your request was an absolute banger.</p>\n", 40)
+	handler := server.Chain(textHandler("text/html", body), Compress(CompressOptions{}))
+
+	// Test: gzip
+	res := run(t, handler, "GET / HTTP/1.1\r\nHost: localhost\r\nAccept-Encoding: gzip, deflate\r\n\r\n")
+	assert.Equal(t, "gzip", res.Headers.Get("Content-Encoding"))
+	assert.Equal(t, "Accept-Encoding", res.Headers.Get("Vary"))
+	assert.Equal(t, `W/"v1"`, res.Headers.Get("ETag"))
+	assert.Equal(t, "", res.Headers.Get("Content-Length"))
+	assert.Less(t, len(res.Body), len(body))
+	assert.Equal(t, body, gunzip(t, res.Body))
+
+	// Test: deflate
+	res = run(t, handler, "GET / HTTP/1.1\r\nHost: localhost\r\nAccept-Encoding: gzip;q=0.1, deflate\r\n\r\n")
+	assert.Equal(t, "deflate", res.Headers.Get("Content-Encoding"))
+	r, err := zlib.NewReader(bytes.NewReader(res.Body))
+	require.NoError(t, err)
+	out, err := io.ReadAll(r)
+	require.NoError(t, err)
+	assert.Equal(t, body, string(out))
+
+	// Test: Levels, NoCompression stores the body as is
+	for _, level := range []int{flate.BestSpeed, flate.BestCompression, flate.HuffmanOnly, NoCompression} {
+		leveled := server.Chain(textHandler("text/html", body), Compress(CompressOptions{Level: level}))
+		res = run(t, leveled, "GET / HTTP/1.1\r\nHost: localhost\r\nAccept-Encoding: gzip\r\n\r\n")
+		assert.Equal(t, "gzip", res.Headers.Get("Content-Encoding"), level)
+		assert.Equal(t, body, gunzip(t, res.Body), level)
+		if level == NoCompression {
+			assert.Greater(t, len(res.Body), len(body))
+		} else {
+			assert.Less(t, len(res.Body), len(body), level)
+		}
+	}
+
+	// Test: No Accept-Encoding
+	res = run(t, handler, "GET / HTTP/1.1\r\nHost: localhost\r\n\r\n")
+	assert.Equal(t, "", res.Headers.Get("Content-Encoding"))
+	assert.Equal(t, "Accept-Encoding", res.Headers.Get("Vary"))
+	assert.Equal(t, strconv.Itoa(len(body)), res.Headers.Get("Content-Length"))
+	assert.Equal(t, body, string(res.Body))
+
+	// Test: HEAD is left alone
+	res = run(t, handler, "HEAD / HTTP/1.1\r\nHost: localhost\r\nAccept-Encoding: gzip\r\n\r\n")
+	assert.Equal(t, "", res.Headers.Get("Content-Encoding"))
+
+	// Test: Tiny body
+	tiny := server.Chain(textHandler("text/plain", "hi"), Compress(CompressOptions{}))
+	res = run(t, tiny, "GET / HTTP/1.1\r\nHost: localhost\r\nAccept-Encoding: gzip\r\n\r\n")
+	assert.Equal(t, "", res.Headers.Get("Content-Encoding"))
+	assert.Equal(t, "hi", string(res.Body))
+
+	// Test: Already compressed media type
+	png := server.Chain(textHandler("image/png", body), Compress(CompressOptions{}))
+	res = run(t, png, "GET / HTTP/1.1\r\nHost: localhost\r\nAccept-Encoding: gzip\r\n\r\n")
+	assert.Equal(t, "", res.Headers.Get("Content-Encoding"))
+	assert.Equal(t, "", res.Headers.Get("Vary"))
+
+	// Test: Already encoded body
+	encoded := server.Chain(func(w *response.Writer, req *request.Request) {
+		w.WriteStatusLine(response.OK)
+		h := headers.NewHeaders()
+		h.Set("Content-Type", "application/json")
+		h.Set("Content-Encoding", "br")
+		h.Set("Content-Length", "300")
+		w.WriteHeaders(h)
+		w.WriteBody(bytes.Repeat([]byte{'x'}, 300))
+	}, Compress(CompressOptions{}))
+	res = run(t, encoded, "GET / HTTP/1.1\r\nHost: localhost\r\nAccept-Encoding: gzip\r\n\r\n")
+	assert.Equal(t, "br", res.Headers.Get("Content-Encoding"))
+	assert.Len(t, res.Body, 300)
+}
+
+func TestCompressChunkedWithTrailers(t *testing.T) {
+	handler := server.Chain(func(w *response.Writer, req *request.Request) {
+		w.WriteStatusLine(response.OK)
+		h := headers.NewHeaders()
+		h.Set("Content-Type", "application/json")
+		h.Set("Transfer-Encoding", "chunked")
+		h.Set("Trailer", "X-Count")
+		w.WriteHeaders(h)
+		for i := 0; i < 3; i++ {
+			w.WriteChunkedBody([]byte(`{"n":` + strconv.Itoa(i) + "}\n"))
+		}
+		w.WriteLastChunk()
+		trailers := headers.NewHeaders()
+		trailers.Set("X-Count", "3")
+		w.WriteTrailers(trailers)
+	}, Compress(CompressOptions{}))
+
+	res := run(t, handler, "GET / HTTP/1.1\r\nHost: localhost\r\nAccept-Encoding: gzip\r\n\r\n")
+	assert.Equal(t, "gzip", res.Headers.Get("Content-Encoding"))
+	assert.Equal(t, "{\"n\":0}\n{\"n\":1}\n{\"n\":2}\n", gunzip(t, res.Body))
+	assert.Equal(t, "3", res.Trailers.Get("X-Count"))
+}
+
+// handOffConn notes whether the writer handed a copy to it, as it does for
+// sendfile
+type handOffConn struct {
+	bytes.Buffer
+	handedOff bool
+}
+
+func (c *handOffConn) ReadFrom(src io.Reader) (int64, error) {
+	c.handedOff = true
+	return c.Buffer.ReadFrom(src)
+}
+
+func TestCompressBypass(t *testing.T) {
+	body := strings.Repeat("x", 4096)
+	handler := server.Chain(func(w *response.Writer, req *request.Request) {
+		w.WriteStatusLine(response.OK)
+		h := headers.NewHeaders()
+		h.Set("Content-Type", "video/mp4")
+		h.Set("Content-Length", strconv.Itoa(len(body)))
+		w.WriteHeaders(h)
+		io.Copy(w, struct{ io.Reader }{strings.NewReader(body)})
+	}, HashTrailers(HashTrailersOptions{}), Compress(CompressOptions{}))
+
+	// Test: Responses neither middleware changes still reach the connection
+	// in one copy
+	req, err := request.FromReader(strings.NewReader("GET / HTTP/1.1\r\nHost: localhost\r\nAccept-Encoding: gzip\r\n\r\n"))
+	require.NoError(t, err)
+	var conn handOffConn
+	w := response.NewWriter(&conn)
+	handler(w, req)
+	require.NoError(t, w.Finish())
+	assert.True(t, conn.handedOff)
+
+	res, err := response.FromReader(&conn, "GET")
+	require.NoError(t, err)
+	assert.Equal(t, "", res.Headers.Get("Content-Encoding"))
+	assert.Equal(t, body, string(res.Body))
+}
@@ -0,0 +1,144 @@
+package middleware
+
+import (
+	"bufio"
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"strconv"
+	"strings"
+
+	"github.com/spaghetti-lover/go-http/pkg/headers"
+	"github.com/spaghetti-lover/go-http/pkg/request"
+	"github.com/spaghetti-lover/go-http/pkg/response"
+	"github.com/spaghetti-lover/go-http/pkg/server"
+)
+
+const defaultMaxDecompressedSize = 10 << 20
+
+var errUnsupportedEncoding = errors.New("unsupported content-encoding")
+var errDecompressedTooLarge = errors.New("decompressed body too large")
+
+// DecompressOptions configures Decompress
+type DecompressOptions struct {
+	// MaxSize caps the decoded body so a small compressed upload can't
+	// expand into gigabytes (zip bomb). 0 means 10 MiB.
+	MaxSize int64
+}
+
+// Decompress transparently decodes request bodies sent with
+// Content-Encoding gzip or deflate. The handler sees the decoded body, a
+// matching Content-Length and no Content-Encoding. Unsupported codings get
+// 415, oversized bodies 413 and corrupt ones 400.
+func Decompress(opts DecompressOptions) server.Middleware {
+	if opts.MaxSize == 0 {
+		opts.MaxSize = defaultMaxDecompressedSize
+	}
+
+	return func(next server.Handler) server.Handler {
+		return func(w *response.Writer, req *request.Request) {
+			contentEncoding := req.Headers.Get("Content-Encoding")
+			if contentEncoding == "" {
+				next(w, req)
+				return
+			}
+
+			body, err := req.ReadBody()
+			if err == nil {
+				body, err = decodeBody(body, contentEncoding, opts.MaxSize)
+			}
+			switch {
+			case errors.Is(err, errUnsupportedEncoding):
+				h := headers.NewHeaders()
+				h.Set("Accept-Encoding", "gzip, deflate")
+				writeStatus(w, response.UnsupportedMediaType, h, err.Error())
+				return
+			case errors.Is(err, errDecompressedTooLarge), errors.Is(err, request.ErrContentTooLarge):
+				writeStatus(w, response.ContentTooLarge, headers.NewHeaders(), err.Error())
+				return
+			case err != nil:
+				writeStatus(w, response.BadRequest, headers.NewHeaders(), "malformed request body")
+				return
+			}
+
+			req.Body = body
+			req.Headers.Del("Content-Encoding")
+			req.Headers.Override("Content-Length", strconv.Itoa(len(body)))
+			next(w, req)
+		}
+	}
+}
+
+// decodeBody undoes the codings listed in contentEncoding, which were applied
+// in order, so the last one is removed first
+func decodeBody(body []byte, contentEncoding string, maxSize int64) ([]byte, error) {
+	codings := strings.Split(contentEncoding, ",")
+	for i := len(codings) - 1; i >= 0; i-- {
+		coding := strings.ToLower(strings.TrimSpace(codings[i]))
+
+		var r io.Reader
+		var err error
+		switch coding {
+		case "", "identity":
+			continue
+		case "gzip", "x-gzip":
+			r, err = gzip.NewReader(bytes.NewReader(body))
+		case "deflate":
+			r, err = newDeflateReader(body)
+		default:
+			return nil, fmt.Errorf("%w: %s", errUnsupportedEncoding, coding)
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		// Read one byte past the limit to tell "exactly max" from "too large"
+		decoded, err := io.ReadAll(io.LimitReader(r, maxSize+1))
+		if err != nil {
+			return nil, err
+		}
+		if int64(len(decoded)) > maxSize {
+			return nil, errDecompressedTooLarge
+		}
+		body = decoded
+	}
+
+	return body, nil
+}
+
+// newDeflateReader reads "deflate" as the zlib format it's specified as, but
+// accepts the raw deflate streams some clients send instead
+func newDeflateReader(body []byte) (io.Reader, error) {
+	br := bufio.NewReader(bytes.NewReader(body))
+	header, err := br.Peek(2)
+	if err == nil && (uint16(header[0])<<8|uint16(header[1]))%31 == 0 && header[0]&0x0f == 8 {
+		return zlib.NewReader(br)
+	}
+	return flate.NewReader(br), nil
+}
+
+func writeStatus(w *response.Writer, statusCode response.StatusCode, h *headers.Headers, message string) {
+	err := w.WriteStatusLine(statusCode)
+	if err != nil {
+		log.Printf("Error writing status line: %v", err)
+		return
+	}
+
+	h.Override("Content-Length", strconv.Itoa(len(message)))
+	h.Override("Content-Type", "text/plain")
+	err = w.WriteHeaders(h)
+	if err != nil {
+		log.Printf("Error writing headers: %v", err)
+		return
+	}
+
+	_, err = w.WriteBody([]byte(message))
+	if err != nil {
+		log.Printf("Error writing body: %v", err)
+	}
+}
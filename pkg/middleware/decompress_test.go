@@ -0,0 +1,112 @@
+package middleware
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"strconv"
+	"testing"
+
+	"github.com/spaghetti-lover/go-http/pkg/headers"
+	"github.com/spaghetti-lover/go-http/pkg/request"
+	"github.com/spaghetti-lover/go-http/pkg/response"
+	"github.com/spaghetti-lover/go-http/pkg/server"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func gzipBytes(t *testing.T, p []byte) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	_, err := zw.Write(p)
+	require.NoError(t, err)
+	require.NoError(t, zw.Close())
+	return buf.Bytes()
+}
+
+func upload(encoding string, body []byte) string {
+	return "POST /upload HTTP/1.1\r\n" +
+		"Host: localhost\r\n" +
+		"Content-Encoding: " + encoding + "\r\n" +
+		"Content-Length: " + strconv.Itoa(len(body)) + "\r\n" +
+		"\r\n" + string(body)
+}
+
+func TestDecompress(t *testing.T) {
+	payload := []byte(`{"device":"phone","readings":[1,2,3,4,5,6,7,8,9]}`)
+
+	var got *request.Request
+	echo := func(w *response.Writer, req *request.Request) {
+		got = req
+		writeStatus(w, response.OK, headers.NewHeaders(), "ok")
+	}
+	handler := server.Chain(echo, Decompress(DecompressOptions{MaxSize: 1024}))
+
+	// Test: gzip
+	got = nil
+	res := run(t, handler, upload("gzip", gzipBytes(t, payload)))
+	assert.Equal(t, response.OK, res.StatusCode)
+	require.NotNil(t, got)
+	assert.Equal(t, payload, got.Body)
+	assert.Equal(t, "", got.Headers.Get("Content-Encoding"))
+	assert.Equal(t, strconv.Itoa(len(payload)), got.Headers.Get("Content-Length"))
+
+	// Test: zlib-wrapped deflate
+	var buf bytes.Buffer
+	zw := zlib.NewWriter(&buf)
+	zw.Write(payload)
+	zw.Close()
+	got = nil
+	run(t, handler, upload("deflate", buf.Bytes()))
+	require.NotNil(t, got)
+	assert.Equal(t, payload, got.Body)
+
+	// Test: raw deflate
+	buf.Reset()
+	fw, _ := flate.NewWriter(&buf, flate.DefaultCompression)
+	fw.Write(payload)
+	fw.Close()
+	got = nil
+	run(t, handler, upload("deflate", buf.Bytes()))
+	require.NotNil(t, got)
+	assert.Equal(t, payload, got.Body)
+
+	// Test: Stacked codings
+	got = nil
+	run(t, handler, upload("gzip, gzip", gzipBytes(t, gzipBytes(t, payload))))
+	require.NotNil(t, got)
+	assert.Equal(t, payload, got.Body)
+
+	// Test: Unsupported coding
+	got = nil
+	res = run(t, handler, upload("br", payload))
+	assert.Nil(t, got)
+	assert.Equal(t, response.UnsupportedMediaType, res.StatusCode)
+	assert.Equal(t, "gzip, deflate", res.Headers.Get("Accept-Encoding"))
+
+	// Test: Zip bomb
+	got = nil
+	res = run(t, handler, upload("gzip", gzipBytes(t, bytes.Repeat([]byte{0}, 1025))))
+	assert.Nil(t, got)
+	assert.Equal(t, response.ContentTooLarge, res.StatusCode)
+
+	// Test: Exactly at the limit
+	got = nil
+	run(t, handler, upload("gzip", gzipBytes(t, bytes.Repeat([]byte{0}, 1024))))
+	require.NotNil(t, got)
+	assert.Len(t, got.Body, 1024)
+
+	// Test: Corrupt body
+	got = nil
+	res = run(t, handler, upload("gzip", []byte("definitely not gzip")))
+	assert.Nil(t, got)
+	assert.Equal(t, response.BadRequest, res.StatusCode)
+
+	// Test: Identity passes through
+	got = nil
+	run(t, handler, upload("identity", payload))
+	require.NotNil(t, got)
+	assert.Equal(t, payload, got.Body)
+}
@@ -0,0 +1,109 @@
+package middleware
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"hash"
+	"strconv"
+
+	"github.com/spaghetti-lover/go-http/pkg/headers"
+	"github.com/spaghetti-lover/go-http/pkg/request"
+	"github.com/spaghetti-lover/go-http/pkg/response"
+	"github.com/spaghetti-lover/go-http/pkg/server"
+)
+
+// HashTrailersOptions picks the trailer fields HashTrailers adds on top of
+// X-Content-SHA256 and X-Content-Length
+type HashTrailersOptions struct {
+	// ContentDigest adds Content-Digest: sha-256=:<base64>: (RFC 9530)
+	ContentDigest bool
+
+	// Digest adds the older Digest: SHA-256=<base64> (RFC 3230)
+	Digest bool
+}
+
+// HashTrailers hashes chunked response bodies as they are written and sends
+// the SHA-256 and length as trailers, declared up front in Trailer. Nothing
+// is buffered. Responses with a Content-Length are left alone since they
+// can't carry trailers.
+//
+// The hash covers the bytes as they leave the filters installed inside it:
+// chain HashTrailers before Compress to digest the compressed content, as
+// Content-Digest expects.
+func HashTrailers(opts HashTrailersOptions) server.Middleware {
+	return func(next server.Handler) server.Handler {
+		return func(w *response.Writer, req *request.Request) {
+			if req.RequestLine.Method != "HEAD" {
+				w.AddFilter(&hashFilter{opts: opts, hash: sha256.New()})
+			}
+			next(w, req)
+		}
+	}
+}
+
+type hashFilter struct {
+	opts   HashTrailersOptions
+	hash   hash.Hash
+	length int64
+	active bool
+}
+
+func (f *hashFilter) Headers(statusCode response.StatusCode, h *headers.Headers) {
+	if !h.HasToken("Transfer-Encoding", "chunked") {
+		return
+	}
+	if statusCode[0] == '1' || statusCode == "204" || statusCode == response.NotModified {
+		return
+	}
+
+	f.active = true
+	for _, name := range f.names() {
+		h.Set("Trailer", name)
+	}
+}
+
+// Bypass reports that the response can't carry trailers, so there's
+// nothing to hash
+func (f *hashFilter) Bypass() bool {
+	return !f.active
+}
+
+func (f *hashFilter) Body(p []byte) ([]byte, error) {
+	if f.active {
+		f.hash.Write(p)
+		f.length += int64(len(p))
+	}
+	return p, nil
+}
+
+func (f *hashFilter) Close() ([]byte, error) {
+	return nil, nil
+}
+
+func (f *hashFilter) Trailers(h *headers.Headers) {
+	if !f.active {
+		return
+	}
+
+	sum := f.hash.Sum(nil)
+	h.Override("X-Content-SHA256", hex.EncodeToString(sum))
+	h.Override("X-Content-Length", strconv.FormatInt(f.length, 10))
+	if f.opts.ContentDigest {
+		h.Override("Content-Digest", "sha-256=:"+base64.StdEncoding.EncodeToString(sum)+":")
+	}
+	if f.opts.Digest {
+		h.Override("Digest", "SHA-256="+base64.StdEncoding.EncodeToString(sum))
+	}
+}
+
+func (f *hashFilter) names() []string {
+	names := []string{"X-Content-SHA256", "X-Content-Length"}
+	if f.opts.ContentDigest {
+		names = append(names, "Content-Digest")
+	}
+	if f.opts.Digest {
+		names = append(names, "Digest")
+	}
+	return names
+}
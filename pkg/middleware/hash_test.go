@@ -0,0 +1,95 @@
+package middleware
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/spaghetti-lover/go-http/pkg/headers"
+	"github.com/spaghetti-lover/go-http/pkg/request"
+	"github.com/spaghetti-lover/go-http/pkg/response"
+	"github.com/spaghetti-lover/go-http/pkg/server"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func chunkedHandler(contentType string, chunks ...string) server.Handler {
+	return func(w *response.Writer, req *request.Request) {
+		w.WriteStatusLine(response.OK)
+		h := headers.NewHeaders()
+		h.Set("Content-Type", contentType)
+		h.Set("Transfer-Encoding", "chunked")
+		w.WriteHeaders(h)
+		for _, chunk := range chunks {
+			w.WriteChunkedBody([]byte(chunk))
+		}
+	}
+}
+
+func TestHashTrailers(t *testing.T) {
+	chunks := []string{"hello ", "streaming ", "world"}
+	body := strings.Join(chunks, "")
+	sum := sha256.Sum256([]byte(body))
+
+	// Test: Chunked body gets declared trailers
+	handler := server.Chain(chunkedHandler("text/plain", chunks...), HashTrailers(HashTrailersOptions{ContentDigest: true, Digest: true}))
+	res := run(t, handler, "GET / HTTP/1.1\r\nHost: localhost\r\n\r\n")
+	assert.Equal(t, body, string(res.Body))
+	assert.Equal(t, "X-Content-SHA256, X-Content-Length, Content-Digest, Digest", res.Headers.Get("Trailer"))
+	require.NotNil(t, res.Trailers)
+	assert.Equal(t, hex.EncodeToString(sum[:]), res.Trailers.Get("X-Content-SHA256"))
+	assert.Equal(t, strconv.Itoa(len(body)), res.Trailers.Get("X-Content-Length"))
+	assert.Equal(t, "sha-256=:"+base64.StdEncoding.EncodeToString(sum[:])+":", res.Trailers.Get("Content-Digest"))
+	assert.Equal(t, "SHA-256="+base64.StdEncoding.EncodeToString(sum[:]), res.Trailers.Get("Digest"))
+
+	// Test: Only the default fields
+	handler = server.Chain(chunkedHandler("text/plain", chunks...), HashTrailers(HashTrailersOptions{}))
+	res = run(t, handler, "GET / HTTP/1.1\r\nHost: localhost\r\n\r\n")
+	assert.Equal(t, "X-Content-SHA256, X-Content-Length", res.Headers.Get("Trailer"))
+	assert.Equal(t, "", res.Trailers.Get("Content-Digest"))
+
+	// Test: Handler trailers are kept
+	handler = server.Chain(func(w *response.Writer, req *request.Request) {
+		w.WriteStatusLine(response.OK)
+		h := headers.NewHeaders()
+		h.Set("Transfer-Encoding", "chunked")
+		h.Set("Trailer", "X-Count")
+		w.WriteHeaders(h)
+		w.WriteChunkedBody([]byte(body))
+		w.WriteLastChunk()
+		trailers := headers.NewHeaders()
+		trailers.Set("X-Count", "1")
+		w.WriteTrailers(trailers)
+	}, HashTrailers(HashTrailersOptions{}))
+	res = run(t, handler, "GET / HTTP/1.1\r\nHost: localhost\r\n\r\n")
+	assert.Equal(t, "X-Count, X-Content-SHA256, X-Content-Length", res.Headers.Get("Trailer"))
+	assert.Equal(t, "1", res.Trailers.Get("X-Count"))
+	assert.Equal(t, hex.EncodeToString(sum[:]), res.Trailers.Get("X-Content-SHA256"))
+
+	// Test: Content-Length responses are left alone
+	handler = server.Chain(textHandler("text/plain", body), HashTrailers(HashTrailersOptions{}))
+	res = run(t, handler, "GET / HTTP/1.1\r\nHost: localhost\r\n\r\n")
+	assert.Equal(t, "", res.Headers.Get("Trailer"))
+	assert.Equal(t, strconv.Itoa(len(body)), res.Headers.Get("Content-Length"))
+	assert.Nil(t, res.Trailers)
+}
+
+func TestHashTrailersCompressed(t *testing.T) {
+	body := strings.Repeat("<p>Your request was an absolute banger.</p>\n", 40)
+
+	// Test: Outside Compress the digest covers the gzip stream
+	handler := server.Chain(textHandler("text/html", body),
+		HashTrailers(HashTrailersOptions{ContentDigest: true}),
+		Compress(CompressOptions{}),
+	)
+	res := run(t, handler, "GET / HTTP/1.1\r\nHost: localhost\r\nAccept-Encoding: gzip\r\n\r\n")
+	assert.Equal(t, "gzip", res.Headers.Get("Content-Encoding"))
+	assert.Equal(t, body, gunzip(t, res.Body))
+	sum := sha256.Sum256(res.Body)
+	assert.Equal(t, hex.EncodeToString(sum[:]), res.Trailers.Get("X-Content-SHA256"))
+	assert.Equal(t, strconv.Itoa(len(res.Body)), res.Trailers.Get("X-Content-Length"))
+	assert.Equal(t, "sha-256=:"+base64.StdEncoding.EncodeToString(sum[:])+":", res.Trailers.Get("Content-Digest"))
+}
@@ -0,0 +1,272 @@
+package proxy
+
+import (
+	"context"
+	"hash/crc32"
+	"log"
+	"net/url"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/spaghetti-lover/go-http/pkg/client"
+	"github.com/spaghetti-lover/go-http/pkg/request"
+)
+
+// Strategy decides which healthy upstream gets a request
+type Strategy int
+
+const (
+	// RoundRobin takes upstreams in turn
+	RoundRobin Strategy = iota
+	// LeastConnections takes the upstream with the fewest requests in flight
+	LeastConnections
+	// ConsistentHash keeps requests with the same key on the same upstream,
+	// and moves only that upstream's keys when it goes away
+	ConsistentHash
+)
+
+// Defaults for the health settings left at zero
+const (
+	DefaultMaxFails            = 3
+	DefaultFailTimeout         = 10 * time.Second
+	DefaultHealthCheckInterval = 10 * time.Second
+	DefaultHealthCheckTimeout  = 2 * time.Second
+)
+
+// ringReplicas is the number of points each upstream gets on the hash ring,
+// enough to spread keys evenly over a handful of upstreams
+const ringReplicas = 100
+
+// HealthCheck configures active checks: every upstream gets a GET for Path
+// each Interval, and a 2xx or 3xx answer within Timeout counts as healthy.
+// An upstream failing a check is taken out until a later check passes.
+type HealthCheck struct {
+	// Path to request, empty disables active checks
+	Path string
+	// Interval between checks, 0 means DefaultHealthCheckInterval
+	Interval time.Duration
+	// Timeout for one check, 0 means DefaultHealthCheckTimeout
+	Timeout time.Duration
+}
+
+type upstream struct {
+	url    *url.URL
+	active atomic.Int64
+
+	mu sync.Mutex
+	// fails counts consecutive failed requests, MaxFails of them eject the
+	// upstream until ejectedUntil
+	fails        int
+	ejectedUntil time.Time
+	// down is set by a failed active check
+	down bool
+}
+
+func (u *upstream) healthy(now time.Time) bool {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return !u.down && !now.Before(u.ejectedUntil)
+}
+
+type ringPoint struct {
+	hash     uint32
+	upstream *upstream
+}
+
+// pick chooses an upstream for req with the configured strategy, nil when
+// none is healthy
+func (p *Proxy) pick(req *request.Request) *upstream {
+	now := time.Now()
+	switch p.opts.Strategy {
+	case LeastConnections:
+		return p.leastConnections(now)
+	case ConsistentHash:
+		return p.consistentHash(req, now)
+	default:
+		return p.roundRobin(now)
+	}
+}
+
+func (p *Proxy) roundRobin(now time.Time) *upstream {
+	start := p.next.Add(1) - 1
+	for i := range p.upstreams {
+		u := p.upstreams[(int(start)+i)%len(p.upstreams)]
+		if u.healthy(now) {
+			return u
+		}
+	}
+	return nil
+}
+
+// leastConnections breaks ties in turn, so idle upstreams share the load
+func (p *Proxy) leastConnections(now time.Time) *upstream {
+	start := p.next.Add(1) - 1
+	var best *upstream
+	for i := range p.upstreams {
+		u := p.upstreams[(int(start)+i)%len(p.upstreams)]
+		if !u.healthy(now) {
+			continue
+		}
+		if best == nil || u.active.Load() < best.active.Load() {
+			best = u
+		}
+	}
+	return best
+}
+
+// consistentHash walks the ring clockwise from the key's hash to the first
+// healthy upstream. The key is the HashHeader field, or the client IP.
+func (p *Proxy) consistentHash(req *request.Request, now time.Time) *upstream {
+	key := ""
+	if p.opts.HashHeader != "" {
+		key = req.Headers.Get(p.opts.HashHeader)
+	}
+	if key == "" {
+		key = peerIP(req)
+	}
+
+	hash := crc32.ChecksumIEEE([]byte(key))
+	start := sort.Search(len(p.ring), func(i int) bool {
+		return p.ring[i].hash >= hash
+	})
+	for i := range p.ring {
+		point := p.ring[(start+i)%len(p.ring)]
+		if point.upstream.healthy(now) {
+			return point.upstream
+		}
+	}
+	return nil
+}
+
+func buildRing(upstreams []*upstream) []ringPoint {
+	ring := make([]ringPoint, 0, len(upstreams)*ringReplicas)
+	for _, u := range upstreams {
+		for i := 0; i < ringReplicas; i++ {
+			hash := crc32.ChecksumIEEE([]byte(u.url.String() + "#" + strconv.Itoa(i)))
+			ring = append(ring, ringPoint{hash: hash, upstream: u})
+		}
+	}
+	sort.Slice(ring, func(i, j int) bool {
+		return ring[i].hash < ring[j].hash
+	})
+	return ring
+}
+
+// succeeded resets the failure count after a request got an answer
+func (p *Proxy) succeeded(u *upstream) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.fails = 0
+}
+
+// failed counts a request that got no answer, ejecting u for FailTimeout
+// once MaxFails of them happened in a row
+func (p *Proxy) failed(u *upstream) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	u.fails++
+	if u.fails < orDefault(p.opts.MaxFails, DefaultMaxFails) {
+		return
+	}
+
+	u.fails = 0
+	failTimeout := p.opts.FailTimeout
+	if failTimeout <= 0 {
+		failTimeout = DefaultFailTimeout
+	}
+	u.ejectedUntil = time.Now().Add(failTimeout)
+	log.Printf("Upstream %s ejected for %s", u.url, failTimeout)
+}
+
+// healthChecks checks every upstream each interval until Close
+func (p *Proxy) healthChecks() {
+	defer close(p.checksDone)
+
+	interval := p.opts.HealthCheck.Interval
+	if interval <= 0 {
+		interval = DefaultHealthCheckInterval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		var wg sync.WaitGroup
+		for _, u := range p.upstreams {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				p.check(u)
+			}()
+		}
+		wg.Wait()
+
+		select {
+		case <-p.stopChecks:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (p *Proxy) check(u *upstream) {
+	timeout := p.opts.HealthCheck.Timeout
+	if timeout <= 0 {
+		timeout = DefaultHealthCheckTimeout
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	target := *u.url
+	target.Path = p.opts.HealthCheck.Path
+	target.RawQuery = ""
+
+	healthy := false
+	req, err := client.NewRequest("GET", target.String(), nil)
+	if err == nil {
+		resp, err := p.transport().RoundTrip(ctx, req)
+		healthy = err == nil && (resp.StatusCode[0] == '2' || resp.StatusCode[0] == '3')
+	}
+
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if !healthy {
+		if !u.down {
+			u.down = true
+			log.Printf("Upstream %s failed its health check", u.url)
+		}
+		return
+	}
+
+	// A passing check re-admits a passively ejected upstream as well
+	wasOut := u.down || time.Now().Before(u.ejectedUntil)
+	u.down = false
+	u.fails = 0
+	u.ejectedUntil = time.Time{}
+	if wasOut {
+		log.Printf("Upstream %s is healthy again", u.url)
+	}
+}
+
+// Close stops active health checks
+func (p *Proxy) Close() error {
+	if p.stopChecks == nil {
+		return nil
+	}
+
+	p.closeOnce.Do(func() {
+		close(p.stopChecks)
+	})
+	<-p.checksDone
+	return nil
+}
+
+func orDefault(n, def int) int {
+	if n <= 0 {
+		return def
+	}
+	return n
+}
@@ -0,0 +1,242 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/spaghetti-lover/go-http/pkg/client"
+	"github.com/spaghetti-lover/go-http/pkg/headers"
+	"github.com/spaghetti-lover/go-http/pkg/request"
+	"github.com/spaghetti-lover/go-http/pkg/response"
+	"github.com/spaghetti-lover/go-http/pkg/server"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// backend answers with its name, /slow takes a while and /health follows
+// the healthy flag
+type backend struct {
+	name    string
+	healthy atomic.Bool
+	srv     *server.Server
+	url     string
+}
+
+func startBackend(t *testing.T, name string) *backend {
+	t.Helper()
+	b := &backend{name: name}
+	b.healthy.Store(true)
+
+	srv, err := server.Serve(0, func(w *response.Writer, req *request.Request) {
+		status := response.OK
+		switch req.RequestLine.RequestTarget {
+		case "/slow":
+			time.Sleep(200 * time.Millisecond)
+		case "/health":
+			if !b.healthy.Load() {
+				status = response.ServiceUnavailable
+			}
+		}
+
+		w.WriteStatusLine(status)
+		h := headers.NewHeaders()
+		h.Set("Content-Length", strconv.Itoa(len(b.name)))
+		w.WriteHeaders(h)
+		w.WriteBody([]byte(b.name))
+	})
+	require.NoError(t, err)
+	t.Cleanup(func() { srv.Close() })
+
+	b.srv = srv
+	b.url = fmt.Sprintf("http://%s", srv.Addr())
+	return b
+}
+
+func startBackends(t *testing.T, n int) ([]*backend, []string) {
+	t.Helper()
+	var backends []*backend
+	var urls []string
+	for i := 0; i < n; i++ {
+		b := startBackend(t, "b"+strconv.Itoa(i))
+		backends = append(backends, b)
+		urls = append(urls, b.url)
+	}
+	return backends, urls
+}
+
+func balanced(t *testing.T, upstreams []string, opts Options) (*Proxy, string) {
+	t.Helper()
+	p, err := NewBalanced(upstreams, opts)
+	require.NoError(t, err)
+	t.Cleanup(func() { p.Close() })
+	return p, serve(t, p.Handle)
+}
+
+func get(t *testing.T, target string, h map[string]string) *client.Response {
+	t.Helper()
+	req, err := client.NewRequest("GET", target, nil)
+	require.NoError(t, err)
+	for name, value := range h {
+		req.Headers.Set(name, value)
+	}
+	resp, err := client.DefaultClient.Do(context.Background(), req)
+	require.NoError(t, err)
+	return resp
+}
+
+func TestRoundRobin(t *testing.T) {
+	_, urls := startBackends(t, 3)
+	_, base := balanced(t, urls, Options{})
+
+	counts := map[string]int{}
+	for i := 0; i < 9; i++ {
+		counts[string(get(t, base+"/", nil).Body)]++
+	}
+	assert.Equal(t, map[string]int{"b0": 3, "b1": 3, "b2": 3}, counts)
+}
+
+func TestLeastConnections(t *testing.T) {
+	_, urls := startBackends(t, 2)
+	p, base := balanced(t, urls, Options{Strategy: LeastConnections})
+
+	// Test: A busy upstream is avoided
+	p.upstreams[0].active.Add(5)
+	for i := 0; i < 4; i++ {
+		assert.Equal(t, "b1", string(get(t, base+"/", nil).Body))
+	}
+	p.upstreams[0].active.Add(-5)
+
+	// Test: Concurrent slow requests spread out
+	counts := map[string]int{}
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			resp := get(t, base+"/slow", nil)
+			mu.Lock()
+			counts[string(resp.Body)]++
+			mu.Unlock()
+		}()
+		time.Sleep(20 * time.Millisecond)
+	}
+	wg.Wait()
+	assert.Equal(t, map[string]int{"b0": 2, "b1": 2}, counts)
+}
+
+func TestConsistentHash(t *testing.T) {
+	_, urls := startBackends(t, 3)
+	p, base := balanced(t, urls, Options{Strategy: ConsistentHash, HashHeader: "X-User"})
+
+	// Test: The same key sticks to one upstream, keys spread over all
+	assigned := map[string]string{}
+	seen := map[string]bool{}
+	for i := 0; i < 30; i++ {
+		user := "user-" + strconv.Itoa(i)
+		name := string(get(t, base+"/", map[string]string{"X-User": user}).Body)
+		assigned[user] = name
+		seen[name] = true
+		assert.Equal(t, name, string(get(t, base+"/", map[string]string{"X-User": user}).Body))
+	}
+	assert.Len(t, seen, 3)
+
+	// Test: Taking an upstream out only moves its own keys
+	p.upstreams[1].mu.Lock()
+	p.upstreams[1].down = true
+	p.upstreams[1].mu.Unlock()
+	for user, before := range assigned {
+		after := string(get(t, base+"/", map[string]string{"X-User": user}).Body)
+		if before == "b1" {
+			assert.NotEqual(t, "b1", after)
+		} else {
+			assert.Equal(t, before, after, user)
+		}
+	}
+
+	// Test: Without the header the client IP is the key
+	first := string(get(t, base+"/", nil).Body)
+	for i := 0; i < 5; i++ {
+		assert.Equal(t, first, string(get(t, base+"/", nil).Body))
+	}
+}
+
+func TestPassiveEjection(t *testing.T) {
+	backends, urls := startBackends(t, 2)
+	_, base := balanced(t, urls, Options{MaxFails: 2, FailTimeout: 300 * time.Millisecond})
+
+	// Test: A dead upstream is ejected after MaxFails failures in a row
+	backends[1].srv.Close()
+	var statuses []response.StatusCode
+	for i := 0; i < 4; i++ {
+		statuses = append(statuses, get(t, base+"/", nil).StatusCode)
+	}
+	assert.Equal(t, []response.StatusCode{"200", "502", "200", "502"}, statuses)
+	for i := 0; i < 4; i++ {
+		resp := get(t, base+"/", nil)
+		assert.Equal(t, response.OK, resp.StatusCode)
+		assert.Equal(t, "b0", string(resp.Body))
+	}
+
+	// Test: It is tried again after FailTimeout
+	time.Sleep(350 * time.Millisecond)
+	codes := map[response.StatusCode]int{}
+	for i := 0; i < 2; i++ {
+		codes[get(t, base+"/", nil).StatusCode]++
+	}
+	assert.Equal(t, 1, codes[response.BadGateway])
+}
+
+func TestHealthChecks(t *testing.T) {
+	backends, urls := startBackends(t, 2)
+	p, base := balanced(t, urls, Options{HealthCheck: HealthCheck{Path: "/health", Interval: 20 * time.Millisecond}})
+
+	// Test: An upstream failing its check gets no traffic
+	backends[0].healthy.Store(false)
+	require.Eventually(t, func() bool {
+		return !p.upstreams[0].healthy(time.Now())
+	}, time.Second, 10*time.Millisecond)
+	for i := 0; i < 4; i++ {
+		assert.Equal(t, "b1", string(get(t, base+"/", nil).Body))
+	}
+
+	// Test: Nothing healthy is a 503
+	backends[1].healthy.Store(false)
+	require.Eventually(t, func() bool {
+		return get(t, base+"/", nil).StatusCode == response.ServiceUnavailable
+	}, time.Second, 10*time.Millisecond)
+
+	// Test: Passing checks re-admit upstreams
+	backends[0].healthy.Store(true)
+	backends[1].healthy.Store(true)
+	require.Eventually(t, func() bool {
+		return p.upstreams[0].healthy(time.Now()) && p.upstreams[1].healthy(time.Now())
+	}, time.Second, 10*time.Millisecond)
+	seen := map[string]bool{}
+	for i := 0; i < 4; i++ {
+		seen[string(get(t, base+"/", nil).Body)] = true
+	}
+	assert.Len(t, seen, 2)
+
+	// Test: A passing check re-admits a passively ejected upstream before
+	// FailTimeout
+	p, _ = balanced(t, urls, Options{
+		MaxFails:    1,
+		FailTimeout: time.Minute,
+		HealthCheck: HealthCheck{Path: "/health", Interval: 20 * time.Millisecond},
+	})
+	p.failed(p.upstreams[0])
+	require.False(t, p.upstreams[0].healthy(time.Now()))
+	require.Eventually(t, func() bool {
+		return p.upstreams[0].healthy(time.Now())
+	}, time.Second, 10*time.Millisecond)
+
+	// Test: Close stops the checks
+	require.NoError(t, p.Close())
+	require.NoError(t, p.Close())
+}
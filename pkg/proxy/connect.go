@@ -0,0 +1,253 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net"
+	"net/netip"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/spaghetti-lover/go-http/pkg/headers"
+	"github.com/spaghetti-lover/go-http/pkg/request"
+	"github.com/spaghetti-lover/go-http/pkg/response"
+	"github.com/spaghetti-lover/go-http/pkg/server"
+)
+
+// Defaults for the TunnelOptions timeouts left at zero
+const (
+	DefaultTunnelDialTimeout = 10 * time.Second
+	DefaultTunnelIdleTimeout = 5 * time.Minute
+)
+
+type TunnelOptions struct {
+	// Allow lists the destinations that may be reached as host:port
+	// patterns. The host may start with "*." to match subdomains or be "*",
+	// the port may be "*", and "*" alone allows everything. Anything not
+	// listed is refused with 403 Forbidden.
+	Allow []string
+
+	// AllowPrivate lets tunnels reach loopback, private and link-local
+	// addresses. They're refused by default, whatever Allow says and
+	// whatever a host name resolves to, so clients can't use the proxy to
+	// reach the network it sits in.
+	AllowPrivate bool
+
+	// DialTimeout bounds connecting to the destination, 0 means
+	// DefaultTunnelDialTimeout
+	DialTimeout time.Duration
+
+	// IdleTimeout closes tunnels without traffic in either direction for
+	// this long, 0 means DefaultTunnelIdleTimeout
+	IdleTimeout time.Duration
+
+	// Dial connects to the destination, nil means a net.Dialer
+	Dial func(ctx context.Context, network, addr string) (net.Conn, error)
+}
+
+// Tunnel answers CONNECT requests, the forward proxy side of https: it dials
+// the requested destination, replies 200 and then copies bytes both ways
+// until either side closes or the tunnel goes idle.
+func Tunnel(opts TunnelOptions) server.Handler {
+	if opts.DialTimeout <= 0 {
+		opts.DialTimeout = DefaultTunnelDialTimeout
+	}
+	if opts.IdleTimeout <= 0 {
+		opts.IdleTimeout = DefaultTunnelIdleTimeout
+	}
+	if opts.Dial == nil {
+		var dialer net.Dialer
+		if !opts.AllowPrivate {
+			dialer.Control = refusePrivate
+		}
+		opts.Dial = dialer.DialContext
+	}
+
+	return func(w *response.Writer, req *request.Request) {
+		if req.RequestLine.Method != "CONNECT" {
+			w.WriteStatusLine(response.MethodNotAllowed)
+			h := headers.NewHeaders()
+			h.Set("Allow", "CONNECT")
+			h.Set("Content-Length", "0")
+			w.WriteHeaders(h)
+			return
+		}
+
+		host, port, err := req.RequestLine.Authority()
+		if err != nil {
+			writeStatus(w, response.BadRequest, "CONNECT needs a host:port target")
+			return
+		}
+		if !allowed(opts.Allow, host, port) {
+			writeStatus(w, response.Forbidden, "Destination not allowed")
+			return
+		}
+		if ip, err := netip.ParseAddr(host); err == nil && !opts.AllowPrivate && privateAddr(ip) {
+			writeStatus(w, response.Forbidden, "Destination not allowed")
+			return
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), opts.DialTimeout)
+		defer cancel()
+		upstream, err := opts.Dial(ctx, "tcp", net.JoinHostPort(host, port))
+		if errors.Is(err, errPrivateDestination) {
+			writeStatus(w, response.Forbidden, "Destination not allowed")
+			return
+		}
+		if err != nil {
+			log.Printf("Error connecting to %s: %v", req.RequestLine.RequestTarget, err)
+			if errors.Is(err, context.DeadlineExceeded) || isTimeout(err) {
+				writeStatus(w, response.GatewayTimeout, "Destination timed out")
+			} else {
+				writeStatus(w, response.BadGateway, "Destination unreachable")
+			}
+			return
+		}
+
+		// A custom Dial may have resolved the name itself
+		if tcp, ok := upstream.RemoteAddr().(*net.TCPAddr); ok && !opts.AllowPrivate && privateAddr(tcp.AddrPort().Addr()) {
+			upstream.Close()
+			writeStatus(w, response.Forbidden, "Destination not allowed")
+			return
+		}
+
+		// A 2xx to CONNECT has no body, the tunnel starts right after it
+		err = w.WriteStatusLine(response.OK)
+		if err == nil {
+			err = w.WriteHeaders(headers.NewHeaders())
+		}
+		if err != nil {
+			log.Printf("Error answering CONNECT: %v", err)
+			upstream.Close()
+			return
+		}
+
+		conn, buffered, err := w.Hijack()
+		if err != nil {
+			log.Printf("Error taking over connection: %v", err)
+			upstream.Close()
+			return
+		}
+
+		// Clients may start talking, e.g. a TLS ClientHello, without waiting
+		// for the 200
+		if len(buffered) > 0 {
+			if _, err := upstream.Write(buffered); err != nil {
+				log.Printf("Error writing to %s: %v", req.RequestLine.RequestTarget, err)
+				conn.Close()
+				upstream.Close()
+				return
+			}
+		}
+
+		go pipe(conn, upstream, opts.IdleTimeout)
+	}
+}
+
+// allowed matches host and port against the allow-list patterns
+func allowed(patterns []string, host, port string) bool {
+	host = strings.ToLower(host)
+	for _, pattern := range patterns {
+		if pattern == "*" {
+			return true
+		}
+
+		patternHost, patternPort, err := net.SplitHostPort(pattern)
+		if err != nil {
+			continue
+		}
+		if patternPort != "*" && patternPort != port {
+			continue
+		}
+
+		patternHost = strings.ToLower(patternHost)
+		switch {
+		case patternHost == "*", patternHost == host:
+			return true
+		case strings.HasPrefix(patternHost, "*.") && strings.HasSuffix(host, patternHost[1:]):
+			return true
+		}
+	}
+	return false
+}
+
+var errPrivateDestination = errors.New("destination is a private address")
+
+// refusePrivate is a net.Dialer Control that stops connections to private
+// addresses once host names are resolved
+func refusePrivate(network, address string, _ syscall.RawConn) error {
+	addrPort, err := netip.ParseAddrPort(address)
+	if err != nil || privateAddr(addrPort.Addr()) {
+		return errPrivateDestination
+	}
+	return nil
+}
+
+// privateAddr reports whether ip belongs to this host or its networks
+// rather than the internet
+func privateAddr(ip netip.Addr) bool {
+	ip = ip.Unmap()
+	return ip.IsLoopback() || ip.IsPrivate() || ip.IsUnspecified() ||
+		ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() || ip.IsInterfaceLocalMulticast() ||
+		sharedAddressSpace.Contains(ip)
+}
+
+// sharedAddressSpace is carrier-grade NAT space (RFC 6598), internal to
+// providers' networks
+var sharedAddressSpace = netip.MustParsePrefix("100.64.0.0/10")
+
+// pipe copies between a and b in both directions. When one side finishes
+// sending, the other is told with a half close and may still answer. Both
+// are closed when done, or when neither sent anything for idleTimeout.
+func pipe(a, b net.Conn, idleTimeout time.Duration) {
+	var lastActivity atomic.Int64
+	lastActivity.Store(time.Now().UnixNano())
+
+	var wg sync.WaitGroup
+	copyHalf := func(dst, src net.Conn) {
+		defer wg.Done()
+
+		buf := make([]byte, 32*1024)
+		for {
+			src.SetReadDeadline(time.Now().Add(idleTimeout))
+			n, err := src.Read(buf)
+			if n > 0 {
+				lastActivity.Store(time.Now().UnixNano())
+				if _, werr := dst.Write(buf[:n]); werr != nil {
+					break
+				}
+			}
+
+			// Only idle if the other direction has been quiet too
+			if isTimeout(err) && time.Since(time.Unix(0, lastActivity.Load())) < idleTimeout {
+				continue
+			}
+			if err != nil {
+				break
+			}
+		}
+
+		if tcp, ok := dst.(interface{ CloseWrite() error }); ok {
+			tcp.CloseWrite()
+		} else {
+			dst.Close()
+		}
+	}
+
+	wg.Add(2)
+	go copyHalf(a, b)
+	go copyHalf(b, a)
+	wg.Wait()
+
+	a.Close()
+	b.Close()
+}
+
+func isTimeout(err error) bool {
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
@@ -0,0 +1,193 @@
+package proxy
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/spaghetti-lover/go-http/pkg/server"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// startEcho starts a TCP server echoing everything back until the client
+// stops sending
+func startEcho(t *testing.T) string {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { listener.Close() })
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+	return listener.Addr().String()
+}
+
+// connect sends CONNECT target through the proxy and returns the connection
+// with the response head read
+func connect(t *testing.T, proxyAddr, target string) (net.Conn, *bufio.Reader, string) {
+	t.Helper()
+	conn, err := net.Dial("tcp", proxyAddr)
+	require.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	_, err = fmt.Fprintf(conn, "CONNECT %s HTTP/1.1\r\nHost: %s\r\n\r\n", target, target)
+	require.NoError(t, err)
+
+	r := bufio.NewReader(conn)
+	var head strings.Builder
+	for {
+		line, err := r.ReadString('\n')
+		require.NoError(t, err)
+		head.WriteString(line)
+		if line == "\r\n" {
+			return conn, r, head.String()
+		}
+	}
+}
+
+func startTunnel(t *testing.T, opts TunnelOptions) string {
+	t.Helper()
+	srv, err := server.Serve(0, Tunnel(opts))
+	require.NoError(t, err)
+	t.Cleanup(func() { srv.Close() })
+	return srv.Addr().String()
+}
+
+func TestTunnel(t *testing.T) {
+	echo := startEcho(t)
+	_, echoPort, _ := net.SplitHostPort(echo)
+	addr := startTunnel(t, TunnelOptions{Allow: []string{"127.0.0.1:" + echoPort}, AllowPrivate: true})
+
+	// Test: Bytes flow both ways once the tunnel is up
+	conn, r, head := connect(t, addr, echo)
+	assert.Equal(t, "HTTP/1.1 200 OK\r\n\r\n", head)
+	_, err := io.WriteString(conn, "ping")
+	require.NoError(t, err)
+	buf := make([]byte, 4)
+	_, err = io.ReadFull(r, buf)
+	require.NoError(t, err)
+	assert.Equal(t, "ping", string(buf))
+
+	// Test: A half close reaches the destination, which closes in turn
+	_, err = io.WriteString(conn, "last words")
+	require.NoError(t, err)
+	require.NoError(t, conn.(*net.TCPConn).CloseWrite())
+	rest, err := io.ReadAll(r)
+	require.NoError(t, err)
+	assert.Equal(t, "last words", string(rest))
+
+	// Test: Destination not on the allow-list
+	_, _, head = connect(t, addr, "127.0.0.1:1")
+	assert.True(t, strings.HasPrefix(head, "HTTP/1.1 403 Forbidden\r\n"), head)
+
+	// Test: Other methods
+	conn, err = net.Dial("tcp", addr)
+	require.NoError(t, err)
+	defer conn.Close()
+	_, err = io.WriteString(conn, "GET / HTTP/1.1\r\nHost: localhost\r\n\r\n")
+	require.NoError(t, err)
+	line, err := bufio.NewReader(conn).ReadString('\n')
+	require.NoError(t, err)
+	assert.Equal(t, "HTTP/1.1 405 Method Not Allowed\r\n", line)
+}
+
+func TestTunnelFailures(t *testing.T) {
+	// Test: Unreachable destination
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	closed := listener.Addr().String()
+	listener.Close()
+	addr := startTunnel(t, TunnelOptions{Allow: []string{"*"}, AllowPrivate: true})
+	_, _, head := connect(t, addr, closed)
+	assert.True(t, strings.HasPrefix(head, "HTTP/1.1 502 Bad Gateway\r\n"), head)
+
+	// Test: Idle tunnels are closed
+	addr = startTunnel(t, TunnelOptions{Allow: []string{"*"}, AllowPrivate: true, IdleTimeout: 100 * time.Millisecond})
+	_, r, head := connect(t, addr, startEcho(t))
+	assert.Equal(t, "HTTP/1.1 200 OK\r\n\r\n", head)
+	start := time.Now()
+	_, err = r.ReadByte()
+	require.ErrorIs(t, err, io.EOF)
+	assert.Less(t, time.Since(start), 2*time.Second)
+}
+
+func TestTunnelPrivate(t *testing.T) {
+	var dialed atomic.Int32
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			dialed.Add(1)
+			conn.Close()
+		}
+	}()
+	_, port, _ := net.SplitHostPort(listener.Addr().String())
+
+	// Test: Loopback and private destinations are refused even when allowed,
+	// by address or by a name resolving to one, without connecting
+	addr := startTunnel(t, TunnelOptions{Allow: []string{"*"}})
+	for _, target := range []string{"127.0.0.1:" + port, "localhost:" + port, "[::1]:" + port, "10.0.0.1:443", "169.254.169.254:80"} {
+		_, _, head := connect(t, addr, target)
+		assert.True(t, strings.HasPrefix(head, "HTTP/1.1 403 Forbidden\r\n"), target+": "+head)
+	}
+	assert.Zero(t, dialed.Load())
+
+	// Test: So are connections a custom Dial makes to one
+	addr = startTunnel(t, TunnelOptions{
+		Allow: []string{"*"},
+		Dial: func(ctx context.Context, network, _ string) (net.Conn, error) {
+			return net.Dial(network, listener.Addr().String())
+		},
+	})
+	_, _, head := connect(t, addr, "example.com:443")
+	assert.True(t, strings.HasPrefix(head, "HTTP/1.1 403 Forbidden\r\n"), head)
+
+	assert.True(t, privateAddr(netip.MustParseAddr("::ffff:192.168.1.1")))
+	assert.True(t, privateAddr(netip.MustParseAddr("100.64.0.1")))
+	assert.False(t, privateAddr(netip.MustParseAddr("93.184.216.34")))
+}
+
+func TestTunnelAllowed(t *testing.T) {
+	patterns := []string{"example.com:443", "*.internal:*", "*:8443"}
+	for _, tc := range []struct {
+		host, port string
+		want       bool
+	}{
+		{"example.com", "443", true},
+		{"EXAMPLE.com", "443", true},
+		{"example.com", "80", false},
+		{"api.example.com", "443", false},
+		{"db.internal", "5432", true},
+		{"internal", "5432", false},
+		{"anything.org", "8443", true},
+		{"anything.org", "443", false},
+	} {
+		assert.Equal(t, tc.want, allowed(patterns, tc.host, tc.port), tc.host+":"+tc.port)
+	}
+	assert.True(t, allowed([]string{"*"}, "x", "1"))
+	assert.False(t, allowed(nil, "x", "1"))
+}
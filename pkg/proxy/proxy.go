@@ -0,0 +1,382 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/spaghetti-lover/go-http/pkg/client"
+	"github.com/spaghetti-lover/go-http/pkg/headers"
+	"github.com/spaghetti-lover/go-http/pkg/request"
+	"github.com/spaghetti-lover/go-http/pkg/response"
+)
+
+// hopByHop are the fields that describe a single connection rather than the
+// message (RFC 9110 §7.6.1), they're never forwarded
+var hopByHop = []string{
+	"Connection",
+	"Proxy-Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"TE",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+// Rewrite replaces a leading Prefix of the request path with Replace
+type Rewrite struct {
+	Prefix  string
+	Replace string
+}
+
+type Options struct {
+	// Rewrites are tried in order, the first one whose Prefix matches the
+	// request path is applied
+	Rewrites []Rewrite
+
+	// Timeout bounds the wait for the upstream's response headers, the
+	// client gets 504 Gateway Timeout past it. 0 means no timeout.
+	Timeout time.Duration
+
+	// Transport sends upstream requests, nil means client.DefaultTransport
+	Transport *client.Transport
+
+	// Strategy picks among several upstreams, RoundRobin by default
+	Strategy Strategy
+
+	// HashHeader names the request field ConsistentHash uses as key, the
+	// client IP is used when it's empty or missing from the request
+	HashHeader string
+
+	// MaxFails consecutive requests getting no answer eject an upstream for
+	// FailTimeout. 0 means DefaultMaxFails and DefaultFailTimeout.
+	MaxFails    int
+	FailTimeout time.Duration
+
+	// HealthCheck enables active health checks when its Path is set
+	HealthCheck HealthCheck
+}
+
+// Proxy forwards requests to upstream servers and streams their responses
+// back. Request bodies are read whole before the upstream request is sent.
+type Proxy struct {
+	upstreams []*upstream
+	opts      Options
+
+	// next rotates RoundRobin and LeastConnections, ring serves ConsistentHash
+	next atomic.Uint64
+	ring []ringPoint
+
+	stopChecks chan struct{}
+	checksDone chan struct{}
+	closeOnce  sync.Once
+}
+
+// New returns a reverse proxy for an http or https upstream URL. A path on
+// upstream is prepended to the forwarded (and rewritten) request path.
+func New(upstream string, opts Options) (*Proxy, error) {
+	return NewBalanced([]string{upstream}, opts)
+}
+
+// NewBalanced returns a reverse proxy spreading requests over upstreams with
+// opts.Strategy. Unhealthy upstreams are skipped, and requests get
+// 503 Service Unavailable when none is left. Close stops health checks.
+func NewBalanced(upstreams []string, opts Options) (*Proxy, error) {
+	if len(upstreams) == 0 {
+		return nil, fmt.Errorf("no upstreams")
+	}
+
+	p := &Proxy{opts: opts}
+	for _, raw := range upstreams {
+		u, err := url.Parse(raw)
+		if err != nil {
+			return nil, err
+		}
+		if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return nil, fmt.Errorf("%w: %q", client.ErrUnsupportedScheme, raw)
+		}
+		p.upstreams = append(p.upstreams, &upstream{url: u})
+	}
+
+	if opts.Strategy == ConsistentHash {
+		p.ring = buildRing(p.upstreams)
+	}
+
+	if opts.HealthCheck.Path != "" {
+		p.stopChecks = make(chan struct{})
+		p.checksDone = make(chan struct{})
+		go p.healthChecks()
+	}
+
+	return p, nil
+}
+
+func (p *Proxy) transport() *client.Transport {
+	if p.opts.Transport == nil {
+		return client.DefaultTransport
+	}
+	return p.opts.Transport
+}
+
+// Handle forwards req upstream and streams the response back chunked.
+// Upstream errors are answered with 502 Bad Gateway, timeouts with
+// 504 Gateway Timeout.
+func (p *Proxy) Handle(w *response.Writer, req *request.Request) {
+	u := p.pick(req)
+	if u == nil {
+		writeStatus(w, response.ServiceUnavailable, "No healthy upstream")
+		return
+	}
+	u.active.Add(1)
+	defer u.active.Add(-1)
+
+	// A client waiting on 100 Continue only sends its body now
+	if _, err := req.ReadBody(); err != nil {
+		if errors.Is(err, request.ErrContentTooLarge) {
+			writeStatus(w, response.ContentTooLarge, "Request body too large")
+		} else {
+			writeStatus(w, response.BadRequest, "Unreadable request body")
+		}
+		return
+	}
+
+	out, err := p.outgoing(req, u.url)
+	if err != nil {
+		log.Printf("Error building upstream request: %v", err)
+		writeStatus(w, response.BadRequest, "Invalid request target")
+		return
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// The timeout covers the response headers, a long body is fine
+	var timedOut atomic.Bool
+	var timer *time.Timer
+	if p.opts.Timeout > 0 {
+		timer = time.AfterFunc(p.opts.Timeout, func() {
+			timedOut.Store(true)
+			cancel()
+		})
+	}
+
+	resp, body, err := p.transport().Open(ctx, out)
+	if timer != nil && !timer.Stop() && err == nil {
+		body.Close()
+		err = context.DeadlineExceeded
+	}
+	if err != nil {
+		p.failed(u)
+		log.Printf("Error proxying to %s: %v", out.RequestLine.RequestTarget, err)
+		if timedOut.Load() {
+			writeStatus(w, response.GatewayTimeout, "Upstream timed out")
+		} else {
+			writeStatus(w, response.BadGateway, "Upstream unavailable")
+		}
+		return
+	}
+	defer body.Close()
+	p.succeeded(u)
+
+	p.writeResponse(w, req, resp, body)
+}
+
+// outgoing builds the upstream request: rewritten absolute target, fields
+// minus hop-by-hop ones, X-Forwarded-* / Forwarded describing the client and
+// the request's trailers
+func (p *Proxy) outgoing(req *request.Request, upstream *url.URL) (*request.Request, error) {
+	target, err := url.Parse(req.RequestLine.RequestTarget)
+	if err != nil {
+		return nil, err
+	}
+
+	// Rewritten escaped, so an encoded slash or the like reaches upstream as sent
+	path := target.EscapedPath()
+	for _, rw := range p.opts.Rewrites {
+		if strings.HasPrefix(path, rw.Prefix) {
+			path = rw.Replace + strings.TrimPrefix(path, rw.Prefix)
+			break
+		}
+	}
+	if !strings.HasPrefix(path, "/") {
+		path = "/" + path
+	}
+
+	u := *upstream
+	u.RawPath = strings.TrimSuffix(upstream.EscapedPath(), "/") + path
+	u.Path, err = url.PathUnescape(u.RawPath)
+	if err != nil {
+		return nil, err
+	}
+	u.RawQuery = target.RawQuery
+
+	h := req.Headers.Clone()
+	removeHopByHop(h)
+
+	host := req.Headers.Get("Host")
+	h.Override("Host", upstream.Host)
+
+	var forwarded []string
+	if ip := peerIP(req); ip != "" {
+		h.Set("X-Forwarded-For", ip)
+		forwarded = append(forwarded, "for="+forwardedNode(ip))
+	}
+	if host != "" {
+		h.Override("X-Forwarded-Host", host)
+		forwarded = append(forwarded, "host="+strconv.Quote(host))
+	}
+	proto := "http"
+	if req.Conn.TLS != nil {
+		proto = "https"
+	}
+	h.Override("X-Forwarded-Proto", proto)
+	forwarded = append(forwarded, "proto="+proto)
+	h.Set("Forwarded", strings.Join(forwarded, ";"))
+
+	// Handle has read the body whole, trailers included; the latter only
+	// fit a chunked body, so one with trailers goes out chunked
+	var trailers *headers.Headers
+	if req.Trailers != nil && len(req.Trailers.Names()) > 0 {
+		trailers = req.Trailers.Clone()
+		removeHopByHop(trailers)
+		h.Del("Content-Length")
+		h.Override("Transfer-Encoding", "chunked")
+		h.Override("Trailer", strings.Join(trailers.Names(), ", "))
+	}
+
+	return &request.Request{
+		RequestLine: request.Line{
+			Method:        req.RequestLine.Method,
+			RequestTarget: u.String(),
+			HttpVersion:   "1.1",
+		},
+		Headers:  h,
+		Body:     req.Body,
+		Trailers: trailers,
+	}, nil
+}
+
+// writeResponse copies the upstream status and fields and streams the body
+// as chunks, forwarding upstream trailers
+func (p *Proxy) writeResponse(w *response.Writer, req *request.Request, resp *client.Response, body io.Reader) {
+	err := w.WriteStatusLine(resp.StatusCode)
+	if err != nil {
+		log.Printf("Error writing status line: %v", err)
+		return
+	}
+
+	h := resp.Headers.Clone()
+	trailer := h.Get("Trailer")
+	removeHopByHop(h)
+
+	streamed := req.RequestLine.Method != "HEAD" && hasBody(resp.StatusCode)
+	if streamed {
+		h.Del("Content-Length")
+		h.Override("Transfer-Encoding", "chunked")
+		if trailer != "" {
+			h.Override("Trailer", trailer)
+		}
+	}
+
+	err = w.WriteHeaders(h)
+	if err != nil {
+		log.Printf("Error writing headers: %v", err)
+		return
+	}
+	if !streamed {
+		return
+	}
+
+	// Headers are out, a failure from here on can only cut the body short
+	_, err = io.Copy(w, body)
+	if err != nil {
+		log.Printf("Error streaming upstream body: %v", err)
+		return
+	}
+
+	if resp.Trailers == nil || len(resp.Trailers.Names()) == 0 {
+		return
+	}
+
+	_, err = w.WriteLastChunk()
+	if err != nil {
+		log.Printf("Error writing final chunk: %v", err)
+		return
+	}
+	err = w.WriteTrailers(resp.Trailers)
+	if err != nil {
+		log.Printf("Error writing trailers: %v", err)
+	}
+}
+
+// removeHopByHop deletes the hop-by-hop fields and any field named in
+// Connection
+func removeHopByHop(h *headers.Headers) {
+	for _, name := range strings.Split(h.Get("Connection"), ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			h.Del(name)
+		}
+	}
+	for _, name := range hopByHop {
+		h.Del(name)
+	}
+}
+
+// peerIP is the IP of whoever the request came from, the last proxy in
+// front of this one if any, or "" when the server didn't say
+func peerIP(req *request.Request) string {
+	if req.Conn.RemoteAddr == nil {
+		return ""
+	}
+	ip, _, err := net.SplitHostPort(req.Conn.RemoteAddr.String())
+	if err != nil {
+		return ""
+	}
+	return ip
+}
+
+// forwardedNode formats an address for Forwarded, IPv6 needs brackets and
+// quotes (RFC 7239 §6)
+func forwardedNode(ip string) string {
+	if strings.Contains(ip, ":") {
+		return `"[` + ip + `]"`
+	}
+	return ip
+}
+
+func hasBody(statusCode response.StatusCode) bool {
+	return statusCode[0] != '1' && statusCode != "204" && statusCode != response.NotModified
+}
+
+func writeStatus(w *response.Writer, statusCode response.StatusCode, message string) {
+	err := w.WriteStatusLine(statusCode)
+	if err != nil {
+		log.Printf("Error writing status line: %v", err)
+		return
+	}
+
+	h := headers.NewHeaders()
+	h.Set("Content-Length", strconv.Itoa(len(message)))
+	h.Set("Content-Type", "text/plain")
+	err = w.WriteHeaders(h)
+	if err != nil {
+		log.Printf("Error writing headers: %v", err)
+		return
+	}
+
+	_, err = w.WriteBody([]byte(message))
+	if err != nil {
+		log.Printf("Error writing body: %v", err)
+	}
+}
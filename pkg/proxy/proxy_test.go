@@ -0,0 +1,222 @@
+package proxy
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/spaghetti-lover/go-http/pkg/client"
+	"github.com/spaghetti-lover/go-http/pkg/headers"
+	"github.com/spaghetti-lover/go-http/pkg/request"
+	"github.com/spaghetti-lover/go-http/pkg/response"
+	"github.com/spaghetti-lover/go-http/pkg/server"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// upstreamHandler describes the request it got in its response fields
+func upstreamHandler(w *response.Writer, req *request.Request) {
+	switch req.RequestLine.RequestTarget {
+	case "/chunked":
+		w.WriteStatusLine(response.OK)
+		h := headers.NewHeaders()
+		h.Set("Transfer-Encoding", "chunked")
+		h.Set("Trailer", "X-Count")
+		w.WriteHeaders(h)
+		w.WriteChunkedBody([]byte("hello "))
+		w.WriteChunkedBody([]byte("world"))
+		w.WriteLastChunk()
+		trailers := headers.NewHeaders()
+		trailers.Set("X-Count", "2")
+		w.WriteTrailers(trailers)
+		return
+	case "/slow":
+		time.Sleep(300 * time.Millisecond)
+	}
+
+	body := req.RequestLine.Method + " " + req.RequestLine.RequestTarget + " " + string(req.Body)
+	w.WriteStatusLine(response.OK)
+	h := headers.NewHeaders()
+	h.Set("Content-Length", strconv.Itoa(len(body)))
+	h.Set("Keep-Alive", "timeout=5")
+	h.Set("X-Upstream", "yes")
+	for _, name := range []string{"Host", "X-Forwarded-For", "X-Forwarded-Host", "X-Forwarded-Proto", "Forwarded", "X-Custom", "X-Secret", "Keep-Alive", "Trailer"} {
+		h.Set("Got-"+name, req.Headers.Get(name))
+	}
+	if req.Trailers != nil {
+		h.Set("Got-X-Checksum", req.Trailers.Get("X-Checksum"))
+	}
+	w.WriteHeaders(h)
+	if req.RequestLine.Method != "HEAD" {
+		w.WriteBody([]byte(body))
+	}
+}
+
+func serve(t *testing.T, handler server.Handler) string {
+	t.Helper()
+	srv, err := server.Serve(0, handler)
+	require.NoError(t, err)
+	t.Cleanup(func() { srv.Close() })
+	return fmt.Sprintf("http://%s", srv.Addr())
+}
+
+// front starts a server proxying to upstream
+func front(t *testing.T, upstream string, opts Options) string {
+	t.Helper()
+	p, err := New(upstream, opts)
+	require.NoError(t, err)
+	return serve(t, p.Handle)
+}
+
+func TestProxy(t *testing.T) {
+	upstream := serve(t, upstreamHandler)
+	base := front(t, upstream+"/api", Options{
+		Rewrites: []Rewrite{{Prefix: "/up", Replace: ""}, {Prefix: "/old", Replace: "/new"}},
+	})
+	ctx := context.Background()
+
+	// Test: Method, target, fields and body are forwarded
+	req, err := client.NewRequest("POST", base+"/up/items?x=1", []byte("payload"))
+	require.NoError(t, err)
+	req.Headers.Set("X-Custom", "kept")
+	req.Headers.Set("Connection", "X-Secret")
+	req.Headers.Set("X-Secret", "dropped")
+	req.Headers.Set("Keep-Alive", "timeout=5")
+	resp, err := client.DefaultClient.Do(ctx, req)
+	require.NoError(t, err)
+	assert.Equal(t, response.OK, resp.StatusCode)
+	assert.Equal(t, "POST /api/items?x=1 payload", string(resp.Body))
+	assert.Equal(t, upstream[len("http://"):], resp.Headers.Get("Got-Host"))
+	assert.Equal(t, "kept", resp.Headers.Get("Got-X-Custom"))
+	assert.Equal(t, "", resp.Headers.Get("Got-X-Secret"))
+	assert.Equal(t, "", resp.Headers.Get("Got-Keep-Alive"))
+
+	// Test: Forwarding fields describe the client
+	frontHost := base[len("http://"):]
+	clientIP := resp.Headers.Get("Got-X-Forwarded-For")
+	require.NotNil(t, net.ParseIP(clientIP), clientIP)
+	assert.Equal(t, frontHost, resp.Headers.Get("Got-X-Forwarded-Host"))
+	assert.Equal(t, "http", resp.Headers.Get("Got-X-Forwarded-Proto"))
+	assert.Equal(t, "for="+forwardedNode(clientIP)+`;host="`+frontHost+`";proto=http`, resp.Headers.Get("Got-Forwarded"))
+
+	// Test: The response is streamed back chunked, without hop-by-hop fields
+	assert.Equal(t, "chunked", resp.Headers.Get("Transfer-Encoding"))
+	assert.Equal(t, "", resp.Headers.Get("Content-Length"))
+	assert.Equal(t, "", resp.Headers.Get("Keep-Alive"))
+	assert.Equal(t, "yes", resp.Headers.Get("X-Upstream"))
+
+	// Test: Existing X-Forwarded-For is appended to
+	req, err = client.NewRequest("GET", base+"/old/path", nil)
+	require.NoError(t, err)
+	req.Headers.Set("X-Forwarded-For", "203.0.113.7")
+	resp, err = client.DefaultClient.Do(ctx, req)
+	require.NoError(t, err)
+	assert.Equal(t, "GET /api/new/path ", string(resp.Body))
+	assert.Equal(t, "203.0.113.7, "+clientIP, resp.Headers.Get("Got-X-Forwarded-For"))
+
+	// Test: Escapes in the path are kept, an encoded slash stays encoded
+	resp, err = client.Get(ctx, base+"/up/files/a%2Fb%20c?x=1")
+	require.NoError(t, err)
+	assert.Equal(t, "GET /api/files/a%2Fb%20c?x=1 ", string(resp.Body))
+
+	// Test: Bodies over many reads are forwarded whole, on kept-alive
+	// connections both ways
+	big := strings.Repeat("x", 50000)
+	for i := 0; i < 2; i++ {
+		req, err = client.NewRequest("POST", base+"/up/big", []byte(big))
+		require.NoError(t, err)
+		resp, err = client.DefaultClient.Do(ctx, req)
+		require.NoError(t, err)
+		assert.Equal(t, "POST /api/big "+big, string(resp.Body))
+	}
+
+	// Test: Request trailers are forwarded in a chunked body
+	req, err = client.NewRequest("POST", base+"/up/sum", []byte("data"))
+	require.NoError(t, err)
+	req.Headers.Set("Transfer-Encoding", "chunked")
+	req.Headers.Set("Trailer", "X-Checksum")
+	req.Trailers = headers.NewHeaders()
+	req.Trailers.Set("X-Checksum", "abc")
+	resp, err = client.DefaultClient.Do(ctx, req)
+	require.NoError(t, err)
+	assert.Equal(t, "POST /api/sum data", string(resp.Body))
+	assert.Equal(t, "X-Checksum", resp.Headers.Get("Got-Trailer"))
+	assert.Equal(t, "abc", resp.Headers.Get("Got-X-Checksum"))
+
+	// Test: Upstream trailers are forwarded
+	direct := front(t, upstream, Options{})
+	resp, err = client.Get(ctx, direct+"/chunked")
+	require.NoError(t, err)
+	assert.Equal(t, "hello world", string(resp.Body))
+	assert.Equal(t, "X-Count", resp.Headers.Get("Trailer"))
+	require.NotNil(t, resp.Trailers)
+	assert.Equal(t, "2", resp.Trailers.Get("X-Count"))
+
+	// Test: HEAD keeps the upstream Content-Length
+	req, err = client.NewRequest("HEAD", direct+"/", nil)
+	require.NoError(t, err)
+	resp, err = client.DefaultClient.Do(ctx, req)
+	require.NoError(t, err)
+	assert.Equal(t, strconv.Itoa(len("HEAD / ")), resp.Headers.Get("Content-Length"))
+	assert.Empty(t, resp.Body)
+}
+
+func TestProxyForwardedProto(t *testing.T) {
+	p, err := New("http://upstream.internal", Options{})
+	require.NoError(t, err)
+	defer p.Close()
+
+	req := &request.Request{
+		RequestLine: request.Line{Method: "GET", RequestTarget: "/", HttpVersion: "1.1"},
+		Headers:     headers.NewHeaders(),
+		Conn:        request.ConnInfo{RemoteAddr: &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 1234}},
+	}
+	req.Headers.Set("Host", "example.com")
+
+	// Test: Plain connections are forwarded as http
+	out, err := p.outgoing(req, p.upstreams[0].url)
+	require.NoError(t, err)
+	assert.Equal(t, "http", out.Headers.Get("X-Forwarded-Proto"))
+	assert.Equal(t, `for=192.0.2.1;host="example.com";proto=http`, out.Headers.Get("Forwarded"))
+
+	// Test: TLS connections are forwarded as https
+	req.Conn.TLS = &tls.ConnectionState{}
+	out, err = p.outgoing(req, p.upstreams[0].url)
+	require.NoError(t, err)
+	assert.Equal(t, "https", out.Headers.Get("X-Forwarded-Proto"))
+	assert.Equal(t, `for=192.0.2.1;host="example.com";proto=https`, out.Headers.Get("Forwarded"))
+}
+
+func TestProxyErrors(t *testing.T) {
+	ctx := context.Background()
+
+	// Test: Unreachable upstream is a 502
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	closed := listener.Addr().String()
+	listener.Close()
+	base := front(t, "http://"+closed, Options{})
+	resp, err := client.Get(ctx, base+"/")
+	require.NoError(t, err)
+	assert.Equal(t, response.BadGateway, resp.StatusCode)
+
+	// Test: Slow upstream is a 504
+	base = front(t, serve(t, upstreamHandler), Options{Timeout: 50 * time.Millisecond})
+	resp, err = client.Get(ctx, base+"/slow")
+	require.NoError(t, err)
+	assert.Equal(t, response.GatewayTimeout, resp.StatusCode)
+
+	// Test: Fast enough
+	resp, err = client.Get(ctx, base+"/fast")
+	require.NoError(t, err)
+	assert.Equal(t, response.OK, resp.StatusCode)
+
+	// Test: Invalid upstream
+	_, err = New("ftp://example.com", Options{})
+	require.ErrorIs(t, err, client.ErrUnsupportedScheme)
+}
@@ -0,0 +1,320 @@
+package proxyproto
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"strconv"
+	"strings"
+
+	"github.com/spaghetti-lover/go-http/internal/netutil"
+)
+
+// Command says whether a header carries the client's addresses
+type Command byte
+
+const (
+	// Local is the proxy talking for itself, e.g. a health check. The
+	// connection's own addresses stand.
+	Local Command = 0x0
+	// Proxy relays a client connection
+	Proxy Command = 0x1
+)
+
+// TLV types from the version 2 specification (§2.2)
+const (
+	TypeALPN      byte = 0x01
+	TypeAuthority byte = 0x02
+	TypeCRC32C    byte = 0x03
+	TypeNoop      byte = 0x04
+	TypeUniqueID  byte = 0x05
+	TypeSSL       byte = 0x20
+	TypeNetNS     byte = 0x30
+)
+
+// TLV is a version 2 type-length-value extension. Values are kept raw,
+// TypeSSL's sub-TLVs included.
+type TLV struct {
+	Type  byte
+	Value []byte
+}
+
+// Header is a PROXY protocol header, sent by a load balancer ahead of the
+// client's bytes
+type Header struct {
+	// Version is 1 for the text format or 2 for the binary one
+	Version int
+	Command Command
+	// Source and Destination are the client's address and the one it
+	// connected to, nil when the proxy didn't say (UNKNOWN, Local or an
+	// unspecified family)
+	Source      net.Addr
+	Destination net.Addr
+	// TLVs are version 2 extensions, in the order sent
+	TLVs []TLV
+}
+
+// TLV returns the value of the first extension of type typ
+func (h *Header) TLV(typ byte) ([]byte, bool) {
+	for _, tlv := range h.TLVs {
+		if tlv.Type == typ {
+			return tlv.Value, true
+		}
+	}
+	return nil, false
+}
+
+var ErrNoHeader = fmt.Errorf("proxyproto: no PROXY protocol header")
+var ErrMalformed = fmt.Errorf("proxyproto: malformed header")
+var ErrUnsupported = fmt.Errorf("proxyproto: unsupported header")
+
+// signature starts every version 2 header
+var signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// maxV1Length is the longest a version 1 header can be, CRLF included
+const maxV1Length = 107
+
+// Read reads a version 1 or 2 header from r. It reads no further than the
+// header, so r can be the connection itself and whatever follows is left
+// for the protocol on top.
+func Read(r io.Reader) (*Header, error) {
+	// Both formats are recognised by their first bytes, and no header is
+	// shorter than the version 2 signature
+	start := make([]byte, len(signature))
+	if _, err := io.ReadFull(r, start); err != nil {
+		return nil, err
+	}
+	switch {
+	case bytes.Equal(start, signature):
+		return readV2(r)
+	case bytes.HasPrefix(start, []byte("PROXY ")):
+		return readV1(r, start)
+	}
+	return nil, ErrNoHeader
+}
+
+// readRest fills b with more of a header that has started
+func readRest(r io.Reader, b []byte) error {
+	_, err := io.ReadFull(r, b)
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+// readV1 reads the rest of a text header, one byte at a time so nothing
+// past the CRLF is consumed
+func readV1(r io.Reader, line []byte) (*Header, error) {
+	b := make([]byte, 1)
+	for !bytes.HasSuffix(line, []byte("\r\n")) {
+		if len(line) == maxV1Length {
+			return nil, fmt.Errorf("%w: line too long", ErrMalformed)
+		}
+		if err := readRest(r, b); err != nil {
+			return nil, err
+		}
+		line = append(line, b[0])
+	}
+	return parseV1(string(line[:len(line)-2]))
+}
+
+// parseV1 parses "PROXY TCP4|TCP6 src dst sport dport" or "PROXY UNKNOWN ..."
+func parseV1(line string) (*Header, error) {
+	fields := strings.Split(line, " ")
+	h := &Header{Version: 1, Command: Proxy}
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		// Whatever follows is to be ignored
+		return h, nil
+	}
+	if len(fields) != 6 {
+		return nil, fmt.Errorf("%w: %q", ErrMalformed, line)
+	}
+
+	var is4 bool
+	switch fields[1] {
+	case "TCP4":
+		is4 = true
+	case "TCP6":
+	default:
+		return nil, fmt.Errorf("%w: protocol %q", ErrMalformed, fields[1])
+	}
+
+	var addrs [2]*net.TCPAddr
+	for i := range addrs {
+		ip, err := netip.ParseAddr(fields[2+i])
+		if err != nil || ip.Is4() != is4 || ip.Zone() != "" {
+			return nil, fmt.Errorf("%w: address %q", ErrMalformed, fields[2+i])
+		}
+		port, err := parsePort(fields[4+i])
+		if err != nil {
+			return nil, err
+		}
+		addrs[i] = net.TCPAddrFromAddrPort(netip.AddrPortFrom(ip, port))
+	}
+	h.Source, h.Destination = addrs[0], addrs[1]
+	return h, nil
+}
+
+// parsePort parses a decimal port without leading zeros
+func parsePort(s string) (uint16, error) {
+	n, err := strconv.ParseUint(s, 10, 16)
+	if err != nil || len(s) > 1 && s[0] == '0' {
+		return 0, fmt.Errorf("%w: port %q", ErrMalformed, s)
+	}
+	return uint16(n), nil
+}
+
+// Version 2 address families and transports, the high and low nibbles of
+// the byte after the command
+const (
+	familyUnspec = 0x0
+	familyInet   = 0x1
+	familyInet6  = 0x2
+	familyUnix   = 0x3
+
+	transportUnspec = 0x0
+	transportStream = 0x1
+)
+
+// readV2 reads the rest of a binary header: command, family, length, then
+// the addresses and TLVs
+func readV2(r io.Reader) (*Header, error) {
+	fixed := make([]byte, 4)
+	if err := readRest(r, fixed); err != nil {
+		return nil, err
+	}
+	if fixed[0]>>4 != 2 {
+		return nil, fmt.Errorf("%w: version %d", ErrUnsupported, fixed[0]>>4)
+	}
+	h := &Header{Version: 2, Command: Command(fixed[0] & 0xf)}
+	if h.Command != Local && h.Command != Proxy {
+		return nil, fmt.Errorf("%w: command %#x", ErrUnsupported, byte(h.Command))
+	}
+
+	rest := make([]byte, binary.BigEndian.Uint16(fixed[2:]))
+	if err := readRest(r, rest); err != nil {
+		return nil, err
+	}
+
+	family, transport := fixed[1]>>4, fixed[1]&0xf
+	addrLen := 0
+	switch family {
+	case familyUnspec:
+	case familyInet:
+		addrLen = 12
+	case familyInet6:
+		addrLen = 36
+	case familyUnix:
+		addrLen = 216
+	default:
+		return nil, fmt.Errorf("%w: address family %#x", ErrUnsupported, family)
+	}
+	if len(rest) < addrLen {
+		return nil, fmt.Errorf("%w: %d bytes of addresses", ErrMalformed, len(rest))
+	}
+	addrs, tlvs := rest[:addrLen], rest[addrLen:]
+
+	// Local headers may still carry addresses, they aren't the client's
+	if h.Command == Proxy && family != familyUnspec {
+		if transport != transportStream {
+			return nil, fmt.Errorf("%w: transport %#x", ErrUnsupported, transport)
+		}
+		h.Source, h.Destination = parseV2Addrs(family, addrs)
+	} else if transport != transportUnspec && transport != transportStream {
+		return nil, fmt.Errorf("%w: transport %#x", ErrUnsupported, transport)
+	}
+
+	for len(tlvs) > 0 {
+		if len(tlvs) < 3 {
+			return nil, fmt.Errorf("%w: truncated TLV", ErrMalformed)
+		}
+		n := int(binary.BigEndian.Uint16(tlvs[1:3]))
+		if len(tlvs) < 3+n {
+			return nil, fmt.Errorf("%w: truncated TLV", ErrMalformed)
+		}
+		h.TLVs = append(h.TLVs, TLV{Type: tlvs[0], Value: tlvs[3 : 3+n]})
+		tlvs = tlvs[3+n:]
+	}
+	return h, nil
+}
+
+// parseV2Addrs decodes the address block of an INET, INET6 or UNIX header
+func parseV2Addrs(family byte, b []byte) (net.Addr, net.Addr) {
+	switch family {
+	case familyInet, familyInet6:
+		size := 4
+		if family == familyInet6 {
+			size = 16
+		}
+		src, _ := netip.AddrFromSlice(b[:size])
+		dst, _ := netip.AddrFromSlice(b[size : 2*size])
+		ports := b[2*size:]
+		return net.TCPAddrFromAddrPort(netip.AddrPortFrom(src, binary.BigEndian.Uint16(ports))),
+			net.TCPAddrFromAddrPort(netip.AddrPortFrom(dst, binary.BigEndian.Uint16(ports[2:])))
+	default:
+		return &net.UnixAddr{Name: unixPath(b[:108]), Net: "unix"},
+			&net.UnixAddr{Name: unixPath(b[108:]), Net: "unix"}
+	}
+}
+
+// unixPath cuts a NUL padded socket path
+func unixPath(b []byte) string {
+	if i := bytes.IndexByte(b, 0); i >= 0 {
+		b = b[:i]
+	}
+	return string(b)
+}
+
+// Conn is a connection that began with a PROXY protocol header. Its
+// RemoteAddr and LocalAddr are the ones the header carried, when it did.
+type Conn struct {
+	net.Conn
+	Header *Header
+}
+
+// NewConn reads the header from conn and wraps it
+func NewConn(conn net.Conn) (*Conn, error) {
+	h, err := Read(conn)
+	if err != nil {
+		return nil, err
+	}
+	return &Conn{Conn: conn, Header: h}, nil
+}
+
+// RemoteAddr is the client's address, or the proxy's when the header has
+// none
+func (c *Conn) RemoteAddr() net.Addr {
+	if c.Header.Source != nil {
+		return c.Header.Source
+	}
+	return c.Conn.RemoteAddr()
+}
+
+// LocalAddr is the address the client connected to, or the one the proxy
+// connected to when the header has none
+func (c *Conn) LocalAddr() net.Addr {
+	if c.Header.Destination != nil {
+		return c.Header.Destination
+	}
+	return c.Conn.LocalAddr()
+}
+
+// ProxyAddr is the address of the proxy that sent the header
+func (c *Conn) ProxyAddr() net.Addr {
+	return c.Conn.RemoteAddr()
+}
+
+// ReadFrom hands r to the connection from the proxy: the header only
+// concerns reads, so files can still go out with sendfile
+func (c *Conn) ReadFrom(r io.Reader) (int64, error) {
+	return netutil.ReadFrom(c.Conn, r)
+}
+
+// CloseWrite half-closes the connection from the proxy, or closes it when it
+// can't be half-closed
+func (c *Conn) CloseWrite() error {
+	return netutil.CloseWrite(c.Conn)
+}
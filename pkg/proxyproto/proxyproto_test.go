@@ -0,0 +1,154 @@
+package proxyproto
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// v2 builds a version 2 header from its command, family and body
+func v2(command, family byte, body []byte) []byte {
+	b := append([]byte{}, signature...)
+	b = append(b, 0x20|command, family, 0, 0)
+	binary.BigEndian.PutUint16(b[14:], uint16(len(body)))
+	return append(b, body...)
+}
+
+func TestReadV1(t *testing.T) {
+	// Test: Addresses and ports, and nothing read past the CRLF
+	r := strings.NewReader("PROXY TCP4 192.0.2.1 198.51.100.2 56324 443\r\nGET / HTTP/1.1\r\n")
+	h, err := Read(r)
+	require.NoError(t, err)
+	assert.Equal(t, 1, h.Version)
+	assert.Equal(t, Proxy, h.Command)
+	assert.Equal(t, "192.0.2.1:56324", h.Source.String())
+	assert.Equal(t, "198.51.100.2:443", h.Destination.String())
+	rest, _ := io.ReadAll(r)
+	assert.Equal(t, "GET / HTTP/1.1\r\n", string(rest))
+
+	h, err = Read(strings.NewReader("PROXY TCP6 2001:db8::1 2001:db8::2 1 80\r\n"))
+	require.NoError(t, err)
+	assert.Equal(t, "[2001:db8::1]:1", h.Source.String())
+
+	// Test: UNKNOWN leaves the addresses out and ignores the rest
+	h, err = Read(strings.NewReader("PROXY UNKNOWN ffff::1 ffff::2 1 2\r\n"))
+	require.NoError(t, err)
+	assert.Nil(t, h.Source)
+	assert.Nil(t, h.Destination)
+	h, err = Read(strings.NewReader("PROXY UNKNOWN\r\n"))
+	require.NoError(t, err)
+	assert.Nil(t, h.Source)
+
+	// Test: Malformed lines
+	for _, line := range []string{
+		"PROXY TCP4 192.0.2.1 198.51.100.2 56324\r\n",
+		"PROXY TCP4 2001:db8::1 198.51.100.2 1 2\r\n",
+		"PROXY TCP6 192.0.2.1 198.51.100.2 1 2\r\n",
+		"PROXY UDP4 192.0.2.1 198.51.100.2 1 2\r\n",
+		"PROXY TCP4 192.0.2.1 198.51.100.2 01 2\r\n",
+		"PROXY TCP4 192.0.2.1 198.51.100.2 1 65536\r\n",
+		"PROXY TCP4  192.0.2.1 198.51.100.2 1 2\r\n",
+		"PROXY TCP4 " + strings.Repeat("1", 100) + "\r\n",
+	} {
+		_, err := Read(strings.NewReader(line))
+		assert.ErrorIs(t, err, ErrMalformed, line)
+	}
+
+	// Test: Anything else isn't a header
+	_, err = Read(strings.NewReader("GET / HTTP/1.1\r\n\r\n"))
+	assert.ErrorIs(t, err, ErrNoHeader)
+	_, err = Read(strings.NewReader("PROXY TCP4 192.0.2.1"))
+	assert.ErrorIs(t, err, io.ErrUnexpectedEOF)
+}
+
+func TestReadV2(t *testing.T) {
+	// Test: IPv4 addresses and TLVs, and nothing read past the header
+	body := []byte{192, 0, 2, 1, 198, 51, 100, 2, 0xdc, 0x04, 0x01, 0xbb}
+	body = append(body, TypeALPN, 0, 2, 'h', '2')
+	body = append(body, TypeUniqueID, 0, 3, 'a', 'b', 'c')
+	r := bytes.NewReader(append(v2(0x1, 0x11, body), "GET"...))
+	h, err := Read(r)
+	require.NoError(t, err)
+	assert.Equal(t, 2, h.Version)
+	assert.Equal(t, Proxy, h.Command)
+	assert.Equal(t, "192.0.2.1:56324", h.Source.String())
+	assert.Equal(t, "198.51.100.2:443", h.Destination.String())
+	assert.Equal(t, []TLV{{TypeALPN, []byte("h2")}, {TypeUniqueID, []byte("abc")}}, h.TLVs)
+	id, ok := h.TLV(TypeUniqueID)
+	assert.True(t, ok)
+	assert.Equal(t, "abc", string(id))
+	_, ok = h.TLV(TypeAuthority)
+	assert.False(t, ok)
+	rest, _ := io.ReadAll(r)
+	assert.Equal(t, "GET", string(rest))
+
+	// Test: IPv6 and Unix addresses
+	body = make([]byte, 36)
+	body[15], body[31], body[33], body[35] = 1, 2, 80, 81
+	h, err = Read(bytes.NewReader(v2(0x1, 0x21, body)))
+	require.NoError(t, err)
+	assert.Equal(t, "[::1]:80", h.Source.String())
+	assert.Equal(t, "[::2]:81", h.Destination.String())
+
+	body = make([]byte, 216)
+	copy(body, "/run/client.sock")
+	copy(body[108:], "/run/http.sock")
+	h, err = Read(bytes.NewReader(v2(0x1, 0x31, body)))
+	require.NoError(t, err)
+	assert.Equal(t, "/run/client.sock", h.Source.String())
+	assert.Equal(t, "/run/http.sock", h.Destination.String())
+
+	// Test: LOCAL headers and unspecified families carry no client address
+	h, err = Read(bytes.NewReader(v2(0x0, 0x11, make([]byte, 12))))
+	require.NoError(t, err)
+	assert.Equal(t, Local, h.Command)
+	assert.Nil(t, h.Source)
+	h, err = Read(bytes.NewReader(v2(0x1, 0x00, nil)))
+	require.NoError(t, err)
+	assert.Nil(t, h.Source)
+
+	// Test: Malformed and unsupported headers
+	_, err = Read(bytes.NewReader(v2(0x1, 0x11, make([]byte, 8))))
+	assert.ErrorIs(t, err, ErrMalformed)
+	_, err = Read(bytes.NewReader(v2(0x1, 0x11, append(make([]byte, 12), TypeNoop, 0, 5, 0))))
+	assert.ErrorIs(t, err, ErrMalformed)
+	_, err = Read(bytes.NewReader(v2(0x1, 0x12, make([]byte, 12))))
+	assert.ErrorIs(t, err, ErrUnsupported)
+	_, err = Read(bytes.NewReader(v2(0x2, 0x11, make([]byte, 12))))
+	assert.ErrorIs(t, err, ErrUnsupported)
+	header := v2(0x1, 0x11, make([]byte, 12))
+	header[12] = 0x31
+	_, err = Read(bytes.NewReader(header))
+	assert.ErrorIs(t, err, ErrUnsupported)
+	_, err = Read(bytes.NewReader(v2(0x1, 0x11, make([]byte, 12))[:20]))
+	assert.ErrorIs(t, err, io.ErrUnexpectedEOF)
+}
+
+func TestConn(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	go io.WriteString(client, "PROXY TCP4 192.0.2.1 198.51.100.2 56324 443\r\nhello")
+
+	// Test: The header's addresses stand for the connection's
+	conn, err := NewConn(server)
+	require.NoError(t, err)
+	defer conn.Close()
+	assert.Equal(t, "192.0.2.1:56324", conn.RemoteAddr().String())
+	assert.Equal(t, "198.51.100.2:443", conn.LocalAddr().String())
+	assert.Equal(t, server.RemoteAddr(), conn.ProxyAddr())
+	buf := make([]byte, 5)
+	_, err = io.ReadFull(conn, buf)
+	require.NoError(t, err)
+	assert.Equal(t, "hello", string(buf))
+
+	// Test: Without addresses in the header the proxy's remain
+	conn = &Conn{Conn: server, Header: &Header{Version: 2, Command: Local}}
+	assert.Equal(t, server.RemoteAddr(), conn.RemoteAddr())
+	assert.Equal(t, server.LocalAddr(), conn.LocalAddr())
+}
@@ -0,0 +1,108 @@
+package request
+
+import (
+	"net/netip"
+	"strings"
+
+	"github.com/spaghetti-lover/go-http/pkg/headers"
+)
+
+// ForwardedHeader is the field trusted proxies record their hops in
+type ForwardedHeader int
+
+const (
+	// XForwardedFor is the de facto X-Forwarded-For, what most proxies append to
+	XForwardedFor ForwardedHeader = iota
+	// Forwarded is RFC 7239's Forwarded, its for= parameters
+	Forwarded
+)
+
+// ForwardedClientIP finds the client behind proxies in trusted. Starting
+// from remote, the address the request came from, each trusted hop is
+// replaced by the address it says it forwarded for, read right to left from
+// the header the proxies write. The other header is ignored: proxies pass it
+// through as the client sent it. The first address that isn't trusted is
+// the client. Where a hop's entry is missing, obfuscated or "unknown", the
+// hop itself is the answer. An invalid remote, as for a peer on a Unix
+// socket, is trusted too: the socket's permissions decide who can connect.
+func ForwardedClientIP(remote netip.Addr, h *headers.Headers, header ForwardedHeader, trusted []netip.Prefix) netip.Addr {
+	ip := remote.Unmap()
+	if len(trusted) == 0 {
+		return ip
+	}
+
+	var hops []string
+	switch header {
+	case Forwarded:
+		if forwarded := h.Get("Forwarded"); forwarded != "" {
+			for _, element := range splitQuoted(forwarded, ',') {
+				hops = append(hops, forwardedFor(element))
+			}
+		}
+	case XForwardedFor:
+		if xff := h.Get("X-Forwarded-For"); xff != "" {
+			hops = strings.Split(xff, ",")
+		}
+	}
+
+	for i := len(hops) - 1; i >= 0 && (!ip.IsValid() || isTrusted(ip, trusted)); i-- {
+		next, ok := parseNode(hops[i])
+		if !ok {
+			break
+		}
+		ip = next
+	}
+	return ip
+}
+
+func isTrusted(ip netip.Addr, trusted []netip.Prefix) bool {
+	for _, prefix := range trusted {
+		if prefix.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// forwardedFor returns the for= parameter of a Forwarded element
+func forwardedFor(element string) string {
+	for _, pair := range splitQuoted(element, ';') {
+		name, value, _ := strings.Cut(strings.TrimSpace(pair), "=")
+		if strings.EqualFold(name, "for") {
+			return value
+		}
+	}
+	return ""
+}
+
+// splitQuoted splits s at sep outside of quoted strings
+func splitQuoted(s string, sep byte) []string {
+	var parts []string
+	quoted, start := false, 0
+	for i := 0; i < len(s); i++ {
+		switch {
+		case s[i] == '"':
+			quoted = !quoted
+		case s[i] == '\\' && quoted:
+			i++
+		case s[i] == sep && !quoted:
+			parts = append(parts, s[start:i])
+			start = i + 1
+		}
+	}
+	return append(parts, s[start:])
+}
+
+// parseNode parses a node as X-Forwarded-For or Forwarded's for= have it:
+// an IP, possibly quoted, bracketed or with a port
+func parseNode(node string) (netip.Addr, bool) {
+	node = strings.Trim(strings.TrimSpace(node), `"`)
+	if ap, err := netip.ParseAddrPort(node); err == nil {
+		return ap.Addr().Unmap(), true
+	}
+	ip, err := netip.ParseAddr(strings.TrimSuffix(strings.TrimPrefix(node, "["), "]"))
+	if err != nil || ip.Zone() != "" {
+		return netip.Addr{}, false
+	}
+	return ip.Unmap(), true
+}
@@ -0,0 +1,74 @@
+package request
+
+import (
+	"net/netip"
+	"testing"
+
+	"github.com/spaghetti-lover/go-http/pkg/headers"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestForwardedClientIP(t *testing.T) {
+	trusted := []netip.Prefix{netip.MustParsePrefix("10.0.0.0/8"), netip.MustParsePrefix("2001:db8::/32")}
+	proxy := netip.MustParseAddr("10.0.0.1")
+	tests := []struct {
+		name    string
+		remote  netip.Addr
+		header  ForwardedHeader
+		headers map[string]string
+		want    string
+	}{
+		// Test: Nothing forwarded, the peer is the client
+		{"direct", netip.MustParseAddr("192.0.2.1"), XForwardedFor, nil, "192.0.2.1"},
+		{"untrusted peer", netip.MustParseAddr("192.0.2.1"), XForwardedFor, map[string]string{"X-Forwarded-For": "203.0.113.9"}, "192.0.2.1"},
+		{"mapped peer", netip.MustParseAddr("::ffff:192.0.2.1"), XForwardedFor, nil, "192.0.2.1"},
+
+		// Test: Trusted hops are walked right to left until one isn't
+		{"x-forwarded-for", proxy, XForwardedFor, map[string]string{"X-Forwarded-For": "203.0.113.9"}, "203.0.113.9"},
+		{"chain", proxy, XForwardedFor, map[string]string{"X-Forwarded-For": "198.51.100.7, 203.0.113.9, 10.1.2.3"}, "203.0.113.9"},
+		{"spoofed first entry", proxy, XForwardedFor, map[string]string{"X-Forwarded-For": "10.9.9.9, 192.0.2.5"}, "192.0.2.5"},
+		{"all trusted", proxy, XForwardedFor, map[string]string{"X-Forwarded-For": "10.1.1.1, 10.2.2.2"}, "10.1.1.1"},
+
+		// Test: Forwarded, with its quoting and ports
+		{"forwarded", proxy, Forwarded, map[string]string{
+			"Forwarded": `for=192.0.2.60;proto=http;by=203.0.113.43, for="[2001:db8:cafe::17]:4711"`,
+		}, "192.0.2.60"},
+		{"forwarded quoted comma", proxy, Forwarded, map[string]string{"Forwarded": `for=192.0.2.60;host="a,b", For=10.3.3.3`}, "192.0.2.60"},
+		{"forwarded port", proxy, Forwarded, map[string]string{"Forwarded": `for="192.0.2.60:8080"`}, "192.0.2.60"},
+
+		// Test: The header the proxies don't write is the client's own and
+		// ignored
+		{"spoofed forwarded", proxy, XForwardedFor, map[string]string{
+			"Forwarded":       "for=1.2.3.4",
+			"X-Forwarded-For": "198.51.100.1",
+		}, "198.51.100.1"},
+		{"spoofed forwarded alone", proxy, XForwardedFor, map[string]string{"Forwarded": "for=1.2.3.4"}, "10.0.0.1"},
+		{"spoofed x-forwarded-for", proxy, Forwarded, map[string]string{
+			"Forwarded":       "for=192.0.2.60",
+			"X-Forwarded-For": "1.2.3.4",
+		}, "192.0.2.60"},
+
+		// Test: An entry that can't be read stops at the hop that sent it
+		{"unknown", proxy, Forwarded, map[string]string{"Forwarded": "for=unknown"}, "10.0.0.1"},
+		{"obfuscated", proxy, Forwarded, map[string]string{"Forwarded": "for=192.0.2.1, for=_hidden"}, "10.0.0.1"},
+		{"no for", proxy, Forwarded, map[string]string{"Forwarded": "proto=https"}, "10.0.0.1"},
+		{"garbage", proxy, XForwardedFor, map[string]string{"X-Forwarded-For": "203.0.113.9, nonsense"}, "10.0.0.1"},
+
+		// Test: A Unix socket peer is trusted
+		{"unix socket", netip.Addr{}, XForwardedFor, map[string]string{"X-Forwarded-For": "203.0.113.9"}, "203.0.113.9"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := headers.NewHeaders()
+			for name, value := range tt.headers {
+				h.Set(name, value)
+			}
+			assert.Equal(t, tt.want, ForwardedClientIP(tt.remote, h, tt.header, trusted).String())
+		})
+	}
+
+	// Test: Without trusted proxies headers are ignored
+	h := headers.NewHeaders()
+	h.Set("X-Forwarded-For", "203.0.113.9")
+	assert.Equal(t, proxy, ForwardedClientIP(proxy, h, XForwardedFor, nil))
+}
@@ -2,10 +2,15 @@ package request
 
 import (
 	"bytes"
+	"crypto/tls"
+	"errors"
 	"fmt"
 	"io"
+	"net"
+	"net/netip"
 	"sort"
 	"strconv"
+	"strings"
 
 	"github.com/spaghetti-lover/go-http/pkg/headers"
 )
@@ -13,11 +18,20 @@ import (
 type parserState string
 
 const (
-	StateInit    parserState = "init"
-	StateHeaders parserState = "headers"
-	StateBody    parserState = "body"
-	StateDone    parserState = "done"
-	StateError   parserState = "error"
+	StateInit      parserState = "init"
+	StateHeaders   parserState = "headers"
+	StateBody      parserState = "body"
+	StateChunkSize parserState = "chunk-size"
+	StateChunkData parserState = "chunk-data"
+	StateChunkEnd  parserState = "chunk-end"
+	StateTrailers  parserState = "trailers"
+	StateDone      parserState = "done"
+	StateError     parserState = "error"
+)
+
+const (
+	initialBufferLen = 1024
+	maxLineSize      = 64 * 1024
 )
 
 type Line struct {
@@ -26,15 +40,70 @@ type Line struct {
 	Method        string
 }
 
+// ValidHTTP reports whether the version is one the parser accepts as a
+// request: HTTP/1.1, HTTP/1.0, or a version-less HTTP/0.9 simple request
 func (r *Line) ValidHTTP() bool {
-	return r.HttpVersion == "1.1"
+	return r.HttpVersion == "1.1" || r.HttpVersion == "1.0" || r.HttpVersion == "0.9"
+}
+
+// HTTP2Preface reports whether this is the start of the HTTP/2 connection
+// preface (RFC 9113 §3.4) rather than a request. The rest of the preface,
+// "SM\r\n\r\n", follows the empty header section.
+func (r *Line) HTTP2Preface() bool {
+	return r.Method == "PRI" && r.RequestTarget == "*" && r.HttpVersion == "2.0"
+}
+
+// Authority splits an authority-form target, the host:port CONNECT asks
+// for (RFC 9112 §3.2.3)
+func (r *Line) Authority() (host, port string, err error) {
+	host, port, err = net.SplitHostPort(r.RequestTarget)
+	if err != nil {
+		return "", "", err
+	}
+	if host == "" || port == "" || strings.Contains(r.RequestTarget, "/") {
+		return "", "", fmt.Errorf("not an authority-form target: %q", r.RequestTarget)
+	}
+	return host, port, nil
 }
 
 type Request struct {
 	RequestLine Line
 	Headers     *headers.Headers
-	Body        []byte
-	state       parserState
+	// Body is incomplete until ReadBody when the server deferred reading it,
+	// as it does for Expect: 100-continue
+	Body []byte
+	// Trailers holds the trailer section of a chunked body, nil otherwise
+	Trailers *headers.Headers
+	// Conn describes the connection the request arrived on, set by the server
+	Conn ConnInfo
+	// ClientIP is the client's IP, set by the server: the one in
+	// Conn.RemoteAddr or, behind trusted proxies, the one they forwarded
+	ClientIP       netip.Addr
+	state          parserState
+	chunkRemaining int
+	maxBodySize    int64
+	// readBody reads a deferred body, bodyErr is how that went
+	readBody func() error
+	bodyErr  error
+}
+
+// ConnInfo describes the connection a request arrived on
+type ConnInfo struct {
+	// ID tells the server's connections apart, counting from 1
+	ID uint64
+	// RemoteAddr and LocalAddr are the client's address and the one it
+	// connected to, as a PROXY protocol header gave them if there was one
+	RemoteAddr net.Addr
+	LocalAddr  net.Addr
+	// TLS is the handshake's outcome on a TLS connection, nil otherwise
+	TLS *tls.ConnectionState
+	// Requests is how many requests the connection has carried, this one
+	// included. On HTTP/2 each stream counts.
+	Requests int64
+	// Proxy is the PROXY protocol header the connection started with, nil
+	// when it had none. It's left to the transport that read it, see
+	// server.ProxyHeader.
+	Proxy any
 }
 
 func newRequest() *Request {
@@ -48,8 +117,13 @@ var ErrMalformedRequestLine = fmt.Errorf("malformed start line")
 var ErrUnsupportedHTTPVersion = fmt.Errorf("unsupported http version")
 var ErrorRequestInErrorState = fmt.Errorf("request in error state")
 var ErrBodyTooLarge = fmt.Errorf("body exceeds content-length")
+var ErrContentTooLarge = fmt.Errorf("body exceeds the size limit")
+var ErrMalformedChunk = fmt.Errorf("malformed chunk")
+var ErrLineTooLong = fmt.Errorf("line exceeds maximum length")
 var SEPARATOR = []byte("\r\n")
 
+const http2Preface = "PRI * HTTP/2.0"
+
 func parseRequestLine(b []byte) (*Line, int, error) {
 	idx := bytes.Index(b, SEPARATOR)
 	if idx == -1 {
@@ -60,24 +134,70 @@ func parseRequestLine(b []byte) (*Line, int, error) {
 	read := idx + len(SEPARATOR)
 
 	parts := bytes.Split(startLine, []byte(" "))
+
+	// An HTTP/0.9 simple request is a GET without a version, nor headers
+	if len(parts) == 2 {
+		if string(parts[0]) != "GET" || !bytes.HasPrefix(parts[1], []byte("/")) {
+			return nil, 0, ErrMalformedRequestLine
+		}
+		return &Line{Method: "GET", RequestTarget: string(parts[1]), HttpVersion: "0.9"}, read, nil
+	}
+
 	if len(parts) != 3 {
 		return nil, 0, ErrMalformedRequestLine
 	}
 
-	httpParts := bytes.Split(parts[2], []byte("/"))
-	if len(httpParts) != 2 || string(httpParts[0]) != "HTTP" || string(httpParts[1]) != "1.1" {
-		return nil, 0, ErrMalformedRequestLine
+	// The HTTP/2 connection preface starts out like a request line, the
+	// server decides whether to switch protocols
+	if string(startLine) == http2Preface {
+		return &Line{Method: "PRI", RequestTarget: "*", HttpVersion: "2.0"}, read, nil
+	}
+
+	version, err := parseVersion(parts[2])
+	if err != nil {
+		return nil, 0, err
 	}
 
 	rl := &Line{
 		Method:        string(parts[0]),
 		RequestTarget: string(parts[1]),
-		HttpVersion:   string(httpParts[1]),
+		HttpVersion:   version,
+	}
+
+	// CONNECT names a host and port, nothing else
+	if rl.Method == "CONNECT" {
+		if _, _, err := rl.Authority(); err != nil {
+			return nil, 0, ErrMalformedRequestLine
+		}
 	}
 
 	return rl, read, nil
 }
 
+// parseVersion reads HTTP-version (RFC 9112 §2.3). Later 1.x minor versions
+// are backwards compatible and read as 1.1, other major versions are well
+// formed but unsupported.
+func parseVersion(b []byte) (string, error) {
+	name, version, ok := bytes.Cut(b, []byte("/"))
+	if !ok || string(name) != "HTTP" || len(version) != 3 || version[1] != '.' ||
+		!isDigit(version[0]) || !isDigit(version[2]) {
+		return "", ErrMalformedRequestLine
+	}
+
+	switch {
+	case version[0] != '1':
+		return "", ErrUnsupportedHTTPVersion
+	case version[2] == '0':
+		return "1.0", nil
+	default:
+		return "1.1", nil
+	}
+}
+
+func isDigit(b byte) bool {
+	return b >= '0' && b <= '9'
+}
+
 func (r *Request) parseSingle(data []byte) (int, error) {
 	switch r.state {
 	case StateError:
@@ -94,6 +214,9 @@ func (r *Request) parseSingle(data []byte) (int, error) {
 
 		r.RequestLine = *rl
 		r.state = StateHeaders
+		if rl.HttpVersion == "0.9" {
+			r.state = StateDone
+		}
 		return n, nil
 
 	case StateHeaders:
@@ -109,6 +232,12 @@ func (r *Request) parseSingle(data []byte) (int, error) {
 		return n, nil
 
 	case StateBody:
+		// Chunked framing wins over Content-Length (RFC 9112 §6.3)
+		if isChunked(r.Headers) {
+			r.state = StateChunkSize
+			return 0, nil
+		}
+
 		contentLengthStr := r.Headers.Get("Content-Length")
 		if contentLengthStr == "" {
 			r.state = StateDone
@@ -119,22 +248,82 @@ func (r *Request) parseSingle(data []byte) (int, error) {
 		if err != nil {
 			return 0, fmt.Errorf("invalid content-length: %w", err)
 		}
-
-		// Append all available data to body
-		r.Body = append(r.Body, data...)
-
-		// Check if body exceeds content length
-		if len(r.Body) > contentLength {
-			return 0, ErrBodyTooLarge
+		if contentLength < 0 {
+			return 0, fmt.Errorf("invalid content-length: %d", contentLength)
+		}
+		if r.maxBodySize > 0 && int64(contentLength) > r.maxBodySize {
+			return 0, ErrContentTooLarge
 		}
 
+		// Take the body and no more, what follows belongs to the next request
+		n := min(contentLength-len(r.Body), len(data))
+		r.Body = append(r.Body, data[:n]...)
+
 		// Check if receiving all the body data
 		if len(r.Body) == contentLength {
 			r.state = StateDone
 		}
 
-		// Report that consuming all the data
-		return len(data), nil
+		return n, nil
+
+	case StateChunkSize:
+		idx := bytes.Index(data, SEPARATOR)
+		if idx == -1 {
+			return 0, nil
+		}
+
+		// Ignore chunk extensions
+		sizeStr, _, _ := strings.Cut(string(data[:idx]), ";")
+		size, err := strconv.ParseInt(strings.TrimSpace(sizeStr), 16, 32)
+		if err != nil || size < 0 {
+			return 0, ErrMalformedChunk
+		}
+
+		// A chunked body has no length up front, the limit applies as it grows
+		if r.maxBodySize > 0 && int64(len(r.Body))+size > r.maxBodySize {
+			return 0, ErrContentTooLarge
+		}
+
+		if size == 0 {
+			r.Trailers = headers.NewHeaders()
+			r.state = StateTrailers
+		} else {
+			r.chunkRemaining = int(size)
+			r.state = StateChunkData
+		}
+		return idx + len(SEPARATOR), nil
+
+	case StateChunkData:
+		n := min(r.chunkRemaining, len(data))
+		r.Body = append(r.Body, data[:n]...)
+		r.chunkRemaining -= n
+
+		if r.chunkRemaining == 0 {
+			r.state = StateChunkEnd
+		}
+		return n, nil
+
+	case StateChunkEnd:
+		if len(data) < len(SEPARATOR) {
+			return 0, nil
+		}
+		if !bytes.HasPrefix(data, SEPARATOR) {
+			return 0, ErrMalformedChunk
+		}
+
+		r.state = StateChunkSize
+		return len(SEPARATOR), nil
+
+	case StateTrailers:
+		n, done, err := r.Trailers.Parse(data)
+		if err != nil {
+			return 0, err
+		}
+
+		if done {
+			r.state = StateDone
+		}
+		return n, nil
 
 	case StateDone:
 		return 0, nil
@@ -143,16 +332,22 @@ func (r *Request) parseSingle(data []byte) (int, error) {
 	return 0, nil
 }
 
+func isChunked(h *headers.Headers) bool {
+	return strings.Contains(strings.ToLower(h.Get("Transfer-Encoding")), "chunked")
+}
+
 func (r *Request) parse(data []byte) (int, error) {
 	totalBytesParsed := 0
 
 	for r.state != StateDone {
+		prevState := r.state
 		n, err := r.parseSingle(data[totalBytesParsed:])
 		if err != nil {
 			return 0, err
 		}
 
-		if n == 0 {
+		// Switching the body framing consumes nothing but isn't a stall
+		if n == 0 && r.state == prevState {
 			break
 		}
 
@@ -199,32 +394,221 @@ func (r *Request) String() string {
 	return buf.String()
 }
 
+// Write serializes the request in HTTP/1.1 wire format: the request line
+// with the parsed method and target, header fields in their original order
+// and spelling, then the body. The version is always HTTP/1.1, whatever the
+// request arrived with, since the framing written is 1.1's. A chunked request
+// is sent as a single chunk followed by its trailers, anything else gets a
+// Content-Length matching Body. Repeated fields get a line per value.
+func (r *Request) Write(w io.Writer) error {
+	var buf bytes.Buffer
+
+	buf.WriteString(fmt.Sprintf("%s %s HTTP/1.1\r\n", r.RequestLine.Method, r.RequestLine.RequestTarget))
+
+	chunked := isChunked(r.Headers)
+	h := r.Headers.Clone()
+	if chunked {
+		h.Del("Content-Length")
+	} else if len(r.Body) > 0 || h.Get("Content-Length") != "" {
+		h.Override("Content-Length", strconv.Itoa(len(r.Body)))
+	}
+
+	writeFields(&buf, h)
+	buf.Write(SEPARATOR)
+
+	if chunked && len(r.Body) > 0 {
+		buf.WriteString(fmt.Sprintf("%X\r\n", len(r.Body)))
+	}
+
+	_, err := w.Write(buf.Bytes())
+	if err != nil {
+		return fmt.Errorf("error writing request head: %w", err)
+	}
+
+	// The body goes out as is rather than being copied into the buffer
+	if len(r.Body) > 0 {
+		_, err = w.Write(r.Body)
+		if err != nil {
+			return fmt.Errorf("error writing request body: %w", err)
+		}
+	}
+
+	if !chunked {
+		return nil
+	}
+
+	buf.Reset()
+	if len(r.Body) > 0 {
+		buf.Write(SEPARATOR)
+	}
+	buf.WriteString("0\r\n")
+	if r.Trailers != nil {
+		writeFields(&buf, r.Trailers)
+	}
+	buf.Write(SEPARATOR)
+
+	_, err = w.Write(buf.Bytes())
+	if err != nil {
+		return fmt.Errorf("error writing request trailers: %w", err)
+	}
+	return nil
+}
+
+func writeFields(buf *bytes.Buffer, h *headers.Headers) {
+	for _, name := range h.Names() {
+		for _, value := range h.Values(name) {
+			buf.WriteString(fmt.Sprintf("%s: %s\r\n", name, value))
+		}
+	}
+}
+
+// HeadersHook is called once the header section has been parsed, before the
+// parser blocks waiting for body bytes. Returning an error aborts parsing,
+// except for a *DeferBody.
+type HeadersHook func(r *Request) error
+
+// DeferBody, returned by a HeadersHook, has ReadRequest return the request
+// without its body. The first ReadBody calls Continue, which is where a
+// server sends 100 Continue, then reads the body. Nothing is deferred when
+// the body already arrived whole.
+type DeferBody struct {
+	Continue func() error
+}
+
+func (d *DeferBody) Error() string {
+	return "request body deferred"
+}
+
+// ReadBody returns the body, reading it first if the server deferred that
+// to the handler's first call. The Reader the request came from mustn't be
+// used for anything else until then.
+func (r *Request) ReadBody() ([]byte, error) {
+	if r.readBody != nil {
+		read := r.readBody
+		r.readBody = nil
+		r.bodyErr = read()
+	}
+	return r.Body, r.bodyErr
+}
+
+// BodyRead reports whether the whole body has been read, false when it was
+// deferred and ReadBody wasn't called or failed. The connection can't carry
+// another request then.
+func (r *Request) BodyRead() bool {
+	return r.readBody == nil && r.bodyErr == nil
+}
+
 func FromReader(reader io.Reader) (*Request, error) {
+	return FromReaderHook(reader, nil)
+}
+
+// FromReaderHook is FromReader with a hook between headers and body, which is
+// where a server answers Expect: 100-continue or rejects a request early.
+func FromReaderHook(reader io.Reader, hook HeadersHook) (*Request, error) {
+	return NewReader(reader).ReadRequest(hook)
+}
+
+// Reader parses consecutive requests from one connection. Bytes read past
+// the end of a request are kept for the next one, or for whoever takes the
+// connection over.
+type Reader struct {
+	reader      io.Reader
+	buf         []byte
+	bufLen      int
+	maxBodySize int64
+}
+
+func NewReader(reader io.Reader) *Reader {
+	return &Reader{
+		reader: reader,
+		buf:    make([]byte, initialBufferLen),
+	}
+}
+
+// SetMaxBodySize fails requests whose body, chunked or not, is larger than
+// n bytes with ErrContentTooLarge, once their headers are in. 0 means no
+// limit.
+func (r *Reader) SetMaxBodySize(n int64) {
+	r.maxBodySize = n
+}
+
+// ReadRequest parses the next request, calling hook once its headers are in
+// if hook isn't nil
+func (r *Reader) ReadRequest(hook HeadersHook) (*Request, error) {
 	request := newRequest()
+	request.maxBodySize = r.maxBodySize
+
+	err := r.read(request, hook)
+	var deferred *DeferBody
+	if errors.As(err, &deferred) {
+		request.readBody = func() error {
+			if err := deferred.Continue(); err != nil {
+				return err
+			}
+			return r.read(request, nil)
+		}
+		return request, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return request, nil
+}
+
+// read parses into request until it's complete, calling hook once its
+// headers are in if hook isn't nil
+func (r *Reader) read(request *Request, hook HeadersHook) error {
+	hooked := hook == nil
 
-	// NOTE: buffer could get overrun... a header/body that exceed 1k byte would do that
-	buf := make([]byte, 1024)
-	bufLen := 0
-	for !request.done() {
-		n, err := reader.Read(buf[bufLen:])
+	for {
+		readN, err := request.parse(r.buf[:r.bufLen])
 		if err != nil {
-			return nil, err
+			return err
 		}
 
-		bufLen += n
+		copy(r.buf, r.buf[readN:r.bufLen])
+		r.bufLen -= readN
+
+		if !hooked && request.state != StateInit && request.state != StateHeaders {
+			hooked = true
+			err := hook(request)
+			var deferred *DeferBody
+			if errors.As(err, &deferred) && request.done() {
+				err = nil
+			}
+			if err != nil {
+				return err
+			}
+		}
+
+		if request.done() {
+			break
+		}
 
-		readN, err := request.parse(buf[:bufLen])
+		// A request line or field that doesn't fit gets more room, up to a limit
+		if r.bufLen == len(r.buf) {
+			if len(r.buf) >= maxLineSize {
+				return ErrLineTooLong
+			}
+			r.buf = append(r.buf, make([]byte, len(r.buf))...)
+		}
+
+		n, err := r.reader.Read(r.buf[r.bufLen:])
 		if err != nil {
-			return nil, err
+			return err
 		}
 
-		copy(buf, buf[readN:bufLen])
-		bufLen -= readN
+		r.bufLen += n
 	}
 
 	if request.error() {
-		return nil, fmt.Errorf("request parsing failed")
+		return fmt.Errorf("request parsing failed")
 	}
+	return nil
+}
 
-	return request, nil
+// Buffered returns a copy of the bytes read from the connection but not
+// parsed yet, the start of whatever the client sent next
+func (r *Reader) Buffered() []byte {
+	return bytes.Clone(r.buf[:r.bufLen])
 }
@@ -1,9 +1,15 @@
 package request
 
 import (
+	"bytes"
+	"fmt"
 	"io"
+	"math/rand"
+	"strings"
 	"testing"
 
+	"github.com/spaghetti-lover/go-http/pkg/headers"
+
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 )
@@ -23,6 +29,7 @@ func (r *chunkReader) Read(p []byte) (n int, err error) {
 	if r.offset+n > len(r.data) {
 		n = len(r.data) - r.offset
 	}
+	n = min(n, len(p))
 
 	copy(p, r.data[r.offset:r.offset+n])
 	r.offset += n
@@ -153,3 +160,425 @@ func TestRequestFromReader_Body(t *testing.T) {
 	require.NotNil(t, r)
 	assert.Equal(t, "", string(r.Body))
 }
+
+func TestRequestFromReaderHook(t *testing.T) {
+	// Test: Hook runs after headers, before the body is read
+	reader := &chunkReader{
+		data: "POST /upload HTTP/1.1\r\n" +
+			"Host: localhost:42069\r\n" +
+			"Expect: 100-continue\r\n" +
+			"Content-Length: 5\r\n" +
+			"\r\n" +
+			"hello",
+		numBytesPerRead: 3,
+	}
+	var offsetAtHook int
+	r, err := FromReaderHook(reader, func(r *Request) error {
+		offsetAtHook = reader.offset
+		assert.Equal(t, "100-continue", r.Headers.Get("Expect"))
+		assert.Equal(t, StateBody, r.state)
+		return nil
+	})
+	require.NoError(t, err)
+	assert.Equal(t, "hello", string(r.Body))
+	assert.Less(t, offsetAtHook, len(reader.data))
+
+	// Test: Hook error aborts parsing
+	reader = &chunkReader{
+		data:            "POST /upload HTTP/1.1\r\nHost: localhost:42069\r\nContent-Length: 5\r\n\r\nhello",
+		numBytesPerRead: 3,
+	}
+	hookErr := fmt.Errorf("rejected")
+	_, err = FromReaderHook(reader, func(r *Request) error {
+		return hookErr
+	})
+	require.ErrorIs(t, err, hookErr)
+}
+
+func TestRequestFromReader_ChunkedBody(t *testing.T) {
+	// Test: Chunked body with extensions and trailers
+	reader := &chunkReader{
+		data: "POST /submit HTTP/1.1\r\n" +
+			"Host: localhost:42069\r\n" +
+			"Transfer-Encoding: chunked\r\n" +
+			"Trailer: X-Sum\r\n" +
+			"\r\n" +
+			"6;name=value\r\nhello \r\n" +
+			"5\r\nworld\r\n" +
+			"0\r\n" +
+			"X-Sum: abc\r\n" +
+			"\r\n",
+		numBytesPerRead: 2,
+	}
+	r, err := FromReader(reader)
+	require.NoError(t, err)
+	assert.Equal(t, "hello world", string(r.Body))
+	require.NotNil(t, r.Trailers)
+	assert.Equal(t, "abc", r.Trailers.Get("X-Sum"))
+
+	// Test: Empty chunked body
+	reader = &chunkReader{
+		data:            "POST /submit HTTP/1.1\r\nHost: localhost:42069\r\nTransfer-Encoding: chunked\r\n\r\n0\r\n\r\n",
+		numBytesPerRead: 3,
+	}
+	r, err = FromReader(reader)
+	require.NoError(t, err)
+	assert.Empty(t, r.Body)
+
+	// Test: Malformed chunk size
+	reader = &chunkReader{
+		data:            "POST /submit HTTP/1.1\r\nHost: localhost:42069\r\nTransfer-Encoding: chunked\r\n\r\nzz\r\nhello\r\n0\r\n\r\n",
+		numBytesPerRead: 3,
+	}
+	_, err = FromReader(reader)
+	require.ErrorIs(t, err, ErrMalformedChunk)
+
+	// Test: Chunk longer than its size
+	reader = &chunkReader{
+		data:            "POST /submit HTTP/1.1\r\nHost: localhost:42069\r\nTransfer-Encoding: chunked\r\n\r\n2\r\nhello\r\n0\r\n\r\n",
+		numBytesPerRead: 3,
+	}
+	_, err = FromReader(reader)
+	require.ErrorIs(t, err, ErrMalformedChunk)
+}
+
+func TestRequestFromReader_LongLines(t *testing.T) {
+	// Test: Header longer than the initial buffer
+	long := strings.Repeat("x", 5000)
+	reader := &chunkReader{
+		data:            "GET / HTTP/1.1\r\nHost: localhost:42069\r\nCookie: " + long + "\r\n\r\n",
+		numBytesPerRead: 700,
+	}
+	r, err := FromReader(reader)
+	require.NoError(t, err)
+	assert.Equal(t, long, r.Headers.Get("Cookie"))
+
+	// Test: Header past the limit
+	reader = &chunkReader{
+		data:            "GET / HTTP/1.1\r\nCookie: " + strings.Repeat("x", maxLineSize) + "\r\n\r\n",
+		numBytesPerRead: 4096,
+	}
+	_, err = FromReader(reader)
+	require.ErrorIs(t, err, ErrLineTooLong)
+}
+
+func TestRequestFromReader_Connect(t *testing.T) {
+	// Test: Authority-form target
+	r, err := FromReader(strings.NewReader("CONNECT example.com:443 HTTP/1.1\r\nHost: example.com:443\r\n\r\n"))
+	require.NoError(t, err)
+	host, port, err := r.RequestLine.Authority()
+	require.NoError(t, err)
+	assert.Equal(t, "example.com", host)
+	assert.Equal(t, "443", port)
+
+	// Test: IPv6 literal
+	r, err = FromReader(strings.NewReader("CONNECT [::1]:8443 HTTP/1.1\r\nHost: [::1]:8443\r\n\r\n"))
+	require.NoError(t, err)
+	host, _, err = r.RequestLine.Authority()
+	require.NoError(t, err)
+	assert.Equal(t, "::1", host)
+
+	// Test: Anything else is malformed
+	for _, target := range []string{"/", "example.com", "http://example.com:443/", ":443", "example.com:"} {
+		_, err = FromReader(strings.NewReader("CONNECT " + target + " HTTP/1.1\r\nHost: example.com\r\n\r\n"))
+		assert.ErrorIs(t, err, ErrMalformedRequestLine, target)
+	}
+}
+
+func TestRequestFromReader_Versions(t *testing.T) {
+	// Test: HTTP/1.0 is accepted, with or without Host
+	r, err := FromReader(strings.NewReader("GET /probe HTTP/1.0\r\nUser-Agent: ApacheBench/2.3\r\n\r\n"))
+	require.NoError(t, err)
+	assert.Equal(t, "1.0", r.RequestLine.HttpVersion)
+	assert.True(t, r.RequestLine.ValidHTTP())
+
+	// Test: Later 1.x minor versions read as 1.1
+	r, err = FromReader(strings.NewReader("GET / HTTP/1.9\r\nHost: localhost\r\n\r\n"))
+	require.NoError(t, err)
+	assert.Equal(t, "1.1", r.RequestLine.HttpVersion)
+
+	// Test: An HTTP/0.9 simple request has neither version nor headers
+	reader := NewReader(strings.NewReader("GET /index.html\r\nleftover"))
+	r, err = reader.ReadRequest(nil)
+	require.NoError(t, err)
+	assert.Equal(t, Line{Method: "GET", RequestTarget: "/index.html", HttpVersion: "0.9"}, r.RequestLine)
+	assert.Equal(t, "leftover", string(reader.Buffered()))
+
+	_, err = FromReader(strings.NewReader("POST /index.html\r\n"))
+	assert.ErrorIs(t, err, ErrMalformedRequestLine)
+
+	// Test: Other major versions are well formed but unsupported
+	for _, version := range []string{"HTTP/2.0", "HTTP/3.0", "HTTP/0.9"} {
+		_, err = FromReader(strings.NewReader("GET / " + version + "\r\n\r\n"))
+		assert.ErrorIs(t, err, ErrUnsupportedHTTPVersion, version)
+	}
+
+	// Test: Malformed versions are not
+	for _, version := range []string{"HTTP/1", "HTTP/1.10", "HTTPS/1.1", "HTTP/a.b", "http/1.1"} {
+		_, err = FromReader(strings.NewReader("GET / " + version + "\r\n\r\n"))
+		assert.ErrorIs(t, err, ErrMalformedRequestLine, version)
+	}
+}
+
+func TestReader(t *testing.T) {
+	// Test: Consecutive requests in one read are parsed one at a time
+	reader := NewReader(&chunkReader{
+		data: "POST /one HTTP/1.1\r\nHost: localhost\r\nContent-Length: 3\r\n\r\nabc" +
+			"GET /two HTTP/1.1\r\nHost: localhost\r\n\r\n" +
+			"not http",
+		numBytesPerRead: 1024,
+	})
+	r, err := reader.ReadRequest(nil)
+	require.NoError(t, err)
+	assert.Equal(t, "/one", r.RequestLine.RequestTarget)
+	assert.Equal(t, "abc", string(r.Body))
+	assert.Equal(t, "GET /two HTTP/1.1\r\nHost: localhost\r\n\r\nnot http", string(reader.Buffered()))
+
+	r, err = reader.ReadRequest(nil)
+	require.NoError(t, err)
+	assert.Equal(t, "/two", r.RequestLine.RequestTarget)
+
+	// Test: Whatever follows stays buffered for the caller
+	assert.Equal(t, "not http", string(reader.Buffered()))
+
+	// Test: The HTTP/2 preface reads as a bodyless PRI, leaving the rest
+	reader = NewReader(&chunkReader{data: "PRI * HTTP/2.0\r\n\r\nSM\r\n\r\n\x00", numBytesPerRead: 1024})
+	r, err = reader.ReadRequest(nil)
+	require.NoError(t, err)
+	assert.True(t, r.RequestLine.HTTP2Preface())
+	assert.Equal(t, "SM\r\n\r\n\x00", string(reader.Buffered()))
+
+	// Test: Other HTTP/2.0 request lines are unsupported
+	_, err = FromReader(strings.NewReader("GET / HTTP/2.0\r\n\r\n"))
+	assert.ErrorIs(t, err, ErrUnsupportedHTTPVersion)
+}
+
+func TestReaderDeferBody(t *testing.T) {
+	// Test: A deferred body is read, after Continue, on the first ReadBody
+	src := &chunkReader{
+		data:            "POST /upload HTTP/1.1\r\nHost: localhost\r\nExpect: 100-continue\r\nContent-Length: 5\r\n\r\n",
+		numBytesPerRead: 3,
+	}
+	reader := NewReader(src)
+	continued := 0
+	r, err := reader.ReadRequest(func(r *Request) error {
+		return &DeferBody{Continue: func() error {
+			// The client only sends its body once told to
+			continued++
+			src.data += "hello"
+			return nil
+		}}
+	})
+	require.NoError(t, err)
+	assert.Empty(t, r.Body)
+	assert.False(t, r.BodyRead())
+	assert.Zero(t, continued)
+
+	body, err := r.ReadBody()
+	require.NoError(t, err)
+	assert.Equal(t, "hello", string(body))
+	assert.True(t, r.BodyRead())
+	assert.Equal(t, 1, continued)
+
+	// Test: Later calls return the same body without continuing again
+	body, err = r.ReadBody()
+	require.NoError(t, err)
+	assert.Equal(t, "hello", string(body))
+	assert.Equal(t, 1, continued)
+
+	// Test: A Continue error is returned and the body left unread
+	reader = NewReader(strings.NewReader("POST / HTTP/1.1\r\nHost: localhost\r\nContent-Length: 5\r\n\r\n"))
+	continueErr := fmt.Errorf("write failed")
+	r, err = reader.ReadRequest(func(r *Request) error {
+		return &DeferBody{Continue: func() error { return continueErr }}
+	})
+	require.NoError(t, err)
+	_, err = r.ReadBody()
+	require.ErrorIs(t, err, continueErr)
+	assert.False(t, r.BodyRead())
+
+	// Test: Nothing is deferred for a body already read whole
+	r, err = NewReader(strings.NewReader("GET / HTTP/1.1\r\nHost: localhost\r\n\r\n")).ReadRequest(func(r *Request) error {
+		return &DeferBody{Continue: func() error {
+			continued++
+			return nil
+		}}
+	})
+	require.NoError(t, err)
+	assert.True(t, r.BodyRead())
+	_, err = r.ReadBody()
+	require.NoError(t, err)
+	assert.Equal(t, 1, continued)
+}
+
+func TestReaderMaxBodySize(t *testing.T) {
+	// Test: Chunked bodies are limited as they grow
+	reader := NewReader(strings.NewReader("POST / HTTP/1.1\r\nHost: localhost\r\nTransfer-Encoding: chunked\r\n\r\n" +
+		"4\r\nabcd\r\n4\r\nefgh\r\n1\r\ni\r\n0\r\n\r\n"))
+	reader.SetMaxBodySize(8)
+	_, err := reader.ReadRequest(nil)
+	assert.ErrorIs(t, err, ErrContentTooLarge)
+
+	// Test: So are bodies with a Content-Length
+	reader = NewReader(strings.NewReader("POST / HTTP/1.1\r\nHost: localhost\r\nContent-Length: 9\r\n\r\nabcdefghi"))
+	reader.SetMaxBodySize(8)
+	_, err = reader.ReadRequest(nil)
+	assert.ErrorIs(t, err, ErrContentTooLarge)
+
+	// Test: Up to the limit is fine
+	reader = NewReader(strings.NewReader("POST / HTTP/1.1\r\nHost: localhost\r\nTransfer-Encoding: chunked\r\n\r\n" +
+		"4\r\nabcd\r\n4\r\nefgh\r\n0\r\n\r\n"))
+	reader.SetMaxBodySize(8)
+	r, err := reader.ReadRequest(nil)
+	require.NoError(t, err)
+	assert.Equal(t, "abcdefgh", string(r.Body))
+}
+
+func TestRequestWrite(t *testing.T) {
+	// Test: Field order and spelling are kept, Content-Length follows Body
+	r := &Request{
+		RequestLine: Line{Method: "POST", RequestTarget: "/upload", HttpVersion: "1.1"},
+		Headers:     headers.NewHeaders(),
+		Body:        []byte("hello"),
+	}
+	r.Headers.Set("Host", "localhost:42069")
+	r.Headers.Set("X-Trace-ID", "abc")
+	r.Headers.Set("content-length", "99")
+	r.Headers.Set("Accept", "text/html")
+	r.Headers.Set("accept", "*/*")
+
+	var buf bytes.Buffer
+	require.NoError(t, r.Write(&buf))
+	assert.Equal(t, "POST /upload HTTP/1.1\r\n"+
+		"Host: localhost:42069\r\n"+
+		"X-Trace-ID: abc\r\n"+
+		"content-length: 5\r\n"+
+		"Accept: text/html\r\n"+
+		"Accept: */*\r\n"+
+		"\r\n"+
+		"hello", buf.String())
+
+	// Test: Any version goes out as HTTP/1.1, 0.9 included
+	for _, version := range []string{"0.9", "1.0", "2.0", ""} {
+		r = &Request{
+			RequestLine: Line{Method: "GET", RequestTarget: "/", HttpVersion: version},
+			Headers:     headers.NewHeaders(),
+		}
+		buf.Reset()
+		require.NoError(t, r.Write(&buf))
+		assert.Equal(t, "GET / HTTP/1.1\r\n\r\n", buf.String(), version)
+	}
+
+	// Test: Chunked body with trailers
+	r = &Request{
+		RequestLine: Line{Method: "POST", RequestTarget: "/upload", HttpVersion: "1.1"},
+		Headers:     headers.NewHeaders(),
+		Body:        []byte("hello world"),
+		Trailers:    headers.NewHeaders(),
+	}
+	r.Headers.Set("Host", "localhost:42069")
+	r.Headers.Set("Transfer-Encoding", "chunked")
+	r.Headers.Set("Content-Length", "11")
+	r.Trailers.Set("X-Sum", "abc")
+
+	buf.Reset()
+	require.NoError(t, r.Write(&buf))
+	assert.Equal(t, "POST /upload HTTP/1.1\r\n"+
+		"Host: localhost:42069\r\n"+
+		"Transfer-Encoding: chunked\r\n"+
+		"\r\n"+
+		"B\r\nhello world\r\n"+
+		"0\r\n"+
+		"X-Sum: abc\r\n"+
+		"\r\n", buf.String())
+
+	// Test: No body, no Content-Length
+	r = &Request{
+		RequestLine: Line{Method: "GET", RequestTarget: "/", HttpVersion: "1.1"},
+		Headers:     headers.NewHeaders(),
+	}
+	r.Headers.Set("Host", "localhost:42069")
+	buf.Reset()
+	require.NoError(t, r.Write(&buf))
+	assert.Equal(t, "GET / HTTP/1.1\r\nHost: localhost:42069\r\n\r\n", buf.String())
+}
+
+// randomRequest builds a request that survives a parse unchanged: field
+// names are unique ignoring case and values have no surrounding whitespace
+func randomRequest(rng *rand.Rand) *Request {
+	const nameChars = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789-_.!#$%&'*+^`|~"
+	const valueChars = "abcdefghijklmnopqrstuvwxyz0123456789 ,;=/\"()<>@?[]{}:*-"
+
+	randomString := func(chars string, n int) string {
+		b := make([]byte, n)
+		for i := range b {
+			b[i] = chars[rng.Intn(len(chars))]
+		}
+		return string(b)
+	}
+	randomValue := func() string {
+		return strings.TrimSpace(randomString(valueChars, rng.Intn(40)))
+	}
+	randomFields := func(n int) *headers.Headers {
+		h := headers.NewHeaders()
+		for i := 0; i < n; i++ {
+			name := randomString(nameChars, 1+rng.Intn(20))
+			if h.Get(name) != "" || strings.EqualFold(name, "Content-Length") || strings.EqualFold(name, "Transfer-Encoding") {
+				continue
+			}
+			h.Set(name, "v"+randomValue())
+		}
+		return h
+	}
+
+	methods := []string{"GET", "POST", "PUT", "PATCH", "DELETE", "OPTIONS"}
+	r := &Request{
+		RequestLine: Line{
+			Method:        methods[rng.Intn(len(methods))],
+			RequestTarget: "/" + randomString("abcdefghijklmnopqrstuvwxyz0123456789/-_.~?=&", rng.Intn(30)),
+			HttpVersion:   "1.1",
+		},
+		Headers: randomFields(rng.Intn(10)),
+	}
+	r.Headers.Set("Host", "localhost:42069")
+
+	if rng.Intn(3) > 0 {
+		r.Body = make([]byte, rng.Intn(5000))
+		rng.Read(r.Body)
+	}
+	if rng.Intn(2) == 0 {
+		r.Headers.Set("Transfer-Encoding", "chunked")
+		r.Trailers = randomFields(rng.Intn(4))
+	}
+	return r
+}
+
+func TestRequestWriteRoundTrip(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+
+	for i := 0; i < 500; i++ {
+		want := randomRequest(rng)
+
+		var wire bytes.Buffer
+		require.NoError(t, want.Write(&wire))
+
+		got, err := FromReader(&chunkReader{data: wire.String(), numBytesPerRead: 1 + rng.Intn(2000)})
+		require.NoError(t, err, "request %d:\n%s", i, wire.String())
+
+		assert.Equal(t, want.RequestLine, got.RequestLine)
+		assert.Equal(t, string(want.Body), string(got.Body))
+		for _, name := range want.Headers.Names() {
+			assert.Equal(t, want.Headers.Get(name), got.Headers.Get(name), name)
+		}
+		if want.Trailers != nil {
+			for _, name := range want.Trailers.Names() {
+				assert.Equal(t, want.Trailers.Get(name), got.Trailers.Get(name), name)
+			}
+		}
+
+		// Serializing what was parsed must give back the same bytes
+		var again bytes.Buffer
+		require.NoError(t, got.Write(&again))
+		require.Equal(t, wire.String(), again.String(), "request %d", i)
+	}
+}
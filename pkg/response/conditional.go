@@ -0,0 +1,185 @@
+package response
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/spaghetti-lover/go-http/pkg/headers"
+	"github.com/spaghetti-lover/go-http/pkg/request"
+)
+
+// TimeFormat is the IMF-fixdate format used for HTTP dates (RFC 9110 §5.6.7)
+const TimeFormat = "Mon, 02 Jan 2006 15:04:05 GMT"
+
+// Obsolete date formats recipients must still accept
+var dateFormats = []string{
+	TimeFormat,
+	"Monday, 02-Jan-06 15:04:05 GMT",
+	"Mon Jan _2 15:04:05 2006",
+}
+
+func parseHTTPDate(s string) (time.Time, bool) {
+	for _, layout := range dateFormats {
+		t, err := time.Parse(layout, s)
+		if err == nil {
+			return t, true
+		}
+	}
+	return time.Time{}, false
+}
+
+// SetETag sets the ETag header. tag is the opaque value without quotes.
+func SetETag(h *headers.Headers, tag string, weak bool) {
+	etag := `"` + tag + `"`
+	if weak {
+		etag = "W/" + etag
+	}
+	h.Override("ETag", etag)
+}
+
+// SetLastModified sets the Last-Modified header, truncated to whole seconds
+func SetLastModified(h *headers.Headers, t time.Time) {
+	h.Override("Last-Modified", t.UTC().Format(TimeFormat))
+}
+
+type entityTag struct {
+	weak   bool
+	opaque string
+}
+
+func parseETag(s string) (entityTag, bool) {
+	var tag entityTag
+	if strings.HasPrefix(s, "W/") {
+		tag.weak = true
+		s = s[2:]
+	}
+	if len(s) < 2 || s[0] != '"' || s[len(s)-1] != '"' {
+		return entityTag{}, false
+	}
+	tag.opaque = s[1 : len(s)-1]
+	if strings.Contains(tag.opaque, `"`) {
+		return entityTag{}, false
+	}
+	return tag, true
+}
+
+// parseETagList splits an If-Match / If-None-Match value into entity tags.
+// Commas are valid inside an opaque tag, so we can't just split on them.
+func parseETagList(s string) []entityTag {
+	var tags []entityTag
+	for {
+		s = strings.TrimLeft(s, " \t,")
+		if s == "" {
+			return tags
+		}
+
+		start := 0
+		if strings.HasPrefix(s, "W/") {
+			start = 2
+		}
+		if start >= len(s) || s[start] != '"' {
+			return tags
+		}
+		end := strings.IndexByte(s[start+1:], '"')
+		if end == -1 {
+			return tags
+		}
+		end += start + 2
+
+		if tag, ok := parseETag(s[:end]); ok {
+			tags = append(tags, tag)
+		}
+		s = s[end:]
+	}
+}
+
+// matchETag reports whether current matches any tag in the header value.
+// Weak comparison ignores the W/ prefix, strong comparison requires both
+// tags to be strong.
+func matchETag(value, current string, weak bool) bool {
+	if strings.TrimSpace(value) == "*" {
+		return current != ""
+	}
+
+	cur, ok := parseETag(current)
+	if !ok {
+		return false
+	}
+
+	for _, tag := range parseETagList(value) {
+		if tag.opaque != cur.opaque {
+			continue
+		}
+		if weak || (!tag.weak && !cur.weak) {
+			return true
+		}
+	}
+	return false
+}
+
+// CheckPreconditions evaluates If-Match, If-Unmodified-Since, If-None-Match
+// and If-Modified-Since in the order defined by RFC 9110 §13.2.2.
+//
+// etag is the full ETag header value of the selected representation (as set
+// by SetETag) and lastModified its modification time; either may be empty or
+// zero when unknown. It returns OK when the request should be processed
+// normally, or NotModified / PreconditionFailed when the handler should
+// answer with WriteConditional instead.
+func CheckPreconditions(req *request.Request, etag string, lastModified time.Time) StatusCode {
+	method := req.RequestLine.Method
+	isGetOrHead := method == "GET" || method == "HEAD"
+	lastModified = lastModified.Truncate(time.Second)
+
+	// Step 1 and 2: If-Match, falling back to If-Unmodified-Since
+	if ifMatch := req.Headers.Get("If-Match"); ifMatch != "" {
+		if !matchETag(ifMatch, etag, false) {
+			return PreconditionFailed
+		}
+	} else if ius := req.Headers.Get("If-Unmodified-Since"); ius != "" && !lastModified.IsZero() {
+		if t, ok := parseHTTPDate(ius); ok && lastModified.After(t) {
+			return PreconditionFailed
+		}
+	}
+
+	// Step 3 and 4: If-None-Match, falling back to If-Modified-Since
+	if ifNoneMatch := req.Headers.Get("If-None-Match"); ifNoneMatch != "" {
+		if matchETag(ifNoneMatch, etag, true) {
+			if isGetOrHead {
+				return NotModified
+			}
+			return PreconditionFailed
+		}
+	} else if ims := req.Headers.Get("If-Modified-Since"); ims != "" && isGetOrHead && !lastModified.IsZero() {
+		if t, ok := parseHTTPDate(ims); ok && !lastModified.After(t) {
+			return NotModified
+		}
+	}
+
+	return OK
+}
+
+// WriteConditional writes a bodiless 304 or 412 response. For 304 the
+// validator headers (ETag, Last-Modified, Cache-Control, ...) in h are sent
+// as-is; Content-Length is dropped since no body follows.
+func WriteConditional(w *Writer, statusCode StatusCode, h *headers.Headers) error {
+	if statusCode != NotModified && statusCode != PreconditionFailed {
+		return fmt.Errorf("unexpected conditional status code: %s", statusCode)
+	}
+
+	out := headers.NewHeaders()
+	for key, value := range h.All() {
+		if key == "content-length" || key == "transfer-encoding" {
+			continue
+		}
+		out.Override(key, value)
+	}
+	if statusCode == PreconditionFailed {
+		out.Override("Content-Length", "0")
+	}
+
+	if err := w.WriteStatusLine(statusCode); err != nil {
+		return err
+	}
+	return w.WriteHeaders(out)
+}
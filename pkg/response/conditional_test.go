@@ -0,0 +1,127 @@
+package response
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/spaghetti-lover/go-http/pkg/headers"
+	"github.com/spaghetti-lover/go-http/pkg/request"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestRequest(t *testing.T, method string, fields ...string) *request.Request {
+	t.Helper()
+	raw := method + " / HTTP/1.1\r\nHost: localhost\r\n"
+	for _, f := range fields {
+		raw += f + "\r\n"
+	}
+	raw += "\r\n"
+	req, err := request.FromReader(strings.NewReader(raw))
+	require.NoError(t, err)
+	return req
+}
+
+func TestSetValidators(t *testing.T) {
+	h := headers.NewHeaders()
+	SetETag(h, "abc", false)
+	assert.Equal(t, `"abc"`, h.Get("ETag"))
+
+	SetETag(h, "abc", true)
+	assert.Equal(t, `W/"abc"`, h.Get("ETag"))
+
+	SetLastModified(h, time.Date(2024, 3, 1, 12, 30, 45, 500, time.FixedZone("X", 3600)))
+	assert.Equal(t, "Fri, 01 Mar 2024 11:30:45 GMT", h.Get("Last-Modified"))
+}
+
+func TestCheckPreconditions(t *testing.T) {
+	modTime := time.Date(2024, 3, 1, 11, 30, 45, 0, time.UTC)
+	before := modTime.Add(-time.Hour).Format(TimeFormat)
+	after := modTime.Add(time.Hour).Format(TimeFormat)
+
+	// Test: No preconditions
+	req := newTestRequest(t, "GET")
+	assert.Equal(t, OK, CheckPreconditions(req, `"v1"`, modTime))
+
+	// Test: If-None-Match hit on GET
+	req = newTestRequest(t, "GET", `If-None-Match: "v0", "v1"`)
+	assert.Equal(t, NotModified, CheckPreconditions(req, `"v1"`, modTime))
+
+	// Test: If-None-Match uses weak comparison
+	req = newTestRequest(t, "GET", `If-None-Match: W/"v1"`)
+	assert.Equal(t, NotModified, CheckPreconditions(req, `"v1"`, modTime))
+
+	// Test: If-None-Match miss
+	req = newTestRequest(t, "GET", `If-None-Match: "v2"`)
+	assert.Equal(t, OK, CheckPreconditions(req, `"v1"`, modTime))
+
+	// Test: If-None-Match hit on unsafe method
+	req = newTestRequest(t, "PUT", `If-None-Match: *`)
+	assert.Equal(t, PreconditionFailed, CheckPreconditions(req, `"v1"`, modTime))
+
+	// Test: If-None-Match takes precedence over If-Modified-Since
+	req = newTestRequest(t, "GET", `If-None-Match: "v2"`, "If-Modified-Since: "+after)
+	assert.Equal(t, OK, CheckPreconditions(req, `"v1"`, modTime))
+
+	// Test: If-Modified-Since not modified
+	req = newTestRequest(t, "GET", "If-Modified-Since: "+modTime.Format(TimeFormat))
+	assert.Equal(t, NotModified, CheckPreconditions(req, `"v1"`, modTime.Add(300*time.Millisecond)))
+
+	// Test: If-Modified-Since modified
+	req = newTestRequest(t, "GET", "If-Modified-Since: "+before)
+	assert.Equal(t, OK, CheckPreconditions(req, `"v1"`, modTime))
+
+	// Test: If-Modified-Since ignored for POST
+	req = newTestRequest(t, "POST", "If-Modified-Since: "+after)
+	assert.Equal(t, OK, CheckPreconditions(req, `"v1"`, modTime))
+
+	// Test: If-Match requires strong comparison
+	req = newTestRequest(t, "PUT", `If-Match: W/"v1"`)
+	assert.Equal(t, PreconditionFailed, CheckPreconditions(req, `W/"v1"`, modTime))
+
+	// Test: If-Match hit
+	req = newTestRequest(t, "PUT", `If-Match: "a,b", "v1"`)
+	assert.Equal(t, OK, CheckPreconditions(req, `"v1"`, modTime))
+
+	// Test: If-Match star without a current representation
+	req = newTestRequest(t, "PUT", "If-Match: *")
+	assert.Equal(t, PreconditionFailed, CheckPreconditions(req, "", time.Time{}))
+
+	// Test: If-Unmodified-Since failed
+	req = newTestRequest(t, "DELETE", "If-Unmodified-Since: "+before)
+	assert.Equal(t, PreconditionFailed, CheckPreconditions(req, `"v1"`, modTime))
+
+	// Test: If-Unmodified-Since ignored when If-Match is present
+	req = newTestRequest(t, "DELETE", `If-Match: "v1"`, "If-Unmodified-Since: "+before)
+	assert.Equal(t, OK, CheckPreconditions(req, `"v1"`, modTime))
+
+	// Test: Invalid dates are ignored
+	req = newTestRequest(t, "GET", "If-Modified-Since: yesterday")
+	assert.Equal(t, OK, CheckPreconditions(req, `"v1"`, modTime))
+
+	// Test: Obsolete RFC 850 date format
+	req = newTestRequest(t, "GET", "If-Modified-Since: Friday, 01-Mar-24 11:30:45 GMT")
+	assert.Equal(t, NotModified, CheckPreconditions(req, `"v1"`, modTime))
+}
+
+func TestWriteConditional(t *testing.T) {
+	var buf bytes.Buffer
+	w := NewWriter(&buf)
+
+	h := headers.NewHeaders()
+	SetETag(h, "v1", false)
+	h.Set("Content-Length", "42")
+
+	err := WriteConditional(w, NotModified, h)
+	require.NoError(t, err)
+	out := buf.String()
+	assert.True(t, strings.HasPrefix(out, "HTTP/1.1 304 Not Modified\r\n"))
+	assert.Contains(t, out, "etag: \"v1\"\r\n")
+	assert.NotContains(t, out, "content-length")
+	assert.True(t, strings.HasSuffix(out, "\r\n\r\n"))
+
+	err = WriteConditional(NewWriter(&buf), OK, h)
+	require.Error(t, err)
+}
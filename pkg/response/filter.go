@@ -0,0 +1,89 @@
+package response
+
+import (
+	"slices"
+
+	"github.com/spaghetti-lover/go-http/pkg/headers"
+)
+
+// Filter rewrites a response while it passes through a Writer. Middleware
+// installs filters with AddFilter before calling the next handler; the filter
+// added last is the innermost one and sees the handler's output first.
+type Filter interface {
+	// Headers may modify h right before the header block is written. A filter
+	// that changes the body length must drop Content-Length and switch the
+	// response to Transfer-Encoding: chunked.
+	Headers(statusCode StatusCode, h *headers.Headers)
+
+	// Body transforms a piece of the body and returns the bytes to send,
+	// which may be empty if the filter buffers internally. The returned slice
+	// must stay valid after the call.
+	Body(p []byte) ([]byte, error)
+
+	// Close is called once when the body is complete and returns whatever the
+	// filter still holds
+	Close() ([]byte, error)
+
+	// Trailers may modify or add trailer fields of a chunked response
+	Trailers(h *headers.Headers)
+}
+
+// Bypasser is implemented by filters that may decide in Headers to leave
+// the response alone, e.g. compression for a media type that doesn't
+// compress. Once the headers are written, the writer drops a filter whose
+// Bypass reports true, so it no longer sees the body or trailers and
+// ReadFrom can still hand the body to the connection.
+type Bypasser interface {
+	Bypass() bool
+}
+
+// AddFilter installs f on the writer. It must be called before WriteHeaders.
+func (w *Writer) AddFilter(f Filter) {
+	w.filters = append(w.filters, f)
+}
+
+// dropBypassed removes the filters that chose to leave the response alone
+func (w *Writer) dropBypassed() {
+	w.filters = slices.DeleteFunc(w.filters, func(f Filter) bool {
+		b, ok := f.(Bypasser)
+		return ok && b.Bypass()
+	})
+}
+
+func (w *Writer) filter(p []byte) ([]byte, error) {
+	var err error
+	for i := len(w.filters) - 1; i >= 0; i-- {
+		p, err = w.filters[i].Body(p)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return p, nil
+}
+
+// closeFilters flushes the filters from the inside out, bytes released by an
+// inner filter still pass through the outer ones
+func (w *Writer) closeFilters() ([]byte, error) {
+	if w.filtersClosed {
+		return nil, nil
+	}
+	w.filtersClosed = true
+
+	var out []byte
+	for i := len(w.filters) - 1; i >= 0; i-- {
+		if len(out) > 0 {
+			p, err := w.filters[i].Body(out)
+			if err != nil {
+				return nil, err
+			}
+			out = p
+		}
+
+		rest, err := w.filters[i].Close()
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, rest...)
+	}
+	return out, nil
+}
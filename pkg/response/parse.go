@@ -0,0 +1,393 @@
+package response
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/spaghetti-lover/go-http/pkg/headers"
+)
+
+type parserState string
+
+const (
+	StateInit       parserState = "init"
+	StateHeaders    parserState = "headers"
+	StateBody       parserState = "body"
+	StateChunkSize  parserState = "chunk-size"
+	StateChunkData  parserState = "chunk-data"
+	StateChunkEnd   parserState = "chunk-end"
+	StateTrailers   parserState = "trailers"
+	StateUntilClose parserState = "until-close"
+	StateDone       parserState = "done"
+	StateError      parserState = "error"
+)
+
+const (
+	initialBufferLen = 1024
+	maxLineSize      = 64 * 1024
+)
+
+var ErrMalformedStatusLine = fmt.Errorf("malformed status line")
+var ErrMalformedChunk = fmt.Errorf("malformed chunk")
+var ErrLineTooLong = fmt.Errorf("line exceeds maximum length")
+var ErrorResponseInErrorState = fmt.Errorf("response in error state")
+var SEPARATOR = []byte("\r\n")
+
+// Interim is a 1xx response received before the final one
+type Interim struct {
+	StatusCode StatusCode
+	Headers    *headers.Headers
+}
+
+// Response is a parsed HTTP/1.1 response
+type Response struct {
+	HttpVersion string
+	StatusCode  StatusCode
+	Reason      string
+	Headers     *headers.Headers
+	Body        []byte
+	Trailers    *headers.Headers
+	Interim     []Interim
+
+	method         string
+	state          parserState
+	contentLength  int
+	chunkRemaining int
+	// bodyRead counts the Content-Length body parsed so far, Body may have
+	// been handed out already by a streaming reader
+	bodyRead int
+}
+
+func newResponse(method string) *Response {
+	return &Response{
+		method:  method,
+		state:   StateInit,
+		Headers: headers.NewHeaders(),
+	}
+}
+
+func parseStatusLine(b []byte) (*Response, int, error) {
+	idx := bytes.Index(b, SEPARATOR)
+	if idx == -1 {
+		return nil, 0, nil
+	}
+
+	statusLine := b[:idx]
+	read := idx + len(SEPARATOR)
+
+	// The reason phrase may be empty or contain spaces
+	parts := bytes.SplitN(statusLine, []byte(" "), 3)
+	if len(parts) < 2 {
+		return nil, 0, ErrMalformedStatusLine
+	}
+
+	httpParts := bytes.Split(parts[0], []byte("/"))
+	if len(httpParts) != 2 || string(httpParts[0]) != "HTTP" || !bytes.HasPrefix(httpParts[1], []byte("1.")) {
+		return nil, 0, ErrMalformedStatusLine
+	}
+
+	code := parts[1]
+	if len(code) != 3 || code[0] < '1' || code[0] > '5' {
+		return nil, 0, ErrMalformedStatusLine
+	}
+	if _, err := strconv.Atoi(string(code)); err != nil {
+		return nil, 0, ErrMalformedStatusLine
+	}
+
+	resp := &Response{
+		HttpVersion: string(httpParts[1]),
+		StatusCode:  StatusCode(code),
+	}
+	if len(parts) == 3 {
+		resp.Reason = string(parts[2])
+	}
+
+	return resp, read, nil
+}
+
+// bodyState picks how the body is framed once the headers are complete
+// (RFC 9112 §6.3)
+func (r *Response) bodyState() (parserState, error) {
+	if r.method == "HEAD" || !bodyAllowed(r.StatusCode) {
+		return StateDone, nil
+	}
+
+	if strings.Contains(strings.ToLower(r.Headers.Get("Transfer-Encoding")), "chunked") {
+		return StateChunkSize, nil
+	}
+
+	if contentLengthStr := r.Headers.Get("Content-Length"); contentLengthStr != "" {
+		contentLength, err := strconv.Atoi(contentLengthStr)
+		if err != nil || contentLength < 0 {
+			return StateError, fmt.Errorf("invalid content-length: %q", contentLengthStr)
+		}
+		r.contentLength = contentLength
+		if contentLength == 0 {
+			return StateDone, nil
+		}
+		return StateBody, nil
+	}
+
+	return StateUntilClose, nil
+}
+
+func (r *Response) parseSingle(data []byte) (int, error) {
+	switch r.state {
+	case StateError:
+		return 0, ErrorResponseInErrorState
+	case StateInit:
+		sl, n, err := parseStatusLine(data)
+		if err != nil {
+			return 0, err
+		}
+
+		if n == 0 {
+			return 0, nil
+		}
+
+		r.HttpVersion = sl.HttpVersion
+		r.StatusCode = sl.StatusCode
+		r.Reason = sl.Reason
+		r.state = StateHeaders
+		return n, nil
+
+	case StateHeaders:
+		n, done, err := r.Headers.Parse(data)
+		if err != nil {
+			return 0, err
+		}
+
+		if !done {
+			return n, nil
+		}
+
+		// An interim response is followed by another status line
+		if r.StatusCode[0] == '1' && r.StatusCode != "101" {
+			r.Interim = append(r.Interim, Interim{StatusCode: r.StatusCode, Headers: r.Headers})
+			r.Headers = headers.NewHeaders()
+			r.state = StateInit
+			return n, nil
+		}
+
+		r.state, err = r.bodyState()
+		if err != nil {
+			return 0, err
+		}
+		return n, nil
+
+	case StateBody:
+		n := min(r.contentLength-r.bodyRead, len(data))
+		r.Body = append(r.Body, data[:n]...)
+		r.bodyRead += n
+
+		if r.bodyRead == r.contentLength {
+			r.state = StateDone
+		}
+		return n, nil
+
+	case StateChunkSize:
+		idx := bytes.Index(data, SEPARATOR)
+		if idx == -1 {
+			return 0, nil
+		}
+
+		// Ignore chunk extensions
+		sizeStr, _, _ := strings.Cut(string(data[:idx]), ";")
+		size, err := strconv.ParseInt(strings.TrimSpace(sizeStr), 16, 32)
+		if err != nil || size < 0 {
+			return 0, ErrMalformedChunk
+		}
+
+		if size == 0 {
+			r.Trailers = headers.NewHeaders()
+			r.state = StateTrailers
+		} else {
+			r.chunkRemaining = int(size)
+			r.state = StateChunkData
+		}
+		return idx + len(SEPARATOR), nil
+
+	case StateChunkData:
+		n := min(r.chunkRemaining, len(data))
+		r.Body = append(r.Body, data[:n]...)
+		r.chunkRemaining -= n
+
+		if r.chunkRemaining == 0 {
+			r.state = StateChunkEnd
+		}
+		return n, nil
+
+	case StateChunkEnd:
+		if len(data) < len(SEPARATOR) {
+			return 0, nil
+		}
+		if !bytes.HasPrefix(data, SEPARATOR) {
+			return 0, ErrMalformedChunk
+		}
+
+		r.state = StateChunkSize
+		return len(SEPARATOR), nil
+
+	case StateTrailers:
+		n, done, err := r.Trailers.Parse(data)
+		if err != nil {
+			return 0, err
+		}
+
+		if done {
+			r.state = StateDone
+		}
+		return n, nil
+
+	case StateUntilClose:
+		r.Body = append(r.Body, data...)
+		return len(data), nil
+
+	case StateDone:
+		return 0, nil
+	}
+
+	return 0, nil
+}
+
+func (r *Response) parse(data []byte) (int, error) {
+	totalBytesParsed := 0
+
+	for r.state != StateDone {
+		n, err := r.parseSingle(data[totalBytesParsed:])
+		if err != nil {
+			r.state = StateError
+			return 0, err
+		}
+
+		if n == 0 {
+			break
+		}
+
+		totalBytesParsed += n
+	}
+
+	return totalBytesParsed, nil
+}
+
+func (r *Response) done() bool {
+	return r.state == StateDone || r.state == StateError
+}
+
+// parser feeds a Response from reader through a buffer that keeps bytes
+// read past what was parsed
+type parser struct {
+	response *Response
+	reader   io.Reader
+	buf      []byte
+	bufLen   int
+}
+
+func newParser(reader io.Reader, method string) *parser {
+	return &parser{
+		response: newResponse(method),
+		reader:   reader,
+		buf:      make([]byte, initialBufferLen),
+	}
+}
+
+// step does one read and parses as much as it can
+func (p *parser) step() error {
+	// A status line or field that doesn't fit gets more room, up to a limit
+	if p.bufLen == len(p.buf) {
+		if len(p.buf) >= maxLineSize {
+			return ErrLineTooLong
+		}
+		p.buf = append(p.buf, make([]byte, len(p.buf))...)
+	}
+
+	n, readErr := p.reader.Read(p.buf[p.bufLen:])
+	p.bufLen += n
+
+	readN, err := p.response.parse(p.buf[:p.bufLen])
+	if err != nil {
+		return err
+	}
+
+	copy(p.buf, p.buf[readN:p.bufLen])
+	p.bufLen -= readN
+
+	if readErr != nil {
+		if !errors.Is(readErr, io.EOF) {
+			return readErr
+		}
+		if p.response.state == StateUntilClose {
+			p.response.state = StateDone
+			return nil
+		}
+		if !p.response.done() {
+			return io.ErrUnexpectedEOF
+		}
+	}
+
+	if p.response.state == StateError {
+		return fmt.Errorf("response parsing failed")
+	}
+	return nil
+}
+
+// FromReader parses one response from reader. method is the method of the
+// request it answers, a response to HEAD never has a body. 1xx interim
+// responses are collected in Interim. Bodies without Content-Length or
+// chunked framing run until reader returns io.EOF.
+func FromReader(reader io.Reader, method string) (*Response, error) {
+	p := newParser(reader, method)
+	for !p.response.done() {
+		if err := p.step(); err != nil {
+			return nil, err
+		}
+	}
+
+	return p.response, nil
+}
+
+// HeadFromReader parses a response up to the end of its headers and returns
+// the body as a stream instead of collecting it in Body. The body reader
+// undoes chunked framing and returns io.EOF at the end of the body, at
+// which point Trailers are set.
+func HeadFromReader(reader io.Reader, method string) (*Response, io.Reader, error) {
+	p := newParser(reader, method)
+	for p.response.state == StateInit || p.response.state == StateHeaders {
+		if err := p.step(); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	return p.response, &bodyReader{parser: p}, nil
+}
+
+type bodyReader struct {
+	parser  *parser
+	pending []byte
+}
+
+// Read hands out what the parser collected in Body, parsing more when it
+// runs out
+func (b *bodyReader) Read(p []byte) (int, error) {
+	r := b.parser.response
+	for len(b.pending) == 0 {
+		if len(r.Body) > 0 {
+			b.pending, r.Body = r.Body, nil
+			break
+		}
+		if r.done() {
+			return 0, io.EOF
+		}
+		if err := b.parser.step(); err != nil {
+			return 0, err
+		}
+	}
+
+	n := copy(p, b.pending)
+	b.pending = b.pending[n:]
+	return n, nil
+}
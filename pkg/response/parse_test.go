@@ -0,0 +1,262 @@
+package response
+
+import (
+	"bytes"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/spaghetti-lover/go-http/pkg/headers"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type chunkReader struct {
+	data            string
+	numBytesPerRead int
+	offset          int
+}
+
+func (r *chunkReader) Read(p []byte) (n int, err error) {
+	if r.offset >= len(r.data) {
+		return 0, io.EOF
+	}
+
+	n = r.numBytesPerRead
+	if r.offset+n > len(r.data) {
+		n = len(r.data) - r.offset
+	}
+	n = min(n, len(p))
+
+	copy(p, r.data[r.offset:r.offset+n])
+	r.offset += n
+	return n, nil
+}
+
+func TestResponseFromReader_StatusLine(t *testing.T) {
+	// Test: Good status line
+	reader := &chunkReader{
+		data:            "HTTP/1.1 404 Not Found\r\nContent-Length: 0\r\n\r\n",
+		numBytesPerRead: 3,
+	}
+	r, err := FromReader(reader, "GET")
+	require.NoError(t, err)
+	assert.Equal(t, "1.1", r.HttpVersion)
+	assert.Equal(t, NotFound, r.StatusCode)
+	assert.Equal(t, "Not Found", r.Reason)
+
+	// Test: Empty reason phrase
+	reader = &chunkReader{
+		data:            "HTTP/1.1 401\r\nContent-Length: 0\r\n\r\n",
+		numBytesPerRead: 3,
+	}
+	r, err = FromReader(reader, "GET")
+	require.NoError(t, err)
+	assert.Equal(t, StatusCode("401"), r.StatusCode)
+	assert.Equal(t, "", r.Reason)
+
+	// Test: Malformed status lines
+	for _, line := range []string{"HTTP/1.1\r\n", "HTTP/2 200 OK\r\n", "HTTP/1.1 2000 OK\r\n", "HTTP/1.1 abc OK\r\n", "FTP/1.1 200 OK\r\n"} {
+		_, err = FromReader(&chunkReader{data: line + "\r\n", numBytesPerRead: 3}, "GET")
+		require.Error(t, err, line)
+	}
+
+	// Test: Status line longer than the initial buffer
+	long := strings.Repeat("x", 3000)
+	reader = &chunkReader{
+		data:            "HTTP/1.1 200 " + long + "\r\nContent-Length: 0\r\n\r\n",
+		numBytesPerRead: 512,
+	}
+	r, err = FromReader(reader, "GET")
+	require.NoError(t, err)
+	assert.Equal(t, long, r.Reason)
+}
+
+func TestResponseFromReader_Body(t *testing.T) {
+	// Test: Content-Length body
+	reader := &chunkReader{
+		data:            "HTTP/1.1 200 OK\r\nContent-Length: 13\r\n\r\nhello world!\n",
+		numBytesPerRead: 3,
+	}
+	r, err := FromReader(reader, "GET")
+	require.NoError(t, err)
+	assert.Equal(t, "hello world!\n", string(r.Body))
+
+	// Test: Body shorter than Content-Length
+	reader = &chunkReader{
+		data:            "HTTP/1.1 200 OK\r\nContent-Length: 20\r\n\r\npartial",
+		numBytesPerRead: 3,
+	}
+	_, err = FromReader(reader, "GET")
+	require.ErrorIs(t, err, io.ErrUnexpectedEOF)
+
+	// Test: Chunked body with extensions and trailers
+	reader = &chunkReader{
+		data: "HTTP/1.1 200 OK\r\nTransfer-Encoding: chunked\r\nTrailer: X-Sum\r\n\r\n" +
+			"6;name=value\r\nhello \r\n" +
+			"5\r\nworld\r\n" +
+			"0\r\n" +
+			"X-Sum: abc\r\n" +
+			"\r\n",
+		numBytesPerRead: 2,
+	}
+	r, err = FromReader(reader, "GET")
+	require.NoError(t, err)
+	assert.Equal(t, "hello world", string(r.Body))
+	require.NotNil(t, r.Trailers)
+	assert.Equal(t, "abc", r.Trailers.Get("X-Sum"))
+
+	// Test: Malformed chunk
+	reader = &chunkReader{
+		data:            "HTTP/1.1 200 OK\r\nTransfer-Encoding: chunked\r\n\r\nzz\r\nhello\r\n0\r\n\r\n",
+		numBytesPerRead: 3,
+	}
+	_, err = FromReader(reader, "GET")
+	require.ErrorIs(t, err, ErrMalformedChunk)
+
+	// Test: Chunk without trailing CRLF
+	reader = &chunkReader{
+		data:            "HTTP/1.1 200 OK\r\nTransfer-Encoding: chunked\r\n\r\n2\r\nhello\r\n0\r\n\r\n",
+		numBytesPerRead: 3,
+	}
+	_, err = FromReader(reader, "GET")
+	require.ErrorIs(t, err, ErrMalformedChunk)
+
+	// Test: Body delimited by close
+	reader = &chunkReader{
+		data:            "HTTP/1.1 200 OK\r\nConnection: close\r\n\r\nuntil the end",
+		numBytesPerRead: 3,
+	}
+	r, err = FromReader(reader, "GET")
+	require.NoError(t, err)
+	assert.Equal(t, "until the end", string(r.Body))
+
+	// Test: No body for HEAD, 204 and 304
+	for _, tc := range []struct{ method, data string }{
+		{"HEAD", "HTTP/1.1 200 OK\r\nContent-Length: 42\r\n\r\n"},
+		{"GET", "HTTP/1.1 204 No Content\r\n\r\n"},
+		{"GET", "HTTP/1.1 304 Not Modified\r\nContent-Length: 42\r\nETag: \"v1\"\r\n\r\n"},
+	} {
+		r, err = FromReader(&chunkReader{data: tc.data, numBytesPerRead: 3}, tc.method)
+		require.NoError(t, err)
+		assert.Empty(t, r.Body)
+	}
+}
+
+func TestResponseFromReader_Interim(t *testing.T) {
+	reader := &chunkReader{
+		data: "HTTP/1.1 100 Continue\r\n\r\n" +
+			"HTTP/1.1 103 Early Hints\r\nLink: </style.css>; rel=preload\r\n\r\n" +
+			"HTTP/1.1 200 OK\r\nContent-Length: 2\r\n\r\nok",
+		numBytesPerRead: 4,
+	}
+	r, err := FromReader(reader, "POST")
+	require.NoError(t, err)
+	assert.Equal(t, OK, r.StatusCode)
+	assert.Equal(t, "ok", string(r.Body))
+	require.Len(t, r.Interim, 2)
+	assert.Equal(t, Continue, r.Interim[0].StatusCode)
+	assert.Equal(t, EarlyHints, r.Interim[1].StatusCode)
+	assert.Equal(t, "</style.css>; rel=preload", r.Interim[1].Headers.Get("Link"))
+	assert.Equal(t, "", r.Headers.Get("Link"))
+
+	// Test: 101 is final and has no body
+	reader = &chunkReader{
+		data:            "HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\n\r\n",
+		numBytesPerRead: 4,
+	}
+	r, err = FromReader(reader, "GET")
+	require.NoError(t, err)
+	assert.Equal(t, StatusCode("101"), r.StatusCode)
+	assert.Empty(t, r.Interim)
+}
+
+func TestResponseFromReader_WriterRoundTrip(t *testing.T) {
+	var buf bytes.Buffer
+	w := NewWriter(&buf)
+	require.NoError(t, w.WriteInformational(EarlyHints, nil))
+	require.NoError(t, w.WriteStatusLine(OK))
+	h := headers.NewHeaders()
+	h.Set("Transfer-Encoding", "chunked")
+	h.Set("Trailer", "X-Count")
+	require.NoError(t, w.WriteHeaders(h))
+	_, err := w.Write([]byte("round"))
+	require.NoError(t, err)
+	_, err = w.Write([]byte("trip"))
+	require.NoError(t, err)
+	_, err = w.WriteLastChunk()
+	require.NoError(t, err)
+	trailers := headers.NewHeaders()
+	trailers.Set("X-Count", "2")
+	require.NoError(t, w.WriteTrailers(trailers))
+
+	r, err := FromReader(&buf, "GET")
+	require.NoError(t, err)
+	assert.Equal(t, OK, r.StatusCode)
+	assert.Equal(t, "OK", r.Reason)
+	assert.Equal(t, "roundtrip", string(r.Body))
+	assert.Equal(t, "2", r.Trailers.Get("X-Count"))
+	assert.Len(t, r.Interim, 1)
+}
+
+func TestHeadFromReader(t *testing.T) {
+	// Test: Chunked body is streamed, trailers come last
+	reader := &chunkReader{
+		data: "HTTP/1.1 200 OK\r\nTransfer-Encoding: chunked\r\nTrailer: X-Sum\r\n\r\n" +
+			"6\r\nhello \r\n" +
+			"5\r\nworld\r\n" +
+			"0\r\n" +
+			"X-Sum: abc\r\n" +
+			"\r\n",
+		numBytesPerRead: 4,
+	}
+	r, body, err := HeadFromReader(reader, "GET")
+	require.NoError(t, err)
+	assert.Equal(t, OK, r.StatusCode)
+	assert.Equal(t, "X-Sum", r.Headers.Get("Trailer"))
+	assert.Less(t, reader.offset, len(reader.data))
+	assert.Nil(t, r.Trailers)
+
+	out, err := io.ReadAll(body)
+	require.NoError(t, err)
+	assert.Equal(t, "hello world", string(out))
+	assert.Empty(t, r.Body)
+	require.NotNil(t, r.Trailers)
+	assert.Equal(t, "abc", r.Trailers.Get("X-Sum"))
+
+	// Test: A Content-Length body over many reads stops where it ends, with
+	// the next message left unread
+	big := strings.Repeat("x", 5000)
+	reader = &chunkReader{
+		data:            "HTTP/1.1 200 OK\r\nContent-Length: 5000\r\n\r\n" + big + "HTTP/1.1 204 No Content\r\n\r\n",
+		numBytesPerRead: 1,
+	}
+	_, body, err = HeadFromReader(reader, "GET")
+	require.NoError(t, err)
+	out, err = io.ReadAll(body)
+	require.NoError(t, err)
+	assert.Equal(t, big, string(out))
+	assert.Less(t, reader.offset, len(reader.data))
+
+	// Test: Truncated Content-Length body
+	reader = &chunkReader{
+		data:            "HTTP/1.1 200 OK\r\nContent-Length: 20\r\n\r\npartial",
+		numBytesPerRead: 3,
+	}
+	_, body, err = HeadFromReader(reader, "GET")
+	require.NoError(t, err)
+	out, err = io.ReadAll(body)
+	require.ErrorIs(t, err, io.ErrUnexpectedEOF)
+	assert.Equal(t, "partial", string(out))
+
+	// Test: HEAD has an empty body
+	reader = &chunkReader{
+		data:            "HTTP/1.1 200 OK\r\nContent-Length: 20\r\n\r\n",
+		numBytesPerRead: 3,
+	}
+	_, body, err = HeadFromReader(reader, "HEAD")
+	require.NoError(t, err)
+	out, err = io.ReadAll(body)
+	require.NoError(t, err)
+	assert.Empty(t, out)
+}
@@ -1,9 +1,12 @@
 package response
 
 import (
+	"bytes"
 	"fmt"
 	"io"
+	"net"
 	"strconv"
+	"strings"
 
 	"github.com/spaghetti-lover/go-http/pkg/headers"
 )
@@ -11,24 +14,86 @@ import (
 type StatusCode string
 
 const (
-	OK                  StatusCode = "200"
-	BadRequest          StatusCode = "400"
-	InternalServerError StatusCode = "500"
+	Continue                StatusCode = "100"
+	SwitchingProtocols      StatusCode = "101"
+	EarlyHints              StatusCode = "103"
+	OK                      StatusCode = "200"
+	NotModified             StatusCode = "304"
+	BadRequest              StatusCode = "400"
+	Forbidden               StatusCode = "403"
+	NotFound                StatusCode = "404"
+	MethodNotAllowed        StatusCode = "405"
+	PreconditionFailed      StatusCode = "412"
+	ContentTooLarge         StatusCode = "413"
+	UnsupportedMediaType    StatusCode = "415"
+	ExpectationFailed       StatusCode = "417"
+	UpgradeRequired         StatusCode = "426"
+	InternalServerError     StatusCode = "500"
+	BadGateway              StatusCode = "502"
+	ServiceUnavailable      StatusCode = "503"
+	GatewayTimeout          StatusCode = "504"
+	HTTPVersionNotSupported StatusCode = "505"
 )
 
+var statusText = map[StatusCode]string{
+	Continue:                "Continue",
+	SwitchingProtocols:      "Switching Protocols",
+	EarlyHints:              "Early Hints",
+	OK:                      "OK",
+	NotModified:             "Not Modified",
+	BadRequest:              "Bad Request",
+	Forbidden:               "Forbidden",
+	NotFound:                "Not Found",
+	MethodNotAllowed:        "Method Not Allowed",
+	PreconditionFailed:      "Precondition Failed",
+	ContentTooLarge:         "Content Too Large",
+	UnsupportedMediaType:    "Unsupported Media Type",
+	ExpectationFailed:       "Expectation Failed",
+	UpgradeRequired:         "Upgrade Required",
+	InternalServerError:     "internal Server Error",
+	BadGateway:              "Bad Gateway",
+	ServiceUnavailable:      "Service Unavailable",
+	GatewayTimeout:          "Gateway Timeout",
+	HTTPVersionNotSupported: "HTTP Version Not Supported",
+}
+
+func statusLine(statusCode StatusCode) string {
+	if text, ok := statusText[statusCode]; ok {
+		return "HTTP/1.1 " + string(statusCode) + " " + text
+	}
+	return "HTTP/1.1 " + string(statusCode)
+}
+
 type writerState string
 
 const (
-	stateInit     writerState = "init"
-	stateStatus   writerState = "status"
-	stateHeaders  writerState = "headers"
-	stateBody     writerState = "body"
-	stateTrailers writerState = "trailers"
+	stateInit      writerState = "init"
+	stateStatus    writerState = "status"
+	stateHeaders   writerState = "headers"
+	stateBody      writerState = "body"
+	stateChunkDone writerState = "chunkdone"
+	stateTrailers  writerState = "trailers"
 )
 
 type Writer struct {
-	writer io.Writer
-	state  writerState
+	writer        io.Writer
+	state         writerState
+	statusCode    StatusCode
+	chunked       bool
+	closeConn     bool
+	hijacked      bool
+	onHijack      func() []byte
+	filters       []Filter
+	filtersClosed bool
+
+	// requestVersion is the HTTP version of the request being answered,
+	// empty for 1.1. clientKeepAlive is whether an HTTP/1.0 client asked
+	// for Connection: keep-alive.
+	requestVersion  string
+	clientKeepAlive bool
+	// unchunked drops the chunked framing the headers asked for, for
+	// clients that predate it
+	unchunked bool
 }
 
 func NewWriter(w io.Writer) *Writer {
@@ -38,28 +103,92 @@ func NewWriter(w io.Writer) *Writer {
 	}
 }
 
-func (w *Writer) WriteStatusLine(statusCode StatusCode) error {
+// NewConnWriter is NewWriter for a server connection that may be hijacked.
+// onHijack runs when it is, and returns the bytes already read from conn
+// that the caller should see first.
+func NewConnWriter(conn net.Conn, onHijack func() []byte) *Writer {
+	w := NewWriter(conn)
+	w.onHijack = onHijack
+	return w
+}
+
+// SetRequestVersion adapts the response to the HTTP version of the request
+// it answers, before anything is written. Whatever the version, the status
+// line says HTTP/1.1 (RFC 9110 §6.2), but an HTTP/1.0 client gets neither
+// interim responses nor chunked framing: a chunked body is sent as is and
+// ends with the connection. The connection is only kept open when
+// keepAlive, the client having sent Connection: keep-alive, and the body
+// has a Content-Length; the response says which with its Connection field.
+// An HTTP/0.9 client gets the body alone.
+func (w *Writer) SetRequestVersion(version string, keepAlive bool) {
+	if version == "1.1" {
+		version = ""
+	}
+	w.requestVersion = version
+	w.clientKeepAlive = keepAlive
+}
+
+// legacy reports whether the client predates HTTP/1.1
+func (w *Writer) legacy() bool {
+	return w.requestVersion == "1.0" || w.requestVersion == "0.9"
+}
+
+// WriteInformational sends an interim 1xx response such as 100 Continue or
+// 103 Early Hints. It may be called any number of times before
+// WriteStatusLine; h may be nil.
+func (w *Writer) WriteInformational(statusCode StatusCode, h *headers.Headers) error {
 	if w.state != stateInit {
-		return fmt.Errorf("WriteStatusLine must be called first")
+		return fmt.Errorf("WriteInformational must be called before WriteStatusLine")
 	}
 
-	var statusLine string
-	switch statusCode {
-	case OK:
-		statusLine = "HTTP/1.1 200 OK"
-	case BadRequest:
-		statusLine = "HTTP/1.1 400 Bad Request"
-	case InternalServerError:
-		statusLine = "HTTP/1.1 500 internal Server Error"
-	default:
-		statusLine = "HTTP/1.1 " + string(statusCode)
+	// 101 hands the connection to another protocol, it isn't an interim response
+	if len(statusCode) != 3 || statusCode[0] != '1' || statusCode == "101" {
+		return fmt.Errorf("invalid informational status code: %s", statusCode)
 	}
 
-	_, err := w.writer.Write([]byte(statusLine + "\r\n"))
+	// HTTP/1.0 has no interim responses (RFC 9110 §15.2)
+	if w.legacy() {
+		return nil
+	}
+
+	_, err := w.writer.Write([]byte(statusLine(statusCode) + "\r\n"))
 	if err != nil {
 		return fmt.Errorf("error writing status line: %w", err)
 	}
 
+	if h != nil {
+		for key, value := range h.All() {
+			for _, value := range fieldValues(h, key, value) {
+				headerLine := fmt.Sprintf("%s: %s\r\n", key, value)
+				_, err := w.writer.Write([]byte(headerLine))
+				if err != nil {
+					return fmt.Errorf("error writing header: %w", err)
+				}
+			}
+		}
+	}
+
+	_, err = w.writer.Write([]byte("\r\n"))
+	if err != nil {
+		return fmt.Errorf("error writing header separator: %w", err)
+	}
+
+	return nil
+}
+
+func (w *Writer) WriteStatusLine(statusCode StatusCode) error {
+	if w.state != stateInit {
+		return fmt.Errorf("WriteStatusLine must be called first")
+	}
+
+	if w.requestVersion != "0.9" {
+		_, err := w.writer.Write([]byte(statusLine(statusCode) + "\r\n"))
+		if err != nil {
+			return fmt.Errorf("error writing status line: %w", err)
+		}
+	}
+
+	w.statusCode = statusCode
 	w.state = stateStatus
 	return nil
 }
@@ -69,13 +198,47 @@ func (w *Writer) WriteHeaders(h *headers.Headers) error {
 		return fmt.Errorf("WriteHeaders must be called after WriteStatusLine")
 	}
 
+	// Innermost filter (added last) sees the handler's headers first
+	for i := len(w.filters) - 1; i >= 0; i-- {
+		w.filters[i].Headers(w.statusCode, h)
+	}
+	w.dropBypassed()
+
+	w.chunked = strings.Contains(strings.ToLower(h.Get("Transfer-Encoding")), "chunked")
+	if w.chunked && w.legacy() {
+		h.Del("Transfer-Encoding")
+		w.chunked = false
+		w.unchunked = true
+	}
+
+	// A body without a length only ends when the connection does
+	closeDelimited := bodyAllowed(w.statusCode) && !w.chunked && h.Get("Content-Length") == ""
+	w.closeConn = closeDelimited || h.HasToken("Connection", "close")
+
+	switch w.requestVersion {
+	case "1.0":
+		// HTTP/1.0 connections close unless both sides say otherwise
+		if w.closeConn || !w.clientKeepAlive {
+			w.closeConn = true
+			h.Override("Connection", "close")
+		} else {
+			h.Override("Connection", "keep-alive")
+		}
+	case "0.9":
+		w.closeConn = true
+		w.state = stateHeaders
+		return nil
+	}
+
 	allHeaders := h.All()
 
 	for key, value := range allHeaders {
-		headerLine := fmt.Sprintf("%s: %s\r\n", key, value)
-		_, err := w.writer.Write([]byte(headerLine))
-		if err != nil {
-			return fmt.Errorf("error writing header: %w", err)
+		for _, value := range fieldValues(h, key, value) {
+			headerLine := fmt.Sprintf("%s: %s\r\n", key, value)
+			_, err := w.writer.Write([]byte(headerLine))
+			if err != nil {
+				return fmt.Errorf("error writing header: %w", err)
+			}
 		}
 	}
 
@@ -94,7 +257,64 @@ func (w *Writer) WriteBody(p []byte) (int, error) {
 		return 0, fmt.Errorf("WriteBody must be called after WriteHeaders")
 	}
 
-	n, err := w.writer.Write(p)
+	return w.writeBody(p)
+}
+
+// Write implements io.Writer for the response body. Unlike WriteBody it may
+// be called repeatedly, and p is framed as a chunk when the headers declared
+// Transfer-Encoding: chunked.
+func (w *Writer) Write(p []byte) (int, error) {
+	if w.chunked {
+		return w.WriteChunkedBody(p)
+	}
+
+	if w.state != stateHeaders && w.state != stateBody {
+		return 0, fmt.Errorf("Write must be called after WriteHeaders")
+	}
+
+	return w.writeBody(p)
+}
+
+// writeBody sends p through the filters and frames it according to the
+// headers that were actually written, which a filter may have switched to
+// chunked
+func (w *Writer) writeBody(p []byte) (int, error) {
+	out, err := w.filter(p)
+	if err != nil {
+		return 0, err
+	}
+
+	if w.chunked {
+		if err := w.writeChunk(out); err != nil {
+			return 0, err
+		}
+	} else {
+		_, err = w.writer.Write(out)
+		if err != nil {
+			return 0, fmt.Errorf("error writing body: %w", err)
+		}
+	}
+
+	w.state = stateBody
+	return len(p), nil
+}
+
+// ReadFrom implements io.ReaderFrom so io.Copy(w, f) can stream a body
+// without holding it in memory. For non-chunked responses the copy is handed
+// to the underlying connection, which lets *net.TCPConn use sendfile/splice
+// when src is an *os.File. Connections without zero-copy support (e.g. TLS)
+// fall back to a buffered copy, and chunked or filtered responses are
+// written piece by piece. Filters that bypass the response don't count.
+func (w *Writer) ReadFrom(src io.Reader) (int64, error) {
+	if w.state != stateHeaders && w.state != stateBody {
+		return 0, fmt.Errorf("ReadFrom must be called after WriteHeaders")
+	}
+
+	if w.chunked || len(w.filters) > 0 {
+		return w.readFromBuffered(src)
+	}
+
+	n, err := io.Copy(w.writer, src)
 	if err != nil {
 		return n, fmt.Errorf("error writing body: %w", err)
 	}
@@ -103,6 +323,29 @@ func (w *Writer) WriteBody(p []byte) (int, error) {
 	return n, nil
 }
 
+func (w *Writer) readFromBuffered(src io.Reader) (int64, error) {
+	var total int64
+	buf := make([]byte, 32*1024)
+	for {
+		n, err := src.Read(buf)
+		if n > 0 {
+			written, writeErr := w.Write(buf[:n])
+			total += int64(written)
+			if writeErr != nil {
+				return total, writeErr
+			}
+		}
+
+		if err == io.EOF {
+			return total, nil
+		}
+
+		if err != nil {
+			return total, fmt.Errorf("error reading body: %w", err)
+		}
+	}
+}
+
 func (w *Writer) WriteChunkedBody(p []byte) (int, error) {
 	if w.state != stateHeaders && w.state != stateBody {
 		return 0, fmt.Errorf("WriteChunkedBody must be called after WriteHeaders")
@@ -112,83 +355,220 @@ func (w *Writer) WriteChunkedBody(p []byte) (int, error) {
 		return 0, nil
 	}
 
+	out, err := w.filter(p)
+	if err != nil {
+		return 0, err
+	}
+
+	if err := w.writeChunk(out); err != nil {
+		return 0, err
+	}
+
+	w.state = stateBody
+	return len(p), nil
+}
+
+func (w *Writer) writeChunk(p []byte) error {
+	// A zero-sized chunk would end the body, filters may legitimately
+	// produce no output for a given input
+	if len(p) == 0 {
+		return nil
+	}
+
+	if w.unchunked {
+		_, err := w.writer.Write(p)
+		if err != nil {
+			return fmt.Errorf("error writing body: %w", err)
+		}
+		return nil
+	}
+
 	// Write chunk size in hexadecimal
 	chunkSize := fmt.Sprintf("%X\r\n", len(p))
 	_, err := w.writer.Write([]byte(chunkSize))
 	if err != nil {
-		return 0, fmt.Errorf("error writing chunk size: %w", err)
+		return fmt.Errorf("error writing chunk size: %w", err)
 	}
 
 	// Write chunk data
-	n, err := w.writer.Write(p)
+	_, err = w.writer.Write(p)
 	if err != nil {
-		return n, fmt.Errorf("error writing chunk data: %w", err)
+		return fmt.Errorf("error writing chunk data: %w", err)
 	}
 
 	// Write trailing CRLF
 	_, err = w.writer.Write([]byte("\r\n"))
 	if err != nil {
-		return n, fmt.Errorf("error writing chunk trailing CRLF: %w", err)
+		return fmt.Errorf("error writing chunk trailing CRLF: %w", err)
 	}
 
-	w.state = stateBody
-	return n, nil
+	return nil
 }
 
+// WriteChunkedBodyDone ends a chunked body with the last chunk and an empty
+// trailer section, completing the message. To send trailers, end it with
+// WriteLastChunk and WriteTrailers instead.
 func (w *Writer) WriteChunkedBodyDone() (int, error) {
+	n, err := w.WriteLastChunk()
+	if err != nil {
+		return n, err
+	}
+	m, err := w.writeTrailers(headers.NewHeaders())
+	return n + m, err
+}
+
+// WriteLastChunk writes the last (zero-sized) chunk, leaving the message to
+// be completed by WriteTrailers, or by Finish when there are no trailers
+func (w *Writer) WriteLastChunk() (int, error) {
 	if w.state != stateHeaders && w.state != stateBody {
-		return 0, fmt.Errorf("WriteChunkedBodyDone muse be called after WriteHeaders or WriteChunkedBody")
+		return 0, fmt.Errorf("WriteLastChunk must be called after WriteHeaders or WriteChunkedBody")
+	}
+
+	// Whatever the filters still hold goes out before the last chunk
+	rest, err := w.closeFilters()
+	if err != nil {
+		return 0, err
+	}
+	if err := w.writeChunk(rest); err != nil {
+		return 0, err
+	}
+
+	if w.unchunked {
+		w.state = stateChunkDone
+		return 0, nil
 	}
 
-	// Write final chunk: "0\r\n\r\n"
-	n, err := w.writer.Write([]byte("0\r\n\r\n"))
+	// Write last chunk: "0\r\n", the trailer section follows
+	n, err := w.writer.Write([]byte("0\r\n"))
 	if err != nil {
 		return n, fmt.Errorf("error writing final chunk: %w", err)
 	}
 
-	w.state = stateBody
+	w.state = stateChunkDone
 	return n, nil
 }
 
 func (w *Writer) WriteTrailers(h *headers.Headers) error {
-	if w.state != stateBody {
-		return fmt.Errorf("WriteTrailers must be called after WriteChunkedBodyDone")
+	_, err := w.writeTrailers(h)
+	return err
+}
+
+// writeTrailers writes the trailer section, filters' trailers included,
+// returning how many bytes it took
+func (w *Writer) writeTrailers(h *headers.Headers) (int, error) {
+	if w.state != stateChunkDone {
+		return 0, fmt.Errorf("WriteTrailers must be called after WriteLastChunk")
 	}
 
-	allHeaders := h.All()
+	for i := len(w.filters) - 1; i >= 0; i-- {
+		w.filters[i].Trailers(h)
+	}
 
-	for key, value := range allHeaders {
-		trailerLine := fmt.Sprintf("%s: %s\r\n", key, value)
-		_, err := w.writer.Write([]byte(trailerLine))
-		if err != nil {
-			return fmt.Errorf("error writing trailer: %w", err)
+	// Without chunked framing there's nowhere to put trailers
+	if w.unchunked {
+		w.state = stateTrailers
+		return 0, nil
+	}
+
+	var buf bytes.Buffer
+	for key, value := range h.All() {
+		for _, value := range fieldValues(h, key, value) {
+			fmt.Fprintf(&buf, "%s: %s\r\n", key, value)
 		}
 	}
+	// Final CRLF ends the trailers
+	buf.WriteString("\r\n")
 
-	// Write final CRLF to end trailers
-	_, err := w.writer.Write([]byte("\r\n"))
+	n, err := w.writer.Write(buf.Bytes())
 	if err != nil {
-		return fmt.Errorf("error writing trailer separator: %w", err)
+		return n, fmt.Errorf("error writing trailers: %w", err)
 	}
 
 	w.state = stateTrailers
+	return n, nil
+}
+
+// Finish completes the response after the handler returned: a chunked body
+// gets its last chunk and (possibly empty) trailer section, and filters are
+// flushed. It's safe to call more than once, the server calls it for every
+// request.
+func (w *Writer) Finish() error {
+	if w.hijacked || !bodyAllowed(w.statusCode) {
+		return nil
+	}
+
+	switch w.state {
+	case stateHeaders, stateBody:
+		if w.chunked {
+			_, err := w.WriteChunkedBodyDone()
+			return err
+		}
+
+		rest, err := w.closeFilters()
+		if err != nil {
+			return err
+		}
+		if len(rest) > 0 {
+			_, err = w.writer.Write(rest)
+			if err != nil {
+				return fmt.Errorf("error writing body: %w", err)
+			}
+		}
+		w.state = stateBody
+	case stateChunkDone:
+		return w.WriteTrailers(headers.NewHeaders())
+	}
+
 	return nil
 }
 
+var ErrNotHijackable = fmt.Errorf("writer is not backed by a connection")
+var ErrHijacked = fmt.Errorf("connection has been hijacked")
+
+// Hijack hands the underlying connection to the caller, for tunnels and
+// protocols other than HTTP, along with any bytes the server read past the
+// request. Whatever was written so far has been sent, and from now on the
+// writer and the server leave the connection alone: it isn't finished,
+// reused or closed for the caller.
+func (w *Writer) Hijack() (net.Conn, []byte, error) {
+	conn, ok := w.writer.(net.Conn)
+	if !ok {
+		return nil, nil, ErrNotHijackable
+	}
+	if w.hijacked {
+		return nil, nil, ErrHijacked
+	}
+
+	w.hijacked = true
+	var buffered []byte
+	if w.onHijack != nil {
+		buffered = w.onHijack()
+	}
+	return conn, buffered, nil
+}
+
+// Hijacked reports whether Hijack handed the connection over
+func (w *Writer) Hijacked() bool {
+	return w.hijacked
+}
+
+// KeepAlive reports whether the connection can carry another exchange once
+// the response is finished: headers were written, the body is delimited by
+// Content-Length or chunked framing, and Connection: close wasn't sent
+func (w *Writer) KeepAlive() bool {
+	if w.hijacked || w.state == stateInit || w.state == stateStatus {
+		return false
+	}
+	return !w.closeConn
+}
+
+// bodyAllowed reports whether a response with this status may carry a body
+func bodyAllowed(statusCode StatusCode) bool {
+	return statusCode != "" && statusCode[0] != '1' && statusCode != "204" && statusCode != NotModified
+}
+
 func WriteStatusLine(w io.Writer, statusCode StatusCode) error {
-	var statusLine string
-	switch statusCode {
-	case OK:
-		statusLine = "HTTP/1.1 200 OK"
-	case BadRequest:
-		statusLine = "HTTP/1.1 400 Bad Request"
-	case InternalServerError:
-		statusLine = "HTTP/1.1 500 internal Server Error"
-	default:
-		statusLine = "HTTP/1.1 " + string(statusCode)
-	}
-
-	_, err := w.Write([]byte(statusLine + "\r\n"))
+	_, err := w.Write([]byte(statusLine(statusCode) + "\r\n"))
 	if err != nil {
 		return fmt.Errorf("error writing status line: %w", err)
 	}
@@ -196,6 +576,16 @@ func WriteStatusLine(w io.Writer, statusCode StatusCode) error {
 	return nil
 }
 
+// fieldValues returns what goes on the wire for the field key, a line per
+// value. Set-Cookie values can't be joined with commas (RFC 9110 §5.3), the
+// others go out as one line.
+func fieldValues(h *headers.Headers, key, value string) []string {
+	if key == "set-cookie" {
+		return h.Values(key)
+	}
+	return []string{value}
+}
+
 func GetDefaultHeaders(contentLen int) *headers.Headers {
 	h := headers.NewHeaders()
 	h.Set("Content-Length", strconv.Itoa(contentLen))
@@ -208,10 +598,12 @@ func WriteHeaders(w io.Writer, h *headers.Headers) error {
 	allHeaders := h.All()
 
 	for key, value := range allHeaders {
-		headerLine := fmt.Sprintf("%s: %s\r\n", key, value)
-		_, err := w.Write([]byte(headerLine))
-		if err != nil {
-			return fmt.Errorf("error writing header: %w", err)
+		for _, value := range fieldValues(h, key, value) {
+			headerLine := fmt.Sprintf("%s: %s\r\n", key, value)
+			_, err := w.Write([]byte(headerLine))
+			if err != nil {
+				return fmt.Errorf("error writing header: %w", err)
+			}
 		}
 	}
 
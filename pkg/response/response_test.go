@@ -0,0 +1,407 @@
+package response
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/spaghetti-lover/go-http/pkg/headers"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWriterReadFrom(t *testing.T) {
+	// Test: Plain body
+	var buf bytes.Buffer
+	w := NewWriter(&buf)
+	require.NoError(t, w.WriteStatusLine(OK))
+	h := headers.NewHeaders()
+	h.Set("Content-Length", "11")
+	require.NoError(t, w.WriteHeaders(h))
+	n, err := io.Copy(w, strings.NewReader("hello world"))
+	require.NoError(t, err)
+	assert.Equal(t, int64(11), n)
+	assert.Equal(t, "HTTP/1.1 200 OK\r\ncontent-length: 11\r\n\r\nhello world", buf.String())
+
+	// Test: Chunked body
+	buf.Reset()
+	w = NewWriter(&buf)
+	require.NoError(t, w.WriteStatusLine(OK))
+	h = headers.NewHeaders()
+	h.Set("Transfer-Encoding", "chunked")
+	require.NoError(t, w.WriteHeaders(h))
+	n, err = w.ReadFrom(strings.NewReader("hello world"))
+	require.NoError(t, err)
+	assert.Equal(t, int64(11), n)
+	require.NoError(t, w.Finish())
+	assert.Equal(t, "HTTP/1.1 200 OK\r\ntransfer-encoding: chunked\r\n\r\nB\r\nhello world\r\n0\r\n\r\n", buf.String())
+
+	// Test: Called before headers
+	w = NewWriter(&buf)
+	_, err = w.ReadFrom(strings.NewReader("hello"))
+	require.Error(t, err)
+}
+
+func TestWriterChunkedTrailers(t *testing.T) {
+	var buf bytes.Buffer
+	w := NewWriter(&buf)
+	require.NoError(t, w.WriteStatusLine(OK))
+	h := headers.NewHeaders()
+	h.Set("Transfer-Encoding", "chunked")
+	h.Set("Trailer", "X-Count")
+	require.NoError(t, w.WriteHeaders(h))
+	_, err := w.WriteChunkedBody([]byte("abc"))
+	require.NoError(t, err)
+	_, err = w.WriteLastChunk()
+	require.NoError(t, err)
+	trailers := headers.NewHeaders()
+	trailers.Set("X-Count", "3")
+	require.NoError(t, w.WriteTrailers(trailers))
+
+	// Finish after trailers is a no-op
+	require.NoError(t, w.Finish())
+	assert.True(t, strings.HasSuffix(buf.String(), "\r\n\r\n3\r\nabc\r\n0\r\nx-count: 3\r\n\r\n"))
+}
+
+func TestWriterChunkedBodyDone(t *testing.T) {
+	var buf bytes.Buffer
+	w := NewWriter(&buf)
+	require.NoError(t, w.WriteStatusLine(OK))
+	h := headers.NewHeaders()
+	h.Set("Transfer-Encoding", "chunked")
+	require.NoError(t, w.WriteHeaders(h))
+	_, err := w.WriteChunkedBody([]byte("abc"))
+	require.NoError(t, err)
+
+	// Test: WriteChunkedBodyDone completes the message on its own
+	n, err := w.WriteChunkedBodyDone()
+	require.NoError(t, err)
+	assert.Equal(t, 5, n)
+	assert.True(t, strings.HasSuffix(buf.String(), "\r\n\r\n3\r\nabc\r\n0\r\n\r\n"))
+
+	// Test: Nothing can follow it
+	require.Error(t, w.WriteTrailers(headers.NewHeaders()))
+	require.NoError(t, w.Finish())
+	assert.True(t, strings.HasSuffix(buf.String(), "\r\n0\r\n\r\n"))
+}
+
+func TestWriterRequestVersion(t *testing.T) {
+	write := func(version string, keepAlive bool, h *headers.Headers) (string, bool) {
+		var buf bytes.Buffer
+		w := NewWriter(&buf)
+		w.SetRequestVersion(version, keepAlive)
+		require.NoError(t, w.WriteInformational(Continue, nil))
+		require.NoError(t, w.WriteStatusLine(OK))
+		chunked := h.Get("Transfer-Encoding") != ""
+		require.NoError(t, w.WriteHeaders(h))
+		_, err := w.Write([]byte("abc"))
+		require.NoError(t, err)
+		if chunked {
+			_, err = w.WriteLastChunk()
+			require.NoError(t, err)
+			trailers := headers.NewHeaders()
+			trailers.Set("X-Count", "3")
+			require.NoError(t, w.WriteTrailers(trailers))
+		}
+		require.NoError(t, w.Finish())
+		return buf.String(), w.KeepAlive()
+	}
+	chunked := func() *headers.Headers {
+		h := headers.NewHeaders()
+		h.Set("Transfer-Encoding", "chunked")
+		return h
+	}
+	sized := func() *headers.Headers {
+		h := headers.NewHeaders()
+		h.Set("Content-Length", "3")
+		return h
+	}
+
+	// Test: HTTP/1.0 gets no 100 Continue and no chunked framing or trailers
+	out, keepAlive := write("1.0", true, chunked())
+	assert.Equal(t, "HTTP/1.1 200 OK\r\nconnection: close\r\n\r\nabc", out)
+	assert.False(t, keepAlive)
+
+	// Test: HTTP/1.0 keep-alive needs a length and the client asking for it
+	out, keepAlive = write("1.0", true, sized())
+	assert.Contains(t, out, "connection: keep-alive\r\n")
+	assert.True(t, strings.HasSuffix(out, "\r\n\r\nabc"))
+	assert.True(t, keepAlive)
+
+	out, keepAlive = write("1.0", false, sized())
+	assert.Contains(t, out, "connection: close\r\n")
+	assert.False(t, keepAlive)
+
+	// Test: HTTP/0.9 gets the body alone
+	out, keepAlive = write("0.9", false, chunked())
+	assert.Equal(t, "abc", out)
+	assert.False(t, keepAlive)
+
+	// Test: HTTP/1.1 is unchanged
+	out, keepAlive = write("1.1", false, chunked())
+	assert.Equal(t, "HTTP/1.1 100 Continue\r\n\r\nHTTP/1.1 200 OK\r\ntransfer-encoding: chunked\r\n\r\n3\r\nabc\r\n0\r\nx-count: 3\r\n\r\n", out)
+	assert.True(t, keepAlive)
+}
+
+func TestWriterFilter(t *testing.T) {
+	var buf bytes.Buffer
+	w := NewWriter(&buf)
+	w.AddFilter(&tagFilter{tag: "outer"})
+	w.AddFilter(&tagFilter{tag: "inner"})
+	require.NoError(t, w.WriteStatusLine(OK))
+	require.NoError(t, w.WriteHeaders(headers.NewHeaders()))
+	_, err := w.Write([]byte("body"))
+	require.NoError(t, err)
+	require.NoError(t, w.Finish())
+
+	out := buf.String()
+	assert.Contains(t, out, "transfer-encoding: chunked\r\n")
+	assert.Contains(t, out, "x-filters: inner, outer\r\n")
+	assert.True(t, strings.HasSuffix(out, "\r\n\r\n"+
+		"12\r\n<outer><inner>body\r\n"+
+		"17\r\n<outer></inner></outer>\r\n"+
+		"0\r\nx-filters: inner, outer\r\n\r\n"))
+}
+
+// readFromRecorder is a connection that notes whether a copy was handed
+// to it, as sendfile needs
+type readFromRecorder struct {
+	bytes.Buffer
+	handedOff bool
+}
+
+func (r *readFromRecorder) ReadFrom(src io.Reader) (int64, error) {
+	r.handedOff = true
+	return r.Buffer.ReadFrom(src)
+}
+
+func TestWriterFilterBypass(t *testing.T) {
+	var conn readFromRecorder
+	w := NewWriter(&conn)
+	w.AddFilter(&bypassFilter{})
+	require.NoError(t, w.WriteStatusLine(OK))
+	h := headers.NewHeaders()
+	h.Set("Content-Length", "5")
+	require.NoError(t, w.WriteHeaders(h))
+
+	// Test: A filter leaving the response alone keeps ReadFrom zero-copy
+	_, err := io.Copy(w, struct{ io.Reader }{strings.NewReader("hello")})
+	require.NoError(t, err)
+	require.NoError(t, w.Finish())
+	assert.True(t, conn.handedOff)
+	assert.Contains(t, conn.String(), "x-seen: yes\r\n")
+	assert.True(t, strings.HasSuffix(conn.String(), "\r\n\r\nhello"))
+}
+
+// bypassFilter marks the headers and leaves the body alone
+type bypassFilter struct{}
+
+func (f *bypassFilter) Headers(statusCode StatusCode, h *headers.Headers) {
+	h.Set("X-Seen", "yes")
+}
+
+func (f *bypassFilter) Body(p []byte) ([]byte, error) {
+	panic("bypassed filter got the body")
+}
+
+func (f *bypassFilter) Close() ([]byte, error) {
+	panic("bypassed filter was closed")
+}
+
+func (f *bypassFilter) Trailers(h *headers.Headers) {}
+
+func (f *bypassFilter) Bypass() bool {
+	return true
+}
+
+// tagFilter wraps every piece of body in its tag and closes it at the end
+type tagFilter struct {
+	tag string
+}
+
+func (f *tagFilter) Headers(statusCode StatusCode, h *headers.Headers) {
+	h.Override("Transfer-Encoding", "chunked")
+	h.Set("X-Filters", f.tag)
+}
+
+func (f *tagFilter) Body(p []byte) ([]byte, error) {
+	return append([]byte("<"+f.tag+">"), p...), nil
+}
+
+func (f *tagFilter) Close() ([]byte, error) {
+	return []byte("</" + f.tag + ">"), nil
+}
+
+func (f *tagFilter) Trailers(h *headers.Headers) {
+	h.Set("X-Filters", f.tag)
+}
+
+func TestWriterReadFromFile(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "body.bin")
+	data := bytes.Repeat([]byte("0123456789abcdef"), 64*1024)
+	require.NoError(t, os.WriteFile(name, data, 0o644))
+
+	client, server := tcpPair(t)
+	received := make(chan []byte, 1)
+	go func() {
+		b, _ := io.ReadAll(client)
+		received <- b
+	}()
+
+	f, err := os.Open(name)
+	require.NoError(t, err)
+	defer f.Close()
+
+	w := NewWriter(server)
+	require.NoError(t, w.WriteStatusLine(OK))
+	h := headers.NewHeaders()
+	h.Set("Content-Length", strconv.Itoa(len(data)))
+	require.NoError(t, w.WriteHeaders(h))
+	n, err := io.Copy(w, f)
+	require.NoError(t, err)
+	assert.Equal(t, int64(len(data)), n)
+	server.Close()
+
+	out := <-received
+	prefix := "HTTP/1.1 200 OK\r\ncontent-length: " + strconv.Itoa(len(data)) + "\r\n\r\n"
+	require.True(t, bytes.HasPrefix(out, []byte(prefix)))
+	assert.Equal(t, data, out[len(prefix):])
+}
+
+// tcpPair returns both ends of a loopback TCP connection so the writer sees a
+// real *net.TCPConn and can take the sendfile path.
+func tcpPair(tb testing.TB) (client, server net.Conn) {
+	tb.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(tb, err)
+	defer ln.Close()
+
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		conn, _ := ln.Accept()
+		accepted <- conn
+	}()
+
+	client, err = net.Dial("tcp", ln.Addr().String())
+	require.NoError(tb, err)
+	server = <-accepted
+	require.NotNil(tb, server)
+
+	tb.Cleanup(func() {
+		client.Close()
+		server.Close()
+	})
+	return client, server
+}
+
+func benchmarkFile(b *testing.B) (string, int) {
+	b.Helper()
+	name := filepath.Join(b.TempDir(), "body.bin")
+	data := bytes.Repeat([]byte{'x'}, 8<<20)
+	require.NoError(b, os.WriteFile(name, data, 0o644))
+	return name, len(data)
+}
+
+func benchmarkConn(b *testing.B) net.Conn {
+	b.Helper()
+	client, server := tcpPair(b)
+	go io.Copy(io.Discard, client)
+	return server
+}
+
+func writeHead(b *testing.B, w *Writer, size int) {
+	h := headers.NewHeaders()
+	h.Set("Content-Length", strconv.Itoa(size))
+	if err := w.WriteStatusLine(OK); err != nil {
+		b.Fatal(err)
+	}
+	if err := w.WriteHeaders(h); err != nil {
+		b.Fatal(err)
+	}
+}
+
+// BenchmarkWriteBody is the buffered path: the whole file is read into memory
+// and written with WriteBody.
+func BenchmarkWriteBody(b *testing.B) {
+	name, size := benchmarkFile(b)
+	conn := benchmarkConn(b)
+	b.SetBytes(int64(size))
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		data, err := os.ReadFile(name)
+		if err != nil {
+			b.Fatal(err)
+		}
+		w := NewWriter(conn)
+		writeHead(b, w, size)
+		if _, err := w.WriteBody(data); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// BenchmarkReadFrom streams the file with io.Copy, which ends up in sendfile
+func BenchmarkReadFrom(b *testing.B) {
+	name, size := benchmarkFile(b)
+	conn := benchmarkConn(b)
+	b.SetBytes(int64(size))
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		f, err := os.Open(name)
+		if err != nil {
+			b.Fatal(err)
+		}
+		w := NewWriter(conn)
+		writeHead(b, w, size)
+		if _, err := io.Copy(w, f); err != nil {
+			b.Fatal(err)
+		}
+		f.Close()
+	}
+}
+
+func TestWriteInformational(t *testing.T) {
+	var buf bytes.Buffer
+	w := NewWriter(&buf)
+
+	h := headers.NewHeaders()
+	h.Set("Link", "</style.css>; rel=preload; as=style")
+	require.NoError(t, w.WriteInformational(EarlyHints, h))
+	require.NoError(t, w.WriteInformational(Continue, nil))
+	require.Error(t, w.WriteInformational(OK, nil))
+	require.Error(t, w.WriteInformational("101", nil))
+
+	require.NoError(t, w.WriteStatusLine(OK))
+	require.Error(t, w.WriteInformational(Continue, nil))
+
+	assert.Equal(t, "HTTP/1.1 103 Early Hints\r\n"+
+		"link: </style.css>; rel=preload; as=style\r\n\r\n"+
+		"HTTP/1.1 100 Continue\r\n\r\n"+
+		"HTTP/1.1 200 OK\r\n", buf.String())
+}
+
+func TestWriterSetCookie(t *testing.T) {
+	var buf bytes.Buffer
+	w := NewWriter(&buf)
+
+	// Test: Set-Cookie is never joined, each value gets its own line
+	h := headers.NewHeaders()
+	h.Set("Set-Cookie", "a=1; Expires=Wed, 21 Oct 2026 07:28:00 GMT")
+	h.Set("Set-Cookie", "b=2")
+	h.Set("Vary", "Accept")
+	h.Set("Vary", "Origin")
+	require.NoError(t, w.WriteStatusLine(OK))
+	require.NoError(t, w.WriteHeaders(h))
+
+	out := buf.String()
+	assert.Contains(t, out, "\r\nset-cookie: a=1; Expires=Wed, 21 Oct 2026 07:28:00 GMT\r\nset-cookie: b=2\r\n")
+	assert.Contains(t, out, "\r\nvary: Accept, Origin\r\n")
+	assert.Equal(t, 2, strings.Count(out, "set-cookie:"))
+}
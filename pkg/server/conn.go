@@ -0,0 +1,87 @@
+package server
+
+import (
+	"crypto/tls"
+	"io"
+	"net"
+	"net/netip"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/spaghetti-lover/go-http/internal/netutil"
+	"github.com/spaghetti-lover/go-http/pkg/proxyproto"
+	"github.com/spaghetti-lover/go-http/pkg/request"
+)
+
+// connection is an accepted connection with what the server knows about it
+type connection struct {
+	net.Conn
+	id           uint64
+	started      time.Time
+	requests     atomic.Int64
+	bytesRead    atomic.Int64
+	bytesWritten atomic.Int64
+
+	// mu orders state changes and the hooks reporting them
+	mu    sync.Mutex
+	state ConnState
+}
+
+func (s *Server) newConnection(conn net.Conn) *connection {
+	return &connection{Conn: conn, id: s.connIDs.Add(1), started: time.Now()}
+}
+
+func (c *connection) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	c.bytesRead.Add(int64(n))
+	return n, err
+}
+
+func (c *connection) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	c.bytesWritten.Add(int64(n))
+	return n, err
+}
+
+// ReadFrom counts bytes the response writer sends without copying them,
+// files for the most part
+func (c *connection) ReadFrom(r io.Reader) (int64, error) {
+	n, err := netutil.ReadFrom(c.Conn, r)
+	c.bytesWritten.Add(n)
+	return n, err
+}
+
+// CloseWrite lets a handler that took the connection over, a CONNECT
+// tunnel say, half-close it to the client
+func (c *connection) CloseWrite() error {
+	return netutil.CloseWrite(c.Conn)
+}
+
+// identify counts req on the connection it arrived on and tells it who it's
+// talking to
+func (s *Server) identify(conn net.Conn, req *request.Request) {
+	req.Conn = request.ConnInfo{RemoteAddr: conn.RemoteAddr(), LocalAddr: conn.LocalAddr()}
+
+	if c, ok := conn.(*connection); ok {
+		req.Conn.ID = c.id
+		req.Conn.Requests = c.requests.Add(1)
+		conn = c.Conn
+	}
+	if proxied, ok := conn.(*proxyproto.Conn); ok {
+		if proxied.Header != nil {
+			req.Conn.Proxy = proxied.Header
+		}
+		conn = proxied.Conn
+	}
+	if tlsConn, ok := conn.(interface{ ConnectionState() tls.ConnectionState }); ok {
+		state := tlsConn.ConnectionState()
+		req.Conn.TLS = &state
+	}
+
+	var remote netip.Addr
+	if addrPort, err := netip.ParseAddrPort(req.Conn.RemoteAddr.String()); err == nil {
+		remote = addrPort.Addr()
+	}
+	req.ClientIP = request.ForwardedClientIP(remote, req.Headers, s.forwarded, s.trustedProxies)
+}
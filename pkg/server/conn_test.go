@@ -0,0 +1,110 @@
+package server
+
+import (
+	"bufio"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"net/netip"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/spaghetti-lover/go-http/pkg/headers"
+	"github.com/spaghetti-lover/go-http/pkg/request"
+	"github.com/spaghetti-lover/go-http/pkg/response"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// connInfoHandler answers with what the request knows of its connection
+func connInfoHandler(w *response.Writer, req *request.Request) {
+	info := req.Conn
+	body := fmt.Sprintf("%d %d %s %s %s %v", info.ID, info.Requests, info.RemoteAddr, info.LocalAddr, req.ClientIP, info.TLS != nil)
+	w.WriteStatusLine(response.OK)
+	h := headers.NewHeaders()
+	h.Set("Content-Length", strconv.Itoa(len(body)))
+	w.WriteHeaders(h)
+	w.WriteBody([]byte(body))
+}
+
+// readInfo reads a connInfoHandler response
+func readInfo(t *testing.T, r *bufio.Reader) []string {
+	t.Helper()
+	head := readHead(t, r)
+	_, value, _ := strings.Cut(head, "content-length: ")
+	n, err := strconv.Atoi(value[:strings.Index(value, "\r\n")])
+	require.NoError(t, err)
+	return strings.Fields(readBody(t, r, n))
+}
+
+func TestConnInfo(t *testing.T) {
+	get := "GET / HTTP/1.1\r\nHost: localhost\r\nX-Forwarded-For: 203.0.113.9\r\n\r\n"
+
+	// Test: Requests on a connection share its ID and are counted
+	srv := startServer(t, connInfoHandler)
+	conn, r := dial(t, srv)
+	_, err := io.WriteString(conn, get+get)
+	require.NoError(t, err)
+	first, second := readInfo(t, r), readInfo(t, r)
+	ip, _, _ := net.SplitHostPort(conn.LocalAddr().String())
+	assert.Equal(t, []string{first[0], "1", conn.LocalAddr().String(), conn.RemoteAddr().String(), ip, "false"}, first)
+	assert.Equal(t, first[0], second[0])
+	assert.Equal(t, "2", second[1])
+
+	// Test: Another connection gets another ID
+	conn, r = dial(t, srv)
+	_, err = io.WriteString(conn, get)
+	require.NoError(t, err)
+	assert.NotEqual(t, first[0], readInfo(t, r)[0])
+
+	// Test: Behind a trusted proxy the forwarded address is the client's
+	loopback := []netip.Prefix{netip.MustParsePrefix("::1/128"), netip.MustParsePrefix("127.0.0.0/8")}
+	srv = startServer(t, connInfoHandler, WithTrustedProxies(request.XForwardedFor, loopback...))
+	conn, r = dial(t, srv)
+	_, err = io.WriteString(conn, get)
+	require.NoError(t, err)
+	assert.Equal(t, "203.0.113.9", readInfo(t, r)[4])
+
+	// Test: A Forwarded field the client sent through the proxy can't spoof
+	// the address
+	_, err = io.WriteString(conn, "GET / HTTP/1.1\r\nHost: localhost\r\nForwarded: for=1.2.3.4\r\nX-Forwarded-For: 203.0.113.9\r\n\r\n")
+	require.NoError(t, err)
+	assert.Equal(t, "203.0.113.9", readInfo(t, r)[4])
+
+	// Test: TLS connections carry their handshake state
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{testCertificate(t)}})
+	require.NoError(t, err)
+	srv, err = ServeListener(listener, connInfoHandler)
+	require.NoError(t, err)
+	t.Cleanup(func() { srv.Close() })
+	tlsConn, err := tls.Dial("tcp", srv.Addr().String(), &tls.Config{InsecureSkipVerify: true})
+	require.NoError(t, err)
+	defer tlsConn.Close()
+	_, err = io.WriteString(tlsConn, get)
+	require.NoError(t, err)
+	assert.Equal(t, "true", readInfo(t, bufio.NewReader(tlsConn))[5])
+}
+
+// testCertificate makes a self-signed certificate for localhost
+func testCertificate(t *testing.T) tls.Certificate {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		DNSNames:     []string{"localhost"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	require.NoError(t, err)
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
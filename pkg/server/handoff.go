@@ -0,0 +1,129 @@
+package server
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"syscall"
+	"time"
+)
+
+// handoffEnv marks a process started by Handoff. Its listener is
+// descriptor 3, and descriptor 4 tells the parent it's ready.
+const handoffEnv = "GO_HTTP_HANDOFF"
+
+const (
+	handoffListenerFD = 3
+	handoffReadyFD    = 4
+)
+
+// DefaultHandoffTimeout is how long Handoff waits for the new process
+const DefaultHandoffTimeout = 30 * time.Second
+
+var ErrHandoffFailed = fmt.Errorf("new process didn't take over the listener")
+
+// Handoff starts a new copy of the running program, with the same
+// arguments and environment, and hands it the server's listening socket.
+// The socket is shared, so connections keep being accepted throughout. It
+// returns once the new process called HandoffReady, after which this one
+// should Shutdown to drain its connections and exit. If the new process
+// exits or isn't ready within timeout (0 means DefaultHandoffTimeout), it's
+// killed and this server carries on as before.
+func (s *Server) Handoff(timeout time.Duration) (*os.Process, error) {
+	if timeout == 0 {
+		timeout = DefaultHandoffTimeout
+	}
+
+	filer, ok := s.listener.(interface{ File() (*os.File, error) })
+	if !ok {
+		return nil, fmt.Errorf("listener %T has no file descriptor to hand off", s.listener)
+	}
+	listenerFile, err := filer.File()
+	if err != nil {
+		return nil, err
+	}
+	defer listenerFile.Close()
+
+	readyR, readyW, err := os.Pipe()
+	if err != nil {
+		return nil, err
+	}
+	defer readyR.Close()
+
+	exe, err := os.Executable()
+	if err != nil {
+		readyW.Close()
+		return nil, err
+	}
+	cmd := exec.Command(exe, os.Args[1:]...)
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+	cmd.Env = append(os.Environ(), handoffEnv+"=1")
+	cmd.ExtraFiles = []*os.File{listenerFile, readyW}
+	err = cmd.Start()
+	readyW.Close()
+	// Passing the descriptor made the socket, shared with this listener,
+	// blocking, which would leave Accept stuck in the kernel through Close
+	restoreNonblock(s.listener)
+	if err != nil {
+		return nil, err
+	}
+
+	// The child writes a byte when it's serving, or the pipe closes with it
+	readyR.SetReadDeadline(time.Now().Add(timeout))
+	if _, err := readyR.Read(make([]byte, 1)); err != nil {
+		cmd.Process.Kill()
+		cmd.Wait()
+		return nil, fmt.Errorf("%w: %v", ErrHandoffFailed, err)
+	}
+
+	// A Unix socket file now belongs to the new process
+	if unix, ok := s.listener.(*net.UnixListener); ok {
+		unix.SetUnlinkOnClose(false)
+	}
+	return cmd.Process, nil
+}
+
+// restoreNonblock puts listener's socket back into the non-blocking mode
+// the runtime poller expects
+func restoreNonblock(listener net.Listener) {
+	conn, ok := listener.(syscall.Conn)
+	if !ok {
+		return
+	}
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return
+	}
+	raw.Control(func(fd uintptr) {
+		syscall.SetNonblock(int(fd), true)
+	})
+}
+
+// HandoffListener returns the listener passed by a parent's Handoff, or
+// nil when the process wasn't started that way
+func HandoffListener() (net.Listener, error) {
+	if os.Getenv(handoffEnv) == "" {
+		return nil, nil
+	}
+	return ListenFD(handoffListenerFD, "handoff")
+}
+
+// HandoffReady tells the parent that the listener from HandoffListener is
+// being served, so it can drain and exit. It does nothing when there is no
+// parent waiting.
+func HandoffReady() error {
+	if os.Getenv(handoffEnv) == "" {
+		return nil
+	}
+	// Not passed on to a later Handoff
+	os.Unsetenv(handoffEnv)
+
+	ready := os.NewFile(handoffReadyFD, "handoff-ready")
+	if ready == nil {
+		return fmt.Errorf("no handoff descriptor")
+	}
+	defer ready.Close()
+	_, err := ready.Write([]byte{1})
+	return err
+}
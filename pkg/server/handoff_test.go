@@ -0,0 +1,105 @@
+package server
+
+import (
+	"io"
+	"net"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/spaghetti-lover/go-http/pkg/headers"
+	"github.com/spaghetti-lover/go-http/pkg/request"
+	"github.com/spaghetti-lover/go-http/pkg/response"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// handoffTestEnv tells the re-executed test binary how to behave as the
+// process taking over
+const handoffTestEnv = "GO_HTTP_HANDOFF_TEST"
+
+func TestMain(m *testing.M) {
+	if os.Getenv(handoffEnv) != "" {
+		handoffChild()
+		return
+	}
+	os.Exit(m.Run())
+}
+
+// handoffChild serves one request on the handed over listener, answering
+// with "child", then exits
+func handoffChild() {
+	if os.Getenv(handoffTestEnv) == "fail" {
+		os.Exit(1)
+	}
+	listener, err := HandoffListener()
+	if err != nil || listener == nil {
+		os.Exit(2)
+	}
+	served := make(chan struct{}, 1)
+	srv, err := ServeListener(listener, func(w *response.Writer, req *request.Request) {
+		w.WriteStatusLine(response.OK)
+		h := headers.NewHeaders()
+		h.Set("Content-Length", "5")
+		h.Set("Connection", "close")
+		w.WriteHeaders(h)
+		w.WriteBody([]byte("child"))
+		served <- struct{}{}
+	})
+	if err != nil {
+		os.Exit(3)
+	}
+	if err := HandoffReady(); err != nil {
+		os.Exit(4)
+	}
+	select {
+	case <-served:
+	case <-time.After(10 * time.Second):
+	}
+	srv.Close()
+	os.Exit(0)
+}
+
+func TestHandoff(t *testing.T) {
+	srv := startServer(t, keepAliveHandler)
+
+	// Test: The new process takes over the listener once it's ready
+	process, err := srv.Handoff(5 * time.Second)
+	require.NoError(t, err)
+	require.NoError(t, srv.Close())
+
+	conn, err := net.Dial("tcp", srv.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	_, err = io.WriteString(conn, "GET / HTTP/1.1\r\nHost: localhost\r\n\r\n")
+	require.NoError(t, err)
+	response, err := io.ReadAll(conn)
+	require.NoError(t, err)
+	assert.True(t, strings.HasPrefix(string(response), "HTTP/1.1 200 OK\r\n"))
+	assert.True(t, strings.HasSuffix(string(response), "\r\n\r\nchild"))
+
+	state, err := process.Wait()
+	require.NoError(t, err)
+	assert.True(t, state.Success())
+
+	// Test: A new process that exits before being ready leaves the server
+	// serving
+	srv = startServer(t, keepAliveHandler)
+	t.Setenv(handoffTestEnv, "fail")
+	_, err = srv.Handoff(5 * time.Second)
+	assert.ErrorIs(t, err, ErrHandoffFailed)
+
+	conn, r := dial(t, srv)
+	_, err = io.WriteString(conn, "GET /still HTTP/1.1\r\nHost: localhost\r\n\r\n")
+	require.NoError(t, err)
+	readHead(t, r)
+	assert.Equal(t, "/still ", readBody(t, r, 7))
+
+	// Test: Without a parent there's nothing to take over or signal
+	listener, err := HandoffListener()
+	require.NoError(t, err)
+	assert.Nil(t, listener)
+	assert.NoError(t, HandoffReady())
+}
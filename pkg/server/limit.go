@@ -0,0 +1,152 @@
+package server
+
+import (
+	"net"
+	"time"
+
+	"github.com/spaghetti-lover/go-http/pkg/request"
+	"github.com/spaghetti-lover/go-http/pkg/response"
+)
+
+// Overflow is what WithMaxConns does with connections past the limit
+type Overflow int
+
+const (
+	// OverflowWait stops accepting until a connection closes. Clients wait
+	// in the listen backlog and, once that's full, their connects are
+	// refused or retried by the kernel.
+	OverflowWait Overflow = iota
+	// OverflowReject accepts them only to answer 503 Service Unavailable
+	// and close
+	OverflowReject
+)
+
+// rejectTimeout bounds writing a 503 to a connection over the limit
+const rejectTimeout = time.Second
+
+// WithMaxConns serves at most n connections at once, hijacked ones
+// included until their handler returns. What happens to others depends
+// on overflow. n <= 0 means no limit.
+func WithMaxConns(n int, overflow Overflow) Option {
+	return func(s *Server) {
+		if n <= 0 {
+			s.connSlots, s.rejectSlots = nil, nil
+			return
+		}
+		s.connSlots = make(chan struct{}, n)
+		s.rejectSlots = nil
+		if overflow == OverflowReject {
+			// Rejecting is bounded too, past that connections are just closed
+			s.rejectSlots = make(chan struct{}, n)
+		}
+	}
+}
+
+// WithWorkers runs at most n handlers at once, across connections and
+// HTTP/2 streams. Requests read while all are busy wait for one to finish,
+// or get 503 if the server closes first. A handler that hijacks its
+// connection holds its worker until it returns. n <= 0 means no limit.
+func WithWorkers(n int) Option {
+	return func(s *Server) {
+		s.workers = nil
+		if n > 0 {
+			s.workers = make(chan struct{}, n)
+		}
+	}
+}
+
+// acquireConn takes a connection slot before accepting. It reports false
+// when the server closed while waiting for one.
+func (s *Server) acquireConn() bool {
+	if s.connSlots == nil || s.rejectSlots != nil {
+		return true
+	}
+	select {
+	case s.connSlots <- struct{}{}:
+		return true
+	case <-s.done:
+		return false
+	}
+}
+
+// admit decides on an accepted connection, reporting whether to serve it.
+// Connections over an OverflowReject limit are answered 503 in the
+// background.
+func (s *Server) admit(conn net.Conn) bool {
+	if s.rejectSlots == nil {
+		return true
+	}
+	select {
+	case s.connSlots <- struct{}{}:
+		return true
+	default:
+	}
+
+	select {
+	case s.rejectSlots <- struct{}{}:
+		go s.rejectBusy(conn)
+	default:
+		conn.Close()
+	}
+	return false
+}
+
+// cancelConn gives back the slot acquireConn took when no connection came
+// of it
+func (s *Server) cancelConn() {
+	if s.connSlots != nil && s.rejectSlots == nil {
+		<-s.connSlots
+	}
+}
+
+// releaseConn gives back the slot of a connection that's done
+func (s *Server) releaseConn() {
+	if s.connSlots != nil {
+		<-s.connSlots
+	}
+}
+
+// rejectBusy answers 503 and closes conn. The client's request is drained
+// for a moment after, as closing with it unread would reset the connection
+// and could lose the response.
+func (s *Server) rejectBusy(conn net.Conn) {
+	defer func() { <-s.rejectSlots }()
+	defer conn.Close()
+
+	conn.SetDeadline(time.Now().Add(rejectTimeout))
+	w := response.NewWriter(conn)
+	if err := w.WriteStatusLine(response.ServiceUnavailable); err != nil {
+		return
+	}
+	h := response.GetDefaultHeaders(0)
+	h.Set("Retry-After", "1")
+	if err := w.WriteHeaders(h); err != nil {
+		return
+	}
+
+	if cw, ok := conn.(interface{ CloseWrite() error }); ok {
+		cw.CloseWrite()
+		buf := make([]byte, 4096)
+		for {
+			if _, err := conn.Read(buf); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// runHandler runs the handler on a worker, waiting for one when
+// WithWorkers has them all busy. A request still waiting when the server
+// closes is answered 503 without the handler.
+func (s *Server) runHandler(w *response.Writer, req *request.Request) {
+	if s.workers != nil {
+		select {
+		case s.workers <- struct{}{}:
+		case <-s.done:
+			reject(w, response.ServiceUnavailable)
+			return
+		}
+		defer func() { <-s.workers }()
+	}
+	s.handler(w, req)
+}
@@ -0,0 +1,179 @@
+package server
+
+import (
+	"io"
+	"net"
+	"os"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/spaghetti-lover/go-http/pkg/request"
+	"github.com/spaghetti-lover/go-http/pkg/response"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMaxConns(t *testing.T) {
+	get := "GET /limited HTTP/1.1\r\nHost: localhost\r\n\r\n"
+
+	// Test: Past the limit connections wait to be accepted
+	srv := startServer(t, keepAliveHandler, WithMaxConns(1, OverflowWait))
+	first, firstR := dial(t, srv)
+	_, err := io.WriteString(first, get)
+	require.NoError(t, err)
+	readHead(t, firstR)
+	readBody(t, firstR, 9)
+
+	second, secondR := dial(t, srv)
+	_, err = io.WriteString(second, get)
+	require.NoError(t, err)
+	second.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	_, err = secondR.Peek(1)
+	assert.ErrorIs(t, err, os.ErrDeadlineExceeded)
+
+	first.Close()
+	second.SetReadDeadline(time.Now().Add(5 * time.Second))
+	assert.True(t, strings.HasPrefix(readHead(t, secondR), "HTTP/1.1 200 OK\r\n"))
+	assert.Equal(t, "/limited ", readBody(t, secondR, 9))
+
+	// Test: Or are answered 503 right away
+	srv = startServer(t, keepAliveHandler, WithMaxConns(1, OverflowReject))
+	first, firstR = dial(t, srv)
+	_, err = io.WriteString(first, get)
+	require.NoError(t, err)
+	readHead(t, firstR)
+	readBody(t, firstR, 9)
+
+	second, secondR = dial(t, srv)
+	_, err = io.WriteString(second, get)
+	require.NoError(t, err)
+	head := readHead(t, secondR)
+	assert.True(t, strings.HasPrefix(head, "HTTP/1.1 503 Service Unavailable\r\n"), head)
+	assert.Contains(t, head, "retry-after: 1\r\n")
+	_, err = secondR.ReadByte()
+	assert.ErrorIs(t, err, io.EOF)
+	second.Close()
+
+	// Test: A connection closing makes room for the next
+	first.Close()
+	assert.Eventually(t, func() bool {
+		conn, r := dial(t, srv)
+		defer conn.Close()
+		io.WriteString(conn, get)
+		status, _ := r.ReadString('\n')
+		return status == "HTTP/1.1 200 OK\r\n"
+	}, 5*time.Second, 10*time.Millisecond)
+}
+
+func TestWorkers(t *testing.T) {
+	var running, maxRunning, done atomic.Int32
+	srv := startServer(t, func(w *response.Writer, req *request.Request) {
+		n := running.Add(1)
+		if n > maxRunning.Load() {
+			maxRunning.Store(n)
+		}
+		time.Sleep(20 * time.Millisecond)
+		running.Add(-1)
+		done.Add(1)
+		keepAliveHandler(w, req)
+	}, WithWorkers(1))
+
+	// Test: Handlers of different connections take turns
+	for range 3 {
+		conn, _ := dial(t, srv)
+		_, err := io.WriteString(conn, "GET /worker HTTP/1.1\r\nHost: localhost\r\n\r\n")
+		require.NoError(t, err)
+	}
+	require.Eventually(t, func() bool { return done.Load() == 3 }, 5*time.Second, 5*time.Millisecond)
+	assert.Equal(t, int32(1), maxRunning.Load())
+}
+
+func TestLimitsUnset(t *testing.T) {
+	for _, opts := range [][]Option{
+		{WithMaxConns(0, OverflowWait)},
+		{WithMaxConns(-1, OverflowReject)},
+		{WithWorkers(0)},
+		{WithMaxConns(1, OverflowReject), WithMaxConns(0, OverflowReject)},
+	} {
+		// Test: Limits of zero or less are no limits
+		srv := startServer(t, keepAliveHandler, opts...)
+		for range 2 {
+			conn, r := dial(t, srv)
+			_, err := io.WriteString(conn, "GET /unset HTTP/1.1\r\nHost: localhost\r\n\r\n")
+			require.NoError(t, err)
+			assert.True(t, strings.HasPrefix(readHead(t, r), "HTTP/1.1 200 OK\r\n"))
+		}
+	}
+}
+
+func TestWorkersClose(t *testing.T) {
+	release := make(chan struct{})
+	started := make(chan struct{}, 1)
+	var activeConns atomic.Int32
+	srv := startServer(t, func(w *response.Writer, req *request.Request) {
+		started <- struct{}{}
+		<-release
+		keepAliveHandler(w, req)
+	}, WithWorkers(1), WithConnState(func(conn net.Conn, state ConnState, _ ConnStats) {
+		if state == StateActive {
+			activeConns.Add(1)
+		}
+	}))
+
+	first, firstR := dial(t, srv)
+	_, err := io.WriteString(first, "GET /busy HTTP/1.1\r\nHost: localhost\r\n\r\n")
+	require.NoError(t, err)
+	<-started
+
+	second, secondR := dial(t, srv)
+	_, err = io.WriteString(second, "GET /waiting HTTP/1.1\r\nHost: localhost\r\n\r\n")
+	require.NoError(t, err)
+	require.Eventually(t, func() bool { return activeConns.Load() == 2 }, 5*time.Second, 5*time.Millisecond)
+
+	// Test: A request waiting for a worker is answered 503 on close
+	require.NoError(t, srv.Close())
+	head := readHead(t, secondR)
+	assert.True(t, strings.HasPrefix(head, "HTTP/1.1 503 Service Unavailable\r\n"), head)
+	_, err = secondR.ReadByte()
+	assert.ErrorIs(t, err, io.EOF)
+
+	// Test: The one being handled is still completed
+	close(release)
+	assert.True(t, strings.HasPrefix(readHead(t, firstR), "HTTP/1.1 200 OK\r\n"))
+}
+
+// failingListener fails its first Accepts as a process out of file
+// descriptors would
+type failingListener struct {
+	net.Listener
+	failures atomic.Int32
+}
+
+func (l *failingListener) Accept() (net.Conn, error) {
+	if l.failures.Add(-1) >= 0 {
+		return nil, &net.OpError{Op: "accept", Net: "tcp", Err: syscall.EMFILE}
+	}
+	return l.Listener.Accept()
+}
+
+func TestAcceptBackoff(t *testing.T) {
+	tcp, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	listener := &failingListener{Listener: tcp}
+	listener.failures.Store(3)
+
+	// Test: Accept errors are retried after growing pauses
+	start := time.Now()
+	srv, err := ServeListener(listener, keepAliveHandler)
+	require.NoError(t, err)
+	t.Cleanup(func() { srv.Close() })
+	conn, r := dial(t, srv)
+	_, err = io.WriteString(conn, "GET /again HTTP/1.1\r\nHost: localhost\r\n\r\n")
+	require.NoError(t, err)
+	readHead(t, r)
+	assert.Equal(t, "/again ", readBody(t, r, 7))
+	assert.GreaterOrEqual(t, time.Since(start), minAcceptBackoff+2*minAcceptBackoff+4*minAcceptBackoff)
+}
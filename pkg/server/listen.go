@@ -0,0 +1,162 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// UnixOptions sets up the socket file ListenUnix creates
+type UnixOptions struct {
+	// Mode is the permission of the socket file, 0 means DefaultUnixMode.
+	// Clients need write permission to connect.
+	Mode fs.FileMode
+
+	// UID and GID own the socket file, 0 leaves them to the process
+	UID, GID int
+}
+
+// DefaultUnixMode lets the owner and group connect, e.g. a proxy sharing
+// the server's group
+const DefaultUnixMode fs.FileMode = 0660
+
+var ErrSocketInUse = fmt.Errorf("unix socket is in use by another process")
+
+// ListenUnix listens on a Unix domain socket at path. A socket file left
+// behind by a process that's gone is removed first, but one that still
+// accepts connections, or a file that isn't a socket, is an error. The file
+// is removed again when the listener is closed.
+func ListenUnix(path string, opts UnixOptions) (net.Listener, error) {
+	if opts.Mode == 0 {
+		opts.Mode = DefaultUnixMode
+	}
+
+	if err := removeStaleSocket(path); err != nil {
+		return nil, err
+	}
+
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := os.Chmod(path, opts.Mode); err != nil {
+		listener.Close()
+		return nil, err
+	}
+	if opts.UID != 0 || opts.GID != 0 {
+		if err := os.Chown(path, orUnchanged(opts.UID), orUnchanged(opts.GID)); err != nil {
+			listener.Close()
+			return nil, err
+		}
+	}
+	return listener, nil
+}
+
+// orUnchanged maps an unset id to -1, which os.Chown leaves alone
+func orUnchanged(id int) int {
+	if id == 0 {
+		return -1
+	}
+	return id
+}
+
+// removeStaleSocket removes the socket file at path if nothing listens on it
+func removeStaleSocket(path string) error {
+	info, err := os.Lstat(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if info.Mode().Type() != fs.ModeSocket {
+		return fmt.Errorf("%s exists and is not a socket", path)
+	}
+
+	conn, err := net.DialTimeout("unix", path, time.Second)
+	if err == nil {
+		conn.Close()
+		return fmt.Errorf("%w: %s", ErrSocketInUse, path)
+	}
+	if !errors.Is(err, syscall.ECONNREFUSED) {
+		return err
+	}
+	return os.Remove(path)
+}
+
+// ListenFD makes a listener from a socket the process inherited as file
+// descriptor fd. The descriptor itself is closed, the listener holds a
+// duplicate that isn't passed on to child processes.
+func ListenFD(fd uintptr, name string) (net.Listener, error) {
+	f := os.NewFile(fd, name)
+	if f == nil {
+		return nil, fmt.Errorf("invalid file descriptor %d", fd)
+	}
+	defer f.Close()
+
+	listener, err := net.FileListener(f)
+	if err != nil {
+		return nil, fmt.Errorf("file descriptor %d (%s): %w", fd, name, err)
+	}
+	return listener, nil
+}
+
+// listenFDsStart is the first descriptor systemd passes (SD_LISTEN_FDS_START)
+const listenFDsStart = 3
+
+// SystemdListeners returns the listeners passed by systemd socket
+// activation in LISTEN_FDS order, named by their FileDescriptorName= (the
+// socket unit's name by default). It returns none when the process wasn't
+// socket activated. The LISTEN_* variables are unset so child processes
+// don't take them for their own.
+func SystemdListeners() ([]NamedListener, error) {
+	pid, fds := os.Getenv("LISTEN_PID"), os.Getenv("LISTEN_FDS")
+	names := os.Getenv("LISTEN_FDNAMES")
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDS")
+	os.Unsetenv("LISTEN_FDNAMES")
+
+	// The variables are meant for the process systemd started, not a child
+	if pid == "" || pid != strconv.Itoa(os.Getpid()) {
+		return nil, nil
+	}
+	n, err := strconv.Atoi(fds)
+	if err != nil || n < 0 {
+		return nil, fmt.Errorf("invalid LISTEN_FDS %q", fds)
+	}
+
+	var fdNames []string
+	if names != "" {
+		fdNames = strings.Split(names, ":")
+	}
+
+	listeners := make([]NamedListener, 0, n)
+	for i := 0; i < n; i++ {
+		name := "LISTEN_FD_" + strconv.Itoa(listenFDsStart+i)
+		if i < len(fdNames) {
+			name = fdNames[i]
+		}
+		listener, err := ListenFD(uintptr(listenFDsStart+i), name)
+		if err != nil {
+			for _, l := range listeners {
+				l.Close()
+			}
+			return nil, err
+		}
+		listeners = append(listeners, NamedListener{Listener: listener, Name: name})
+	}
+	return listeners, nil
+}
+
+// NamedListener is an inherited listener with the name it was passed under
+type NamedListener struct {
+	net.Listener
+	Name string
+}
@@ -0,0 +1,121 @@
+package server
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestListenUnix(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "http.sock")
+
+	// Test: The socket is created with the requested mode and served on
+	listener, err := ListenUnix(path, UnixOptions{Mode: 0600})
+	require.NoError(t, err)
+	info, err := os.Stat(path)
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0600), info.Mode().Perm())
+
+	srv, err := ServeListener(listener, keepAliveHandler)
+	require.NoError(t, err)
+	conn, err := net.Dial("unix", path)
+	require.NoError(t, err)
+	defer conn.Close()
+	_, err = io.WriteString(conn, "GET /unix HTTP/1.1\r\nHost: localhost\r\n\r\n")
+	require.NoError(t, err)
+	r := bufio.NewReader(conn)
+	assert.True(t, strings.HasPrefix(readHead(t, r), "HTTP/1.1 200 OK\r\n"))
+	assert.Equal(t, "/unix ", readBody(t, r, 6))
+
+	// Test: A socket still in use isn't taken over
+	_, err = ListenUnix(path, UnixOptions{})
+	assert.ErrorIs(t, err, ErrSocketInUse)
+
+	// Test: Closing the server removes the socket file
+	require.NoError(t, srv.Close())
+	_, err = os.Stat(path)
+	assert.True(t, os.IsNotExist(err))
+
+	// Test: A stale socket left behind is replaced
+	stale, err := net.ListenUnix("unix", &net.UnixAddr{Name: path, Net: "unix"})
+	require.NoError(t, err)
+	stale.SetUnlinkOnClose(false)
+	stale.Close()
+	listener, err = ListenUnix(path, UnixOptions{})
+	require.NoError(t, err)
+	info, err = os.Stat(path)
+	require.NoError(t, err)
+	assert.Equal(t, DefaultUnixMode, info.Mode().Perm())
+	listener.Close()
+
+	// Test: Other files are left alone
+	require.NoError(t, os.WriteFile(path, []byte("data"), 0644))
+	_, err = ListenUnix(path, UnixOptions{})
+	assert.Error(t, err)
+}
+
+func TestListenFD(t *testing.T) {
+	tcp, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer tcp.Close()
+	f, err := tcp.(*net.TCPListener).File()
+	require.NoError(t, err)
+	fd, err := syscall.Dup(int(f.Fd()))
+	require.NoError(t, err)
+	f.Close()
+
+	// Test: A listener is rebuilt from an inherited descriptor
+	listener, err := ListenFD(uintptr(fd), "inherited")
+	require.NoError(t, err)
+	assert.Equal(t, tcp.Addr().String(), listener.Addr().String())
+	srv, err := ServeListener(listener, keepAliveHandler)
+	require.NoError(t, err)
+	t.Cleanup(func() { srv.Close() })
+	tcp.Close()
+
+	conn, r := dial(t, srv)
+	_, err = io.WriteString(conn, "GET /fd HTTP/1.1\r\nHost: localhost\r\n\r\n")
+	require.NoError(t, err)
+	readHead(t, r)
+	assert.Equal(t, "/fd ", readBody(t, r, 4))
+
+	// Test: Descriptors that aren't sockets are refused
+	file, err := os.CreateTemp(t.TempDir(), "not-a-socket")
+	require.NoError(t, err)
+	fd, err = syscall.Dup(int(file.Fd()))
+	require.NoError(t, err)
+	file.Close()
+	_, err = ListenFD(uintptr(fd), "file")
+	assert.Error(t, err)
+}
+
+func TestSystemdListeners(t *testing.T) {
+	// Test: Variables meant for another process are ignored, and unset
+	t.Setenv("LISTEN_PID", "1")
+	t.Setenv("LISTEN_FDS", "1")
+	listeners, err := SystemdListeners()
+	require.NoError(t, err)
+	assert.Empty(t, listeners)
+	_, set := os.LookupEnv("LISTEN_FDS")
+	assert.False(t, set)
+
+	// Test: Not being socket activated isn't an error
+	listeners, err = SystemdListeners()
+	require.NoError(t, err)
+	assert.Empty(t, listeners)
+
+	// Test: A malformed count is
+	t.Setenv("LISTEN_PID", strconv.Itoa(os.Getpid()))
+	t.Setenv("LISTEN_FDS", "many")
+	_, err = SystemdListeners()
+	assert.Error(t, err)
+}
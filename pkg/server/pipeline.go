@@ -0,0 +1,275 @@
+package server
+
+import (
+	"bytes"
+	"errors"
+	"log"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/spaghetti-lover/go-http/pkg/request"
+	"github.com/spaghetti-lover/go-http/pkg/response"
+)
+
+// maxSlotBuffer is how much of a response waiting for its turn is held in
+// memory before its handler blocks
+const maxSlotBuffer = 1 << 20
+
+var errPipelineClosed = errors.New("connection closed by an earlier response")
+
+// slot holds a pipelined response until those before it are written
+type slot struct {
+	conn net.Conn
+
+	mu      sync.Mutex
+	cond    *sync.Cond
+	buf     bytes.Buffer
+	live    bool // first in line, writes go straight to the connection
+	discard bool // an earlier response closed the connection
+
+	activated chan struct{}
+	done      chan struct{}
+}
+
+func newSlot(conn net.Conn) *slot {
+	sl := &slot{conn: conn, activated: make(chan struct{}), done: make(chan struct{})}
+	sl.cond = sync.NewCond(&sl.mu)
+	return sl
+}
+
+func (sl *slot) Write(p []byte) (int, error) {
+	sl.mu.Lock()
+	defer sl.mu.Unlock()
+
+	for !sl.live && !sl.discard && sl.buf.Len() > 0 && sl.buf.Len()+len(p) > maxSlotBuffer {
+		sl.cond.Wait()
+	}
+	switch {
+	case sl.discard:
+		return 0, errPipelineClosed
+	case sl.live:
+		return sl.conn.Write(p)
+	}
+	return sl.buf.Write(p)
+}
+
+// activate sends what was buffered once the responses before are out, or
+// drops it if one of them closed the connection
+func (sl *slot) activate(discard bool) {
+	sl.mu.Lock()
+	defer sl.mu.Unlock()
+
+	if discard {
+		sl.discard = true
+	} else {
+		sl.live = true
+		if _, err := sl.conn.Write(sl.buf.Bytes()); err != nil {
+			sl.discard = true
+		}
+	}
+	sl.buf = bytes.Buffer{}
+	sl.cond.Broadcast()
+	close(sl.activated)
+}
+
+// pipeline tracks the requests read ahead on one connection
+type pipeline struct {
+	s    *Server
+	conn net.Conn
+
+	// depth holds a token per request read but not yet answered
+	depth chan struct{}
+	// last is the response queued most recently, owned by the read loop
+	last    *slot
+	closing atomic.Bool
+	wg      sync.WaitGroup
+
+	mu       sync.Mutex
+	inFlight int
+}
+
+// handlePipelined is handle for WithPipelining, reporting whether the
+// connection was hijacked
+func (s *Server) handlePipelined(conn net.Conn, reader *request.Reader) bool {
+	p := &pipeline{s: s, conn: conn, depth: make(chan struct{}, s.pipelineDepth)}
+
+	for served := 0; ; served++ {
+		p.depth <- struct{}{}
+
+		var writer *response.Writer
+		var sl *slot
+		started := false
+		req, err := reader.ReadRequest(func(req *request.Request) error {
+			if !p.begin() {
+				return errPipelineClosed
+			}
+			started = true
+
+			if exclusive(req) {
+				p.drain()
+				if p.closing.Load() {
+					return errPipelineClosed
+				}
+				writer = s.connWriter(conn, reader)
+			} else {
+				sl = p.queue()
+				writer = response.NewWriter(sl)
+			}
+			// Requests answered in turn run while later ones are read, their
+			// body can't wait for the handler
+			return s.prepare(conn, writer, req, sl == nil)
+		})
+		if err != nil {
+			// A body over the limit is answered 413 in its turn
+			tooLarge := errors.Is(err, request.ErrContentTooLarge)
+			if tooLarge && writer != nil {
+				reject(writer, response.ContentTooLarge)
+			}
+
+			// Whatever the hook queued is answered, then the connection closes
+			if sl != nil {
+				p.run(sl, func() bool { return false })
+			} else if started {
+				p.end()
+			}
+			p.wg.Wait()
+
+			if tooLarge && writer == nil {
+				reject(s.connWriter(conn, reader), response.ContentTooLarge)
+			}
+			if errors.Is(err, errRequestRejected) || tooLarge || p.closing.Load() {
+				return false
+			}
+			if errors.Is(err, request.ErrUnsupportedHTTPVersion) {
+				reject(s.connWriter(conn, reader), response.HTTPVersionNotSupported)
+				return false
+			}
+			if !idleClosed(err) || served == 0 && !s.closed.Load() {
+				log.Printf("Error reading from %s: %v", peer(conn), err)
+			}
+			return false
+		}
+
+		if sl != nil {
+			p.run(sl, func() bool {
+				keepAlive, _ := s.respond(conn, reader, writer, req)
+				return keepAlive
+			})
+			if !requestKeepAlive(req) {
+				p.wg.Wait()
+				return false
+			}
+			continue
+		}
+
+		// Everything before an exclusive request is answered and nothing
+		// after it is read until it is
+		keepAlive, err := s.respond(conn, reader, writer, req)
+		if errors.Is(err, response.ErrHijacked) {
+			return true
+		}
+		p.end()
+		<-p.depth
+		if err != nil {
+			if served == 0 || !idleClosed(err) {
+				log.Printf("Error reading from %s: %v", peer(conn), err)
+			}
+			return false
+		}
+		if !keepAlive {
+			return false
+		}
+	}
+}
+
+// exclusive reports whether a request has to be answered alone: it isn't
+// safe to run next to others (RFC 9112 §9.3.2), or it may take over the
+// connection
+func exclusive(req *request.Request) bool {
+	switch req.RequestLine.Method {
+	case "GET", "HEAD", "OPTIONS", "TRACE":
+		return req.Headers.Get("Upgrade") != ""
+	}
+	return true
+}
+
+// queue lines up a response behind the last one
+func (p *pipeline) queue() *slot {
+	sl := newSlot(p.conn)
+	prev := p.last
+	p.last = sl
+	go func() {
+		if prev != nil {
+			<-prev.done
+		}
+		sl.activate(p.closing.Load())
+	}()
+	return sl
+}
+
+// drain waits for every queued response to be written
+func (p *pipeline) drain() {
+	if p.last != nil {
+		<-p.last.done
+		p.last = nil
+	}
+}
+
+// run answers a queued request in the background
+func (p *pipeline) run(sl *slot, respond func() bool) {
+	p.wg.Add(1)
+	go func() {
+		defer p.wg.Done()
+
+		keepAlive := respond()
+		<-sl.activated
+		if !keepAlive {
+			p.close()
+		}
+		close(sl.done)
+		p.end()
+		<-p.depth
+	}()
+}
+
+// begin marks a request as read, the connection is busy until it's
+// answered. It reports false once the connection is closing.
+func (p *pipeline) begin() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.closing.Load() {
+		return false
+	}
+	p.inFlight++
+	p.s.setIdle(p.conn, false)
+	p.conn.SetReadDeadline(time.Time{})
+	return true
+}
+
+// end marks a request as answered. The idle timeout starts once there are
+// none left.
+func (p *pipeline) end() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.inFlight--
+	if p.inFlight > 0 || p.closing.Load() {
+		return
+	}
+	if !p.s.setIdle(p.conn, true) {
+		p.close()
+		return
+	}
+	if p.s.idleTimeout > 0 {
+		p.conn.SetReadDeadline(time.Now().Add(p.s.idleTimeout))
+	}
+}
+
+// close stops reading, the responses already queued are dropped
+func (p *pipeline) close() {
+	p.closing.Store(true)
+	p.conn.SetReadDeadline(time.Now())
+}
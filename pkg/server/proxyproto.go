@@ -0,0 +1,100 @@
+package server
+
+import (
+	"fmt"
+	"net"
+	"net/netip"
+	"time"
+
+	"github.com/spaghetti-lover/go-http/pkg/proxyproto"
+	"github.com/spaghetti-lover/go-http/pkg/request"
+)
+
+// ProxyProtocolOptions configures WithProxyProtocol
+type ProxyProtocolOptions struct {
+	// Trusted are the networks of the load balancers. Connections from them
+	// must start with a PROXY header, others are served as they are. Empty
+	// trusts every connection, for a server only the balancer can reach,
+	// e.g. on a Unix socket.
+	Trusted []netip.Prefix
+
+	// Timeout bounds reading the header, 0 means DefaultProxyHeaderTimeout
+	Timeout time.Duration
+}
+
+// DefaultProxyHeaderTimeout is how long a trusted connection has to send
+// its PROXY header
+const DefaultProxyHeaderTimeout = 5 * time.Second
+
+// WithProxyProtocol reads the HAProxy PROXY protocol header, version 1 or
+// 2, that load balancers send ahead of the client's bytes. The client
+// address it carries becomes the connection's RemoteAddr, in
+// request.Request and in logs, and ProxyHeader returns the header itself,
+// TLVs included.
+func WithProxyProtocol(opts ProxyProtocolOptions) Option {
+	if opts.Timeout == 0 {
+		opts.Timeout = DefaultProxyHeaderTimeout
+	}
+	return func(s *Server) {
+		s.proxyProtocol = &opts
+	}
+}
+
+// ProxyHeader returns the PROXY protocol header the connection of req
+// started with, nil when it had none
+func ProxyHeader(req *request.Request) *proxyproto.Header {
+	h, _ := req.Conn.Proxy.(*proxyproto.Header)
+	return h
+}
+
+// proxyHeader reads the PROXY header of a connection from a trusted
+// balancer and returns the connection standing for the client. Other
+// connections are returned as they are.
+func (s *Server) proxyHeader(conn net.Conn) (net.Conn, error) {
+	if !s.proxyTrusted(conn.RemoteAddr()) {
+		return conn, nil
+	}
+
+	conn.SetReadDeadline(time.Now().Add(s.proxyProtocol.Timeout))
+	proxied, err := proxyproto.NewConn(conn)
+	if err != nil {
+		return nil, err
+	}
+	conn.SetReadDeadline(time.Time{})
+	return proxied, nil
+}
+
+// proxyTrusted reports whether addr may send a PROXY header
+func (s *Server) proxyTrusted(addr net.Addr) bool {
+	if len(s.proxyProtocol.Trusted) == 0 {
+		return true
+	}
+	tcp, ok := addr.(*net.TCPAddr)
+	if !ok {
+		return false
+	}
+	ip := tcp.AddrPort().Addr().Unmap()
+	for _, prefix := range s.proxyProtocol.Trusted {
+		if prefix.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// peer names the client of conn in logs, with the balancer it came through
+// and the ID the balancer gave the connection, if any
+func peer(conn net.Conn) string {
+	if c, ok := conn.(*connection); ok {
+		conn = c.Conn
+	}
+	proxied, ok := conn.(*proxyproto.Conn)
+	if !ok {
+		return conn.RemoteAddr().String()
+	}
+	name := fmt.Sprintf("%s via %s", proxied.RemoteAddr(), proxied.ProxyAddr())
+	if id, ok := proxied.Header.TLV(proxyproto.TypeUniqueID); ok {
+		name += fmt.Sprintf(" (id %q)", id)
+	}
+	return name
+}
@@ -0,0 +1,83 @@
+package server
+
+import (
+	"encoding/binary"
+	"io"
+	"net/netip"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/spaghetti-lover/go-http/pkg/headers"
+	"github.com/spaghetti-lover/go-http/pkg/proxyproto"
+	"github.com/spaghetti-lover/go-http/pkg/request"
+	"github.com/spaghetti-lover/go-http/pkg/response"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// proxyHandler answers with the client address and the PROXY header it saw
+func proxyHandler(w *response.Writer, req *request.Request) {
+	body := req.Conn.RemoteAddr.String()
+	if header := ProxyHeader(req); header != nil {
+		body += " v" + strconv.Itoa(header.Version)
+		if id, ok := header.TLV(proxyproto.TypeUniqueID); ok {
+			body += " " + string(id)
+		}
+	}
+	w.WriteStatusLine(response.OK)
+	h := headers.NewHeaders()
+	h.Set("Content-Length", strconv.Itoa(len(body)))
+	w.WriteHeaders(h)
+	w.WriteBody([]byte(body))
+}
+
+func TestProxyProtocol(t *testing.T) {
+	get := "GET / HTTP/1.1\r\nHost: localhost\r\n\r\n"
+
+	// Test: The client address from a version 1 header stands for the
+	// connection's
+	srv := startServer(t, proxyHandler, WithProxyProtocol(ProxyProtocolOptions{}))
+	conn, r := dial(t, srv)
+	_, err := io.WriteString(conn, "PROXY TCP4 192.0.2.1 198.51.100.2 56324 443\r\n"+get+get)
+	require.NoError(t, err)
+	for range 2 {
+		assert.True(t, strings.HasPrefix(readHead(t, r), "HTTP/1.1 200 OK\r\n"))
+		assert.Equal(t, "192.0.2.1:56324 v1", readBody(t, r, 18))
+	}
+
+	// Test: Version 2 TLVs reach the request
+	header := []byte("\r\n\r\n\x00\r\nQUIT\n\x21\x11\x00\x00")
+	body := []byte{203, 0, 113, 9, 198, 51, 100, 2, 0x10, 0x00, 0x00, 0x50}
+	body = append(body, proxyproto.TypeUniqueID, 0, 2, 'i', 'd')
+	binary.BigEndian.PutUint16(header[14:], uint16(len(body)))
+	conn, r = dial(t, srv)
+	_, err = conn.Write(append(append(header, body...), get...))
+	require.NoError(t, err)
+	readHead(t, r)
+	assert.Equal(t, "203.0.113.9:4096 v2 id", readBody(t, r, 22))
+
+	// Test: A trusted connection without a header is dropped
+	conn, _ = dial(t, srv)
+	_, err = io.WriteString(conn, get)
+	require.NoError(t, err)
+	_, err = conn.Read(make([]byte, 1))
+	assert.Error(t, err)
+
+	// Test: Connections from elsewhere are served as they are, a header
+	// from them is a malformed request
+	srv = startServer(t, proxyHandler, WithProxyProtocol(ProxyProtocolOptions{
+		Trusted: []netip.Prefix{netip.MustParsePrefix("10.0.0.0/8")},
+	}))
+	conn, r = dial(t, srv)
+	_, err = io.WriteString(conn, get)
+	require.NoError(t, err)
+	readHead(t, r)
+	assert.Equal(t, conn.LocalAddr().String(), readBody(t, r, len(conn.LocalAddr().String())))
+
+	conn, r = dial(t, srv)
+	_, err = io.WriteString(conn, "PROXY TCP4 192.0.2.1 198.51.100.2 56324 443\r\n"+get)
+	require.NoError(t, err)
+	_, err = r.ReadByte()
+	assert.Error(t, err)
+}
@@ -1,24 +1,139 @@
 package server
 
 import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
 	"log"
 	"net"
+	"net/netip"
 	"strconv"
+	"strings"
+	"sync"
 	"sync/atomic"
+	"time"
 
+	"github.com/spaghetti-lover/go-http/pkg/headers"
+	"github.com/spaghetti-lover/go-http/pkg/http2"
 	"github.com/spaghetti-lover/go-http/pkg/request"
 	"github.com/spaghetti-lover/go-http/pkg/response"
 )
 
 type Handler func(w *response.Writer, req *request.Request)
 
+// Middleware wraps a Handler to add behaviour before or after it runs
+type Middleware func(Handler) Handler
+
+// Chain applies middlewares to h so that the first one is the outermost
+func Chain(h Handler, middlewares ...Middleware) Handler {
+	for i := len(middlewares) - 1; i >= 0; i-- {
+		h = middlewares[i](h)
+	}
+	return h
+}
+
+// DefaultIdleTimeout is how long a kept-alive connection may wait for its
+// next request
+const DefaultIdleTimeout = 60 * time.Second
+
 type Server struct {
-	listener net.Listener
-	handler  Handler
-	closed   atomic.Bool
+	listener       net.Listener
+	handler        Handler
+	closed         atomic.Bool
+	maxBodySize    int64
+	expectContinue func(req *request.Request) response.StatusCode
+	idleTimeout    time.Duration
+	h2c            bool
+	pipelineDepth  int
+	proxyProtocol  *ProxyProtocolOptions
+	trustedProxies []netip.Prefix
+	forwarded      request.ForwardedHeader
+	connIDs        atomic.Uint64
+	connState      ConnHook
+
+	// connSlots, rejectSlots and workers are semaphores, nil when unlimited
+	connSlots   chan struct{}
+	rejectSlots chan struct{}
+	workers     chan struct{}
+	// done is closed by Close
+	done chan struct{}
+
+	// conns maps open connections to whether they are idle between requests
+	mu    sync.Mutex
+	conns map[net.Conn]bool
+	// active counts connections being served, hijacked ones excluded
+	active atomic.Int64
+}
+
+// Option configures a Server in Serve
+type Option func(*Server)
+
+// WithMaxBodySize rejects requests whose Content-Length exceeds n with
+// 413 Content Too Large before their body is read. Chunked bodies, whose
+// size isn't known up front, are cut off with 413 as soon as a chunk would
+// take them past n.
+func WithMaxBodySize(n int64) Option {
+	return func(s *Server) {
+		s.maxBodySize = n
+	}
+}
+
+// WithExpectContinue installs a check for requests sent with
+// Expect: 100-continue. It sees the headers before the client has sent the
+// body and returns response.Continue to let it through, or a final status
+// such as 401 or 417 to reject it without reading the body. Requests let
+// through reach the handler before their body: 100 Continue goes out when
+// it first calls req.ReadBody, and not at all if it answers without.
+func WithExpectContinue(check func(req *request.Request) response.StatusCode) Option {
+	return func(s *Server) {
+		s.expectContinue = check
+	}
+}
+
+// WithIdleTimeout closes kept-alive connections that don't start another
+// request within d
+func WithIdleTimeout(d time.Duration) Option {
+	return func(s *Server) {
+		s.idleTimeout = d
+	}
+}
+
+// WithH2C serves cleartext HTTP/2 next to HTTP/1.1, to clients that start
+// with the HTTP/2 preface or ask for Upgrade: h2c. Streams go to the same
+// handler as HTTP/1.1 requests.
+func WithH2C() Option {
+	return func(s *Server) {
+		s.h2c = true
+	}
+}
+
+// WithPipelining reads up to depth requests ahead on a connection and runs
+// the handlers of safe methods (GET, HEAD, OPTIONS, TRACE) concurrently.
+// Responses still go out in request order. Other methods, upgrades and
+// CONNECT wait for the responses before them and run alone. With depth 1,
+// the default, pipelined requests are answered one after the other.
+func WithPipelining(depth int) Option {
+	return func(s *Server) {
+		s.pipelineDepth = depth
+	}
 }
 
-func Serve(port int, handler Handler) (*Server, error) {
+// WithTrustedProxies names the reverse proxies, and the header they record
+// their hops in, that are believed when setting request.Request.ClientIP, see
+// request.ForwardedClientIP. The other header is ignored, proxies pass on
+// whatever the client sent in it. Without this option ClientIP is the
+// connection's peer.
+func WithTrustedProxies(header request.ForwardedHeader, prefixes ...netip.Prefix) Option {
+	return func(s *Server) {
+		s.forwarded = header
+		s.trustedProxies = prefixes
+	}
+}
+
+var errRequestRejected = errors.New("request rejected before reading body")
+
+func Serve(port int, handler Handler, opts ...Option) (*Server, error) {
 	listener, err := net.Listen("tcp", ":"+strconv.Itoa(port))
 	if err != nil {
 		log.Printf("Error listening to port: %v", err)
@@ -27,9 +142,22 @@ func Serve(port int, handler Handler) (*Server, error) {
 
 	log.Println("Server listening on port", port)
 
+	return ServeListener(listener, handler, opts...)
+}
+
+// ServeListener serves on a listener that is already open, such as a Unix
+// socket from ListenUnix or one inherited through SystemdListeners. The
+// server owns it from then on and closes it in Close.
+func ServeListener(listener net.Listener, handler Handler, opts ...Option) (*Server, error) {
 	server := &Server{
-		listener: listener,
-		handler:  handler,
+		listener:    listener,
+		handler:     handler,
+		idleTimeout: DefaultIdleTimeout,
+		conns:       map[net.Conn]bool{},
+		done:        make(chan struct{}),
+	}
+	for _, opt := range opts {
+		opt(server)
 	}
 
 	go server.listen()
@@ -37,40 +165,378 @@ func Serve(port int, handler Handler) (*Server, error) {
 	return server, nil
 }
 
+// Addr returns the address the server is listening on
+func (s *Server) Addr() net.Addr {
+	return s.listener.Addr()
+}
+
+// Close stops accepting connections and closes the idle ones, including
+// those yet to send a request. Requests in flight are completed, their
+// connections close afterwards.
 func (s *Server) Close() error {
-	s.closed.Store(true)
-	return s.listener.Close()
+	if !s.closed.Swap(true) {
+		close(s.done)
+	}
+	err := s.listener.Close()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for conn, idle := range s.conns {
+		if idle {
+			conn.Close()
+		}
+	}
+	return err
 }
 
+// Shutdown is Close, then waiting for the requests in flight to be answered
+// and their connections closed. Connections still open when ctx is done
+// are closed and ctx's error is returned. Hijacked connections aren't
+// waited for.
+func (s *Server) Shutdown(ctx context.Context) error {
+	err := s.Close()
+
+	ticker := time.NewTicker(10 * time.Millisecond)
+	defer ticker.Stop()
+	for s.active.Load() > 0 {
+		select {
+		case <-ctx.Done():
+			s.mu.Lock()
+			for conn := range s.conns {
+				conn.Close()
+			}
+			s.mu.Unlock()
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+	return err
+}
+
+// setIdle records whether conn is waiting for its next request. It reports
+// false when the server is closing and the connection should go.
+func (s *Server) setIdle(conn net.Conn, idle bool) bool {
+	s.mu.Lock()
+	s.conns[conn] = idle
+	s.mu.Unlock()
+
+	if idle {
+		s.setState(conn, StateIdle)
+	} else {
+		s.setState(conn, StateActive)
+	}
+	return !s.closed.Load()
+}
+
+// forget stops tracking conn, once it's closed or hijacked
+func (s *Server) forget(conn net.Conn) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.conns, conn)
+}
+
+// Accept errors, such as running out of file descriptors, are retried
+// after a pause that doubles up to maxAcceptBackoff
+const (
+	minAcceptBackoff = 5 * time.Millisecond
+	maxAcceptBackoff = time.Second
+)
+
 func (s *Server) listen() {
+	var backoff time.Duration
 	for {
+		if !s.acquireConn() {
+			return
+		}
+
 		conn, err := s.listener.Accept()
 		if err != nil {
+			s.cancelConn()
 			// Ignore errors after server is closed
-			if s.closed.Load() {
+			if s.closed.Load() || errors.Is(err, net.ErrClosed) {
+				return
+			}
+
+			backoff = min(max(2*backoff, minAcceptBackoff), maxAcceptBackoff)
+			log.Printf("Error accepting connection: %v, retrying in %v", err, backoff)
+			select {
+			case <-time.After(backoff):
+			case <-s.done:
 				return
 			}
-			log.Printf("Error accepting connection: %v", err)
 			continue
 		}
+		backoff = 0
 
+		if !s.admit(conn) {
+			continue
+		}
+		s.active.Add(1)
 		go s.handle(conn)
 	}
 }
 
+// handle serves requests on conn until either side asks to close it, the
+// response can't be delimited without closing, or it sits idle too long
 func (s *Server) handle(conn net.Conn) {
-	defer conn.Close()
+	hijacked := false
+	defer func() {
+		// A hijacked connection belongs to the handler now
+		if !hijacked {
+			s.forget(conn)
+			conn.Close()
+			s.active.Add(-1)
+			s.setState(conn, StateClosed)
+		}
+		s.releaseConn()
+	}()
+
+	if s.proxyProtocol != nil {
+		proxied, err := s.proxyHeader(conn)
+		if err != nil {
+			log.Printf("Error reading PROXY header from %s: %v", peer(conn), err)
+			return
+		}
+		conn = proxied
+	}
+	c := s.newConnection(conn)
+	conn = c
+	if s.connState != nil {
+		s.connState(conn, StateNew, c.stats())
+	}
+
+	// Until its first request a connection is as idle as a kept-alive one
+	if !s.setIdle(conn, true) {
+		return
+	}
+
+	reader := request.NewReader(conn)
+	reader.SetMaxBodySize(s.maxBodySize)
+
+	if s.pipelineDepth > 1 {
+		hijacked = s.handlePipelined(conn, reader)
+		return
+	}
+
+	for served := 0; ; served++ {
+		// The first request gets no idle deadline, as before keep-alive
+		if served > 0 {
+			if !s.setIdle(conn, true) {
+				return
+			}
+			if s.idleTimeout > 0 {
+				conn.SetReadDeadline(time.Now().Add(s.idleTimeout))
+			}
+		}
+
+		keepAlive, err := s.serve(conn, reader)
+		if errors.Is(err, response.ErrHijacked) {
+			hijacked = true
+			return
+		}
+		if err != nil {
+			// A kept-alive connection going away between requests is normal,
+			// as is Close dropping one that never sent a request
+			if !idleClosed(err) || served == 0 && !s.closed.Load() {
+				log.Printf("Error reading from %s: %v", peer(conn), err)
+			}
+			return
+		}
+		if !keepAlive {
+			return
+		}
+	}
+}
+
+// serve reads one request from conn and answers it, reporting whether the
+// connection can be reused
+func (s *Server) serve(conn net.Conn, reader *request.Reader) (bool, error) {
+	// Create a response writer, interim responses may go out while parsing
+	writer := s.connWriter(conn, reader)
 
 	// Parse the request from the connection
-	req, err := request.FromReader(conn)
+	req, err := reader.ReadRequest(func(req *request.Request) error {
+		s.setIdle(conn, false)
+		conn.SetReadDeadline(time.Time{})
+		return s.prepare(conn, writer, req, true)
+	})
+	if errors.Is(err, request.ErrUnsupportedHTTPVersion) {
+		reject(writer, response.HTTPVersionNotSupported)
+		return false, nil
+	}
+	if errors.Is(err, errRequestRejected) {
+		return false, nil
+	}
+	if errors.Is(err, request.ErrContentTooLarge) {
+		reject(writer, response.ContentTooLarge)
+		return false, nil
+	}
 	if err != nil {
-		log.Printf("Error reading from %s: %v", conn.RemoteAddr(), err)
-		return
+		return false, err
 	}
 
-	// Create a response writer
-	writer := response.NewWriter(conn)
+	return s.respond(conn, reader, writer, req)
+}
+
+// connWriter writes responses straight to conn. Hijacking takes the
+// connection off the server's books right away.
+func (s *Server) connWriter(conn net.Conn, reader *request.Reader) *response.Writer {
+	return response.NewConnWriter(conn, func() []byte {
+		s.forget(conn)
+		s.active.Add(-1)
+		s.setState(conn, StateHijacked)
+		return reader.Buffered()
+	})
+}
+
+// prepare runs once the request headers are in, before the body is read.
+// deferBody lets the handler's first ReadBody send 100 Continue, it must be
+// false when the connection is read on while the handler runs.
+func (s *Server) prepare(conn net.Conn, w *response.Writer, req *request.Request, deferBody bool) error {
+	// The HTTP/2 preface parses as a request but isn't one
+	if !req.RequestLine.HTTP2Preface() {
+		s.identify(conn, req)
+	}
+	w.SetRequestVersion(req.RequestLine.HttpVersion, requestKeepAlive(req))
+	return s.checkExpectations(w, req, deferBody)
+}
+
+// respond answers a request that has been read, reporting whether the
+// connection can be reused
+func (s *Server) respond(conn net.Conn, reader *request.Reader, writer *response.Writer, req *request.Request) (bool, error) {
+	if req.RequestLine.HTTP2Preface() {
+		if !s.h2c {
+			return false, errors.New("HTTP/2 preface without h2c enabled")
+		}
+		// The preface was parsed as a request, give it back to HTTP/2 whole
+		r := io.MultiReader(strings.NewReader("PRI * HTTP/2.0\r\n\r\n"), bytes.NewReader(reader.Buffered()), conn)
+		return false, s.serveHTTP2(conn, r, nil)
+	}
+	if s.h2c && http2.IsUpgrade(req) {
+		err := writer.WriteStatusLine(response.SwitchingProtocols)
+		if err != nil {
+			return false, err
+		}
+		h := headers.NewHeaders()
+		h.Set("Connection", "Upgrade")
+		h.Set("Upgrade", "h2c")
+		err = writer.WriteHeaders(h)
+		if err != nil {
+			return false, err
+		}
+		return false, s.serveHTTP2(conn, io.MultiReader(bytes.NewReader(reader.Buffered()), conn), req)
+	}
 
 	// Call the handler function
-	s.handler(writer, req)
+	s.runHandler(writer, req)
+	if writer.Hijacked() {
+		return false, response.ErrHijacked
+	}
+
+	// Complete chunked bodies and flush response filters
+	err := writer.Finish()
+	if err != nil {
+		log.Printf("Error finishing response to %s: %v", peer(conn), err)
+		return false, nil
+	}
+
+	// A body the handler never asked for may still be on its way
+	return writer.KeepAlive() && requestKeepAlive(req) && req.BodyRead(), nil
+}
+
+// serveHTTP2 hands the connection over to HTTP/2 for good
+func (s *Server) serveHTTP2(conn net.Conn, r io.Reader, upgrade *request.Request) error {
+	handler := func(w *response.Writer, req *request.Request) {
+		// An upgrade request was identified as HTTP/1.1 already
+		if req.Conn.ID == 0 {
+			s.identify(conn, req)
+		}
+		s.runHandler(w, req)
+	}
+	return http2.ServeConn(conn, r, handler, http2.Options{
+		MaxBodySize: s.maxBodySize,
+		IdleTimeout: s.idleTimeout,
+	}, upgrade)
+}
+
+// requestKeepAlive reports whether the client is willing to send another
+// request on the same connection: HTTP/1.1 unless it says close, HTTP/1.0
+// only when it asks for keep-alive
+func requestKeepAlive(req *request.Request) bool {
+	switch req.RequestLine.HttpVersion {
+	case "1.1":
+		return !req.Headers.HasToken("Connection", "close")
+	case "1.0":
+		return req.Headers.HasToken("Connection", "keep-alive")
+	}
+	return false
+}
+
+func idleClosed(err error) bool {
+	var netErr net.Error
+	return errors.Is(err, io.EOF) || errors.Is(err, net.ErrClosed) || (errors.As(err, &netErr) && netErr.Timeout())
+}
+
+// checkExpectations runs once the request headers are in. It rejects
+// HTTP/1.1 requests without Host, bodies over the size limit and unmet
+// expectations. 100 Continue goes out when the handler first reads the body
+// or, without deferBody, right away.
+func (s *Server) checkExpectations(w *response.Writer, req *request.Request, deferBody bool) error {
+	// Host is optional before HTTP/1.1 (RFC 9112 §3.2)
+	if req.RequestLine.HttpVersion == "1.1" && req.Headers.Get("Host") == "" {
+		return reject(w, response.BadRequest)
+	}
+
+	contentLength, _ := strconv.ParseInt(req.Headers.Get("Content-Length"), 10, 64)
+	if s.maxBodySize > 0 && contentLength > s.maxBodySize {
+		return reject(w, response.ContentTooLarge)
+	}
+
+	expect := strings.ToLower(strings.TrimSpace(req.Headers.Get("Expect")))
+	if expect == "" {
+		return nil
+	}
+
+	if expect != "100-continue" {
+		return reject(w, response.ExpectationFailed)
+	}
+
+	if s.expectContinue != nil {
+		if status := s.expectContinue(req); status != response.Continue {
+			return reject(w, status)
+		}
+	}
+
+	// Nothing to wait for, the final response is next anyway
+	chunked := strings.Contains(strings.ToLower(req.Headers.Get("Transfer-Encoding")), "chunked")
+	if contentLength == 0 && !chunked {
+		return nil
+	}
+
+	sendContinue := func() error {
+		return w.WriteInformational(response.Continue, nil)
+	}
+	if !deferBody {
+		return sendContinue()
+	}
+	return &request.DeferBody{Continue: sendContinue}
+}
+
+// reject answers a request whose body was never read. The connection can't
+// be reused after that, so it's closed.
+func reject(w *response.Writer, statusCode response.StatusCode) error {
+	err := w.WriteStatusLine(statusCode)
+	if err != nil {
+		return err
+	}
+
+	h := headers.NewHeaders()
+	h.Set("Content-Length", "0")
+	h.Set("Connection", "close")
+	err = w.WriteHeaders(h)
+	if err != nil {
+		return err
+	}
+
+	return errRequestRejected
 }
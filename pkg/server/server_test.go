@@ -0,0 +1,623 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/spaghetti-lover/go-http/pkg/headers"
+	"github.com/spaghetti-lover/go-http/pkg/http2"
+	"github.com/spaghetti-lover/go-http/pkg/request"
+	"github.com/spaghetti-lover/go-http/pkg/response"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func echoHandler(w *response.Writer, req *request.Request) {
+	body, err := req.ReadBody()
+	if err != nil {
+		reject(w, response.BadRequest)
+		return
+	}
+	w.WriteStatusLine(response.OK)
+	h := headers.NewHeaders()
+	h.Set("Content-Length", strconv.Itoa(len(body)))
+	h.Set("Connection", "close")
+	w.WriteHeaders(h)
+	w.WriteBody(body)
+}
+
+func startServer(t *testing.T, handler Handler, opts ...Option) *Server {
+	t.Helper()
+	srv, err := Serve(0, handler, opts...)
+	require.NoError(t, err)
+	t.Cleanup(func() { srv.Close() })
+	return srv
+}
+
+func dial(t *testing.T, srv *Server) (net.Conn, *bufio.Reader) {
+	t.Helper()
+	conn, err := net.Dial("tcp", srv.Addr().String())
+	require.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	return conn, bufio.NewReader(conn)
+}
+
+// readHead reads a status line and header block
+func readHead(t *testing.T, r *bufio.Reader) string {
+	t.Helper()
+	var head strings.Builder
+	for {
+		line, err := r.ReadString('\n')
+		require.NoError(t, err)
+		head.WriteString(line)
+		if line == "\r\n" {
+			return head.String()
+		}
+	}
+}
+
+func TestExpectContinue(t *testing.T) {
+	srv := startServer(t, echoHandler)
+
+	// Test: 100 Continue is sent before the body
+	conn, r := dial(t, srv)
+	_, err := io.WriteString(conn, "POST /upload HTTP/1.1\r\nHost: localhost\r\nExpect: 100-continue\r\nContent-Length: 5\r\n\r\n")
+	require.NoError(t, err)
+	assert.Equal(t, "HTTP/1.1 100 Continue\r\n\r\n", readHead(t, r))
+
+	_, err = io.WriteString(conn, "hello")
+	require.NoError(t, err)
+	head := readHead(t, r)
+	assert.True(t, strings.HasPrefix(head, "HTTP/1.1 200 OK\r\n"))
+	body, err := io.ReadAll(r)
+	require.NoError(t, err)
+	assert.Equal(t, "hello", string(body))
+
+	// Test: Unknown expectation
+	conn, r = dial(t, srv)
+	_, err = io.WriteString(conn, "POST /upload HTTP/1.1\r\nHost: localhost\r\nExpect: teapot\r\nContent-Length: 5\r\n\r\n")
+	require.NoError(t, err)
+	assert.True(t, strings.HasPrefix(readHead(t, r), "HTTP/1.1 417 Expectation Failed\r\n"))
+
+	// Test: Empty body needs no 100 Continue
+	conn, r = dial(t, srv)
+	_, err = io.WriteString(conn, "POST /upload HTTP/1.1\r\nHost: localhost\r\nExpect: 100-continue\r\nContent-Length: 0\r\n\r\n")
+	require.NoError(t, err)
+	assert.True(t, strings.HasPrefix(readHead(t, r), "HTTP/1.1 200 OK\r\n"))
+
+	// Test: A body sent without waiting is read as usual
+	conn, r = dial(t, srv)
+	_, err = io.WriteString(conn, "POST /upload HTTP/1.1\r\nHost: localhost\r\nExpect: 100-continue\r\nContent-Length: 5\r\n\r\nhello")
+	require.NoError(t, err)
+	assert.True(t, strings.HasPrefix(readHead(t, r), "HTTP/1.1 200 OK\r\n"))
+	body, err = io.ReadAll(r)
+	require.NoError(t, err)
+	assert.Equal(t, "hello", string(body))
+}
+
+func TestExpectContinueLazy(t *testing.T) {
+	var running atomic.Bool
+	handler := func(w *response.Writer, req *request.Request) {
+		running.Store(true)
+		if req.RequestLine.RequestTarget == "/read" {
+			body, err := req.ReadBody()
+			require.NoError(t, err)
+			req.Body = body
+		}
+		keepAliveHandler(w, req)
+	}
+
+	for _, opts := range [][]Option{nil, {WithPipelining(4)}} {
+		running.Store(false)
+		srv := startServer(t, handler, opts...)
+
+		// Test: 100 Continue waits for the handler to read the body
+		conn, r := dial(t, srv)
+		_, err := io.WriteString(conn, "POST /read HTTP/1.1\r\nHost: localhost\r\nExpect: 100-continue\r\nContent-Length: 5\r\n\r\n")
+		require.NoError(t, err)
+		assert.Equal(t, "HTTP/1.1 100 Continue\r\n\r\n", readHead(t, r))
+		assert.True(t, running.Load())
+		_, err = io.WriteString(conn, "hello")
+		require.NoError(t, err)
+		assert.True(t, strings.HasPrefix(readHead(t, r), "HTTP/1.1 200 OK\r\n"))
+		assert.Equal(t, "/read hello", readBody(t, r, len("/read hello")))
+
+		// Test: The connection goes on after a body that was read
+		_, err = io.WriteString(conn, "GET /next HTTP/1.1\r\nHost: localhost\r\n\r\n")
+		require.NoError(t, err)
+		assert.True(t, strings.HasPrefix(readHead(t, r), "HTTP/1.1 200 OK\r\n"))
+		assert.Equal(t, "/next ", readBody(t, r, len("/next ")))
+
+		// Test: A handler answering without the body sends no 100 Continue, and
+		// the connection closes as the body may still come
+		conn, r = dial(t, srv)
+		_, err = io.WriteString(conn, "POST /skip HTTP/1.1\r\nHost: localhost\r\nExpect: 100-continue\r\nContent-Length: 5\r\n\r\n")
+		require.NoError(t, err)
+		assert.True(t, strings.HasPrefix(readHead(t, r), "HTTP/1.1 200 OK\r\n"))
+		assert.Equal(t, "/skip ", readBody(t, r, len("/skip ")))
+		_, err = r.ReadByte()
+		assert.ErrorIs(t, err, io.EOF)
+	}
+}
+
+func TestExpectContinueRejected(t *testing.T) {
+	var called atomic.Bool
+	handler := func(w *response.Writer, req *request.Request) {
+		called.Store(true)
+		echoHandler(w, req)
+	}
+	srv := startServer(t, handler,
+		WithMaxBodySize(1024),
+		WithExpectContinue(func(req *request.Request) response.StatusCode {
+			if req.Headers.Get("Authorization") == "" {
+				return response.StatusCode("401")
+			}
+			return response.Continue
+		}),
+	)
+
+	// Test: Body over the limit
+	conn, r := dial(t, srv)
+	_, err := io.WriteString(conn, "POST /upload HTTP/1.1\r\nHost: localhost\r\nExpect: 100-continue\r\nAuthorization: yes\r\nContent-Length: 4096\r\n\r\n")
+	require.NoError(t, err)
+	assert.True(t, strings.HasPrefix(readHead(t, r), "HTTP/1.1 413 Content Too Large\r\n"))
+
+	// Test: Rejected by the check
+	conn, r = dial(t, srv)
+	_, err = io.WriteString(conn, "POST /upload HTTP/1.1\r\nHost: localhost\r\nExpect: 100-continue\r\nContent-Length: 5\r\n\r\n")
+	require.NoError(t, err)
+	assert.True(t, strings.HasPrefix(readHead(t, r), "HTTP/1.1 401\r\n"))
+	assert.False(t, called.Load())
+
+	// Test: Accepted by the check
+	conn, r = dial(t, srv)
+	_, err = io.WriteString(conn, "POST /upload HTTP/1.1\r\nHost: localhost\r\nExpect: 100-continue\r\nAuthorization: yes\r\nContent-Length: 5\r\n\r\n")
+	require.NoError(t, err)
+	assert.Equal(t, "HTTP/1.1 100 Continue\r\n\r\n", readHead(t, r))
+	_, err = io.WriteString(conn, "hello")
+	require.NoError(t, err)
+	assert.True(t, strings.HasPrefix(readHead(t, r), "HTTP/1.1 200 OK\r\n"))
+	assert.True(t, called.Load())
+}
+
+func TestMaxBodySizeChunked(t *testing.T) {
+	var called atomic.Int32
+	handler := func(w *response.Writer, req *request.Request) {
+		called.Add(1)
+		echoHandler(w, req)
+	}
+
+	for _, opts := range [][]Option{
+		{WithMaxBodySize(8)},
+		{WithMaxBodySize(8), WithPipelining(4)},
+	} {
+		srv := startServer(t, handler, opts...)
+
+		// Test: A chunked body within the limit is served
+		conn, r := dial(t, srv)
+		_, err := io.WriteString(conn, "POST / HTTP/1.1\r\nHost: localhost\r\nTransfer-Encoding: chunked\r\n\r\n5\r\nhello\r\n0\r\n\r\n")
+		require.NoError(t, err)
+		assert.True(t, strings.HasPrefix(readHead(t, r), "HTTP/1.1 200 OK\r\n"))
+
+		// Test: One growing past it is cut off with 413 and the connection
+		// closed, without the handler running
+		called.Store(0)
+		conn, r = dial(t, srv)
+		_, err = io.WriteString(conn, "POST / HTTP/1.1\r\nHost: localhost\r\nTransfer-Encoding: chunked\r\n\r\n5\r\nhello\r\n5\r\nworld\r\n")
+		require.NoError(t, err)
+		head := readHead(t, r)
+		assert.True(t, strings.HasPrefix(head, "HTTP/1.1 413 Content Too Large\r\n"), head)
+		assert.Contains(t, head, "connection: close\r\n")
+		_, err = r.ReadByte()
+		assert.Error(t, err)
+		assert.Zero(t, called.Load())
+	}
+}
+
+func keepAliveHandler(w *response.Writer, req *request.Request) {
+	w.WriteStatusLine(response.OK)
+	h := headers.NewHeaders()
+	if req.RequestLine.RequestTarget == "/stream" {
+		// No Content-Length: the body ends when the connection does
+		w.WriteHeaders(h)
+		w.Write([]byte("streamed"))
+		return
+	}
+	body := req.RequestLine.RequestTarget + " " + string(req.Body)
+	h.Set("Content-Length", strconv.Itoa(len(body)))
+	w.WriteHeaders(h)
+	w.WriteBody([]byte(body))
+}
+
+// readBody reads a Content-Length body after readHead
+func readBody(t *testing.T, r *bufio.Reader, n int) string {
+	t.Helper()
+	buf := make([]byte, n)
+	_, err := io.ReadFull(r, buf)
+	require.NoError(t, err)
+	return string(buf)
+}
+
+func TestKeepAlive(t *testing.T) {
+	srv := startServer(t, keepAliveHandler)
+
+	// Test: Several requests on one connection
+	conn, r := dial(t, srv)
+	_, err := io.WriteString(conn, "GET /one HTTP/1.1\r\nHost: localhost\r\n\r\n")
+	require.NoError(t, err)
+	assert.True(t, strings.HasPrefix(readHead(t, r), "HTTP/1.1 200 OK\r\n"))
+	assert.Equal(t, "/one ", readBody(t, r, 5))
+
+	_, err = io.WriteString(conn, "POST /two HTTP/1.1\r\nHost: localhost\r\nContent-Length: 5\r\n\r\nhello")
+	require.NoError(t, err)
+	readHead(t, r)
+	assert.Equal(t, "/two hello", readBody(t, r, 10))
+
+	// Test: Requests sent back to back are each answered, the bytes read
+	// ahead are kept for the next one
+	_, err = io.WriteString(conn, "POST /three HTTP/1.1\r\nHost: localhost\r\nContent-Length: 2\r\n\r\nhi"+
+		"GET /four HTTP/1.1\r\nHost: localhost\r\n\r\n")
+	require.NoError(t, err)
+	readHead(t, r)
+	assert.Equal(t, "/three hi", readBody(t, r, 9))
+	readHead(t, r)
+	assert.Equal(t, "/four ", readBody(t, r, 6))
+
+	// Test: Connection: close from the client
+	_, err = io.WriteString(conn, "GET /five HTTP/1.1\r\nHost: localhost\r\nConnection: close\r\n\r\n")
+	require.NoError(t, err)
+	readHead(t, r)
+	rest, err := io.ReadAll(r)
+	require.NoError(t, err)
+	assert.Equal(t, "/five ", string(rest))
+
+	// Test: A body without a length closes the connection
+	conn, r = dial(t, srv)
+	_, err = io.WriteString(conn, "GET /stream HTTP/1.1\r\nHost: localhost\r\n\r\n")
+	require.NoError(t, err)
+	readHead(t, r)
+	rest, err = io.ReadAll(r)
+	require.NoError(t, err)
+	assert.Equal(t, "streamed", string(rest))
+
+	// Test: Connection: close from the handler
+	srv = startServer(t, echoHandler)
+	conn, r = dial(t, srv)
+	_, err = io.WriteString(conn, "POST / HTTP/1.1\r\nHost: localhost\r\nContent-Length: 2\r\n\r\nhi")
+	require.NoError(t, err)
+	readHead(t, r)
+	rest, err = io.ReadAll(r)
+	require.NoError(t, err)
+	assert.Equal(t, "hi", string(rest))
+}
+
+func TestHTTPVersions(t *testing.T) {
+	srv := startServer(t, keepAliveHandler)
+
+	// Test: HTTP/1.0 without Host is served, then the connection closes
+	conn, r := dial(t, srv)
+	_, err := io.WriteString(conn, "GET /old HTTP/1.0\r\n\r\n")
+	require.NoError(t, err)
+	head := readHead(t, r)
+	assert.True(t, strings.HasPrefix(head, "HTTP/1.1 200 OK\r\n"))
+	assert.Contains(t, head, "connection: close\r\n")
+	rest, err := io.ReadAll(r)
+	require.NoError(t, err)
+	assert.Equal(t, "/old ", string(rest))
+
+	// Test: HTTP/1.0 keep-alive is opt-in
+	conn, r = dial(t, srv)
+	_, err = io.WriteString(conn, "GET /one HTTP/1.0\r\nConnection: keep-alive\r\n\r\n")
+	require.NoError(t, err)
+	assert.Contains(t, readHead(t, r), "connection: keep-alive\r\n")
+	assert.Equal(t, "/one ", readBody(t, r, 5))
+	_, err = io.WriteString(conn, "GET /stream HTTP/1.0\r\nConnection: keep-alive\r\n\r\n")
+	require.NoError(t, err)
+	assert.Contains(t, readHead(t, r), "connection: close\r\n")
+	rest, err = io.ReadAll(r)
+	require.NoError(t, err)
+	assert.Equal(t, "streamed", string(rest))
+
+	// Test: HTTP/0.9 gets the bare body
+	conn, r = dial(t, srv)
+	_, err = io.WriteString(conn, "GET /ancient\r\n")
+	require.NoError(t, err)
+	rest, err = io.ReadAll(r)
+	require.NoError(t, err)
+	assert.Equal(t, "/ancient ", string(rest))
+
+	// Test: HTTP/1.1 still needs Host
+	conn, r = dial(t, srv)
+	_, err = io.WriteString(conn, "GET / HTTP/1.1\r\n\r\n")
+	require.NoError(t, err)
+	assert.True(t, strings.HasPrefix(readHead(t, r), "HTTP/1.1 400 Bad Request\r\n"))
+
+	// Test: Unsupported versions get 505
+	conn, r = dial(t, srv)
+	_, err = io.WriteString(conn, "GET / HTTP/3.0\r\nHost: localhost\r\n\r\n")
+	require.NoError(t, err)
+	head = readHead(t, r)
+	assert.True(t, strings.HasPrefix(head, "HTTP/1.1 505 HTTP Version Not Supported\r\n"))
+	assert.Contains(t, head, "connection: close\r\n")
+}
+
+func TestKeepAliveIdle(t *testing.T) {
+	// Test: Idle connections time out
+	srv := startServer(t, keepAliveHandler, WithIdleTimeout(50*time.Millisecond))
+	conn, r := dial(t, srv)
+	_, err := io.WriteString(conn, "GET /one HTTP/1.1\r\nHost: localhost\r\n\r\n")
+	require.NoError(t, err)
+	readHead(t, r)
+	readBody(t, r, 5)
+	start := time.Now()
+	_, err = r.ReadByte()
+	require.ErrorIs(t, err, io.EOF)
+	assert.Less(t, time.Since(start), time.Second)
+
+	// Test: Close drops idle connections
+	srv = startServer(t, keepAliveHandler)
+	conn, r = dial(t, srv)
+	_, err = io.WriteString(conn, "GET /one HTTP/1.1\r\nHost: localhost\r\n\r\n")
+	require.NoError(t, err)
+	readHead(t, r)
+	readBody(t, r, 5)
+	require.NoError(t, srv.Close())
+	_, err = r.ReadByte()
+	require.ErrorIs(t, err, io.EOF)
+}
+
+func TestHijack(t *testing.T) {
+	srv := startServer(t, func(w *response.Writer, req *request.Request) {
+		w.WriteStatusLine(response.SwitchingProtocols)
+		h := headers.NewHeaders()
+		h.Set("Upgrade", "echo")
+		h.Set("Connection", "Upgrade")
+		w.WriteHeaders(h)
+
+		conn, buffered, err := w.Hijack()
+		require.NoError(t, err)
+		_, _, err = w.Hijack()
+		assert.ErrorIs(t, err, response.ErrHijacked)
+
+		// Echo lines until the client goes away, starting with what was buffered
+		go func() {
+			defer conn.Close()
+			lines := bufio.NewScanner(io.MultiReader(bytes.NewReader(buffered), conn))
+			for lines.Scan() {
+				io.WriteString(conn, "echo: "+lines.Text()+"\n")
+			}
+		}()
+	})
+
+	// Test: Bytes sent along with the request are handed over
+	conn, r := dial(t, srv)
+	_, err := io.WriteString(conn, "GET /echo HTTP/1.1\r\nHost: localhost\r\nUpgrade: echo\r\nConnection: Upgrade\r\n\r\nearly\n")
+	require.NoError(t, err)
+	assert.True(t, strings.HasPrefix(readHead(t, r), "HTTP/1.1 101 Switching Protocols\r\n"))
+	line, err := r.ReadString('\n')
+	require.NoError(t, err)
+	assert.Equal(t, "echo: early\n", line)
+
+	// Test: The server no longer owns the connection, Close leaves it open
+	require.NoError(t, srv.Close())
+	srv.mu.Lock()
+	assert.Empty(t, srv.conns)
+	srv.mu.Unlock()
+	_, err = io.WriteString(conn, "late\n")
+	require.NoError(t, err)
+	line, err = r.ReadString('\n')
+	require.NoError(t, err)
+	assert.Equal(t, "echo: late\n", line)
+
+	// Test: Writers not backed by a connection can't be hijacked
+	_, _, err = response.NewWriter(&bytes.Buffer{}).Hijack()
+	assert.ErrorIs(t, err, response.ErrNotHijackable)
+}
+
+func TestH2C(t *testing.T) {
+	emptySettings := "\x00\x00\x00\x04\x00\x00\x00\x00\x00"
+
+	// readFrameType reads a frame from the server and returns its type
+	readFrameType := func(r *bufio.Reader) byte {
+		head := make([]byte, 9)
+		_, err := io.ReadFull(r, head)
+		require.NoError(t, err)
+		_, err = r.Discard(int(head[0])<<16 | int(head[1])<<8 | int(head[2]))
+		require.NoError(t, err)
+		return head[3]
+	}
+
+	// Test: Without h2c the preface is refused
+	srv := startServer(t, echoHandler)
+	conn, r := dial(t, srv)
+	_, err := io.WriteString(conn, http2.ClientPreface+emptySettings)
+	require.NoError(t, err)
+	_, err = r.ReadByte()
+	assert.ErrorIs(t, err, io.EOF)
+
+	// Test: With prior knowledge the server answers with its SETTINGS
+	srv = startServer(t, echoHandler, WithH2C())
+	conn, r = dial(t, srv)
+	_, err = io.WriteString(conn, http2.ClientPreface+emptySettings)
+	require.NoError(t, err)
+	assert.Equal(t, byte(0x4), readFrameType(r))
+
+	// Test: An upgrade gets 101, then HTTP/2 with the response on stream 1
+	conn, r = dial(t, srv)
+	_, err = io.WriteString(conn, "GET / HTTP/1.1\r\nHost: localhost\r\nConnection: Upgrade, HTTP2-Settings\r\n"+
+		"Upgrade: h2c\r\nHTTP2-Settings: \r\n\r\n"+http2.ClientPreface+emptySettings)
+	require.NoError(t, err)
+	head := readHead(t, r)
+	assert.True(t, strings.HasPrefix(head, "HTTP/1.1 101 Switching Protocols\r\n"))
+	assert.Contains(t, head, "upgrade: h2c\r\n")
+	types := map[byte]bool{}
+	for !types[0x1] {
+		types[readFrameType(r)] = true
+	}
+	assert.True(t, types[0x4])
+
+	// Test: Upgrades aren't taken up without h2c enabled
+	srv = startServer(t, echoHandler)
+	conn, r = dial(t, srv)
+	_, err = io.WriteString(conn, "GET / HTTP/1.1\r\nHost: localhost\r\nConnection: Upgrade, HTTP2-Settings\r\n"+
+		"Upgrade: h2c\r\nHTTP2-Settings: \r\n\r\n")
+	require.NoError(t, err)
+	assert.True(t, strings.HasPrefix(readHead(t, r), "HTTP/1.1 200 OK\r\n"))
+}
+
+func TestPipelining(t *testing.T) {
+	pipelined := "GET /one HTTP/1.1\r\nHost: localhost\r\n\r\n" +
+		"POST /two HTTP/1.1\r\nHost: localhost\r\nContent-Length: 5\r\n\r\nhello" +
+		"GET /three HTTP/1.1\r\nHost: localhost\r\n\r\n"
+	readAll := func(r *bufio.Reader, targets ...string) {
+		for _, target := range targets {
+			head := readHead(t, r)
+			require.True(t, strings.HasPrefix(head, "HTTP/1.1 200 OK\r\n"), head)
+			assert.Equal(t, target, readBody(t, r, len(target)))
+		}
+	}
+
+	// Test: Requests sent back to back are all answered, one at a time
+	srv := startServer(t, keepAliveHandler)
+	conn, r := dial(t, srv)
+	_, err := io.WriteString(conn, pipelined)
+	require.NoError(t, err)
+	readAll(r, "/one ", "/two hello", "/three ")
+
+	// enter counts a running handler and records the most seen at once
+	var running, maxRunning atomic.Int32
+	enter := func() int32 {
+		n := running.Add(1)
+		for m := maxRunning.Load(); n > m && !maxRunning.CompareAndSwap(m, n); m = maxRunning.Load() {
+		}
+		return n
+	}
+
+	// Test: With pipelining, safe requests run concurrently but are answered in order
+	slowRunning, release := make(chan struct{}), make(chan struct{})
+	srv = startServer(t, func(w *response.Writer, req *request.Request) {
+		n := enter()
+		defer running.Add(-1)
+
+		switch req.RequestLine.RequestTarget {
+		case "/slow":
+			close(slowRunning)
+			<-release
+		case "/fast":
+			<-slowRunning
+			close(release)
+		case "/two":
+			// Unsafe methods run alone
+			assert.Equal(t, int32(1), n)
+		}
+		keepAliveHandler(w, req)
+	}, WithPipelining(4))
+	conn, r = dial(t, srv)
+	_, err = io.WriteString(conn, "GET /slow HTTP/1.1\r\nHost: localhost\r\n\r\n"+
+		"GET /fast HTTP/1.1\r\nHost: localhost\r\n\r\n"+pipelined)
+	require.NoError(t, err)
+	readAll(r, "/slow ", "/fast ", "/one ", "/two hello", "/three ")
+	assert.GreaterOrEqual(t, maxRunning.Load(), int32(2))
+
+	// Test: No more than depth requests are read ahead
+	maxRunning.Store(0)
+	srv = startServer(t, func(w *response.Writer, req *request.Request) {
+		enter()
+		defer running.Add(-1)
+		time.Sleep(20 * time.Millisecond)
+		keepAliveHandler(w, req)
+	}, WithPipelining(2))
+	conn, r = dial(t, srv)
+	_, err = io.WriteString(conn, strings.Repeat("GET /x HTTP/1.1\r\nHost: localhost\r\n\r\n", 6))
+	require.NoError(t, err)
+	readAll(r, "/x ", "/x ", "/x ", "/x ", "/x ", "/x ")
+	assert.Equal(t, int32(2), maxRunning.Load())
+
+	// Test: A response that closes the connection drops those after it
+	srv = startServer(t, keepAliveHandler, WithPipelining(4))
+	conn, r = dial(t, srv)
+	_, err = io.WriteString(conn, "GET /one HTTP/1.1\r\nHost: localhost\r\n\r\n"+
+		"GET /stream HTTP/1.1\r\nHost: localhost\r\n\r\n"+
+		"GET /three HTTP/1.1\r\nHost: localhost\r\n\r\n")
+	require.NoError(t, err)
+	readAll(r, "/one ")
+	readHead(t, r)
+	rest, err := io.ReadAll(r)
+	require.NoError(t, err)
+	assert.Equal(t, "streamed", string(rest))
+}
+
+func TestShutdown(t *testing.T) {
+	release := make(chan struct{})
+	started := make(chan struct{}, 2)
+	srv := startServer(t, func(w *response.Writer, req *request.Request) {
+		started <- struct{}{}
+		<-release
+		keepAliveHandler(w, req)
+	})
+
+	// Test: A request in flight is answered before Shutdown returns
+	conn, r := dial(t, srv)
+	_, err := io.WriteString(conn, "GET /slow HTTP/1.1\r\nHost: localhost\r\n\r\n")
+	require.NoError(t, err)
+	<-started
+	idle, _ := dial(t, srv)
+
+	done := make(chan error, 1)
+	go func() { done <- srv.Shutdown(context.Background()) }()
+	select {
+	case <-done:
+		t.Fatal("Shutdown returned with a request in flight")
+	case <-time.After(50 * time.Millisecond):
+	}
+	close(release)
+	require.NoError(t, <-done)
+	assert.True(t, strings.HasPrefix(readHead(t, r), "HTTP/1.1 200 OK\r\n"))
+	assert.Equal(t, "/slow ", readBody(t, r, 6))
+
+	// Test: The connection that never sent a request was closed
+	_, err = idle.Read(make([]byte, 1))
+	assert.ErrorIs(t, err, io.EOF)
+
+	// Test: Connections still busy when the context is done are closed
+	srv = startServer(t, func(w *response.Writer, req *request.Request) {
+		started <- struct{}{}
+		time.Sleep(time.Second)
+	})
+	conn, _ = dial(t, srv)
+	_, err = io.WriteString(conn, "GET /stuck HTTP/1.1\r\nHost: localhost\r\n\r\n")
+	require.NoError(t, err)
+	<-started
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	assert.ErrorIs(t, srv.Shutdown(ctx), context.DeadlineExceeded)
+	_, err = conn.Read(make([]byte, 1))
+	assert.Error(t, err)
+
+	// Test: Hijacked connections aren't waited for
+	hijacked := make(chan struct{})
+	srv = startServer(t, func(w *response.Writer, req *request.Request) {
+		conn, _, err := w.Hijack()
+		require.NoError(t, err)
+		defer conn.Close()
+		close(hijacked)
+		<-release
+		time.Sleep(time.Second)
+	})
+	conn, _ = dial(t, srv)
+	_, err = io.WriteString(conn, "GET /ws HTTP/1.1\r\nHost: localhost\r\n\r\n")
+	require.NoError(t, err)
+	<-hijacked
+	ctx, cancel = context.WithTimeout(context.Background(), 500*time.Millisecond)
+	defer cancel()
+	assert.NoError(t, srv.Shutdown(ctx))
+}
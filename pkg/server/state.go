@@ -0,0 +1,106 @@
+package server
+
+import (
+	"net"
+	"strconv"
+	"time"
+)
+
+// ConnState is where a connection is in its life, as reported to the
+// WithConnState hook
+type ConnState int
+
+const (
+	// StateNew is a connection that was just accepted, and whose PROXY
+	// header, if any, has been read. Its first request makes it
+	// StateActive.
+	StateNew ConnState = iota
+	// StateActive is a connection with requests being read or answered.
+	// HTTP/2 connections stay active until they close.
+	StateActive
+	// StateIdle is a kept-alive connection waiting for its next request
+	StateIdle
+	// StateHijacked is a connection a handler took over. It's final, the
+	// server doesn't report it again.
+	StateHijacked
+	// StateClosed is a connection the server closed. It's final.
+	StateClosed
+)
+
+var stateNames = []string{"new", "active", "idle", "hijacked", "closed"}
+
+func (st ConnState) String() string {
+	if st < 0 || int(st) >= len(stateNames) {
+		return "ConnState(" + strconv.Itoa(int(st)) + ")"
+	}
+	return stateNames[st]
+}
+
+// ConnStats are what a connection has done so far
+type ConnStats struct {
+	// ID is the connection's, as in request.ConnInfo
+	ID uint64
+	// BytesRead and BytesWritten count bytes on the wire, after any PROXY
+	// header and before any TLS decryption done underneath
+	BytesRead    int64
+	BytesWritten int64
+	// Requests counts the requests read, HTTP/2 streams included
+	Requests int64
+	// Duration is how long the connection has been open, its whole life
+	// once it's StateClosed
+	Duration time.Duration
+}
+
+// ConnHook is told of a connection's changes of state, with its stats then
+type ConnHook func(conn net.Conn, state ConnState, stats ConnStats)
+
+// WithConnState calls hook every time a connection changes state. The hooks
+// of a connection run one at a time, in order, on the goroutines serving
+// it, so they should be quick. Closing conn from a hook drops the
+// connection, e.g. to enforce a quota.
+func WithConnState(hook ConnHook) Option {
+	return func(s *Server) {
+		s.connState = hook
+	}
+}
+
+// Stats returns the stats of a connection the server accepted, such as one
+// given to a ConnHook or hijacked by a handler. It reports false for any
+// other connection.
+func Stats(conn net.Conn) (ConnStats, bool) {
+	c, ok := conn.(*connection)
+	if !ok {
+		return ConnStats{}, false
+	}
+	return c.stats(), true
+}
+
+func (c *connection) stats() ConnStats {
+	return ConnStats{
+		ID:           c.id,
+		BytesRead:    c.bytesRead.Load(),
+		BytesWritten: c.bytesWritten.Load(),
+		Requests:     c.requests.Load(),
+		Duration:     time.Since(c.started),
+	}
+}
+
+// setState moves conn to state and reports it, unless it's there already or
+// was hijacked or closed. A connection stays new until its first request.
+func (s *Server) setState(conn net.Conn, state ConnState) {
+	c, ok := conn.(*connection)
+	if !ok || s.connState == nil {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	switch {
+	case c.state == state, c.state == StateHijacked, c.state == StateClosed:
+		return
+	case c.state == StateNew && state == StateIdle:
+		return
+	}
+	c.state = state
+	s.connState(conn, state, c.stats())
+}
@@ -0,0 +1,147 @@
+package server
+
+import (
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/spaghetti-lover/go-http/pkg/headers"
+	"github.com/spaghetti-lover/go-http/pkg/request"
+	"github.com/spaghetti-lover/go-http/pkg/response"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type stateChange struct {
+	state ConnState
+	stats ConnStats
+}
+
+// recordStates returns a hook and the state changes it's told of, calling
+// policy, if any, first
+func recordStates(policy ConnHook) (ConnHook, chan stateChange) {
+	changes := make(chan stateChange, 100)
+	return func(conn net.Conn, state ConnState, stats ConnStats) {
+		if policy != nil {
+			policy(conn, state, stats)
+		}
+		changes <- stateChange{state, stats}
+	}, changes
+}
+
+// nextStates waits for the next n state changes
+func nextStates(t *testing.T, changes chan stateChange, n int) []stateChange {
+	t.Helper()
+	var got []stateChange
+	for range n {
+		select {
+		case change := <-changes:
+			got = append(got, change)
+		case <-time.After(time.Second):
+			require.FailNow(t, "no state change", "got %v", got)
+		}
+	}
+	return got
+}
+
+func states(changes []stateChange) []ConnState {
+	var got []ConnState
+	for _, change := range changes {
+		got = append(got, change.state)
+	}
+	return got
+}
+
+func okHandler(w *response.Writer, req *request.Request) {
+	w.WriteStatusLine(response.OK)
+	h := headers.NewHeaders()
+	h.Set("Content-Length", "2")
+	w.WriteHeaders(h)
+	w.WriteBody([]byte("ok"))
+}
+
+func TestConnState(t *testing.T) {
+	get := "GET / HTTP/1.1\r\nHost: localhost\r\n\r\n"
+	last := "GET / HTTP/1.1\r\nHost: localhost\r\nConnection: close\r\n\r\n"
+
+	// Test: A kept-alive connection goes back and forth between active and
+	// idle, and its stats add up to what went over the wire
+	hook, changes := recordStates(nil)
+	srv := startServer(t, okHandler, WithConnState(hook))
+	conn, r := dial(t, srv)
+	_, err := io.WriteString(conn, get)
+	require.NoError(t, err)
+	first := readHead(t, r) + readBody(t, r, 2)
+	assert.Equal(t, []ConnState{StateNew, StateActive, StateIdle}, states(nextStates(t, changes, 3)))
+
+	_, err = io.WriteString(conn, last)
+	require.NoError(t, err)
+	rest, err := io.ReadAll(r)
+	require.NoError(t, err)
+	got := nextStates(t, changes, 2)
+	assert.Equal(t, []ConnState{StateActive, StateClosed}, states(got))
+	stats := got[1].stats
+	assert.NotZero(t, stats.ID)
+	assert.Equal(t, int64(2), stats.Requests)
+	assert.Equal(t, int64(len(get+last)), stats.BytesRead)
+	assert.Equal(t, int64(len(first)+len(rest)), stats.BytesWritten)
+	assert.Positive(t, stats.Duration)
+
+	// Test: A hook can enforce a policy by closing the connection, here one
+	// request per connection
+	hook, changes = recordStates(func(conn net.Conn, state ConnState, stats ConnStats) {
+		if state == StateIdle {
+			conn.Close()
+		}
+	})
+	srv = startServer(t, okHandler, WithConnState(hook))
+	conn, r = dial(t, srv)
+	_, err = io.WriteString(conn, get)
+	require.NoError(t, err)
+	readHead(t, r)
+	readBody(t, r, 2)
+	_, err = r.ReadByte()
+	assert.Error(t, err)
+	assert.Equal(t, []ConnState{StateNew, StateActive, StateIdle, StateClosed}, states(nextStates(t, changes, 4)))
+
+	// Test: A hijacked connection is reported once and not closed by the
+	// server, its stats are still at hand
+	hijacked := make(chan ConnStats, 1)
+	hook, changes = recordStates(nil)
+	srv = startServer(t, func(w *response.Writer, req *request.Request) {
+		conn, _, err := w.Hijack()
+		require.NoError(t, err)
+		io.WriteString(conn, "bye\n")
+		stats, ok := Stats(conn)
+		assert.True(t, ok)
+		hijacked <- stats
+		conn.Close()
+	}, WithConnState(hook))
+	conn, r = dial(t, srv)
+	_, err = io.WriteString(conn, get)
+	require.NoError(t, err)
+	line, err := r.ReadString('\n')
+	require.NoError(t, err)
+	assert.Equal(t, "bye\n", line)
+	assert.Equal(t, []ConnState{StateNew, StateActive, StateHijacked}, states(nextStates(t, changes, 3)))
+	stats = <-hijacked
+	assert.Equal(t, int64(1), stats.Requests)
+	assert.Equal(t, int64(4), stats.BytesWritten)
+	select {
+	case change := <-changes:
+		assert.Fail(t, "hijacked connection reported again", "%v", change.state)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	// Test: Only connections the server accepted have stats
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+	_, ok := Stats(server)
+	assert.False(t, ok)
+
+	assert.Equal(t, "hijacked", StateHijacked.String())
+	assert.True(t, strings.HasPrefix(ConnState(9).String(), "ConnState("))
+}
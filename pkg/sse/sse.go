@@ -0,0 +1,205 @@
+package sse
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/spaghetti-lover/go-http/pkg/headers"
+	"github.com/spaghetti-lover/go-http/pkg/request"
+	"github.com/spaghetti-lover/go-http/pkg/response"
+)
+
+// DefaultHeartbeat is how often an idle stream sends a comment, often enough
+// to keep proxies from timing it out
+const DefaultHeartbeat = 15 * time.Second
+
+type Options struct {
+	// Heartbeat sends a comment line after this long without an event, which
+	// also notices clients that went away. 0 means DefaultHeartbeat, a
+	// negative value turns heartbeats off.
+	Heartbeat time.Duration
+
+	// Retry tells the client how long to wait before reconnecting, sent
+	// once when the stream starts. 0 leaves it to the client.
+	Retry time.Duration
+}
+
+// Event is one message on the stream. Data may span several lines; ID and
+// Event must be single lines.
+type Event struct {
+	ID    string
+	Event string
+	Data  string
+
+	// Retry updates the client's reconnection delay when set
+	Retry time.Duration
+}
+
+var ErrClosed = fmt.Errorf("event stream closed")
+var ErrInvalidField = fmt.Errorf("event field contains a line break")
+
+// Stream writes text/event-stream responses. Send and Comment are safe for
+// concurrent use; Close must be called before the handler returns.
+type Stream struct {
+	w           *response.Writer
+	lastEventID string
+
+	mu     sync.Mutex
+	err    error
+	done   chan struct{}
+	active chan struct{}
+
+	stop     chan struct{}
+	stopOnce sync.Once
+	wg       sync.WaitGroup
+}
+
+// Start answers req with a chunked event stream and starts the heartbeat
+func Start(w *response.Writer, req *request.Request, opts Options) (*Stream, error) {
+	if opts.Heartbeat == 0 {
+		opts.Heartbeat = DefaultHeartbeat
+	}
+
+	err := w.WriteStatusLine(response.OK)
+	if err != nil {
+		return nil, err
+	}
+	h := headers.NewHeaders()
+	h.Set("Content-Type", "text/event-stream")
+	h.Set("Cache-Control", "no-cache")
+	h.Set("Transfer-Encoding", "chunked")
+	// Stops nginx from buffering the stream
+	h.Set("X-Accel-Buffering", "no")
+	err = w.WriteHeaders(h)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &Stream{
+		w:           w,
+		lastEventID: strings.TrimSpace(req.Headers.Get("Last-Event-ID")),
+		done:        make(chan struct{}),
+		active:      make(chan struct{}, 1),
+		stop:        make(chan struct{}),
+	}
+
+	if opts.Retry > 0 {
+		err = s.write("retry: " + strconv.FormatInt(opts.Retry.Milliseconds(), 10) + "\n\n")
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if opts.Heartbeat > 0 {
+		s.wg.Add(1)
+		go s.heartbeat(opts.Heartbeat)
+	}
+	return s, nil
+}
+
+// LastEventID returns the ID of the last event a reconnecting client saw,
+// from its Last-Event-ID header, so the stream can resume after it
+func (s *Stream) LastEventID() string {
+	return s.lastEventID
+}
+
+// Done is closed once the client is gone, when a write to it failed
+func (s *Stream) Done() <-chan struct{} {
+	return s.done
+}
+
+// Send writes one event
+func (s *Stream) Send(e Event) error {
+	if strings.ContainsAny(e.ID, "\r\n\x00") || strings.ContainsAny(e.Event, "\r\n") {
+		return ErrInvalidField
+	}
+
+	var b strings.Builder
+	if e.Event != "" {
+		b.WriteString("event: " + e.Event + "\n")
+	}
+	if e.ID != "" {
+		b.WriteString("id: " + e.ID + "\n")
+	}
+	if e.Retry > 0 {
+		b.WriteString("retry: " + strconv.FormatInt(e.Retry.Milliseconds(), 10) + "\n")
+	}
+
+	// Each line of data gets its own field, the client joins them with \n
+	data := strings.ReplaceAll(e.Data, "\r\n", "\n")
+	data = strings.ReplaceAll(data, "\r", "\n")
+	for _, line := range strings.Split(data, "\n") {
+		b.WriteString("data: " + line + "\n")
+	}
+	b.WriteString("\n")
+
+	return s.write(b.String())
+}
+
+// Comment writes a comment line, which clients ignore
+func (s *Stream) Comment(text string) error {
+	var b strings.Builder
+	for _, line := range strings.Split(strings.ReplaceAll(text, "\r", ""), "\n") {
+		b.WriteString(": " + line + "\n")
+	}
+	b.WriteString("\n")
+	return s.write(b.String())
+}
+
+// Close stops the heartbeat. The server ends the chunked body once the
+// handler returns.
+func (s *Stream) Close() {
+	s.mu.Lock()
+	if s.err == nil {
+		s.err = ErrClosed
+	}
+	s.mu.Unlock()
+
+	s.stopOnce.Do(func() { close(s.stop) })
+	s.wg.Wait()
+}
+
+func (s *Stream) write(p string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.err != nil {
+		return s.err
+	}
+
+	_, err := s.w.WriteChunkedBody([]byte(p))
+	if err != nil {
+		s.err = err
+		close(s.done)
+		return err
+	}
+
+	select {
+	case s.active <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// heartbeat sends a comment whenever interval passes without a write
+func (s *Stream) heartbeat(interval time.Duration) {
+	defer s.wg.Done()
+
+	timer := time.NewTimer(interval)
+	defer timer.Stop()
+	for {
+		select {
+		case <-s.stop:
+			return
+		case <-s.active:
+			timer.Reset(interval)
+		case <-timer.C:
+			if s.write(": heartbeat\n\n") != nil {
+				return
+			}
+			timer.Reset(interval)
+		}
+	}
+}
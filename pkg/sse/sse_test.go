@@ -0,0 +1,148 @@
+package sse
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/spaghetti-lover/go-http/pkg/client"
+	"github.com/spaghetti-lover/go-http/pkg/request"
+	"github.com/spaghetti-lover/go-http/pkg/response"
+	"github.com/spaghetti-lover/go-http/pkg/server"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// open starts a server running handler and opens a stream from it
+func open(t *testing.T, handler server.Handler, lastEventID string) (*client.Response, io.ReadCloser, *bufio.Reader) {
+	t.Helper()
+	srv, err := server.Serve(0, handler)
+	require.NoError(t, err)
+	t.Cleanup(func() { srv.Close() })
+
+	req, err := client.NewRequest("GET", fmt.Sprintf("http://%s/events", srv.Addr()), nil)
+	require.NoError(t, err)
+	if lastEventID != "" {
+		req.Headers.Set("Last-Event-ID", lastEventID)
+	}
+	resp, body, err := client.DefaultClient.Open(context.Background(), req)
+	require.NoError(t, err)
+	t.Cleanup(func() { body.Close() })
+	return resp, body, bufio.NewReader(body)
+}
+
+// readEvent reads the lines up to the next blank one
+func readEvent(t *testing.T, r *bufio.Reader) string {
+	t.Helper()
+	var b strings.Builder
+	for {
+		line, err := r.ReadString('\n')
+		require.NoError(t, err)
+		if line == "\n" {
+			return b.String()
+		}
+		b.WriteString(line)
+	}
+}
+
+func TestStream(t *testing.T) {
+	resp, _, r := open(t, func(w *response.Writer, req *request.Request) {
+		s, err := Start(w, req, Options{Retry: 3 * time.Second, Heartbeat: -1})
+		require.NoError(t, err)
+		defer s.Close()
+
+		require.NoError(t, s.Send(Event{Data: "hello"}))
+		require.NoError(t, s.Send(Event{ID: "7", Event: "update", Data: "line one\nline two\r\nline three"}))
+		require.NoError(t, s.Send(Event{Retry: 500 * time.Millisecond}))
+		require.NoError(t, s.Comment("just saying"))
+		assert.ErrorIs(t, s.Send(Event{ID: "8\n", Data: "x"}), ErrInvalidField)
+		assert.ErrorIs(t, s.Send(Event{Event: "a\rb", Data: "x"}), ErrInvalidField)
+	}, "")
+
+	// Test: Stream headers
+	assert.Equal(t, response.OK, resp.StatusCode)
+	assert.Equal(t, "text/event-stream", resp.Headers.Get("Content-Type"))
+	assert.Equal(t, "no-cache", resp.Headers.Get("Cache-Control"))
+	assert.Equal(t, "chunked", resp.Headers.Get("Transfer-Encoding"))
+
+	// Test: Retry up front, then events with every line of data prefixed
+	assert.Equal(t, "retry: 3000\n", readEvent(t, r))
+	assert.Equal(t, "data: hello\n", readEvent(t, r))
+	assert.Equal(t, "event: update\nid: 7\ndata: line one\ndata: line two\ndata: line three\n", readEvent(t, r))
+	assert.Equal(t, "retry: 500\ndata: \n", readEvent(t, r))
+	assert.Equal(t, ": just saying\n", readEvent(t, r))
+
+	// Test: The stream ends with the handler
+	_, err := r.ReadByte()
+	assert.ErrorIs(t, err, io.EOF)
+}
+
+func TestStreamResume(t *testing.T) {
+	handler := func(w *response.Writer, req *request.Request) {
+		s, err := Start(w, req, Options{Heartbeat: -1})
+		require.NoError(t, err)
+		defer s.Close()
+
+		next := 1
+		if s.LastEventID() != "" {
+			fmt.Sscan(s.LastEventID(), &next)
+			next++
+		}
+		for id := next; id < next+2; id++ {
+			s.Send(Event{ID: fmt.Sprint(id), Data: "event"})
+		}
+	}
+
+	// Test: A fresh client starts at the beginning
+	_, _, r := open(t, handler, "")
+	assert.Equal(t, "id: 1\ndata: event\n", readEvent(t, r))
+
+	// Test: A reconnecting client picks up after the last event it saw
+	_, _, r = open(t, handler, "41")
+	assert.Equal(t, "id: 42\ndata: event\n", readEvent(t, r))
+	assert.Equal(t, "id: 43\ndata: event\n", readEvent(t, r))
+}
+
+func TestStreamHeartbeat(t *testing.T) {
+	gone := make(chan error, 1)
+	_, body, r := open(t, func(w *response.Writer, req *request.Request) {
+		s, err := Start(w, req, Options{Heartbeat: 20 * time.Millisecond})
+		require.NoError(t, err)
+		defer s.Close()
+
+		select {
+		case <-s.Done():
+			gone <- s.Send(Event{Data: "anyone?"})
+		case <-time.After(5 * time.Second):
+			gone <- fmt.Errorf("disconnect not noticed")
+		}
+	}, "")
+
+	// Test: Idle streams get comments
+	assert.Equal(t, ": heartbeat\n", readEvent(t, r))
+	assert.Equal(t, ": heartbeat\n", readEvent(t, r))
+
+	// Test: Heartbeats notice the client leaving
+	body.Close()
+	err := <-gone
+	require.Error(t, err)
+	assert.NotErrorIs(t, err, ErrClosed)
+}
+
+func TestStreamClosed(t *testing.T) {
+	_, _, r := open(t, func(w *response.Writer, req *request.Request) {
+		s, err := Start(w, req, Options{})
+		require.NoError(t, err)
+		s.Close()
+		s.Close()
+
+		// Test: Nothing is sent after Close
+		assert.ErrorIs(t, s.Send(Event{Data: "late"}), ErrClosed)
+	}, "")
+	_, err := r.ReadByte()
+	assert.ErrorIs(t, err, io.EOF)
+}
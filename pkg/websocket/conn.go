@@ -0,0 +1,511 @@
+package websocket
+
+import (
+	"bufio"
+	"bytes"
+	"compress/flate"
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+type MessageType int
+
+const (
+	TextMessage   MessageType = 1
+	BinaryMessage MessageType = 2
+)
+
+const (
+	opContinuation = 0x0
+	opText         = 0x1
+	opBinary       = 0x2
+	opClose        = 0x8
+	opPing         = 0x9
+	opPong         = 0xA
+)
+
+// Close codes (RFC 6455 §7.4.1)
+const (
+	CloseNormal          = 1000
+	CloseGoingAway       = 1001
+	CloseProtocolError   = 1002
+	CloseUnsupportedData = 1003
+	CloseNoStatus        = 1005
+	CloseInvalidPayload  = 1007
+	ClosePolicyViolation = 1008
+	CloseMessageTooBig   = 1009
+	CloseInternalError   = 1011
+)
+
+// maxControlPayload is the most a ping, pong or close frame may carry
+const maxControlPayload = 125
+
+var ErrClosed = fmt.Errorf("websocket connection closed")
+var ErrProtocol = fmt.Errorf("websocket protocol error")
+var ErrMessageTooBig = fmt.Errorf("websocket message too big")
+var ErrInvalidUTF8 = fmt.Errorf("websocket text message is not valid utf-8")
+
+// CloseError is returned by ReadMessage once the peer closed the connection
+type CloseError struct {
+	Code   int
+	Reason string
+}
+
+func (e *CloseError) Error() string {
+	if e.Reason == "" {
+		return fmt.Sprintf("websocket closed with %d", e.Code)
+	}
+	return fmt.Sprintf("websocket closed with %d: %s", e.Code, e.Reason)
+}
+
+// Conn is an established websocket connection. One goroutine may read while
+// others write; writes are serialized.
+type Conn struct {
+	conn        net.Conn
+	reader      *bufio.Reader
+	server      bool
+	opts        Options
+	subprotocol string
+	compress    bool
+
+	readMu  sync.Mutex
+	readErr error
+
+	writeMu   sync.Mutex
+	closeSent bool
+
+	closeOnce sync.Once
+	done      chan struct{}
+}
+
+// newConn wraps conn, reading through reader. Servers read masked frames and
+// write unmasked ones, clients the other way around.
+func newConn(conn net.Conn, reader *bufio.Reader, server bool, opts Options) *Conn {
+	return &Conn{
+		conn:   conn,
+		reader: reader,
+		server: server,
+		opts:   opts,
+		done:   make(chan struct{}),
+	}
+}
+
+// Subprotocol returns the subprotocol agreed on in the handshake, if any
+func (c *Conn) Subprotocol() string {
+	return c.subprotocol
+}
+
+func (c *Conn) SetReadDeadline(t time.Time) error {
+	return c.conn.SetReadDeadline(t)
+}
+
+func (c *Conn) SetWriteDeadline(t time.Time) error {
+	return c.conn.SetWriteDeadline(t)
+}
+
+// ReadMessage returns the next text or binary message, reassembled from its
+// fragments and decompressed. Pings are answered and pongs skipped along the
+// way. Once the peer closes, it returns a *CloseError; after a protocol
+// violation the connection is closed with the matching code and the error
+// returned. Every later call returns the same error.
+func (c *Conn) ReadMessage() (MessageType, []byte, error) {
+	c.readMu.Lock()
+	defer c.readMu.Unlock()
+
+	if c.readErr != nil {
+		return 0, nil, c.readErr
+	}
+
+	messageType, data, err := c.readMessage()
+	if err != nil {
+		c.readErr = err
+	}
+	return messageType, data, err
+}
+
+func (c *Conn) readMessage() (MessageType, []byte, error) {
+	var messageType MessageType
+	var message []byte
+	inMessage := false
+	compressed := false
+
+	for {
+		fin, rsv1, op, payload, err := c.readFrame(c.opts.MaxMessageSize - int64(len(message)))
+		if err != nil {
+			return 0, nil, err
+		}
+
+		switch op {
+		case opPing:
+			// No pongs once closing, the peer's close is all that's left
+			err := c.writeFrame(true, false, opPong, payload)
+			if err != nil && err != ErrClosed {
+				return 0, nil, err
+			}
+			continue
+		case opPong:
+			continue
+		case opClose:
+			return 0, nil, c.closeReceived(payload)
+		case opText, opBinary:
+			if inMessage {
+				return 0, nil, c.fail(CloseProtocolError, fmt.Errorf("%w: new message before the last one ended", ErrProtocol))
+			}
+			if rsv1 && !c.compress {
+				return 0, nil, c.fail(CloseProtocolError, fmt.Errorf("%w: compressed frame without permessage-deflate", ErrProtocol))
+			}
+			inMessage = true
+			messageType = MessageType(op)
+			compressed = rsv1
+		case opContinuation:
+			if !inMessage {
+				return 0, nil, c.fail(CloseProtocolError, fmt.Errorf("%w: continuation outside a message", ErrProtocol))
+			}
+			if rsv1 {
+				return 0, nil, c.fail(CloseProtocolError, fmt.Errorf("%w: RSV1 on a continuation frame", ErrProtocol))
+			}
+		}
+
+		message = append(message, payload...)
+		if !fin {
+			continue
+		}
+
+		if compressed {
+			message, err = inflate(message, c.opts.MaxMessageSize)
+			if err == ErrMessageTooBig {
+				return 0, nil, c.fail(CloseMessageTooBig, err)
+			}
+			if err != nil {
+				return 0, nil, c.fail(CloseInvalidPayload, fmt.Errorf("%w: %w", ErrProtocol, err))
+			}
+		}
+		if messageType == TextMessage && !utf8.Valid(message) {
+			return 0, nil, c.fail(CloseInvalidPayload, ErrInvalidUTF8)
+		}
+		if message == nil {
+			message = []byte{}
+		}
+		return messageType, message, nil
+	}
+}
+
+// readFrame reads one frame and unmasks its payload. Data frames longer
+// than limit aren't read but fail the connection with 1009.
+func (c *Conn) readFrame(limit int64) (fin, rsv1 bool, op byte, payload []byte, err error) {
+	var head [14]byte
+	if _, err := io.ReadFull(c.reader, head[:2]); err != nil {
+		c.closeConn()
+		return false, false, 0, nil, err
+	}
+
+	fin = head[0]&0x80 != 0
+	rsv1 = head[0]&0x40 != 0
+	op = head[0] & 0x0F
+	masked := head[1]&0x80 != 0
+	length := uint64(head[1] & 0x7F)
+
+	switch length {
+	case 126:
+		if _, err := io.ReadFull(c.reader, head[2:4]); err != nil {
+			c.closeConn()
+			return false, false, 0, nil, err
+		}
+		length = uint64(binary.BigEndian.Uint16(head[2:4]))
+	case 127:
+		if _, err := io.ReadFull(c.reader, head[2:10]); err != nil {
+			c.closeConn()
+			return false, false, 0, nil, err
+		}
+		length = binary.BigEndian.Uint64(head[2:10])
+	}
+
+	switch {
+	case head[0]&0x30 != 0:
+		err = fmt.Errorf("%w: reserved bits set", ErrProtocol)
+	case c.server && !masked:
+		err = fmt.Errorf("%w: client frames must be masked", ErrProtocol)
+	case !c.server && masked:
+		err = fmt.Errorf("%w: server frames must not be masked", ErrProtocol)
+	case op > opBinary && op != opClose && op != opPing && op != opPong:
+		err = fmt.Errorf("%w: unknown opcode %#x", ErrProtocol, op)
+	case op >= opClose && (!fin || rsv1 || length > maxControlPayload):
+		err = fmt.Errorf("%w: invalid control frame", ErrProtocol)
+	}
+	if err != nil {
+		return false, false, 0, nil, c.fail(CloseProtocolError, err)
+	}
+
+	if op < opClose && length > uint64(max(limit, 0)) {
+		return false, false, 0, nil, c.fail(CloseMessageTooBig, ErrMessageTooBig)
+	}
+
+	var mask [4]byte
+	if masked {
+		if _, err := io.ReadFull(c.reader, mask[:]); err != nil {
+			c.closeConn()
+			return false, false, 0, nil, err
+		}
+	}
+
+	payload = make([]byte, length)
+	if _, err := io.ReadFull(c.reader, payload); err != nil {
+		c.closeConn()
+		return false, false, 0, nil, err
+	}
+	if masked {
+		maskBytes(mask, payload)
+	}
+
+	return fin, rsv1, op, payload, nil
+}
+
+// closeReceived answers the peer's close frame, echoing its code, and
+// closes the connection
+func (c *Conn) closeReceived(payload []byte) error {
+	closeErr := &CloseError{Code: CloseNoStatus}
+	switch {
+	case len(payload) == 1:
+		return c.fail(CloseProtocolError, fmt.Errorf("%w: truncated close code", ErrProtocol))
+	case len(payload) >= 2:
+		closeErr.Code = int(binary.BigEndian.Uint16(payload))
+		closeErr.Reason = string(payload[2:])
+		if !validCloseCode(closeErr.Code) {
+			return c.fail(CloseProtocolError, fmt.Errorf("%w: close code %d", ErrProtocol, closeErr.Code))
+		}
+		if !utf8.ValidString(closeErr.Reason) {
+			return c.fail(CloseInvalidPayload, ErrInvalidUTF8)
+		}
+	}
+
+	c.writeClose(closeErr.Code, "")
+	c.closeConn()
+	return closeErr
+}
+
+// fail closes the connection with code after a violation by the peer
+func (c *Conn) fail(code int, err error) error {
+	c.writeClose(code, err.Error())
+	c.closeConn()
+	return err
+}
+
+func validCloseCode(code int) bool {
+	switch {
+	case code >= 1000 && code <= 1003, code >= 1007 && code <= 1011:
+		return true
+	case code >= 3000 && code <= 4999:
+		return true
+	}
+	return false
+}
+
+// WriteMessage sends data as one message, compressed if permessage-deflate
+// was agreed on and split into frames of Options.FragmentSize
+func (c *Conn) WriteMessage(messageType MessageType, data []byte) error {
+	if messageType != TextMessage && messageType != BinaryMessage {
+		return fmt.Errorf("invalid message type %d", messageType)
+	}
+
+	if c.compress {
+		var err error
+		data, err = deflate(data)
+		if err != nil {
+			return err
+		}
+	}
+
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	if c.closeSent {
+		return ErrClosed
+	}
+
+	op := byte(messageType)
+	for first := true; first || len(data) > 0; first = false {
+		frame := data
+		if c.opts.FragmentSize > 0 && len(frame) > c.opts.FragmentSize {
+			frame = frame[:c.opts.FragmentSize]
+		}
+		data = data[len(frame):]
+
+		err := c.writeFrameLocked(len(data) == 0, first && c.compress, op, frame)
+		if err != nil {
+			return err
+		}
+		op = opContinuation
+	}
+	return nil
+}
+
+// Ping sends a ping, the peer's pong is skipped by ReadMessage
+func (c *Conn) Ping(data []byte) error {
+	if len(data) > maxControlPayload {
+		return fmt.Errorf("ping payload over %d bytes", maxControlPayload)
+	}
+	return c.writeFrame(true, false, opPing, data)
+}
+
+// Close starts the close handshake with code and reason, waits up to
+// Options.CloseTimeout for the peer's answer and closes the connection.
+// Messages arriving meanwhile are dropped. A goroutine blocked in
+// ReadMessage sees the peer's answer as a *CloseError.
+func (c *Conn) Close(code int, reason string) error {
+	err := c.writeClose(code, reason)
+
+	if c.readMu.TryLock() {
+		if c.readErr == nil {
+			c.conn.SetReadDeadline(time.Now().Add(c.opts.CloseTimeout))
+			for c.readErr == nil {
+				_, _, c.readErr = c.readMessage()
+			}
+		}
+		c.readMu.Unlock()
+	} else {
+		select {
+		case <-c.done:
+		case <-time.After(c.opts.CloseTimeout):
+		}
+	}
+
+	c.closeConn()
+	return err
+}
+
+// writeClose sends a close frame unless one was sent already
+func (c *Conn) writeClose(code int, reason string) error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	if c.closeSent {
+		return nil
+	}
+	c.closeSent = true
+
+	var payload []byte
+	if code != CloseNoStatus {
+		reason = truncateUTF8(reason, maxControlPayload-2)
+		payload = binary.BigEndian.AppendUint16(nil, uint16(code))
+		payload = append(payload, reason...)
+	}
+	return c.writeFrameLocked(true, false, opClose, payload)
+}
+
+func (c *Conn) writeFrame(fin, rsv1 bool, op byte, payload []byte) error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	if c.closeSent {
+		return ErrClosed
+	}
+	return c.writeFrameLocked(fin, rsv1, op, payload)
+}
+
+func (c *Conn) writeFrameLocked(fin, rsv1 bool, op byte, payload []byte) error {
+	b0 := op
+	if fin {
+		b0 |= 0x80
+	}
+	if rsv1 {
+		b0 |= 0x40
+	}
+
+	var b1 byte
+	if !c.server {
+		b1 = 0x80
+	}
+
+	frame := make([]byte, 0, 14+len(payload))
+	switch length := len(payload); {
+	case length <= 125:
+		frame = append(frame, b0, b1|byte(length))
+	case length <= 0xFFFF:
+		frame = append(frame, b0, b1|126)
+		frame = binary.BigEndian.AppendUint16(frame, uint16(length))
+	default:
+		frame = append(frame, b0, b1|127)
+		frame = binary.BigEndian.AppendUint64(frame, uint64(length))
+	}
+
+	if c.server {
+		frame = append(frame, payload...)
+	} else {
+		var mask [4]byte
+		rand.Read(mask[:])
+		frame = append(frame, mask[:]...)
+		start := len(frame)
+		frame = append(frame, payload...)
+		maskBytes(mask, frame[start:])
+	}
+
+	_, err := c.conn.Write(frame)
+	return err
+}
+
+func (c *Conn) closeConn() {
+	c.closeOnce.Do(func() {
+		c.conn.Close()
+		close(c.done)
+	})
+}
+
+func maskBytes(mask [4]byte, p []byte) {
+	for i := range p {
+		p[i] ^= mask[i%4]
+	}
+}
+
+// truncateUTF8 cuts s to at most n bytes without splitting a character
+func truncateUTF8(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	for n > 0 && !utf8.RuneStart(s[n]) {
+		n--
+	}
+	return s[:n]
+}
+
+var flateWriters = sync.Pool{New: func() any {
+	w, _ := flate.NewWriter(nil, flate.DefaultCompression)
+	return w
+}}
+
+// deflateTail ends a permessage-deflate payload: the sync marker the sender
+// strips (RFC 7692 §7.2.2) and an empty final block so the reader sees EOF
+var deflateTail = []byte{0x00, 0x00, 0xFF, 0xFF, 0x01, 0x00, 0x00, 0xFF, 0xFF}
+
+// deflate compresses a message on its own, without the trailing sync marker
+func deflate(p []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	w := flateWriters.Get().(*flate.Writer)
+	defer flateWriters.Put(w)
+	w.Reset(&buf)
+
+	if _, err := w.Write(p); err != nil {
+		return nil, err
+	}
+	if err := w.Flush(); err != nil {
+		return nil, err
+	}
+	return bytes.TrimSuffix(buf.Bytes(), deflateTail[:4]), nil
+}
+
+// inflate decompresses a message, failing with ErrMessageTooBig past limit
+func inflate(p []byte, limit int64) ([]byte, error) {
+	r := flate.NewReader(io.MultiReader(bytes.NewReader(p), bytes.NewReader(deflateTail)))
+	defer r.Close()
+
+	data, err := io.ReadAll(io.LimitReader(r, limit+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(data)) > limit {
+		return nil, ErrMessageTooBig
+	}
+	return data, nil
+}
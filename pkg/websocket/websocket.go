@@ -0,0 +1,188 @@
+package websocket
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha1"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/spaghetti-lover/go-http/pkg/headers"
+	"github.com/spaghetti-lover/go-http/pkg/request"
+	"github.com/spaghetti-lover/go-http/pkg/response"
+)
+
+// Defaults for the Options left at zero
+const (
+	DefaultMaxMessageSize = 1 << 20
+	DefaultCloseTimeout   = 5 * time.Second
+)
+
+// acceptGUID is appended to Sec-WebSocket-Key before hashing (RFC 6455 §1.3)
+const acceptGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+type Options struct {
+	// Subprotocols the server speaks, in order of preference. The first one
+	// the client also offers is picked, none if there's no match.
+	Subprotocols []string
+
+	// MaxMessageSize limits a message after reassembly and decompression,
+	// bigger ones close the connection with 1009. 0 means
+	// DefaultMaxMessageSize.
+	MaxMessageSize int64
+
+	// FragmentSize splits written messages into frames of at most this many
+	// bytes, 0 sends each message in a single frame
+	FragmentSize int
+
+	// Compression accepts permessage-deflate (RFC 7692) when the client
+	// offers it. Both sides compress every message on its own, without
+	// context takeover.
+	Compression bool
+
+	// CloseTimeout bounds waiting for the peer to answer a close frame, 0
+	// means DefaultCloseTimeout
+	CloseTimeout time.Duration
+}
+
+var ErrBadHandshake = fmt.Errorf("bad websocket handshake")
+
+// Upgrade answers a websocket handshake request with 101 Switching Protocols
+// and takes the connection over from the server. Invalid handshakes are
+// answered with 400, or 426 for an unsupported version, and return
+// ErrBadHandshake; either way the handler has nothing left to write.
+func Upgrade(w *response.Writer, req *request.Request, opts Options) (*Conn, error) {
+	if opts.MaxMessageSize <= 0 {
+		opts.MaxMessageSize = DefaultMaxMessageSize
+	}
+	if opts.CloseTimeout <= 0 {
+		opts.CloseTimeout = DefaultCloseTimeout
+	}
+
+	h := req.Headers
+	switch {
+	case req.RequestLine.Method != "GET":
+		return nil, reject(w, response.BadRequest, "method %s", req.RequestLine.Method)
+	case !h.HasToken("Connection", "upgrade") || !h.HasToken("Upgrade", "websocket"):
+		return nil, reject(w, response.BadRequest, "not an upgrade to websocket")
+	case strings.TrimSpace(h.Get("Sec-WebSocket-Version")) != "13":
+		return nil, reject(w, response.UpgradeRequired, "version %q", h.Get("Sec-WebSocket-Version"))
+	}
+
+	key := strings.TrimSpace(h.Get("Sec-WebSocket-Key"))
+	if nonce, err := base64.StdEncoding.DecodeString(key); err != nil || len(nonce) != 16 {
+		return nil, reject(w, response.BadRequest, "Sec-WebSocket-Key %q", key)
+	}
+
+	res := headers.NewHeaders()
+	res.Set("Upgrade", "websocket")
+	res.Set("Connection", "Upgrade")
+	res.Set("Sec-WebSocket-Accept", acceptKey(key))
+
+	subprotocol := selectSubprotocol(opts.Subprotocols, h.Get("Sec-WebSocket-Protocol"))
+	if subprotocol != "" {
+		res.Set("Sec-WebSocket-Protocol", subprotocol)
+	}
+
+	compress := opts.Compression && acceptDeflate(h.Get("Sec-WebSocket-Extensions"))
+	if compress {
+		res.Set("Sec-WebSocket-Extensions", "permessage-deflate; server_no_context_takeover; client_no_context_takeover")
+	}
+
+	err := w.WriteStatusLine(response.SwitchingProtocols)
+	if err != nil {
+		return nil, err
+	}
+	err = w.WriteHeaders(res)
+	if err != nil {
+		return nil, err
+	}
+
+	conn, buffered, err := w.Hijack()
+	if err != nil {
+		return nil, err
+	}
+
+	// Frames the client sent right behind the handshake come first
+	reader := bufio.NewReader(io.MultiReader(bytes.NewReader(buffered), conn))
+	c := newConn(conn, reader, true, opts)
+	c.subprotocol = subprotocol
+	c.compress = compress
+	return c, nil
+}
+
+// reject answers a handshake that can't be accepted
+func reject(w *response.Writer, statusCode response.StatusCode, format string, args ...any) error {
+	body := "Bad websocket handshake"
+	h := headers.NewHeaders()
+	if statusCode == response.UpgradeRequired {
+		h.Set("Sec-WebSocket-Version", "13")
+		h.Set("Upgrade", "websocket")
+		body = "Unsupported websocket version"
+	}
+	h.Set("Content-Type", "text/plain")
+	h.Set("Content-Length", fmt.Sprint(len(body)))
+
+	err := w.WriteStatusLine(statusCode)
+	if err == nil {
+		err = w.WriteHeaders(h)
+	}
+	if err == nil {
+		_, err = w.WriteBody([]byte(body))
+	}
+	if err != nil {
+		return err
+	}
+	return fmt.Errorf("%w: "+format, append([]any{ErrBadHandshake}, args...)...)
+}
+
+// acceptKey computes Sec-WebSocket-Accept for a client's key
+func acceptKey(key string) string {
+	sum := sha1.Sum([]byte(key + acceptGUID))
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
+
+// selectSubprotocol picks the first of the server's subprotocols that is in
+// the client's comma-separated list
+func selectSubprotocol(supported []string, offered string) string {
+	for _, protocol := range supported {
+		for _, o := range strings.Split(offered, ",") {
+			if strings.TrimSpace(o) == protocol {
+				return protocol
+			}
+		}
+	}
+	return ""
+}
+
+// acceptDeflate reports whether one of the client's permessage-deflate
+// offers can be taken. compress/flate always uses a 32 KiB window, so offers
+// that limit the server's window are declined.
+func acceptDeflate(offers string) bool {
+	for _, offer := range strings.Split(offers, ",") {
+		params := strings.Split(offer, ";")
+		if !strings.EqualFold(strings.TrimSpace(params[0]), "permessage-deflate") {
+			continue
+		}
+
+		ok := true
+		for _, param := range params[1:] {
+			name, value, _ := strings.Cut(strings.TrimSpace(param), "=")
+			value = strings.Trim(strings.TrimSpace(value), `"`)
+			switch strings.ToLower(strings.TrimSpace(name)) {
+			case "server_no_context_takeover", "client_no_context_takeover", "client_max_window_bits":
+			case "server_max_window_bits":
+				ok = ok && value == "15"
+			default:
+				ok = false
+			}
+		}
+		if ok {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,315 @@
+package websocket
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/spaghetti-lover/go-http/pkg/request"
+	"github.com/spaghetti-lover/go-http/pkg/response"
+	"github.com/spaghetti-lover/go-http/pkg/server"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const testKey = "dGhlIHNhbXBsZSBub25jZQ=="
+
+// startEcho serves websocket connections that echo every message back, and
+// reports how each one ended on errs
+func startEcho(t *testing.T, opts Options) (string, chan error) {
+	t.Helper()
+	errs := make(chan error, 10)
+	srv, err := server.Serve(0, func(w *response.Writer, req *request.Request) {
+		conn, err := Upgrade(w, req, opts)
+		if err != nil {
+			errs <- err
+			return
+		}
+		for {
+			messageType, data, err := conn.ReadMessage()
+			if err != nil {
+				errs <- err
+				return
+			}
+			if err := conn.WriteMessage(messageType, data); err != nil {
+				errs <- err
+				return
+			}
+		}
+	})
+	require.NoError(t, err)
+	t.Cleanup(func() { srv.Close() })
+	return srv.Addr().String(), errs
+}
+
+// handshake sends an upgrade request with extra header lines and returns
+// the response head along with the connection
+func handshake(t *testing.T, addr string, extra ...string) (net.Conn, *bufio.Reader, string) {
+	t.Helper()
+	conn, err := net.Dial("tcp", addr)
+	require.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	raw := "GET /ws HTTP/1.1\r\nHost: localhost\r\n" + strings.Join(extra, "")
+	if !strings.Contains(raw, "Sec-WebSocket-Version") {
+		raw += "Sec-WebSocket-Version: 13\r\n"
+	}
+	if !strings.Contains(raw, "Sec-WebSocket-Key") {
+		raw += "Sec-WebSocket-Key: " + testKey + "\r\n"
+	}
+	if !strings.Contains(raw, "Upgrade:") {
+		raw += "Upgrade: websocket\r\nConnection: Upgrade\r\n"
+	}
+	_, err = io.WriteString(conn, raw+"\r\n")
+	require.NoError(t, err)
+
+	r := bufio.NewReader(conn)
+	var head strings.Builder
+	for {
+		line, err := r.ReadString('\n')
+		require.NoError(t, err)
+		head.WriteString(line)
+		if line == "\r\n" {
+			return conn, r, head.String()
+		}
+	}
+}
+
+// dial completes a handshake and returns the client side of the connection
+func dial(t *testing.T, addr string, extra ...string) (*Conn, string) {
+	t.Helper()
+	conn, r, head := handshake(t, addr, extra...)
+	require.True(t, strings.HasPrefix(head, "HTTP/1.1 101 Switching Protocols\r\n"), head)
+	c := newConn(conn, r, false, Options{MaxMessageSize: DefaultMaxMessageSize, CloseTimeout: time.Second})
+	c.compress = strings.Contains(head, "permessage-deflate")
+	return c, head
+}
+
+func closeCode(t *testing.T, err error) int {
+	t.Helper()
+	var closeErr *CloseError
+	require.True(t, errors.As(err, &closeErr), "%v", err)
+	return closeErr.Code
+}
+
+func TestUpgrade(t *testing.T) {
+	addr, _ := startEcho(t, Options{Subprotocols: []string{"v2.chat", "v1.chat"}})
+
+	// Test: Accept key from RFC 6455 §1.3 and subprotocol by server preference
+	c, head := dial(t, addr, "Sec-WebSocket-Protocol: v1.chat, v2.chat\r\n")
+	assert.Contains(t, head, "sec-websocket-accept: s3pPLMBiTxaQ9kYGzzhZRbK+xOo=\r\n")
+	assert.Contains(t, head, "sec-websocket-protocol: v2.chat\r\n")
+	assert.Contains(t, head, "upgrade: websocket\r\n")
+	assert.NotContains(t, head, "sec-websocket-Extensions")
+	require.NoError(t, c.WriteMessage(TextMessage, []byte("hello")))
+	messageType, data, err := c.ReadMessage()
+	require.NoError(t, err)
+	assert.Equal(t, TextMessage, messageType)
+	assert.Equal(t, "hello", string(data))
+
+	// Test: No common subprotocol
+	_, head = dial(t, addr, "Sec-WebSocket-Protocol: v3.chat\r\n")
+	assert.NotContains(t, head, "sec-websocket-Protocol")
+
+	// Test: Bad handshakes
+	for _, tc := range []struct {
+		extra  string
+		status string
+	}{
+		{"Sec-WebSocket-Version: 8\r\n", "426 Upgrade Required"},
+		{"Sec-WebSocket-Key: c2hvcnQ=\r\n", "400 Bad Request"},
+		{"Sec-WebSocket-Key: not base64!\r\n", "400 Bad Request"},
+		{"Upgrade: h2c\r\nConnection: Upgrade\r\n", "400 Bad Request"},
+	} {
+		_, _, head := handshake(t, addr, tc.extra)
+		assert.True(t, strings.HasPrefix(head, "HTTP/1.1 "+tc.status+"\r\n"), head)
+	}
+	_, _, head = handshake(t, addr, "Sec-WebSocket-Version: 8\r\n")
+	assert.Contains(t, head, "sec-websocket-version: 13\r\n")
+}
+
+func TestMessages(t *testing.T) {
+	addr, errs := startEcho(t, Options{})
+	c, _ := dial(t, addr)
+
+	// Test: Lengths using each size encoding
+	for _, n := range []int{0, 125, 126, 65535, 65536, 200000} {
+		require.NoError(t, c.WriteMessage(BinaryMessage, []byte(strings.Repeat("x", n))))
+		messageType, data, err := c.ReadMessage()
+		require.NoError(t, err)
+		assert.Equal(t, BinaryMessage, messageType)
+		assert.Len(t, data, n)
+	}
+
+	// Test: Fragments with a ping in between are reassembled and the ping answered
+	require.NoError(t, c.writeFrame(false, false, opText, []byte("frag")))
+	require.NoError(t, c.writeFrame(true, false, opPing, []byte("are you there")))
+	require.NoError(t, c.writeFrame(false, false, opContinuation, []byte("men")))
+	require.NoError(t, c.writeFrame(true, false, opContinuation, []byte("ted")))
+	fin, _, op, payload, err := c.readFrame(DefaultMaxMessageSize)
+	require.NoError(t, err)
+	assert.True(t, fin)
+	assert.Equal(t, byte(opPong), op)
+	assert.Equal(t, "are you there", string(payload))
+	_, data, err := c.ReadMessage()
+	require.NoError(t, err)
+	assert.Equal(t, "fragmented", string(data))
+
+	// Test: Client initiated close is echoed
+	require.NoError(t, c.Close(CloseGoingAway, "bye"))
+	assert.Equal(t, CloseGoingAway, closeCode(t, <-errs))
+	assert.Equal(t, CloseGoingAway, closeCode(t, c.readErr))
+}
+
+func TestServerFragments(t *testing.T) {
+	addr, _ := startEcho(t, Options{FragmentSize: 4})
+	c, _ := dial(t, addr)
+
+	// Test: Written messages are split into frames
+	require.NoError(t, c.WriteMessage(TextMessage, []byte("hello world")))
+	var frames []string
+	for {
+		fin, _, _, payload, err := c.readFrame(DefaultMaxMessageSize)
+		require.NoError(t, err)
+		frames = append(frames, string(payload))
+		if fin {
+			break
+		}
+	}
+	assert.Equal(t, []string{"hell", "o wo", "rld"}, frames)
+}
+
+func TestProtocolErrors(t *testing.T) {
+	addr, errs := startEcho(t, Options{MaxMessageSize: 1024})
+
+	for _, tc := range []struct {
+		name string
+		send func(c *Conn) error
+		code int
+		err  error
+	}{
+		{"too big", func(c *Conn) error {
+			return c.WriteMessage(BinaryMessage, make([]byte, 1025))
+		}, CloseMessageTooBig, ErrMessageTooBig},
+		{"too big in fragments", func(c *Conn) error {
+			c.writeFrame(false, false, opBinary, make([]byte, 1000))
+			return c.writeFrame(true, false, opContinuation, make([]byte, 1000))
+		}, CloseMessageTooBig, ErrMessageTooBig},
+		{"invalid utf-8", func(c *Conn) error {
+			return c.WriteMessage(TextMessage, []byte{0xff, 0xfe})
+		}, CloseInvalidPayload, ErrInvalidUTF8},
+		{"unmasked", func(c *Conn) error {
+			c.server = true
+			return c.WriteMessage(TextMessage, []byte("hi"))
+		}, CloseProtocolError, ErrProtocol},
+		{"stray continuation", func(c *Conn) error {
+			return c.writeFrame(true, false, opContinuation, []byte("hi"))
+		}, CloseProtocolError, ErrProtocol},
+		{"fragmented ping", func(c *Conn) error {
+			return c.writeFrame(false, false, opPing, nil)
+		}, CloseProtocolError, ErrProtocol},
+		{"unknown opcode", func(c *Conn) error {
+			return c.writeFrame(true, false, 0x3, nil)
+		}, CloseProtocolError, ErrProtocol},
+		{"compressed without deflate", func(c *Conn) error {
+			return c.writeFrame(true, true, opText, []byte("hi"))
+		}, CloseProtocolError, ErrProtocol},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			c, _ := dial(t, addr)
+			require.NoError(t, tc.send(c))
+			c.server = false
+
+			// The server closes with the code, then drops the connection
+			_, _, err := c.ReadMessage()
+			assert.Equal(t, tc.code, closeCode(t, err))
+			assert.ErrorIs(t, <-errs, tc.err)
+		})
+	}
+}
+
+func TestServerClose(t *testing.T) {
+	closed := make(chan error, 1)
+	srv, err := server.Serve(0, func(w *response.Writer, req *request.Request) {
+		conn, err := Upgrade(w, req, Options{CloseTimeout: time.Second})
+		require.NoError(t, err)
+		conn.WriteMessage(TextMessage, []byte("going away"))
+		closed <- conn.Close(CloseNormal, "done")
+	})
+	require.NoError(t, err)
+	t.Cleanup(func() { srv.Close() })
+
+	// Test: The client answers the server's close and both sides end
+	c, _ := dial(t, srv.Addr().String())
+	_, data, err := c.ReadMessage()
+	require.NoError(t, err)
+	assert.Equal(t, "going away", string(data))
+	_, _, err = c.ReadMessage()
+	var closeErr *CloseError
+	require.ErrorAs(t, err, &closeErr)
+	assert.Equal(t, CloseError{Code: CloseNormal, Reason: "done"}, *closeErr)
+	require.NoError(t, <-closed)
+
+	// Test: Writing after close
+	assert.ErrorIs(t, c.WriteMessage(TextMessage, []byte("late")), ErrClosed)
+}
+
+func TestCompression(t *testing.T) {
+	addr, _ := startEcho(t, Options{Compression: true, FragmentSize: 8})
+
+	// Test: permessage-deflate is agreed on and used both ways
+	c, head := dial(t, addr, "Sec-WebSocket-Extensions: permessage-deflate; client_max_window_bits\r\n")
+	assert.Contains(t, head, "sec-websocket-extensions: permessage-deflate; server_no_context_takeover; client_no_context_takeover\r\n")
+	require.True(t, c.compress)
+	message := strings.Repeat("compress me please ", 100)
+	require.NoError(t, c.WriteMessage(TextMessage, []byte(message)))
+	var compressed []byte
+	for first := true; ; first = false {
+		fin, rsv1, _, payload, err := c.readFrame(DefaultMaxMessageSize)
+		require.NoError(t, err)
+		assert.Equal(t, first, rsv1)
+		compressed = append(compressed, payload...)
+		if fin {
+			break
+		}
+	}
+	assert.Less(t, len(compressed), len(message)/4)
+	data, err := inflate(compressed, DefaultMaxMessageSize)
+	require.NoError(t, err)
+	assert.Equal(t, message, string(data))
+
+	// Test: Compressed fragments are reassembled
+	require.NoError(t, c.WriteMessage(TextMessage, []byte(message)))
+	_, data, err = c.ReadMessage()
+	require.NoError(t, err)
+	assert.Equal(t, message, string(data))
+
+	// Test: Offers restricting the server window are declined
+	_, head = dial(t, addr, "sec-websocket-extensions: permessage-deflate; server_max_window_bits=10\r\n")
+	assert.NotContains(t, head, "sec-websocket-Extensions")
+
+	// Test: Not offered, not used
+	_, head = dial(t, addr)
+	assert.NotContains(t, head, "sec-websocket-Extensions")
+}
+
+func TestAcceptDeflate(t *testing.T) {
+	for offers, want := range map[string]bool{
+		"permessage-deflate":                                               true,
+		"permessage-deflate; server_max_window_bits=15":                    true,
+		`permessage-deflate; server_max_window_bits="15"`:                  true,
+		"permessage-deflate; server_max_window_bits=9":                     false,
+		"permessage-deflate; server_max_window_bits=9, permessage-deflate": true,
+		"permessage-deflate; unknown_param":                                false,
+		"x-webkit-deflate-frame":                                           false,
+		"":                                                                 false,
+	} {
+		assert.Equal(t, want, acceptDeflate(offers), fmt.Sprintf("%q", offers))
+	}
+}